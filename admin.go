@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// toggleWriter discards everything written to it unless enabled, which allows
+// the Sarama logger to be switched on and off at runtime
+type toggleWriter struct {
+	enabled int32
+	out     io.Writer
+}
+
+func (w *toggleWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&w.enabled) == 0 {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+func (w *toggleWriter) set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&w.enabled, v)
+}
+
+// adminServer serves the HTTP admin API used to control the consumers at runtime
+type adminServer struct {
+	token    string
+	shutdown chan struct{}
+}
+
+// newAdminServer returns the admin API handler. Every request must carry the
+// token as "Authorization: Bearer <token>".
+func newAdminServer(token string) *adminServer {
+	if *adminDebug {
+		expvar.Publish("consumers", expvar.Func(runningStatus))
+	}
+	return &adminServer{
+		token:    token,
+		shutdown: make(chan struct{}),
+	}
+}
+
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+a.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/assignments", a.assignments)
+	mux.HandleFunc("/pause", a.post(func(c *Consumer) error { c.pause(); return nil }))
+	mux.HandleFunc("/resume", a.post(func(c *Consumer) error { c.resume(); return nil }))
+	mux.HandleFunc("/commit", a.post((*Consumer).commit))
+	mux.HandleFunc("/log-level", a.logLevel)
+	mux.HandleFunc("/shutdown", a.shutdownHandler)
+	if *adminDebug {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// selected returns the consumers addressed by the optional consumer query parameter
+func selected(r *http.Request) ([]*Consumer, error) {
+	name := r.URL.Query().Get("consumer")
+
+	runningMu.RLock()
+	defer runningMu.RUnlock()
+
+	if name != "" {
+		consumer, ok := running[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown consumer %q", name)
+		}
+		return []*Consumer{consumer}, nil
+	}
+
+	var names []string
+	for name := range running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []*Consumer
+	for _, name := range names {
+		result = append(result, running[name])
+	}
+	return result, nil
+}
+
+// post returns a handler applying action to the selected consumers
+func (a *adminServer) post(action func(*Consumer) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		consumers, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		for _, consumer := range consumers {
+			if err := action(consumer); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a *adminServer) assignments(w http.ResponseWriter, r *http.Request) {
+	consumers, err := selected(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var result []consumerStatus
+	for _, consumer := range consumers {
+		result = append(result, consumer.status())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runningStatus returns the status of the running consumers by name, published
+// as the consumers expvar variable
+func runningStatus() interface{} {
+	runningMu.RLock()
+	defer runningMu.RUnlock()
+
+	statuses := make(map[string]consumerStatus, len(running))
+	for name, consumer := range running {
+		statuses[name] = consumer.status()
+	}
+	return statuses
+}
+
+func (a *adminServer) logLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch level := strings.ToLower(r.URL.Query().Get("level")); level {
+	case "debug":
+		saramaOutput.set(true)
+	case "info":
+		saramaOutput.set(false)
+	default:
+		http.Error(w, "level must be debug or info", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	select {
+	case <-a.shutdown:
+	default:
+		close(a.shutdown)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// consumerStatus is the current assignment of a consumer as reported by the admin API
+type consumerStatus struct {
+	Name       string            `json:"name"`
+	Group      string            `json:"group"`
+	MemberID   string            `json:"member_id"`
+	Generation int32             `json:"generation"`
+	Paused     bool              `json:"paused"`
+	Partitions []partitionStatus `json:"partitions"`
+
+	OffsetGaps       int64 `json:"offset_gaps"`
+	OffsetDuplicates int64 `json:"offset_duplicates"`
+
+	TransactionMarkers int64 `json:"transaction_markers"`
+	AbortedRecords     int64 `json:"aborted_records"`
+
+	Breaker  string `json:"breaker,omitempty"`
+	InFlight int    `json:"in_flight"`
+
+	MemoryPaused bool `json:"memory_paused"`
+
+	LagSLOBreached []string `json:"lag_slo_breached,omitempty"`
+	CaughtUp       bool     `json:"caught_up"`
+
+	Watermarks map[string]time.Time `json:"watermarks,omitempty"`
+
+	CommitFailures  int64  `json:"commit_failures"`
+	LastCommitError string `json:"last_commit_error,omitempty"`
+}
+
+type partitionStatus struct {
+	Topic         string `json:"topic"`
+	Partition     int32  `json:"partition"`
+	Offset        int64  `json:"offset"`
+	HighWaterMark int64  `json:"high_water_mark"`
+	Lag           int64  `json:"lag"`
+	BacklogPaused bool   `json:"backlog_paused"`
+	FairPaused    bool   `json:"fair_paused"`
+}
+
+// partitionState tracks the progress of a claimed partition
+type partitionState struct {
+	// offset is the next offset to be consumed, as marked after processing
+	offset        int64
+	highWaterMark int64
+	// timestamp is the timestamp of the last processed message
+	timestamp time.Time
+	// committed is the offset last committed by this process, -1 before the first commit
+	committed int64
+	// backlogPaused is set while fetching is paused because of -pause-backlog
+	backlogPaused bool
+	// fairPaused is set while fetching is paused because of -fair-progress
+	fairPaused bool
+	// pending counts the messages processed since the last commit, see -max-in-flight
+	pending int
+	// worker is the goroutine consuming the claim of the partition
+	worker *claimWorker
+}
+
+func (consumer *Consumer) status() consumerStatus {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+
+	status := consumerStatus{
+		Name:   consumer.settings().Name,
+		Group:  consumer.settings().Group,
+		Paused: consumer.paused,
+
+		Breaker:  consumer.breaker.current(),
+		InFlight: consumer.inFlight.current(),
+
+		MemoryPaused: atomic.LoadInt32(&memoryPaused) == 1,
+
+		LagSLOBreached: consumer.lagSLO.breachedTopics(),
+		CaughtUp:       consumer.caughtUp,
+
+		Watermarks: consumer.watermarks.watermarks(),
+	}
+	status.OffsetGaps, status.OffsetDuplicates = consumer.audit.counts()
+	status.TransactionMarkers, status.AbortedRecords = consumer.audit.skipped()
+	status.CommitFailures, status.LastCommitError = consumer.commitFailures.Count(), consumer.lastCommitError
+	if consumer.session != nil {
+		status.MemberID = consumer.session.MemberID()
+		status.Generation = consumer.session.GenerationID()
+	}
+
+	for topic, partitions := range consumer.partitions {
+		for partition, state := range partitions {
+			p := partitionStatus{
+				Topic:         topic,
+				Partition:     partition,
+				Offset:        state.offset,
+				HighWaterMark: state.highWaterMark,
+				BacklogPaused: state.backlogPaused,
+				FairPaused:    state.fairPaused,
+			}
+			if state.offset >= 0 && state.highWaterMark >= 0 {
+				p.Lag = state.highWaterMark - state.offset
+			}
+			status.Partitions = append(status.Partitions, p)
+		}
+	}
+	sort.Slice(status.Partitions, func(i, j int) bool {
+		if status.Partitions[i].Topic != status.Partitions[j].Topic {
+			return status.Partitions[i].Topic < status.Partitions[j].Topic
+		}
+		return status.Partitions[i].Partition < status.Partitions[j].Partition
+	})
+
+	return status
+}
+
+// commit immediately commits the offsets processed in the current session,
+// instead of waiting for the next interval commit
+func (consumer *Consumer) commit() error {
+	committed, err := consumer.commitOffsets()
+	if err != nil {
+		return err
+	}
+	consumer.logger.Printf("Committed offsets of %d partitions", committed)
+	return nil
+}
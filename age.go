@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// checkAge counts the message when it is older than -max-message-age and
+// applies -on-stale-message to it. It reports whether the message was handled
+// and must not be processed.
+func (consumer *Consumer) checkAge(message *sarama.ConsumerMessage) (bool, error) {
+	if *maxMessageAge <= 0 || message.Timestamp.IsZero() || time.Since(message.Timestamp) <= *maxMessageAge {
+		return false, nil
+	}
+	consumer.stale.Inc(1)
+
+	switch *onStaleMessage {
+	case "skip":
+		return true, nil
+	case "dead-letter":
+		topic := *deadLetterTopic
+		if *shadow {
+			topic += shadowTopicSuffix
+		}
+		if err := forward(consumer.producer, topic, message, consumer.settings().cluster); err != nil {
+			consumer.logger.Printf("Unable to dead-letter topic = %s, partition = %d, offset = %d to %s: %v", message.Topic, message.Partition, message.Offset, topic, err)
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// deadLettering reports whether stale, oversized or failed large messages are
+// produced to -dead-letter-topic
+func deadLettering() bool {
+	return *onStaleMessage == "dead-letter" || *maxHandleBytes > 0 && *onOversizedMessage == "dead-letter" || *onLargeMsgFailure == "dead-letter"
+}
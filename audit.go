@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// offsetAudit tracks the offsets delivered per partition for the lifetime of
+// the consumer, across rebalances. A gap means messages were never delivered,
+// e.g. lost to retention while the partition was unassigned, a repeat means
+// they are processed again. Compacted topics and transaction markers also
+// leave gaps in the offsets.
+type offsetAudit struct {
+	mu         sync.Mutex
+	last       map[string]map[int32]int64
+	gaps       int64
+	duplicates int64
+
+	// skipped records of transactional topics, counted with -debug-transactions
+	markers int64
+	aborted int64
+}
+
+// offsetGap is the error returned by check for a gap
+type offsetGap struct {
+	topic     string
+	partition int32
+	expected  int64
+	offset    int64
+}
+
+func (g *offsetGap) Error() string {
+	return fmt.Sprintf("offset gap at topic = %s, partition = %d, offset = %d, expected offset %d", g.topic, g.partition, g.offset, g.expected)
+}
+
+func newOffsetAudit() *offsetAudit {
+	return &offsetAudit{last: make(map[string]map[int32]int64)}
+}
+
+// check records the message, expected being the offset the claim should
+// deliver next or negative when unknown. It returns an error describing a gap
+// or repeat.
+func (a *offsetAudit) check(message *sarama.ConsumerMessage, expected int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	partitions := a.last[message.Topic]
+	if partitions == nil {
+		partitions = make(map[int32]int64)
+		a.last[message.Topic] = partitions
+	}
+	last, seen := partitions[message.Partition]
+	if !seen || message.Offset > last {
+		partitions[message.Partition] = message.Offset
+	}
+
+	switch {
+	case seen && message.Offset <= last:
+		a.duplicates++
+		return fmt.Errorf("offset repeated at topic = %s, partition = %d, offset = %d, already delivered up to offset %d", message.Topic, message.Partition, message.Offset, last)
+	case expected >= 0 && message.Offset > expected:
+		a.gaps++
+		return &offsetGap{topic: message.Topic, partition: message.Partition, expected: expected, offset: message.Offset}
+	}
+	return nil
+}
+
+// counts returns the number of gaps and repeats detected so far
+func (a *offsetAudit) counts() (int64, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.gaps, a.duplicates
+}
+
+// explained records the skipped transactional records of a gap, a gap made of
+// nothing else isn't counted as a gap
+func (a *offsetAudit) explained(stats gapStats) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.markers += stats.markers
+	a.aborted += stats.aborted
+	if stats.missing == 0 && stats.other == 0 {
+		a.gaps--
+	}
+}
+
+// skipped returns the number of transaction markers and aborted records skipped so far
+func (a *offsetAudit) skipped() (int64, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.markers, a.aborted
+}
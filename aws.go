@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsTimeout bounds a request to an AWS API
+const awsTimeout = 5 * time.Minute
+
+// awsCredentials sign the requests to AWS APIs, read from the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables. Only what the sinks need of the APIs is implemented, over plain
+// HTTP requests signed with Signature Version 4.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+}
+
+// envAWSCredentials returns the credentials of the environment for the region,
+// AWS_REGION by default
+func envAWSCredentials(region string) (awsCredentials, error) {
+	creds := awsCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		region:          region,
+	}
+	if creds.region == "" {
+		creds.region = os.Getenv("AWS_REGION")
+	}
+	if creds.region == "" {
+		creds.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return creds, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if creds.region == "" {
+		return creds, errors.New("no AWS region given and AWS_REGION isn't set")
+	}
+	return creds, nil
+}
+
+// sign adds the Signature Version 4 authorization of the service to the
+// request, whose body has the given hex encoded SHA-256 hash
+func (creds awsCredentials) sign(req *http.Request, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if service != "s3" {
+		// every service but S3 normalizes and escapes the path twice
+		path = awsEscape(path, false)
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + creds.region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretAccessKey), date)
+	key = hmacSHA256(key, creds.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+// awsCanonicalQuery returns the query sorted by name and value, escaped as
+// Signature Version 4 requires
+func awsCanonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name, true)+"="+awsEscape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes every byte but the unreserved characters of RFC
+// 3986, and the slash unless escapeSlash is set
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsError reads the error of a failed request to an AWS API
+func awsError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// s3Location is a bucket and key prefix given as s3://bucket/prefix
+type s3Location struct {
+	bucket string
+	prefix string
+	// endpoint is a custom endpoint such as MinIO, addressed path-style
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// parseS3Location parses an s3://bucket/prefix URL
+func parseS3Location(location, endpoint, region string) (*s3Location, error) {
+	rest := strings.TrimPrefix(location, "s3://")
+	parts := strings.SplitN(rest, "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("invalid S3 location %q, expected s3://bucket/prefix", location)
+	}
+
+	creds, err := envAWSCredentials(region)
+	if err != nil {
+		return nil, err
+	}
+	s3 := &s3Location{
+		bucket:   parts[0],
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    creds,
+		client:   &http.Client{Timeout: awsTimeout},
+	}
+	if len(parts) == 2 {
+		s3.prefix = strings.Trim(parts[1], "/")
+	}
+	return s3, nil
+}
+
+// objectURL returns the URL of the object with the key below the prefix
+func (s3 *s3Location) objectURL(key string) string {
+	if s3.prefix != "" {
+		key = s3.prefix + "/" + key
+	}
+	if s3.endpoint != "" {
+		return s3.endpoint + "/" + s3.bucket + "/" + awsEscape(key, false)
+	}
+	return "https://" + s3.bucket + ".s3." + s3.creds.region + ".amazonaws.com/" + awsEscape(key, false)
+}
+
+// putFile uploads the file as the object with the key below the prefix, in a
+// single PUT limited to 5 GB
+func (s3 *s3Location) putFile(key string, file *os.File) error {
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+
+	req, err := http.NewRequest(http.MethodPut, s3.objectURL(key), ioutil.NopCloser(file))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	s3.creds.sign(req, "s3", payloadHash, time.Now())
+
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsError(resp)
+	}
+	return nil
+}
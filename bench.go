@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// benchHandler consumes messages as fast as possible without processing them
+type benchHandler struct {
+	start *startPositions
+	ready chan bool
+	once  sync.Once
+
+	messages int64
+	bytes    int64
+
+	// delivery latency since the message timestamp, and the end-to-end latency
+	// per topic of messages produced by the produce subcommand
+	delivery *latencies
+	mu       sync.Mutex
+	endToEnd map[string]*latencies
+}
+
+// runBench consumes the topics of the consumer for -duration and reports the throughput
+func runBench(c consumerConfig) {
+	config, err := newSaramaConfig(c)
+	if err != nil {
+		fatal(err)
+	}
+
+	client, err := sarama.NewClient(strings.Split(c.Brokers, ","), config)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+
+	group, err := sarama.NewConsumerGroupFromClient(c.Group, client)
+	if err != nil {
+		fatal(err)
+	}
+	defer group.Close()
+
+	handler := &benchHandler{
+		start:    newStartPositions(client, c.topicPositions, log.New(os.Stderr, "", log.LstdFlags)),
+		ready:    make(chan bool),
+		delivery: newLatencies(),
+		endToEnd: make(map[string]*latencies),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for ctx.Err() == nil {
+			if err := group.Consume(ctx, c.topicNames, handler); err != nil && ctx.Err() == nil {
+				log.Printf("Error from consumer: %v", err)
+				time.Sleep(consumerRetryBackoff)
+			}
+		}
+	}()
+
+	<-handler.ready
+	log.Printf("Benchmarking for %v", *duration)
+	started := time.Now()
+	time.Sleep(*duration)
+	elapsed := time.Since(started)
+	cancel()
+
+	handler.report(elapsed, config.MetricRegistry)
+}
+
+func (h *benchHandler) report(elapsed time.Duration, registry metrics.Registry) {
+	messages := atomic.LoadInt64(&h.messages)
+	megabytes := float64(atomic.LoadInt64(&h.bytes)) / (1 << 20)
+	seconds := elapsed.Seconds()
+
+	log.Printf("Consumed %d messages (%.2f MB) in %v", messages, megabytes, elapsed.Round(time.Millisecond))
+	log.Printf("Throughput: %.0f msgs/s, %.2f MB/s", float64(messages)/seconds, megabytes/seconds)
+
+	if fetches, ok := registry.Get("response-size").(metrics.Histogram); ok {
+		snapshot := fetches.Snapshot()
+		log.Printf("Fetch response size: mean = %.0f bytes, p99 = %.0f bytes, max = %d bytes", snapshot.Mean(), snapshot.Percentile(0.99), snapshot.Max())
+	}
+
+	if p := h.delivery.percentiles(0.50, 0.99); p != nil {
+		log.Printf("Delivery latency: p50 = %v, p99 = %v", p[0], p[1])
+	} else {
+		log.Println("Delivery latency: no message timestamps, requires Kafka 0.10 or later")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var topics []string
+	for topic := range h.endToEnd {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		l := h.endToEnd[topic]
+		p := l.percentiles(0.50, 0.95, 0.99)
+		log.Printf("End-to-end latency of topic %s: p50 = %v, p95 = %v, p99 = %v", topic, p[0], p[1], p[2])
+		log.Printf("End-to-end latency histogram of topic %s: %s", topic, l.histogram())
+	}
+}
+
+// topicLatencies returns the end-to-end latencies of a topic
+func (h *benchHandler) topicLatencies(topic string) *latencies {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.endToEnd[topic]
+	if !ok {
+		l = newLatencies()
+		h.endToEnd[topic] = l
+	}
+	return l
+}
+
+func (h *benchHandler) Setup(session sarama.ConsumerGroupSession) error {
+	if _, err := h.start.apply(session); err != nil {
+		return err
+	}
+	h.once.Do(func() { close(h.ready) })
+	return nil
+}
+
+func (h *benchHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *benchHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		atomic.AddInt64(&h.messages, 1)
+		atomic.AddInt64(&h.bytes, int64(len(message.Key)+len(message.Value)))
+		if !message.Timestamp.IsZero() {
+			h.delivery.observe(time.Since(message.Timestamp))
+		}
+		if produced, ok := produceTimestamp(message); ok {
+			h.topicLatencies(message.Topic).observe(time.Since(produced))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// bigQueryScope is the OAuth2 scope of streaming inserts
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery.insertdata"
+
+// bigQueryEndpoint is the base URL of the BigQuery API
+const bigQueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2"
+
+// bigQueryRow is a row of an insertAll request, the locator of the message is
+// its insert id so BigQuery drops the rows inserted again after a failed commit
+type bigQueryRow struct {
+	InsertID string                 `json:"insertId"`
+	JSON     map[string]interface{} `json:"json"`
+}
+
+// bigQueryInsertResponse holds the rows rejected by an insertAll request
+type bigQueryInsertResponse struct {
+	InsertErrors []struct {
+		Index  int `json:"index"`
+		Errors []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+// bigQuerySink streams the claimed messages into BigQuery tables with the
+// insertAll API. Rows are buffered and inserted in batches of -bigquery-batch-size
+// rows, and at the latest by the commit barrier, so the offsets are committed
+// only once the rows of their messages were inserted.
+type bigQuerySink struct {
+	// table is project.dataset.table, {topic} is replaced by the topic
+	table       string
+	mapping     fieldMapping
+	batchSize   int
+	skipInvalid bool
+	tokens      *gcpTokenSource
+
+	mu       sync.Mutex
+	rows     map[string][]bigQueryRow
+	ids      map[string]bool
+	buffered int
+}
+
+func newBigQuerySink(table, columns string, batchSize int, skipInvalid bool) (*bigQuerySink, error) {
+	if len(strings.Split(table, ".")) != 3 {
+		return nil, fmt.Errorf("invalid -bigquery-table %q, expected project.dataset.table", table)
+	}
+	if batchSize <= 0 || batchSize > 50000 {
+		return nil, fmt.Errorf("-bigquery-batch-size must be between 1 and 50000")
+	}
+	mapping, err := parseFieldMapping(columns)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newGCPTokenSource(bigQueryScope)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bigQuerySink{
+		table:       table,
+		mapping:     mapping,
+		batchSize:   batchSize,
+		skipInvalid: skipInvalid,
+		tokens:      tokens,
+		rows:        make(map[string][]bigQueryRow),
+		ids:         make(map[string]bool),
+	}, nil
+}
+
+func (s *bigQuerySink) name() string {
+	return "bigquery sink " + s.table
+}
+
+func (s *bigQuerySink) write(message *sarama.ConsumerMessage, value []byte) error {
+	fields, err := s.mapping.row(message, value)
+	if err != nil {
+		return err
+	}
+	id := idempotencyKey(message)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a write retried after a failed insert is buffered already
+	if !s.ids[id] {
+		table := strings.Replace(s.table, "{topic}", identifierName(message.Topic), -1)
+		s.rows[table] = append(s.rows[table], bigQueryRow{InsertID: id, JSON: fields})
+		s.ids[id] = true
+		s.buffered++
+	}
+	if s.buffered >= s.batchSize {
+		return s.insert()
+	}
+	return nil
+}
+
+// flush inserts the buffered rows, the barrier of a commit
+func (s *bigQuerySink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert()
+}
+
+// insert inserts the buffered rows in batches, the rows of failed batches
+// stay buffered for the next attempt
+func (s *bigQuerySink) insert() error {
+	for table, rows := range s.rows {
+		for len(rows) > 0 {
+			n := len(rows)
+			if n > s.batchSize {
+				n = s.batchSize
+			}
+			if err := s.insertAll(table, rows[:n]); err != nil {
+				s.rows[table] = rows
+				return err
+			}
+			for _, row := range rows[:n] {
+				delete(s.ids, row.InsertID)
+			}
+			s.buffered -= n
+			rows = rows[n:]
+		}
+		delete(s.rows, table)
+	}
+	return nil
+}
+
+// insertAll inserts a batch of rows into the table. Without -bigquery-skip-invalid
+// a single invalid row fails the batch.
+func (s *bigQuerySink) insertAll(table string, rows []bigQueryRow) error {
+	parts := strings.Split(table, ".")
+	endpoint := fmt.Sprintf("%s/projects/%s/datasets/%s/tables/%s/insertAll", bigQueryEndpoint, parts[0], parts[1], parts[2])
+	request := map[string]interface{}{
+		"kind":            "bigquery#tableDataInsertAllRequest",
+		"skipInvalidRows": s.skipInvalid,
+		"rows":            rows,
+	}
+
+	var response bigQueryInsertResponse
+	if err := s.tokens.do("POST", endpoint, request, &response); err != nil {
+		return fmt.Errorf("unable to insert into %s: %v", table, err)
+	}
+	if len(response.InsertErrors) == 0 {
+		return nil
+	}
+
+	rejected := 0
+	var cause string
+	for _, insertError := range response.InsertErrors {
+		for _, e := range insertError.Errors {
+			// the valid rows of a failed batch are reported as stopped
+			if e.Reason == "stopped" || insertError.Index < 0 || insertError.Index >= len(rows) {
+				continue
+			}
+			rejected++
+			cause = fmt.Sprintf("%s: %s", e.Reason, e.Message)
+			if s.skipInvalid {
+				log.Printf("BigQuery rejected the row of %s in %s: %s", rows[insertError.Index].InsertID, table, cause)
+			}
+		}
+	}
+	if s.skipInvalid {
+		return nil
+	}
+	return fmt.Errorf("BigQuery rejected %d rows of the batch for %s, e.g. %s", rejected, table, cause)
+}
+
+// identifierName replaces the characters not allowed in the unquoted table
+// names of BigQuery and ClickHouse by _
+func identifierName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (s *bigQuerySink) close() error {
+	return s.flush(commitPoint{})
+}
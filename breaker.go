@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops the claims from hammering a sink that is down. After
+// threshold consecutive failures it opens, and once the cooldown expired it
+// lets a single probe through, closing again when the probe succeeds. A nil
+// breaker is always closed.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	// changed is closed and replaced whenever the state changes, waking waiting claims
+	changed chan struct{}
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+		changed:   make(chan struct{}),
+	}
+}
+
+// allow blocks while the breaker is open or another claim is probing. It
+// returns false when ctx is done first.
+func (b *circuitBreaker) allow(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+
+	for {
+		b.mu.Lock()
+		var wait <-chan time.Time
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return true
+		case breakerOpen:
+			remaining := b.cooldown - time.Since(b.openedAt)
+			if remaining <= 0 {
+				b.setState(breakerHalfOpen)
+				b.probing = true
+				b.mu.Unlock()
+				return true
+			}
+			wait = time.After(remaining)
+		case breakerHalfOpen:
+			if !b.probing {
+				b.probing = true
+				b.mu.Unlock()
+				return true
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-wait:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// success records a successful call. It reports whether this closed the breaker.
+func (b *circuitBreaker) success() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	if b.state == breakerClosed {
+		return false
+	}
+	b.setState(breakerClosed)
+	return true
+}
+
+// failure records a failed call. It reports whether this opened a closed breaker.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+
+	switch {
+	case b.state == breakerHalfOpen:
+		// the probe failed, wait another cooldown
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	case b.state == breakerClosed && b.failures >= b.threshold:
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+		return true
+	}
+	return false
+}
+
+// current returns the state of the breaker, "" when disabled
+func (b *circuitBreaker) current() string {
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState must be called with the lock held
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
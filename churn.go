@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// membershipWatchdog tracks the partitions claimed by a consumer across
+// sessions and warns when they change again shortly after the last change,
+// which happens when another member of the group keeps leaving and joining
+type membershipWatchdog struct {
+	claims     map[string]bool
+	lastChange time.Time
+}
+
+// observe compares the claims of a new session with the previous ones. It
+// returns the added and removed partitions as <topic>/<partition>, and whether
+// the claims changed within -churn-window of the previous change.
+func (w *membershipWatchdog) observe(claims map[string][]int32) (added, removed []string, flapping bool) {
+	current := make(map[string]bool)
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			current[fmt.Sprintf("%s/%d", topic, partition)] = true
+		}
+	}
+
+	for partition := range current {
+		if !w.claims[partition] {
+			added = append(added, partition)
+		}
+	}
+	for partition := range w.claims {
+		if !current[partition] {
+			removed = append(removed, partition)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	first := w.claims == nil
+	w.claims = current
+	if first || len(added)+len(removed) == 0 {
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	flapping = !w.lastChange.IsZero() && now.Sub(w.lastChange) < *churnWindow
+	w.lastChange = now
+	return added, removed, flapping
+}
+
+// watchMembership logs the change of the claims of a new session and counts
+// the moved partitions in the rebalance-churn metric
+func (consumer *Consumer) watchMembership(generation int32, claims map[string][]int32) {
+	added, removed, flapping := consumer.membership.observe(claims)
+	if len(added)+len(removed) == 0 {
+		return
+	}
+	consumer.churn.Inc(int64(len(added) + len(removed)))
+
+	if flapping {
+		consumer.logger.Printf("Warning: claims changed again within -churn-window %v, another member may be flapping: generation = %d, added = [%s], removed = [%s]", *churnWindow, generation, strings.Join(added, " "), strings.Join(removed, " "))
+		return
+	}
+	consumer.logger.Printf("Claims changed: generation = %d, added = [%s], removed = [%s]", generation, strings.Join(added, " "), strings.Join(removed, " "))
+}
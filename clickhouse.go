@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// clickHouseTimeout bounds an insert into ClickHouse
+const clickHouseTimeout = 5 * time.Minute
+
+// clickHouseSink inserts the claimed messages into ClickHouse tables over its
+// HTTP interface, as JSONEachRow rows mapped by -clickhouse-columns. The table
+// of a topic is given by -clickhouse-tables, or else the -clickhouse-table
+// template.
+//
+// Rows are inserted in batches of -clickhouse-batch-size rows, and at the
+// latest by the commit barrier, as async inserts which ClickHouse merges with
+// the inserts of other clients. The inserts wait for the async insert to be
+// flushed to the table, so offsets are committed only once their rows are
+// stored. Failed batches stay buffered and are inserted again.
+type clickHouseSink struct {
+	endpoint  string
+	table     string
+	tables    map[string]string
+	mapping   fieldMapping
+	batchSize int
+	client    *http.Client
+
+	mu       sync.Mutex
+	rows     map[string]*bytes.Buffer
+	counts   map[string]int
+	buffered int
+}
+
+// newClickHouseSink returns the sink for the URL of the HTTP interface, with
+// optional credentials as its user info
+func newClickHouseSink(clickHouseURL, table, tables, columns string, batchSize int) (*clickHouseSink, error) {
+	u, err := url.Parse(clickHouseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -clickhouse-url %q", clickHouseURL)
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("-clickhouse-batch-size must be positive")
+	}
+	mapping, err := parseFieldMapping(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &clickHouseSink{
+		endpoint:  strings.TrimSuffix(u.String(), "/") + "/",
+		table:     table,
+		tables:    make(map[string]string),
+		mapping:   mapping,
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: clickHouseTimeout},
+		rows:      make(map[string]*bytes.Buffer),
+		counts:    make(map[string]int),
+	}
+	for _, pair := range strings.Split(tables, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid -clickhouse-tables entry %q, expected topic=table", pair)
+		}
+		s.tables[kv[0]] = kv[1]
+	}
+	return s, nil
+}
+
+func (s *clickHouseSink) name() string {
+	return "clickhouse sink " + s.endpoint
+}
+
+func (s *clickHouseSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	fields, err := s.mapping.row(message, value)
+	if err != nil {
+		return err
+	}
+	row, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	table, ok := s.tables[message.Topic]
+	if !ok {
+		table = strings.Replace(s.table, "{topic}", identifierName(message.Topic), -1)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// insert before buffering, so a write retried after a failure isn't buffered twice
+	if s.buffered >= s.batchSize {
+		if err := s.insert(); err != nil {
+			return err
+		}
+	}
+	rows, ok := s.rows[table]
+	if !ok {
+		rows = &bytes.Buffer{}
+		s.rows[table] = rows
+	}
+	rows.Write(row)
+	rows.WriteByte('\n')
+	s.counts[table]++
+	s.buffered++
+	return nil
+}
+
+// flush inserts the buffered rows, the barrier of a commit
+func (s *clickHouseSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert()
+}
+
+// insert inserts the buffered rows of every table, the rows of failed
+// inserts stay buffered for the next attempt
+func (s *clickHouseSink) insert() error {
+	for table, rows := range s.rows {
+		if err := s.insertRows(table, rows.Bytes()); err != nil {
+			return fmt.Errorf("unable to insert into %s: %v", table, err)
+		}
+		s.buffered -= s.counts[table]
+		delete(s.rows, table)
+		delete(s.counts, table)
+	}
+	return nil
+}
+
+// insertRows sends an async insert of the rows, waiting until ClickHouse
+// flushed it to the table
+func (s *clickHouseSink) insertRows(table string, rows []byte) error {
+	query := url.Values{
+		"query":                            {"INSERT INTO " + table + " FORMAT JSONEachRow"},
+		"async_insert":                     {"1"},
+		"wait_for_async_insert":            {"1"},
+		"date_time_input_format":           {"best_effort"},
+		"input_format_skip_unknown_fields": {"1"},
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"?"+query.Encode(), bytes.NewReader(rows))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func (s *clickHouseSink) close() error {
+	return s.flush(commitPoint{})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// cloudEventHeaderPrefix prefixes the attributes of CloudEvents in the Kafka
+// binary content mode
+const cloudEventHeaderPrefix = "ce_"
+
+// cloudEventsContentType is the content type of CloudEvents in the
+// structured content mode
+const cloudEventsContentType = "application/cloudevents+json"
+
+// cloudEventMessage returns the message in the binary content mode of
+// CloudEvents when it is a structured JSON event, detected by its content-type
+// header or its specversion and type: a copy with the attributes as ce_
+// headers, the datacontenttype as content-type header and the data as value.
+// Events in the binary mode and other messages are returned unchanged.
+func cloudEventMessage(message *sarama.ConsumerMessage, value []byte) (*sarama.ConsumerMessage, []byte) {
+	if message.Value == nil || cloudEventHeader(message, "specversion") != "" {
+		return message, value
+	}
+	contentTypeHeader, _ := header(message, "content-type")
+	structured := strings.HasPrefix(string(contentTypeHeader), cloudEventsContentType)
+	if !structured && !bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+		return message, value
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return message, value
+	}
+	event, ok := doc.(map[string]interface{})
+	if !ok {
+		return message, value
+	}
+	if _, ok := event["specversion"].(string); !ok {
+		return message, value
+	}
+	if _, ok := event["type"].(string); !ok && !structured {
+		return message, value
+	}
+
+	var data []byte
+	contentType, _ := event["datacontenttype"].(string)
+	switch element := event["data"].(type) {
+	case nil:
+		if encoded, ok := event["data_base64"].(string); ok {
+			data, _ = base64.StdEncoding.DecodeString(encoded)
+		}
+	case string:
+		if isJSONContentType(contentType) {
+			data, _ = json.Marshal(element)
+		} else {
+			data = []byte(element)
+		}
+	default:
+		data, _ = encodeJSON(element)
+	}
+	if data == nil {
+		data = []byte{}
+	}
+
+	names := make([]string, 0, len(event))
+	for name := range event {
+		if name != "data" && name != "data_base64" && name != "datacontenttype" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	binary := *message
+	binary.Value = data
+	binary.Headers = nil
+	for _, h := range message.Headers {
+		if h != nil && !strings.EqualFold(string(h.Key), "content-type") {
+			binary.Headers = append(binary.Headers, h)
+		}
+	}
+	if contentType != "" {
+		binary.Headers = append(binary.Headers, &sarama.RecordHeader{Key: []byte("content-type"), Value: []byte(contentType)})
+	}
+	for _, name := range names {
+		binary.Headers = append(binary.Headers, &sarama.RecordHeader{
+			Key:   []byte(cloudEventHeaderPrefix + name),
+			Value: []byte(jsonText(event[name])),
+		})
+	}
+	return &binary, data
+}
+
+// isJSONContentType reports whether data of the content type is JSON, which
+// it is by default
+func isJSONContentType(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return mediaType == "" || mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// cloudEventHeader returns the attribute of the event in the binary content
+// mode, or an empty string
+func cloudEventHeader(message *sarama.ConsumerMessage, attribute string) string {
+	value, _ := header(message, cloudEventHeaderPrefix+attribute)
+	return string(value)
+}
+
+// appendCloudEvent appends the ce_ attributes of an event in the binary
+// content mode as name = value pairs, each after the separator
+func appendCloudEvent(buf []byte, message *sarama.ConsumerMessage, separator string) []byte {
+	for _, h := range message.Headers {
+		if h == nil || !strings.HasPrefix(string(h.Key), cloudEventHeaderPrefix) {
+			continue
+		}
+		buf = append(buf, separator...)
+		buf = append(buf, h.Key...)
+		buf = append(buf, " = "...)
+		buf = append(buf, h.Value...)
+	}
+	return buf
+}
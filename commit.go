@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/hrak/kafka-consumergroup/consumergroup"
+)
+
+// commitRetryBackoff is the backoff before the first retry of a failed commit, doubled on every retry
+const commitRetryBackoff = 100 * time.Millisecond
+
+// commitLoop commits the processed offsets every -commit-interval, delayed by
+// a random jitter of up to -commit-jitter so the members of a group don't all
+// hit the coordinator at once. It returns when the session ends, Cleanup
+// commits one last time.
+func (consumer *Consumer) commitLoop(session sarama.ConsumerGroupSession) {
+	for {
+		delay := *commitInterval
+		if *commitJitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(*commitJitter)))
+		}
+
+		select {
+		case <-time.After(delay):
+			consumer.commitWithRetry(session.Context())
+		case <-consumer.commitNow:
+			consumer.commitWithRetry(session.Context())
+		case <-session.Context().Done():
+			return
+		}
+	}
+}
+
+// commitSoon requests a commit without waiting for the -commit-interval
+func (consumer *Consumer) commitSoon() {
+	select {
+	case consumer.commitNow <- struct{}{}:
+	default:
+	}
+}
+
+// commitWithRetry commits the processed offsets, retrying failures up to
+// -commit-retries times with an exponential backoff until ctx is done
+func (consumer *Consumer) commitWithRetry(ctx context.Context) error {
+	backoff := commitRetryBackoff
+	for attempt := 0; ; attempt++ {
+		_, err := consumer.commitOffsets()
+		if err == nil {
+			return nil
+		}
+		if fenced, ok := err.(*fencedCommit); ok {
+			consumer.reportFencing(fenced)
+			return err
+		}
+
+		consumer.commitFailures.Inc(1)
+		consumer.stateMu.Lock()
+		consumer.lastCommitError = err.Error()
+		consumer.stateMu.Unlock()
+		if consumergroup.Category(err) == "" {
+			consumer.recordError(&consumergroup.CommitError{Err: err})
+		} else {
+			consumer.recordError(err)
+		}
+
+		if attempt >= *commitRetries {
+			consumer.logger.Printf("Unable to commit offsets after %d attempts: %v", attempt+1, err)
+			return err
+		}
+		consumer.logger.Printf("Unable to commit offsets, retrying in %v: %v", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// commitOffsets commits the offsets processed in the current session that
+// changed since the last commit. It returns the number of committed partitions.
+func (consumer *Consumer) commitOffsets() (int, error) {
+	// the commit loop and the admin API must not release the same pending messages twice
+	consumer.commitMu.Lock()
+	defer consumer.commitMu.Unlock()
+
+	consumer.stateMu.Lock()
+	session := consumer.session
+	request := &sarama.OffsetCommitRequest{
+		ConsumerGroup: consumer.settings().Group,
+	}
+	// the commit timestamp of version 1 is the time the coordinator received it,
+	// versions 2 to 4 use the offsets retention of the broker
+	timestamp := int64(0)
+	if session != nil {
+		request.Version = offsetCommitVersion(consumer.client.Config().Version)
+		request.ConsumerID = session.MemberID()
+		request.ConsumerGroupGeneration = session.GenerationID()
+		switch request.Version {
+		case 1:
+			timestamp = sarama.ReceiveTime
+		case 2, 3, 4:
+			request.RetentionTime = -1
+		}
+	}
+	offsets := make(map[*partitionState]int64)
+	pending := make(map[*partitionState]int)
+	point := commitPoint{Group: request.ConsumerGroup, Generation: request.ConsumerGroupGeneration, Offsets: make(map[string]map[int32]int64)}
+	for topic, partitions := range consumer.partitions {
+		for partition, state := range partitions {
+			if state.offset >= 0 && state.offset != state.committed {
+				request.AddBlock(topic, partition, state.offset, -1, timestamp, consumer.start.metadata(topic))
+				offsets[state] = state.offset
+				pending[state] = state.pending
+				if point.Offsets[topic] == nil {
+					point.Offsets[topic] = make(map[int32]int64)
+				}
+				point.Offsets[topic][partition] = state.offset
+			}
+		}
+	}
+	consumer.stateMu.Unlock()
+
+	if session == nil || len(offsets) == 0 {
+		return 0, nil
+	}
+
+	// the commit barrier, the sinks persist what they were written before the offsets are committed
+	if err := flushSinks(consumer.sinks, point); err != nil {
+		return 0, &consumergroup.SinkError{Sink: "the sinks", Err: err}
+	}
+
+	coordinator, err := consumer.client.Coordinator(request.ConsumerGroup)
+	if err != nil {
+		return 0, err
+	}
+	response, err := coordinator.CommitOffset(request)
+	if err != nil {
+		// the coordinator may have moved, look it up again on the next attempt
+		consumer.client.RefreshCoordinator(request.ConsumerGroup)
+		return 0, err
+	}
+	for topic, partitions := range response.Errors {
+		for partition, kerr := range partitions {
+			if kerr != sarama.ErrNoError {
+				if kerr == sarama.ErrNotCoordinatorForConsumer || kerr == sarama.ErrConsumerCoordinatorNotAvailable {
+					consumer.client.RefreshCoordinator(request.ConsumerGroup)
+				}
+				if fenced, ok := asFencedCommit(kerr, request.ConsumerGroup, request.ConsumerID, request.ConsumerGroupGeneration); ok {
+					return 0, fenced
+				}
+				return 0, fmt.Errorf("unable to commit topic = %s, partition = %d: %v", topic, partition, kerr)
+			}
+		}
+	}
+
+	consumer.stateMu.Lock()
+	for state, offset := range offsets {
+		state.committed = offset
+		state.pending -= pending[state]
+		consumer.inFlight.release(pending[state])
+	}
+	consumer.stateMu.Unlock()
+	return len(offsets), nil
+}
+
+// offsetCommitVersion returns the version of the OffsetCommit request for the
+// Kafka version of the cluster, the newest one up to 7 it supports like Sarama
+// picks it, as Kafka 4.0 removed versions 0 and 1
+func offsetCommitVersion(version sarama.KafkaVersion) int16 {
+	switch {
+	case version.IsAtLeast(sarama.V2_3_0_0):
+		return 7
+	case version.IsAtLeast(sarama.V2_1_0_0):
+		return 6
+	case version.IsAtLeast(sarama.V2_0_0_0):
+		return 4
+	case version.IsAtLeast(sarama.V0_11_0_0):
+		return 3
+	case version.IsAtLeast(sarama.V0_9_0_0):
+		return 2
+	}
+	return 1
+}
+
+// commitAudit is a record published to the AuditTopic of a consumer, the
+// history of the consumption progress of its group
+type commitAudit struct {
+	Group           string    `json:"group"`
+	Topic           string    `json:"topic"`
+	Partition       int32     `json:"partition"`
+	CommittedOffset int64     `json:"committed_offset"`
+	Host            string    `json:"host"`
+	MemberID        string    `json:"member_id"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// auditLoop publishes the committed offsets of the claimed partitions to the
+// AuditTopic every -audit-interval until the session ends
+func (consumer *Consumer) auditLoop(session sarama.ConsumerGroupSession) {
+	ticker := time.NewTicker(*auditInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := consumer.publishAudit(session); err != nil {
+				consumer.logger.Printf("Unable to publish the audit records to %s: %v", consumer.settings().AuditTopic, err)
+			}
+		case <-session.Context().Done():
+			return
+		}
+	}
+}
+
+// publishAudit publishes a record per claimed partition with a committed offset
+func (consumer *Consumer) publishAudit(session sarama.ConsumerGroupSession) error {
+	settings := consumer.settings()
+	host, _ := os.Hostname()
+	now := time.Now()
+
+	var messages []*sarama.ProducerMessage
+	consumer.stateMu.Lock()
+	for topic, partitions := range consumer.partitions {
+		for partition, state := range partitions {
+			if state.committed < 0 {
+				continue
+			}
+			record, err := json.Marshal(commitAudit{
+				Group:           settings.Group,
+				Topic:           topic,
+				Partition:       partition,
+				CommittedOffset: state.committed,
+				Host:            host,
+				MemberID:        session.MemberID(),
+				Timestamp:       now,
+			})
+			if err != nil {
+				consumer.stateMu.Unlock()
+				return err
+			}
+			messages = append(messages, &sarama.ProducerMessage{
+				Topic:     settings.AuditTopic,
+				Key:       sarama.StringEncoder(fmt.Sprintf("%s/%s/%d", settings.Group, topic, partition)),
+				Value:     sarama.ByteEncoder(record),
+				Timestamp: now,
+			})
+		}
+	}
+	consumer.stateMu.Unlock()
+
+	if len(messages) == 0 {
+		return nil
+	}
+	return consumer.producer.SendMessages(messages)
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/hrak/kafka-consumergroup/consumergroup"
+)
+
+// consumerConfig holds the settings of a single consumer group consumer.
+// Without a -config file a single consumer is configured from the command line flags.
+type consumerConfig struct {
+	Name           string `json:"name"`
+	Brokers        string `json:"brokers"`
+	Version        string `json:"version"`
+	Group          string `json:"group"`
+	Topics         string `json:"topics"`
+	Certificate    string `json:"certificate"`
+	Key            string `json:"key"`
+	CA             string `json:"ca"`
+	Verify         bool   `json:"verify"`
+	MemberUserData string `json:"member-user-data"`
+	AuditTopic     string `json:"audit-topic"`
+	IsolationLevel string `json:"isolation-level"`
+	// Clusters consumes the topics from several clusters at once, see expandClusters
+	Clusters map[string]string `json:"clusters"`
+
+	// Processing capacity shared by the claims of the consumer
+	MaxConcurrentClaims int    `json:"max-concurrent-claims"`
+	TopicWeights        string `json:"topic-weights"`
+
+	// Sinks overrides the sink flags of the same name, see openConsumerSinks
+	Sinks map[string]string `json:"sinks"`
+
+	// Settings below are applied without reconnecting when the config is reloaded
+	ValueDecompress string                 `json:"value-decompress"`
+	ForwardTopic    string                 `json:"forward-topic"`
+	Routes          []route                `json:"routes"`
+	PauseBacklog    int                    `json:"pause-backlog"`
+	Retry           map[string]retryConfig `json:"retry"`
+	StrictOffsets   bool                   `json:"strict-offsets"`
+	Print           string                 `json:"print"`
+
+	// cluster is the name of the cluster of a consumer expanded from Clusters
+	cluster string
+
+	// Parsed Topics
+	topicNames     []string
+	topicPositions map[string]startPosition
+
+	// Parsed TopicWeights
+	topicWeights map[string]int
+
+	// Parsed Retry
+	retryPolicies map[string]consumergroup.RetryPolicy
+}
+
+// retryConfig is the retry policy of a topic in the -config file
+type retryConfig struct {
+	MaxAttempts    int      `json:"max-attempts"`
+	InitialBackoff string   `json:"initial-backoff"`
+	MaxBackoff     string   `json:"max-backoff"`
+	Multiplier     float64  `json:"multiplier"`
+	Jitter         float64  `json:"jitter"`
+	Retryable      []string `json:"retryable"`
+	Fatal          []string `json:"fatal"`
+}
+
+// parse validates the retry config and converts it to a policy
+func (r retryConfig) parse() (consumergroup.RetryPolicy, error) {
+	policy := consumergroup.RetryPolicy{
+		MaxAttempts: r.MaxAttempts,
+		Multiplier:  r.Multiplier,
+		Jitter:      r.Jitter,
+	}
+	if r.MaxAttempts < 1 {
+		return policy, errors.New("max-attempts must be at least 1")
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return policy, errors.New("jitter must be between 0 and 1")
+	}
+
+	var err error
+	if r.InitialBackoff != "" {
+		if policy.InitialBackoff, err = time.ParseDuration(r.InitialBackoff); err != nil {
+			return policy, fmt.Errorf("invalid initial-backoff: %v", err)
+		}
+	}
+	if r.MaxBackoff != "" {
+		if policy.MaxBackoff, err = time.ParseDuration(r.MaxBackoff); err != nil {
+			return policy, fmt.Errorf("invalid max-backoff: %v", err)
+		}
+	}
+
+	if policy.Retryable, err = parseErrorClasses(r.Retryable); err != nil {
+		return policy, err
+	}
+	if policy.Fatal, err = parseErrorClasses(r.Fatal); err != nil {
+		return policy, err
+	}
+	return policy, nil
+}
+
+func parseErrorClasses(names []string) ([]consumergroup.ErrorClass, error) {
+	var classes []consumergroup.ErrorClass
+	for _, name := range names {
+		class := consumergroup.ErrorClass(name)
+		switch class {
+		case consumergroup.ClassTimeout, consumergroup.ClassNetwork, consumergroup.ClassKafka, consumergroup.ClassOther:
+		default:
+			return nil, fmt.Errorf("unknown error class %q, expected timeout, network, kafka or other", name)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// retryPolicy returns the retry policy of the topic, falling back to the "*"
+// entry of Retry. Without either, failures aren't retried.
+func (c consumerConfig) retryPolicy(topic string) consumergroup.RetryPolicy {
+	if policy, ok := c.retryPolicies[topic]; ok {
+		return policy
+	}
+	return c.retryPolicies["*"]
+}
+
+// configFile is the layout of the -config file
+type configFile struct {
+	// LogLevel is debug to enable the Sarama log, or info to disable it
+	LogLevel  string           `json:"log-level"`
+	Consumers []consumerConfig `json:"consumers"`
+}
+
+// applyLogLevel enables or disables the Sarama log according to the log-level
+// of the file, leaving it as is without one
+func (f configFile) applyLogLevel() {
+	switch f.LogLevel {
+	case "debug":
+		saramaOutput.set(true)
+	case "info":
+		saramaOutput.set(false)
+	}
+}
+
+// flagConsumerConfig returns the consumer configured by the command line flags
+func flagConsumerConfig() consumerConfig {
+	return consumerConfig{
+		Brokers:        *brokers,
+		Version:        *version,
+		Group:          *group,
+		Topics:         *topics,
+		Certificate:    *certFile,
+		Key:            *keyFile,
+		CA:             *caFile,
+		Verify:         *verifySsl,
+		MemberUserData: *memberUserData,
+		AuditTopic:     *auditTopic,
+		IsolationLevel: *isolationLevel,
+
+		MaxConcurrentClaims: *maxConcurrentClaims,
+		TopicWeights:        *topicWeights,
+
+		ValueDecompress: *valueDecompress,
+		ForwardTopic:    *forwardTopic,
+		PauseBacklog:    *pauseBacklog,
+		StrictOffsets:   *strictOffsets,
+		Print:           *printMode,
+	}
+}
+
+// loadConfig reads the consumers defined in a JSON config file. The brokers,
+// version, value-decompress, isolation-level and print settings of a consumer
+// default to their flags.
+func loadConfig(path string) (configFile, error) {
+	var file configFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return file, err
+	}
+
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	if len(file.Consumers) == 0 {
+		return file, fmt.Errorf("no consumers defined in %s", path)
+	}
+	switch file.LogLevel {
+	case "", "debug", "info":
+	default:
+		return file, fmt.Errorf("invalid log-level in %s, expected debug or info", path)
+	}
+
+	consumers, err := expandClusters(file.Consumers)
+	if err != nil {
+		return file, fmt.Errorf("%s: %v", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range consumers {
+		c := &consumers[i]
+		if names[c.Name] {
+			return file, fmt.Errorf("duplicate consumer name %q in %s", c.Name, path)
+		}
+		names[c.Name] = true
+
+		if c.Brokers == "" {
+			c.Brokers = *brokers
+		}
+		if c.Version == "" {
+			c.Version = *version
+		}
+		if c.ValueDecompress == "" {
+			c.ValueDecompress = *valueDecompress
+		}
+		if c.IsolationLevel == "" {
+			c.IsolationLevel = *isolationLevel
+		}
+		if c.Print == "" {
+			c.Print = *printMode
+		}
+	}
+
+	file.Consumers = consumers
+	return file, nil
+}
+
+// expandClusters replaces every consumer listing Clusters by a consumer per
+// cluster, named <name>@<cluster>, so the same topics are consumed from all
+// clusters concurrently, e.g. in an active-active setup. The messages of the
+// expanded consumers carry the name of their cluster. Consumer names default
+// to their group.
+func expandClusters(consumers []consumerConfig) ([]consumerConfig, error) {
+	var expanded []consumerConfig
+	for _, c := range consumers {
+		if c.Name == "" {
+			c.Name = c.Group
+		}
+		if len(c.Clusters) == 0 {
+			expanded = append(expanded, c)
+			continue
+		}
+		if c.Brokers != "" {
+			return nil, fmt.Errorf("consumer %s defines both brokers and clusters", c.Name)
+		}
+
+		clusters := make([]string, 0, len(c.Clusters))
+		for cluster := range c.Clusters {
+			clusters = append(clusters, cluster)
+		}
+		sort.Strings(clusters)
+
+		for _, cluster := range clusters {
+			if cluster == "" || c.Clusters[cluster] == "" {
+				return nil, fmt.Errorf("consumer %s requires a name and brokers for every cluster", c.Name)
+			}
+			clusterConsumer := c
+			clusterConsumer.Name = c.Name + "@" + cluster
+			clusterConsumer.Brokers = c.Clusters[cluster]
+			clusterConsumer.cluster = cluster
+			expanded = append(expanded, clusterConsumer)
+		}
+	}
+	return expanded, nil
+}
+
+// validate checks the required settings and parses the topics of the consumer
+func (c *consumerConfig) validate() error {
+	if c.Brokers == "" && *mock == "" {
+		return fmt.Errorf("no Kafka brokers defined for consumer %s", c.Name)
+	}
+	if c.Group == "" && !groupless[command] && *mock == "" {
+		return fmt.Errorf("no Kafka consumer group defined for consumer %s", c.Name)
+	}
+	if c.Topics == "" {
+		return fmt.Errorf("no topics defined for consumer %s", c.Name)
+	}
+	if *jobID != "" && c.Group != "" {
+		// the offsets of the job are kept apart from those of the group itself
+		c.Group += "." + *jobID
+	}
+	if *shadow && c.Group != "" {
+		// the shadow never moves the offsets of the group it is testing against
+		c.Group += shadowGroupSuffix
+	}
+
+	if !validValueDecompress(c.ValueDecompress) {
+		return fmt.Errorf("invalid value-decompress for consumer %s, expected one of none, auto, gzip, snappy or zstd", c.Name)
+	}
+
+	switch c.IsolationLevel {
+	case "", "read_uncommitted", "read_committed":
+	default:
+		return fmt.Errorf("invalid isolation-level for consumer %s, expected read_uncommitted or read_committed", c.Name)
+	}
+
+	if c.Print != "all" && c.Print != "metadata" {
+		return fmt.Errorf("invalid print for consumer %s, expected all or metadata", c.Name)
+	}
+
+	if c.MaxConcurrentClaims < 0 {
+		return fmt.Errorf("max-concurrent-claims of consumer %s must not be negative", c.Name)
+	}
+
+	if c.PauseBacklog < 0 || c.PauseBacklog >= sarama.NewConfig().ChannelBufferSize {
+		return fmt.Errorf("pause-backlog of consumer %s must be between 0 and %d", c.Name, sarama.NewConfig().ChannelBufferSize-1)
+	}
+
+	for name := range c.Sinks {
+		if !sinkFlags[name] {
+			return fmt.Errorf("unknown sink setting %q for consumer %s", name, c.Name)
+		}
+	}
+
+	for i := range c.Routes {
+		if err := c.Routes[i].parse(); err != nil {
+			return fmt.Errorf("consumer %s: %v", c.Name, err)
+		}
+	}
+
+	c.retryPolicies = make(map[string]consumergroup.RetryPolicy)
+	for topic, retry := range c.Retry {
+		policy, err := retry.parse()
+		if err != nil {
+			return fmt.Errorf("consumer %s: retry of topic %s: %v", c.Name, topic, err)
+		}
+		c.retryPolicies[topic] = policy
+	}
+
+	var err error
+	c.topicNames, c.topicPositions, err = parseTopics(c.Topics)
+	if err != nil {
+		return fmt.Errorf("consumer %s: %v", c.Name, err)
+	}
+
+	c.topicWeights, err = parseTopicWeights(c.TopicWeights)
+	if err != nil {
+		return fmt.Errorf("consumer %s: %v", c.Name, err)
+	}
+
+	if *last > 0 || *rewind > 0 {
+		for _, topic := range c.topicNames {
+			if _, ok := c.topicPositions[topic]; !ok {
+				c.topicPositions[topic] = startPosition{last: *last, rewind: *rewind}
+			}
+		}
+	}
+
+	return nil
+}
+
+// requiresRestart reports whether switching from c to other requires the
+// consumer group client to be reconnected
+func (c consumerConfig) requiresRestart(other consumerConfig) bool {
+	return c.Brokers != other.Brokers ||
+		c.Version != other.Version ||
+		c.Group != other.Group ||
+		c.Topics != other.Topics ||
+		c.Certificate != other.Certificate ||
+		c.Key != other.Key ||
+		c.CA != other.CA ||
+		c.Verify != other.Verify ||
+		c.MemberUserData != other.MemberUserData ||
+		c.AuditTopic != other.AuditTopic ||
+		c.IsolationLevel != other.IsolationLevel ||
+		c.cluster != other.cluster ||
+		c.MaxConcurrentClaims != other.MaxConcurrentClaims ||
+		c.TopicWeights != other.TopicWeights ||
+		!reflect.DeepEqual(c.Sinks, other.Sinks) ||
+		c.forwarding() != other.forwarding()
+}
+
+// reload re-reads the -config file and applies it to the running consumers.
+// Consumers whose connection, group or topics changed are restarted, removed
+// consumers are closed and new ones are started. An invalid file is ignored
+// altogether, and a consumer that can't be restarted keeps running with its
+// previous configuration.
+func reload() {
+	log.Printf("Reloading %s", *configPath)
+
+	file, err := loadConfig(*configPath)
+	reloaded := file.Consumers
+	if err == nil {
+		for i := range reloaded {
+			if err = reloaded[i].validate(); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to reload %s, keeping the current configuration: %v", *configPath, err)
+		return
+	}
+	file.applyLogLevel()
+
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	names := make(map[string]bool)
+	for _, c := range reloaded {
+		names[c.Name] = true
+
+		previous, ok := running[c.Name]
+		if ok && !previous.settings().requiresRestart(c) {
+			previous.apply(c)
+			continue
+		}
+
+		// the new client is connected before the previous consumer is closed
+		consumer, err := newConsumer(c)
+		if err != nil {
+			if ok {
+				previous.logger.Printf("Unable to restart consumer, keeping the previous configuration: %v", err)
+			} else {
+				log.Printf("Unable to start consumer %s: %v", c.Name, err)
+			}
+			continue
+		}
+		if ok {
+			previous.logger.Println("Restarting consumer to apply the new configuration")
+			previous.Close()
+		}
+		running[c.Name] = consumer
+		go consumer.consume()
+	}
+
+	for name, consumer := range running {
+		if !names[name] {
+			consumer.logger.Println("Stopping consumer removed from the configuration")
+			consumer.Close()
+			delete(running, name)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Package consumergroup embeds a Sarama consumer group in an application.
+//
+// Messages can either be handled by a callback passed to Run, which marks each
+// message once the callback returns without error, or be received from the
+// Messages channel and acknowledged explicitly with Ack, which integrates with
+// the select loop of the application.
+package consumergroup
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// ErrAlreadyStarted is returned by Run when the consumer is already consuming
+var ErrAlreadyStarted = errors.New("consumergroup: consumer already started")
+
+// ConsumedMessage is a message delivered by the consumer group
+type ConsumedMessage struct {
+	*sarama.ConsumerMessage
+
+	// GenerationID is the group generation the message was delivered in
+	GenerationID int32
+	// SessionState is the state created by the SessionSetup of the consumer
+	// for the session the message was delivered in
+	SessionState interface{}
+	// Decoded is the value decoded by the Decoder registered for the topic,
+	// nil without one. Under Messages DecodeErr is set instead when the
+	// decoder failed, Run applies the FailurePolicy to the message.
+	Decoded   interface{}
+	DecodeErr error
+
+	session sarama.ConsumerGroupSession
+}
+
+// Handler processes a single message. The context carries the MessageInfo of
+// the message and the state of the SessionSetup, and expires with the
+// HandlerTimeout. Returning an error applies the FailurePolicy of the
+// consumer.
+type Handler func(ctx context.Context, msg *ConsumedMessage) error
+
+// Consumer consumes a set of topics as a member of a consumer group
+type Consumer struct {
+	// HandlerTimeout limits the time Run waits for a handler to process a
+	// message, zero means no limit
+	HandlerTimeout time.Duration
+	// FailurePolicy decides what Run does when a handler fails or times out,
+	// defaults to FailStop
+	FailurePolicy FailurePolicy
+	// MaxRetries and RetryBackoff configure the FailRetry policy
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Retry, when its MaxAttempts is set, retries failed messages before the
+	// FailurePolicy applies, TopicRetry overrides it per topic
+	Retry      RetryPolicy
+	TopicRetry map[string]RetryPolicy
+	// DeadLetter receives the messages failed under the FailDeadLetter policy
+	DeadLetter func(ctx context.Context, msg *ConsumedMessage, err error) error
+	// Interceptors are invoked in order for every message before it is delivered
+	Interceptors []Interceptor
+	// Middleware wraps the handler passed to Run, the first being the outermost
+	Middleware []Middleware
+	// SessionSetup, when set, creates state for every session that is passed
+	// to the handlers. Under Messages the state may already be cleaned up when
+	// a message of an ended session is received, see Ack.
+	SessionSetup SessionSetup
+
+	// decoders by topic, see RegisterDecoder
+	decoders map[string]Decoder
+
+	client sarama.Client
+	group  sarama.ConsumerGroup
+	topics []string
+
+	started  int32
+	messages chan *ConsumedMessage
+	errors   chan error
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	generation int32
+}
+
+// New connects to the brokers and returns a consumer for the given group and topics
+func New(brokers []string, groupID string, topics []string, config *sarama.Config) (*Consumer, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := sarama.NewConsumerGroupFromClient(groupID, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Consumer{
+		MaxRetries:   3,
+		RetryBackoff: time.Second,
+
+		client:   client,
+		group:    group,
+		topics:   topics,
+		messages: make(chan *ConsumedMessage),
+		errors:   make(chan error, errorsBufferSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	if config.Consumer.Return.Errors {
+		go func() {
+			for err := range group.Errors() {
+				c.reportError(Categorize(err))
+			}
+		}()
+	}
+	return c, nil
+}
+
+// Client returns the underlying Sarama client
+func (c *Consumer) Client() sarama.Client {
+	return c.client
+}
+
+// Messages starts consuming on first use and returns the channel the consumed
+// messages are delivered on. Every message must be passed to Ack once it has
+// been processed. The channel is closed when the consumer is closed.
+func (c *Consumer) Messages() <-chan *ConsumedMessage {
+	if atomic.CompareAndSwapInt32(&c.started, 0, 1) {
+		go func() {
+			defer close(c.messages)
+			c.consume(c.ctx, &handler{consumer: c, deliver: c.send})
+		}()
+	}
+	return c.messages
+}
+
+func (c *Consumer) send(ctx context.Context, msg *ConsumedMessage) error {
+	if !Intercept(ctx, c.Interceptors, msg) {
+		// not marked, the Ack of a later message of the partition covers it
+		return nil
+	}
+	msg.DecodeErr = c.decode(msg)
+	select {
+	case c.messages <- msg:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// Ack marks the message as processed, so its offset is committed. As offsets
+// are committed per partition, this also acknowledges all earlier messages of
+// the same partition. Acknowledgements of messages delivered in a previous
+// group generation are ignored, as their partition may have been reassigned.
+func (c *Consumer) Ack(msg *ConsumedMessage) {
+	if msg.GenerationID != atomic.LoadInt32(&c.generation) {
+		return
+	}
+	msg.session.MarkMessage(msg.ConsumerMessage, "")
+}
+
+// Run consumes messages by passing them to fn until ctx is canceled, the consumer
+// is closed or fn fails under the FailStop policy. Messages are marked as processed
+// once fn returns successfully or the failure policy moves past them. Run can't be
+// combined with Messages.
+func (c *Consumer) Run(ctx context.Context, fn Handler) error {
+	if !atomic.CompareAndSwapInt32(&c.started, 0, 1) {
+		return ErrAlreadyStarted
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	fn = Chain(c.Middleware...)(fn)
+	h := &handler{consumer: c}
+	var once sync.Once
+	var handlerErr error
+	h.deliver = func(ctx context.Context, msg *ConsumedMessage) error {
+		if !Intercept(ctx, c.Interceptors, msg) {
+			msg.session.MarkMessage(msg.ConsumerMessage, "")
+			return nil
+		}
+		err := c.handle(ctx, fn, msg)
+		if err != nil && ctx.Err() != nil {
+			// the session ended, the message is redelivered to the next owner of the partition
+			return nil
+		}
+		if err != nil {
+			once.Do(func() {
+				handlerErr = err
+				cancel()
+			})
+			return err
+		}
+		msg.session.MarkMessage(msg.ConsumerMessage, "")
+		return nil
+	}
+
+	c.consume(ctx, h)
+	return handlerErr
+}
+
+// consume keeps consuming across rebalances until ctx is canceled or the group is closed
+func (c *Consumer) consume(ctx context.Context, h *handler) {
+	defer close(c.done)
+
+	for {
+		err := c.group.Consume(ctx, c.topics, h)
+		if err == sarama.ErrClosedConsumerGroup || ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.reportError(Categorize(err))
+			select {
+			case <-time.After(c.client.Config().Consumer.Group.Rebalance.Retry.Backoff):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Close stops consuming and closes the consumer group and its client
+func (c *Consumer) Close() error {
+	c.cancel()
+	if atomic.LoadInt32(&c.started) == 1 {
+		<-c.done
+	}
+
+	if err := c.group.Close(); err != nil {
+		c.client.Close()
+		return err
+	}
+	return c.client.Close()
+}
+
+// handler adapts the consumer to sarama.ConsumerGroupHandler
+type handler struct {
+	consumer *Consumer
+	deliver  func(ctx context.Context, msg *ConsumedMessage) error
+
+	// state of the current session, sessions of a handler never overlap
+	state   interface{}
+	cleanup func()
+}
+
+func (h *handler) Setup(session sarama.ConsumerGroupSession) error {
+	atomic.StoreInt32(&h.consumer.generation, session.GenerationID())
+
+	if h.consumer.SessionSetup == nil {
+		return nil
+	}
+	state, cleanup, err := h.consumer.SessionSetup(session.Context(), Session{
+		MemberID:     session.MemberID(),
+		GenerationID: session.GenerationID(),
+		Claims:       session.Claims(),
+	})
+	if err != nil {
+		return err
+	}
+	h.state, h.cleanup = state, cleanup
+	return nil
+}
+
+// Cleanup is also called by Sarama when Setup failed
+func (h *handler) Cleanup(sarama.ConsumerGroupSession) error {
+	if h.cleanup != nil {
+		h.cleanup()
+	}
+	h.state, h.cleanup = nil, nil
+	return nil
+}
+
+func (h *handler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	ctx := session.Context()
+	if h.state != nil {
+		ctx = context.WithValue(ctx, sessionStateKey{}, h.state)
+	}
+
+	for message := range claim.Messages() {
+		msg := &ConsumedMessage{
+			ConsumerMessage: message,
+			GenerationID:    session.GenerationID(),
+			SessionState:    h.state,
+			session:         session,
+		}
+		if err := h.deliver(ctx, msg); err != nil {
+			// reported on Errors and returned by Run, which ends the session
+			return nil
+		}
+		if session.Context().Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
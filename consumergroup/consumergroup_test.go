@@ -0,0 +1,51 @@
+package consumergroup
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// testSession is a group session recording the marked messages
+type testSession struct {
+	generation int32
+	marked     []int64
+}
+
+func (s *testSession) Claims() map[string][]int32               { return map[string][]int32{"orders": {0}} }
+func (s *testSession) MemberID() string                         { return "member" }
+func (s *testSession) GenerationID() int32                      { return s.generation }
+func (s *testSession) MarkOffset(string, int32, int64, string)  {}
+func (s *testSession) Commit()                                  {}
+func (s *testSession) ResetOffset(string, int32, int64, string) {}
+func (s *testSession) Context() context.Context                 { return context.Background() }
+func (s *testSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.marked = append(s.marked, msg.Offset)
+}
+
+func TestAckIgnoresPreviousGenerations(t *testing.T) {
+	c := &Consumer{}
+	h := &handler{consumer: c}
+
+	previous := &testSession{generation: 1}
+	if err := h.Setup(previous); err != nil {
+		t.Fatal(err)
+	}
+	stale := &ConsumedMessage{ConsumerMessage: &sarama.ConsumerMessage{Topic: "orders", Offset: 5}, GenerationID: 1, session: previous}
+
+	current := &testSession{generation: 2}
+	if err := h.Setup(current); err != nil {
+		t.Fatal(err)
+	}
+	fresh := &ConsumedMessage{ConsumerMessage: &sarama.ConsumerMessage{Topic: "orders", Offset: 7}, GenerationID: 2, session: current}
+
+	c.Ack(stale)
+	c.Ack(fresh)
+	if len(previous.marked) != 0 {
+		t.Errorf("marked %v in the previous generation, want nothing", previous.marked)
+	}
+	if len(current.marked) != 1 || current.marked[0] != 7 {
+		t.Errorf("marked %v in the current generation, want [7]", current.marked)
+	}
+}
@@ -0,0 +1,53 @@
+package consumergroup
+
+import "fmt"
+
+// Decoder deserializes the value of a message of a topic, such as a custom
+// binary format, into the value passed to the handlers as Decoded
+type Decoder func(value []byte) (interface{}, error)
+
+// DecodeError is returned when the Decoder of a topic fails on a message
+type DecodeError struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("consumergroup: unable to decode topic = %s, partition = %d, offset = %d: %v", e.Topic, e.Partition, e.Offset, e.Err)
+}
+
+// Unwrap returns the error of the Decoder
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// RegisterDecoder sets the decoder of the values of topic, replacing any
+// decoder registered before. The topic "*" applies to all topics without a
+// decoder of their own. Decoders must be registered before Run or Messages.
+func (c *Consumer) RegisterDecoder(topic string, decoder Decoder) {
+	if c.decoders == nil {
+		c.decoders = make(map[string]Decoder)
+	}
+	c.decoders[topic] = decoder
+}
+
+// decode sets Decoded of the message with the decoder of its topic, if any.
+// Tombstones aren't decoded, their Decoded stays nil.
+func (c *Consumer) decode(msg *ConsumedMessage) error {
+	decoder, ok := c.decoders[msg.Topic]
+	if !ok {
+		decoder = c.decoders["*"]
+	}
+	if decoder == nil || msg.Value == nil {
+		return nil
+	}
+
+	decoded, err := decoder(msg.Value)
+	if err != nil {
+		return &DecodeError{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset, Err: err}
+	}
+	msg.Decoded = decoded
+	return nil
+}
@@ -0,0 +1,56 @@
+package consumergroup
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestDecode(t *testing.T) {
+	errInvalid := errors.New("invalid value")
+	c := &Consumer{}
+	c.RegisterDecoder("orders", func(value []byte) (interface{}, error) {
+		if string(value) == "bad" {
+			return nil, errInvalid
+		}
+		return "order " + string(value), nil
+	})
+	c.RegisterDecoder("*", func(value []byte) (interface{}, error) {
+		return strings.ToUpper(string(value)), nil
+	})
+
+	for _, test := range []struct {
+		topic   string
+		value   []byte
+		decoded interface{}
+		err     error
+	}{
+		{"orders", []byte("42"), "order 42", nil},
+		{"payments", []byte("paid"), "PAID", nil},
+		{"orders", nil, nil, nil},
+		{"orders", []byte("bad"), nil, errInvalid},
+	} {
+		msg := &ConsumedMessage{ConsumerMessage: &sarama.ConsumerMessage{Topic: test.topic, Partition: 1, Offset: 9, Value: test.value}}
+		err := c.decode(msg)
+		if msg.Decoded != test.decoded {
+			t.Errorf("decoded %s %q to %v, want %v", test.topic, test.value, msg.Decoded, test.decoded)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("decoding %s %q returned %v, want %v", test.topic, test.value, err, test.err)
+		}
+		var decodeErr *DecodeError
+		if test.err != nil && (!errors.As(err, &decodeErr) || decodeErr.Topic != test.topic || decodeErr.Offset != 9) {
+			t.Errorf("decoding %s %q returned %#v, want a DecodeError of the message", test.topic, test.value, err)
+		}
+	}
+}
+
+func TestDecodeWithoutDecoder(t *testing.T) {
+	c := &Consumer{}
+	msg := &ConsumedMessage{ConsumerMessage: &sarama.ConsumerMessage{Topic: "orders", Value: []byte("42")}}
+	if err := c.decode(msg); err != nil || msg.Decoded != nil {
+		t.Errorf("decode = %v with %v decoded, want nothing decoded", err, msg.Decoded)
+	}
+}
@@ -0,0 +1,182 @@
+package consumergroup
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// errorsBufferSize is the capacity of the Errors channel
+const errorsBufferSize = 64
+
+// authErrors are the errors of the brokers categorized as an AuthError
+var authErrors = []sarama.KError{
+	sarama.ErrSASLAuthenticationFailed, sarama.ErrTopicAuthorizationFailed, sarama.ErrGroupAuthorizationFailed,
+	sarama.ErrClusterAuthorizationFailed, sarama.ErrIllegalSASLState, sarama.ErrUnsupportedSASLMechanism,
+	sarama.ErrDelegationTokenAuthorizationFailed, sarama.ErrTransactionalIDAuthorizationFailed,
+}
+
+// Error categories, as returned by Category and counted by the
+// errors-<category> counters of the MetricRegistry of the Sarama config
+const (
+	CategoryAuth      = "auth"
+	CategoryRebalance = "rebalance"
+	CategoryHandler   = "handler"
+	CategorySink      = "sink"
+	CategoryCommit    = "commit"
+)
+
+// AuthError is a failed authentication or authorization with the brokers,
+// which doesn't go away by retrying
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("consumergroup: not authorized: %v", e.Err)
+}
+
+// Unwrap returns the Sarama error
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// RebalanceError is a failure to join, sync or stay in the group, after which
+// the consumer rejoins the group
+type RebalanceError struct {
+	Err error
+}
+
+func (e *RebalanceError) Error() string {
+	return fmt.Sprintf("consumergroup: group session failed: %v", e.Err)
+}
+
+// Unwrap returns the Sarama error
+func (e *RebalanceError) Unwrap() error {
+	return e.Err
+}
+
+// HandlerError is a message the handler failed to process, reported after
+// the retries and the FailurePolicy applied
+type HandlerError struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("consumergroup: handler failed on topic = %s, partition = %d, offset = %d: %v", e.Topic, e.Partition, e.Offset, e.Err)
+}
+
+// Unwrap returns the error of the handler
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// SinkError is a message that couldn't be written to a destination such as
+// the DeadLetter function
+type SinkError struct {
+	Sink      string
+	Topic     string
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("consumergroup: unable to write topic = %s, partition = %d, offset = %d to %s: %v", e.Topic, e.Partition, e.Offset, e.Sink, e.Err)
+}
+
+// Unwrap returns the error of the sink
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// CommitError is a failure to commit the offset of a partition, or of all
+// partitions when Topic is empty
+type CommitError struct {
+	Topic     string
+	Partition int32
+	Err       error
+}
+
+func (e *CommitError) Error() string {
+	if e.Topic == "" {
+		return fmt.Sprintf("consumergroup: unable to commit offsets: %v", e.Err)
+	}
+	return fmt.Sprintf("consumergroup: unable to commit topic = %s, partition = %d: %v", e.Topic, e.Partition, e.Err)
+}
+
+// Unwrap returns the Sarama error
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// Category returns the category of an error of the Errors channel, or an
+// empty string for other errors
+func Category(err error) string {
+	switch err.(type) {
+	case *AuthError:
+		return CategoryAuth
+	case *RebalanceError:
+		return CategoryRebalance
+	case *HandlerError:
+		return CategoryHandler
+	case *SinkError:
+		return CategorySink
+	case *CommitError:
+		return CategoryCommit
+	}
+	return ""
+}
+
+// Categorize wraps an error returned by a Sarama consumer group, from Consume
+// or its Errors channel, in the type of its category: authentication and
+// authorization failures in an AuthError, failed offset commits in a
+// CommitError and everything else in a RebalanceError. Errors of a category
+// returned by a ConsumeClaim, which the group passes on its Errors channel,
+// are returned unwrapped.
+func Categorize(err error) error {
+	var topic string
+	var partition int32
+	cause := err
+	if cerr, ok := err.(*sarama.ConsumerError); ok {
+		topic, partition, cause = cerr.Topic, cerr.Partition, cerr.Err
+	}
+	if Category(cause) != "" {
+		return cause
+	}
+
+	for _, kerr := range authErrors {
+		// Sarama wraps the errors of the brokers, e.g. in ErrOutOfBrokers
+		if errors.Is(cause, kerr) {
+			return &AuthError{Err: err}
+		}
+	}
+	switch cause {
+	case sarama.ErrOffsetMetadataTooLarge, sarama.ErrInvalidCommitOffsetSize, sarama.ErrOffsetsLoadInProgress:
+		return &CommitError{Topic: topic, Partition: partition, Err: cause}
+	}
+	return &RebalanceError{Err: err}
+}
+
+// reportError counts the error in the MetricRegistry and delivers it on the
+// Errors channel, dropping it when the channel is full
+func (c *Consumer) reportError(err error) {
+	metrics.GetOrRegisterCounter("errors-"+Category(err), c.client.Config().MetricRegistry).Inc(1)
+	select {
+	case c.errors <- err:
+	default:
+	}
+}
+
+// Errors returns the channel the errors of the consumer are delivered on, as
+// an *AuthError, *RebalanceError, *HandlerError, *SinkError or *CommitError,
+// so applications can react to their category. Errors are dropped while the
+// channel is full, reading it is optional.
+func (c *Consumer) Errors() <-chan error {
+	return c.errors
+}
@@ -0,0 +1,33 @@
+package consumergroup
+
+import "context"
+
+// Interceptor is invoked for every consumed message before it reaches the
+// handler or the Messages channel, like the ConsumerInterceptor of the Java
+// client. It is meant for telemetry and gating.
+type Interceptor interface {
+	// OnConsume may modify the message, including replacing its
+	// ConsumerMessage, or return false to drop it. Run marks dropped messages
+	// as processed, with Messages they are covered by the Ack of a later
+	// message of the same partition.
+	OnConsume(ctx context.Context, msg *ConsumedMessage) bool
+}
+
+// InterceptorFunc adapts a function to the Interceptor interface
+type InterceptorFunc func(ctx context.Context, msg *ConsumedMessage) bool
+
+// OnConsume calls f(ctx, msg)
+func (f InterceptorFunc) OnConsume(ctx context.Context, msg *ConsumedMessage) bool {
+	return f(ctx, msg)
+}
+
+// Intercept passes the message through the interceptors in order and reports
+// whether it should be delivered
+func Intercept(ctx context.Context, interceptors []Interceptor, msg *ConsumedMessage) bool {
+	for _, interceptor := range interceptors {
+		if !interceptor.OnConsume(ctx, msg) {
+			return false
+		}
+	}
+	return true
+}
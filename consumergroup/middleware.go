@@ -0,0 +1,137 @@
+package consumergroup
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Middleware wraps a Handler with behavior such as logging, metrics or
+// retries. It is applied to every call of the handler, so the retries of the
+// Retry policy and the FailRetry policy pass through it once per attempt.
+type Middleware func(next Handler) Handler
+
+// Chain composes the middlewares into one, the first being the outermost
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Logger is the subset of *log.Logger used by the Logging middleware
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Logging logs every message the handler fails on with the error and the
+// time it took. With verbose set the messages handled successfully are logged
+// as well.
+func Logging(logger Logger, verbose bool) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *ConsumedMessage) error {
+			started := time.Now()
+			err := next(ctx, msg)
+			switch {
+			case err != nil:
+				logger.Printf("Handler failed on topic = %s, partition = %d, offset = %d after %v: %v", msg.Topic, msg.Partition, msg.Offset, time.Since(started), err)
+			case verbose:
+				logger.Printf("Handled topic = %s, partition = %d, offset = %d in %v", msg.Topic, msg.Partition, msg.Offset, time.Since(started))
+			}
+			return err
+		}
+	}
+}
+
+// Metrics records the handled messages in the registry, which may be the
+// MetricRegistry of the Sarama config: the handler-messages and handler-errors
+// meters and the handler-latency timer, plus a copy of each named
+// <metric>-for-topic-<topic>
+func Metrics(registry metrics.Registry) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *ConsumedMessage) error {
+			started := time.Now()
+			err := next(ctx, msg)
+			for _, suffix := range []string{"", "-for-topic-" + msg.Topic} {
+				metrics.GetOrRegisterMeter("handler-messages"+suffix, registry).Mark(1)
+				if err != nil {
+					metrics.GetOrRegisterMeter("handler-errors"+suffix, registry).Mark(1)
+				}
+				metrics.GetOrRegisterTimer("handler-latency"+suffix, registry).UpdateSince(started)
+			}
+			return err
+		}
+	}
+}
+
+// Tracer starts a span for a handled message, adapting a tracing library such
+// as OpenTelemetry. The context it returns is passed to the handler, and end
+// is called with the result of the handler.
+type Tracer interface {
+	Start(ctx context.Context, msg *ConsumedMessage) (spanCtx context.Context, end func(err error))
+}
+
+// TracerFunc adapts a function to the Tracer interface
+type TracerFunc func(ctx context.Context, msg *ConsumedMessage) (context.Context, func(err error))
+
+// Start calls f(ctx, msg)
+func (f TracerFunc) Start(ctx context.Context, msg *ConsumedMessage) (context.Context, func(err error)) {
+	return f(ctx, msg)
+}
+
+// Tracing wraps every call of the handler in a span of the tracer
+func Tracing(tracer Tracer) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *ConsumedMessage) error {
+			ctx, end := tracer.Start(ctx, msg)
+			err := next(ctx, msg)
+			end(err)
+			return err
+		}
+	}
+}
+
+// Retry calls the handler again with the policy until it succeeds. Unlike the
+// Retry policy of the consumer it can be placed anywhere in the chain, e.g.
+// after Tracing so a single span covers all attempts.
+func Retry(policy RetryPolicy) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *ConsumedMessage) error {
+			return policy.Do(ctx, func() error {
+				return next(ctx, msg)
+			})
+		}
+	}
+}
+
+// PanicError is returned by the Recover middleware for a handler that panicked
+type PanicError struct {
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("consumergroup: handler panicked: %v", e.Value)
+}
+
+// Recover turns a panic of the handler into a *PanicError, to which the
+// FailurePolicy applies like to any other error. Without it a panic crashes
+// the application.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *ConsumedMessage) (err error) {
+			defer func() {
+				if value := recover(); value != nil {
+					err = &PanicError{Value: value, Stack: debug.Stack()}
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
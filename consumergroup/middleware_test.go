@@ -0,0 +1,46 @@
+package consumergroup
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, msg *ConsumedMessage) error {
+				calls = append(calls, name+" before")
+				err := next(ctx, msg)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+
+	handler := Chain(record("outer"), record("inner"))(func(ctx context.Context, msg *ConsumedMessage) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+	if err := handler(context.Background(), &ConsumedMessage{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestChainWithoutMiddleware(t *testing.T) {
+	called := false
+	handler := Chain()(func(ctx context.Context, msg *ConsumedMessage) error {
+		called = true
+		return nil
+	})
+	handler(context.Background(), &ConsumedMessage{})
+	if !called {
+		t.Error("the handler wasn't called")
+	}
+}
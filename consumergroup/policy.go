@@ -0,0 +1,126 @@
+package consumergroup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrHandlerTimeout is passed to the failure policy when a handler exceeds HandlerTimeout
+var ErrHandlerTimeout = errors.New("consumergroup: handler timed out")
+
+// FailurePolicy decides what Run does with a message its handler failed to process
+type FailurePolicy int
+
+const (
+	// FailStop stops Run and returns the handler error. The message is not
+	// marked, so it is redelivered when consumption restarts.
+	FailStop FailurePolicy = iota
+	// FailRetry calls the handler again, up to MaxRetries times unless a Retry
+	// or TopicRetry policy is set, before stopping.
+	FailRetry
+	// FailSkip marks the message as processed and continues with the next one.
+	FailSkip
+	// FailDeadLetter passes the message to DeadLetter, marks it as processed
+	// and continues with the next one.
+	FailDeadLetter
+)
+
+// MessageInfo identifies the message a handler is processing
+type MessageInfo struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+type messageInfoKey struct{}
+
+// MessageInfoFromContext returns the message carried by the context passed to a handler
+func MessageInfoFromContext(ctx context.Context) (MessageInfo, bool) {
+	info, ok := ctx.Value(messageInfoKey{}).(MessageInfo)
+	return info, ok
+}
+
+// handle decodes a message and passes it to fn, applying the handler timeout
+// and failure policy. Decode errors aren't retried. It returns an error only
+// when Run should stop.
+func (c *Consumer) handle(ctx context.Context, fn Handler, msg *ConsumedMessage) error {
+	ctx = context.WithValue(ctx, messageInfoKey{}, MessageInfo{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+	})
+
+	policy := c.retryPolicy(msg.Topic)
+	err := c.decode(msg)
+	if err == nil {
+		err = policy.Do(ctx, func() error {
+			return c.call(ctx, fn, msg)
+		})
+	}
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() == nil {
+		c.reportError(&HandlerError{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset, Err: err})
+	}
+	if policy.IsFatal(err) {
+		return err
+	}
+
+	switch c.FailurePolicy {
+	case FailSkip:
+		return nil
+	case FailDeadLetter:
+		if c.DeadLetter == nil {
+			return fmt.Errorf("consumergroup: no DeadLetter function for %v", err)
+		}
+		if err := c.DeadLetter(ctx, msg, err); err != nil {
+			c.reportError(&SinkError{Sink: "dead letter", Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset, Err: err})
+			return err
+		}
+		return nil
+	}
+	return err
+}
+
+// retryPolicy returns the retry policy of the topic: its TopicRetry, the Retry
+// of the consumer, or MaxRetries and RetryBackoff under FailRetry
+func (c *Consumer) retryPolicy(topic string) RetryPolicy {
+	if policy, ok := c.TopicRetry[topic]; ok {
+		return policy
+	}
+	if c.Retry.MaxAttempts > 0 {
+		return c.Retry
+	}
+	if c.FailurePolicy == FailRetry {
+		return RetryPolicy{MaxAttempts: c.MaxRetries + 1, InitialBackoff: c.RetryBackoff}
+	}
+	return RetryPolicy{}
+}
+
+// call runs fn with the handler timeout. On timeout the handler is abandoned
+// with a canceled context rather than blocking the claim.
+func (c *Consumer) call(ctx context.Context, fn Handler, msg *ConsumedMessage) error {
+	if c.HandlerTimeout <= 0 {
+		return fn(ctx, msg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.HandlerTimeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- fn(ctx, msg)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrHandlerTimeout
+		}
+		return ctx.Err()
+	}
+}
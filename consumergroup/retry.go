@@ -0,0 +1,125 @@
+package consumergroup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// ErrorClass groups errors for the Retryable and Fatal lists of a RetryPolicy
+type ErrorClass string
+
+const (
+	// ClassTimeout are handler timeouts, expired deadlines and network timeouts
+	ClassTimeout ErrorClass = "timeout"
+	// ClassNetwork are other network errors and connections closed unexpectedly
+	ClassNetwork ErrorClass = "network"
+	// ClassKafka are errors returned by a Kafka broker
+	ClassKafka ErrorClass = "kafka"
+	// ClassOther are all remaining errors
+	ClassOther ErrorClass = "other"
+)
+
+// Classify returns the class of the error, looking through the errors it wraps
+func Classify(err error) ErrorClass {
+	if errors.Is(err, ErrHandlerTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return ClassTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ClassNetwork
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ClassTimeout
+		}
+		return ClassNetwork
+	}
+	var kerr sarama.KError
+	if errors.As(err, &kerr) {
+		return ClassKafka
+	}
+	return ClassOther
+}
+
+// RetryPolicy configures how often and when a failed message is retried
+type RetryPolicy struct {
+	// MaxAttempts is the number of calls including the first one, values
+	// below 1 call once
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the backoff, zero means no cap
+	MaxBackoff time.Duration
+	// Multiplier grows the backoff after every retry, values below 1 keep it constant
+	Multiplier float64
+	// Jitter randomizes every backoff by up to this fraction, e.g. 0.2 for ±20%
+	Jitter float64
+	// Retryable lists the error classes that are retried, all classes when empty
+	Retryable []ErrorClass
+	// Fatal lists the error classes that are never retried. Under Run they
+	// also stop consuming regardless of the FailurePolicy.
+	Fatal []ErrorClass
+}
+
+// Backoff returns the wait before the given retry, counting from 0
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+	if p.Multiplier > 1 {
+		backoff *= math.Pow(p.Multiplier, float64(retry))
+	}
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		backoff *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(backoff)
+}
+
+// IsFatal reports whether the error belongs to one of the Fatal classes
+func (p RetryPolicy) IsFatal(err error) bool {
+	return hasClass(p.Fatal, Classify(err))
+}
+
+// retryable reports whether the error may be retried
+func (p RetryPolicy) retryable(err error) bool {
+	class := Classify(err)
+	if hasClass(p.Fatal, class) {
+		return false
+	}
+	return len(p.Retryable) == 0 || hasClass(p.Retryable, class)
+}
+
+func hasClass(classes []ErrorClass, class ErrorClass) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Do calls fn until it succeeds, returns an error that isn't retryable, the
+// attempts are exhausted or ctx is done. It returns the last error.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !p.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(p.Backoff(attempt - 1)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package consumergroup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	for retry, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if backoff := policy.Backoff(retry); backoff != want {
+			t.Errorf("Backoff(%d) = %v, want %v", retry, backoff, want)
+		}
+	}
+
+	constant := RetryPolicy{InitialBackoff: 50 * time.Millisecond, Multiplier: 0.5}
+	if backoff := constant.Backoff(3); backoff != 50*time.Millisecond {
+		t.Errorf("Backoff(3) with a multiplier below 1 = %v, want 50ms", backoff)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if backoff := policy.Backoff(0); backoff < 80*time.Millisecond || backoff > 120*time.Millisecond {
+			t.Fatalf("Backoff(0) = %v, want within 20%% of 100ms", backoff)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	errOther := errors.New("failed")
+	errWrapped := fmt.Errorf("producing: %w", sarama.ErrNotLeaderForPartition)
+	for _, test := range []struct {
+		name     string
+		policy   RetryPolicy
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{"success", RetryPolicy{MaxAttempts: 3}, []error{nil}, 1, nil},
+		{"retried until success", RetryPolicy{MaxAttempts: 3}, []error{errOther, errOther, nil}, 3, nil},
+		{"attempts exhausted", RetryPolicy{MaxAttempts: 2}, []error{errOther, errOther, nil}, 2, errOther},
+		{"called once without attempts", RetryPolicy{}, []error{errOther, nil}, 1, errOther},
+		{"fatal class", RetryPolicy{MaxAttempts: 3, Fatal: []ErrorClass{ClassOther}}, []error{errOther, nil}, 1, errOther},
+		{"class not retryable", RetryPolicy{MaxAttempts: 3, Retryable: []ErrorClass{ClassNetwork}}, []error{errOther, nil}, 1, errOther},
+		{"retryable class", RetryPolicy{MaxAttempts: 3, Retryable: []ErrorClass{ClassNetwork}}, []error{io.EOF, nil}, 2, nil},
+		{"wrapped fatal class", RetryPolicy{MaxAttempts: 3, Fatal: []ErrorClass{ClassKafka}}, []error{errWrapped, nil}, 1, errWrapped},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := test.policy.Do(context.Background(), func() error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+			if err != test.err || attempts != test.attempts {
+				t.Errorf("Do = %v after %d attempts, want %v after %d", err, attempts, test.err, test.attempts)
+			}
+		})
+	}
+}
+
+func TestDoStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour}
+	attempts := 0
+	errFailed := errors.New("failed")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := policy.Do(ctx, func() error {
+		attempts++
+		return errFailed
+	}); err != errFailed || attempts != 1 {
+		t.Errorf("Do = %v after %d attempts, want the error of the first attempt", err, attempts)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		class ErrorClass
+	}{
+		{ErrHandlerTimeout, ClassTimeout},
+		{context.DeadlineExceeded, ClassTimeout},
+		{io.EOF, ClassNetwork},
+		{io.ErrUnexpectedEOF, ClassNetwork},
+		{sarama.ErrNotLeaderForPartition, ClassKafka},
+		{errors.New("failed"), ClassOther},
+		{&net.DNSError{Err: "lookup timed out", IsTimeout: true}, ClassTimeout},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ClassNetwork},
+
+		// wrapped errors are classified by the error they wrap
+		{fmt.Errorf("calling the service: %w", context.DeadlineExceeded), ClassTimeout},
+		{&HandlerError{Err: ErrHandlerTimeout}, ClassTimeout},
+		{fmt.Errorf("reading the response: %w", io.ErrUnexpectedEOF), ClassNetwork},
+		{fmt.Errorf("producing: %w", &net.OpError{Op: "write", Err: errors.New("broken pipe")}), ClassNetwork},
+		{&SinkError{Sink: "redis", Err: fmt.Errorf("producing: %w", sarama.ErrMessageSizeTooLarge)}, ClassKafka},
+		{&DecodeError{Topic: "orders", Err: errors.New("invalid value")}, ClassOther},
+	} {
+		if class := Classify(test.err); class != test.class {
+			t.Errorf("Classify(%v) = %s, want %s", test.err, class, test.class)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package consumergroup
+
+import "context"
+
+// Session describes a group session, which lasts from a rebalance until the next one
+type Session struct {
+	MemberID     string
+	GenerationID int32
+	// Claims are the partitions assigned to the consumer by topic
+	Claims map[string][]int32
+}
+
+// SessionSetup creates the state shared by the handlers of all claims of a
+// session, such as database connections or caches for the claimed partitions.
+// The state is passed along with every message of the session, and cleanup is
+// called once the session ends and all handlers returned, including when the
+// partitions are revoked or the consumer is closed. An error ends the session,
+// the consumer joins the group again after the rebalance backoff.
+type SessionSetup func(ctx context.Context, session Session) (state interface{}, cleanup func(), err error)
+
+type sessionStateKey struct{}
+
+// SessionStateFromContext returns the state created by the SessionSetup of the
+// consumer, carried by the context passed to a handler
+func SessionStateFromContext(ctx context.Context) interface{} {
+	return ctx.Value(sessionStateKey{})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// correlations groups the printed messages by -correlate, nil without it
+var correlations *correlationTracker
+
+// correlationTracker groups messages across topics by their correlation id
+// header into the timelines of business transactions such as sagas. A timeline
+// is complete once no message of it arrived for the timeout, and is then
+// printed with its messages in the order of their timestamps, or exported as a
+// JSON line.
+type correlationTracker struct {
+	header  string
+	timeout time.Duration
+	max     int
+
+	mu sync.Mutex
+	// timelines are the open timelines by correlation id, in order of
+	// their last message with the most recent first
+	timelines map[string]*list.Element
+	order     *list.List
+	printer   *messagePrinter
+	export    *os.File
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// timeline is the open timeline of a correlation id
+type timeline struct {
+	id       string
+	messages []*timelineMessage
+	updated  time.Time
+}
+
+// timelineMessage is a message of a timeline with its printed value
+type timelineMessage struct {
+	message *sarama.ConsumerMessage
+	value   []byte
+}
+
+// exportedTimeline is a timeline as exported by -correlate-out
+type exportedTimeline struct {
+	CorrelationID string    `json:"correlation_id"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	DurationMS    int64     `json:"duration_ms"`
+	Topics        []string  `json:"topics"`
+	Messages      []fixture `json:"messages"`
+}
+
+// newCorrelationTracker returns the tracker of -correlate, exporting to the out
+// destination when set, or nil when header is empty
+func newCorrelationTracker(header string, timeout time.Duration, max int, out string) (*correlationTracker, error) {
+	if header == "" {
+		return nil, nil
+	}
+	c := &correlationTracker{
+		header:    header,
+		timeout:   timeout,
+		max:       max,
+		timelines: make(map[string]*list.Element),
+		order:     list.New(),
+		printer:   newMessagePrinter(log.New(log.Writer(), "", log.LstdFlags), nil, ""),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if out != "" {
+		var err error
+		if c.export, err = openDestination(out); err != nil {
+			return nil, err
+		}
+	}
+	go c.completeLoop()
+	return c, nil
+}
+
+// add adds the message to the timeline of its correlation id, and reports
+// false when it has none and is printed on its own
+func (c *correlationTracker) add(message *sarama.ConsumerMessage, value []byte) bool {
+	if c == nil {
+		return false
+	}
+	id, ok := header(message, c.header)
+	if !ok || len(id) == 0 {
+		return false
+	}
+	// the value may be a buffer of the decompressor, reused for the next message
+	if value != nil {
+		value = append([]byte(nil), value...)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.timelines[string(id)]
+	if !ok {
+		element = c.order.PushFront(&timeline{id: string(id)})
+		c.timelines[string(id)] = element
+	}
+	t := element.Value.(*timeline)
+	t.messages = append(t.messages, &timelineMessage{message: message, value: value})
+	t.updated = time.Now()
+	c.order.MoveToFront(element)
+
+	if c.order.Len() > c.max {
+		c.complete(c.order.Back())
+	}
+	return true
+}
+
+// completeLoop completes the timelines that timed out until close is called
+func (c *correlationTracker) completeLoop() {
+	defer close(c.stopped)
+
+	interval := c.timeout / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for element := c.order.Back(); element != nil && now.Sub(element.Value.(*timeline).updated) >= c.timeout; element = c.order.Back() {
+				c.complete(element)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// complete removes the timeline and prints or exports it. It must be called
+// with the lock held.
+func (c *correlationTracker) complete(element *list.Element) {
+	t := element.Value.(*timeline)
+	c.order.Remove(element)
+	delete(c.timelines, t.id)
+
+	// messages of other topics and partitions arrive in no particular order
+	sort.SliceStable(t.messages, func(i, j int) bool {
+		return t.messages[i].message.Timestamp.Before(t.messages[j].message.Timestamp)
+	})
+	var topics []string
+	seen := make(map[string]bool)
+	for _, m := range t.messages {
+		if !seen[m.message.Topic] {
+			seen[m.message.Topic] = true
+			topics = append(topics, m.message.Topic)
+		}
+	}
+	start := t.messages[0].message.Timestamp
+	duration := t.messages[len(t.messages)-1].message.Timestamp.Sub(start)
+
+	if c.export == nil {
+		log.Printf("Timeline %s = %s: %d messages across %s over %s", c.header, t.id, len(t.messages), strings.Join(topics, ", "), duration)
+		for _, m := range t.messages {
+			c.printer.print(m.message, m.value)
+		}
+		return
+	}
+
+	exported := exportedTimeline{
+		CorrelationID: t.id,
+		Start:         start,
+		End:           start.Add(duration),
+		DurationMS:    int64(duration / time.Millisecond),
+		Topics:        topics,
+	}
+	for _, m := range t.messages {
+		f := newFixture(m.message)
+		f.Value, f.ValueBase64 = fixtureBytes(m.value)
+		exported.Messages = append(exported.Messages, f)
+	}
+	data, err := json.Marshal(exported)
+	if err == nil {
+		_, err = c.export.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Printf("Unable to export the timeline of %s = %s: %v", c.header, t.id, err)
+	}
+}
+
+// close completes the open timelines, from the least recently updated, and
+// closes the -correlate-out file
+func (c *correlationTracker) close() error {
+	if c == nil {
+		return nil
+	}
+	close(c.stop)
+	<-c.stopped
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.order.Len() > 0 {
+		c.complete(c.order.Back())
+	}
+	if c.export == nil || c.export == os.Stdout || c.export == os.Stderr {
+		return nil
+	}
+	return c.export.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// Headers of the operation and source of Debezium change events, named like
+// those of the ExtractNewRecordState transformation of Debezium
+const (
+	debeziumOpHeader    = "__op"
+	debeziumDBHeader    = "__db"
+	debeziumTableHeader = "__table"
+	debeziumTimeHeader  = "__source_ts_ms"
+)
+
+// debeziumOperations are the operations of Debezium change events: create, update,
+// delete, read by a snapshot, truncate and message
+var debeziumOperations = []string{"c", "u", "d", "r", "t", "m"}
+
+// debeziumOpFilter is the parsed -debezium-ops flag, nil to keep every operation
+var debeziumOpFilter map[string]bool
+
+// parseDebeziumOps parses a comma separated list of operations
+func parseDebeziumOps(spec string) (map[string]bool, error) {
+	ops := make(map[string]bool)
+	for _, op := range strings.Split(spec, ",") {
+		if op = strings.TrimSpace(op); op == "" {
+			continue
+		}
+		known := false
+		for _, debeziumOp := range debeziumOperations {
+			known = known || op == debeziumOp
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown -debezium-ops operation %q, expected one of %s", op, strings.Join(debeziumOperations, ", "))
+		}
+		ops[op] = true
+	}
+	return ops, nil
+}
+
+// debeziumMessage returns the message in the -debezium mode when its value is
+// a Debezium change event, with or without the schema: a copy with the row
+// after the change, or the compact diff of the change, as value and the
+// operation and source as headers. Under after, deletes are tombstones
+// deleting the key. It reports false for events of operations left out by
+// -debezium-ops, and for the tombstones Debezium follows deletes with, which
+// the delete events already represent. Other messages are returned unchanged.
+func debeziumMessage(message *sarama.ConsumerMessage, value []byte) (*sarama.ConsumerMessage, []byte, bool) {
+	if message.Value == nil {
+		return message, value, false
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return message, value, true
+	}
+	event, ok := doc.(map[string]interface{})
+	if payload, isEnvelope := event["payload"].(map[string]interface{}); ok && isEnvelope {
+		event = payload
+	}
+	op, ok := event["op"].(string)
+	if !ok {
+		return message, value, true
+	}
+	if debeziumOpFilter != nil && !debeziumOpFilter[op] {
+		return message, value, false
+	}
+
+	change := *message
+	change.Headers = append(append([]*sarama.RecordHeader(nil), message.Headers...), &sarama.RecordHeader{Key: []byte(debeziumOpHeader), Value: []byte(op)})
+	if source, ok := event["source"].(map[string]interface{}); ok {
+		for _, field := range [][2]string{{debeziumDBHeader, "db"}, {debeziumTableHeader, "table"}, {debeziumTimeHeader, "ts_ms"}} {
+			if text := jsonText(source[field[1]]); text != "" {
+				change.Headers = append(change.Headers, &sarama.RecordHeader{Key: []byte(field[0]), Value: []byte(text)})
+			}
+		}
+	}
+
+	if *debeziumMode == "diff" {
+		change.Value, err = encodeJSON(debeziumDiff(event["before"], event["after"]))
+		if err != nil {
+			return message, value, true
+		}
+		return &change, change.Value, true
+	}
+
+	after := event["after"]
+	if op == "d" || after == nil {
+		change.Value = nil
+		return &change, nil, true
+	}
+	if change.Value, err = encodeJSON(after); err != nil {
+		return message, value, true
+	}
+	return &change, change.Value, true
+}
+
+// debeziumDiff returns the columns changed between the rows before and after
+// a change, as column: [before, after]. Columns of rows missing before a
+// create or after a delete are all changed.
+func debeziumDiff(before, after interface{}) map[string]interface{} {
+	beforeRow, _ := before.(map[string]interface{})
+	afterRow, _ := after.(map[string]interface{})
+
+	columns := make(map[string]bool)
+	for column := range beforeRow {
+		columns[column] = true
+	}
+	for column := range afterRow {
+		columns[column] = true
+	}
+
+	diff := make(map[string]interface{})
+	for column := range columns {
+		was, is := beforeRow[column], afterRow[column]
+		if beforeRow != nil && afterRow != nil && reflect.DeepEqual(was, is) {
+			continue
+		}
+		diff[column] = []interface{}{was, is}
+	}
+	return diff
+}
+
+// appendDebezium appends the operation and table of a change event, as
+// printed by -debezium
+func appendDebezium(buf []byte, message *sarama.ConsumerMessage, separator string) []byte {
+	op, ok := header(message, debeziumOpHeader)
+	if !ok {
+		return buf
+	}
+	buf = append(buf, separator...)
+	buf = append(buf, "op = "...)
+	buf = append(buf, op...)
+
+	var table []string
+	for _, name := range []string{debeziumDBHeader, debeziumTableHeader} {
+		if value, ok := header(message, name); ok {
+			table = append(table, string(value))
+		}
+	}
+	if len(table) > 0 {
+		buf = append(buf, separator...)
+		buf = append(buf, "table = "...)
+		buf = append(buf, strings.Join(table, ".")...)
+	}
+	return buf
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// debugFetchInterval is the interval of the diagnostic fetches of -debug-fetch
+const debugFetchInterval = 30 * time.Second
+
+// debugFetchLoop logs the diagnostics of a fetch at the processed offset of
+// every claimed partition, and the fetch statistics of the consumer per
+// broker, every debugFetchInterval until the session ends
+func (consumer *Consumer) debugFetchLoop(session sarama.ConsumerGroupSession) {
+	ticker := time.NewTicker(debugFetchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-session.Context().Done():
+			return
+		}
+
+		offsets := make(map[string]map[int32]int64)
+		consumer.stateMu.Lock()
+		for topic, partitions := range consumer.partitions {
+			offsets[topic] = make(map[int32]int64)
+			for partition, state := range partitions {
+				offsets[topic][partition] = state.offset
+			}
+		}
+		consumer.stateMu.Unlock()
+
+		brokers := make(map[int32]bool)
+		for topic, partitions := range offsets {
+			for partition, offset := range partitions {
+				if offset < 0 {
+					// nothing processed yet
+					continue
+				}
+				diagnostics, broker, err := describeFetch(consumer.client, topic, partition, offset)
+				if err != nil {
+					consumer.logger.Printf("Unable to fetch topic = %s, partition = %d, offset = %d: %v", topic, partition, offset, err)
+					continue
+				}
+				brokers[broker] = true
+				consumer.logger.Printf("Fetched topic = %s, partition = %d, offset = %d: %s", topic, partition, offset, diagnostics)
+			}
+		}
+		for broker := range brokers {
+			consumer.logger.Printf("Fetches of broker id = %d: %s", broker, consumer.fetchStats(broker))
+		}
+	}
+}
+
+// describeFetch fetches the partition at the offset from its leader, like the
+// consumer does, and describes the response. It returns the id of the leader.
+func describeFetch(client sarama.Client, topic string, partition int32, offset int64) (string, int32, error) {
+	leader, err := client.Leader(topic, partition)
+	if err != nil {
+		return "", -1, err
+	}
+	config := client.Config()
+
+	// the newest version the cluster supports of those carrying the
+	// diagnostics: the log start offset since 1.0 and the preferred read
+	// replica of follower fetching since 2.4
+	request := &sarama.FetchRequest{
+		MaxWaitTime: 0,
+		MinBytes:    1,
+		MaxBytes:    sarama.MaxResponseSize,
+		Isolation:   config.Consumer.IsolationLevel,
+		Version:     4,
+	}
+	switch {
+	case config.Version.IsAtLeast(sarama.V2_4_0_0):
+		request.Version = 11
+		request.RackID = config.RackID
+	case config.Version.IsAtLeast(sarama.V1_0_0_0):
+		request.Version = 5
+	}
+	request.AddBlock(topic, partition, offset, config.Consumer.Fetch.Default, -1)
+
+	started := time.Now()
+	response, err := leader.Fetch(request)
+	if err != nil {
+		return "", leader.ID(), err
+	}
+	latency := time.Since(started)
+	block := response.GetBlock(topic, partition)
+	if block == nil {
+		return "", leader.ID(), fmt.Errorf("no fetch response for topic = %s, partition = %d", topic, partition)
+	}
+	if block.Err != sarama.ErrNoError {
+		return "", leader.ID(), block.Err
+	}
+
+	var batches []string
+	var bytes int
+	for _, records := range block.RecordsSet {
+		switch {
+		case records.RecordBatch != nil:
+			batches = append(batches, fmt.Sprint(len(records.RecordBatch.Records)))
+			for _, record := range records.RecordBatch.Records {
+				bytes += len(record.Key) + len(record.Value)
+			}
+		case records.MsgSet != nil:
+			batches = append(batches, fmt.Sprint(len(records.MsgSet.Messages)))
+			for _, message := range records.MsgSet.Messages {
+				bytes += len(message.Msg.Key) + len(message.Msg.Value)
+			}
+		}
+	}
+
+	replica := "none"
+	if block.PreferredReadReplica >= 0 {
+		replica = fmt.Sprint(block.PreferredReadReplica)
+		if broker, err := client.Broker(block.PreferredReadReplica); err == nil {
+			replica = describeBroker(broker)
+		}
+	}
+
+	return fmt.Sprintf("%s, fetch size = %d, latency = %v, record batches = %d, records per batch = [%s], record bytes = %d, high water mark = %d, last stable offset = %d, log start offset = %d, preferred read replica = %s",
+		describeBroker(leader), config.Consumer.Fetch.Default, latency.Round(time.Millisecond), len(batches), strings.Join(batches, " "), bytes,
+		block.HighWaterMarkOffset, block.LastStableOffset, block.LogStartOffset, replica), leader.ID(), nil
+}
+
+// fetchStats describes the fetches of the consumer from the broker as Sarama
+// measured them, which the diagnostic fetches don't show: the fetch rate, the
+// response sizes, and the records per partition of the fetch responses of
+// all brokers
+func (consumer *Consumer) fetchStats(broker int32) string {
+	var stats []string
+	if meter, ok := consumer.registry.Get(fmt.Sprintf("consumer-fetch-rate-for-broker-%d", broker)).(metrics.Meter); ok {
+		stats = append(stats, fmt.Sprintf("fetch rate = %.1f/s", meter.Rate1()))
+	}
+	if histogram, ok := consumer.registry.Get(fmt.Sprintf("response-size-for-broker-%d", broker)).(metrics.Histogram); ok {
+		stats = append(stats, fmt.Sprintf("mean response size = %.0f bytes, max response size = %d bytes", histogram.Mean(), histogram.Max()))
+	}
+	if histogram, ok := consumer.registry.Get("consumer-batch-size").(metrics.Histogram); ok {
+		stats = append(stats, fmt.Sprintf("mean records per partition fetch = %.1f", histogram.Mean()))
+	}
+	if len(stats) == 0 {
+		return "no fetches measured"
+	}
+	return strings.Join(stats, ", ")
+}
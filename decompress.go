@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	xerial "github.com/eapache/go-xerial-snappy"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic bytes used to detect payload compression in auto mode
+var (
+	gzipMagic         = []byte{0x1f, 0x8b}
+	zstdMagic         = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xerialSnappyMagic = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0x00}
+	framedSnappyMagic = []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}
+)
+
+// validValueDecompress reports whether mode is a supported -value-decompress setting
+func validValueDecompress(mode string) bool {
+	switch mode {
+	case "", "none", "auto", "gzip", "snappy", "zstd":
+		return true
+	}
+	return false
+}
+
+// zstdDecoder returns the decoder shared by all decompressors, whose DecodeAll
+// is safe for concurrent use and limited to -value-decompress-max-bytes
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(*maxDecompressed)))
+})
+
+// decompressedTooLarge is the error of a value decompressing to more than
+// -value-decompress-max-bytes
+func decompressedTooLarge() error {
+	return fmt.Errorf("decompressed value exceeds the -value-decompress-max-bytes of %d bytes", *maxDecompressed)
+}
+
+// decompressor decompresses message values that were compressed by the producer
+// itself, as opposed to the compression codec applied by Kafka on the record batch.
+// It reuses its buffers between messages, so it must not be shared between
+// goroutines and a returned value is only valid until the next call. Values
+// decompressing to more than -value-decompress-max-bytes fail.
+type decompressor struct {
+	buf    bytes.Buffer
+	dst    []byte
+	gzip   *gzip.Reader
+	snappy *snappy.Reader
+	src    bytes.Reader
+}
+
+// decompress decompresses the value with the given -value-decompress mode. In
+// auto mode the algorithm is detected from the magic bytes, and values that
+// don't look compressed are returned unchanged.
+func (d *decompressor) decompress(mode string, value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+
+	switch mode {
+	case "", "none":
+		return value, nil
+	case "auto":
+		switch {
+		case bytes.HasPrefix(value, gzipMagic):
+			return d.gunzip(value)
+		case bytes.HasPrefix(value, zstdMagic):
+			return d.unzstd(value)
+		case bytes.HasPrefix(value, xerialSnappyMagic):
+			return d.unxerial(value)
+		case bytes.HasPrefix(value, framedSnappyMagic):
+			return d.unsnappyFramed(value)
+		}
+		return value, nil
+	case "gzip":
+		return d.gunzip(value)
+	case "snappy":
+		switch {
+		case bytes.HasPrefix(value, framedSnappyMagic):
+			return d.unsnappyFramed(value)
+		case bytes.HasPrefix(value, xerialSnappyMagic):
+			return d.unxerial(value)
+		}
+		return d.unsnappy(value)
+	case "zstd":
+		return d.unzstd(value)
+	}
+
+	return nil, fmt.Errorf("unknown value decompression %q", mode)
+}
+
+func (d *decompressor) gunzip(value []byte) ([]byte, error) {
+	d.src.Reset(value)
+	if d.gzip == nil {
+		reader, err := gzip.NewReader(&d.src)
+		if err != nil {
+			return nil, err
+		}
+		d.gzip = reader
+	} else if err := d.gzip.Reset(&d.src); err != nil {
+		return nil, err
+	}
+
+	return d.readAll(d.gzip)
+}
+
+func (d *decompressor) unsnappyFramed(value []byte) ([]byte, error) {
+	d.src.Reset(value)
+	if d.snappy == nil {
+		d.snappy = snappy.NewReader(&d.src)
+	} else {
+		d.snappy.Reset(&d.src)
+	}
+
+	return d.readAll(d.snappy)
+}
+
+func (d *decompressor) unsnappy(value []byte) ([]byte, error) {
+	// the length is declared up front, so it is checked before allocating
+	if n, err := snappy.DecodedLen(value); err != nil {
+		return nil, err
+	} else if int64(n) > *maxDecompressed {
+		return nil, decompressedTooLarge()
+	}
+	result, err := snappy.Decode(d.dst[:cap(d.dst)], value)
+	if err != nil {
+		return nil, err
+	}
+	d.dst = result
+	return result, nil
+}
+
+// unxerial decodes the xerial framing of snappy chunks. The ratio of snappy is
+// bounded, so the size is checked once the chunks are decoded.
+func (d *decompressor) unxerial(value []byte) ([]byte, error) {
+	result, err := xerial.DecodeInto(d.dst[:cap(d.dst)], value)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(result)) > *maxDecompressed {
+		return nil, decompressedTooLarge()
+	}
+	d.dst = result
+	return result, nil
+}
+
+func (d *decompressor) unzstd(value []byte) ([]byte, error) {
+	decoder, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	result, err := decoder.DecodeAll(value, d.dst[:0])
+	if err == zstd.ErrDecoderSizeExceeded {
+		return nil, decompressedTooLarge()
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.dst = result
+	return result, nil
+}
+
+func (d *decompressor) readAll(r io.Reader) ([]byte, error) {
+	d.buf.Reset()
+	if _, err := d.buf.ReadFrom(io.LimitReader(r, *maxDecompressed+1)); err != nil {
+		return nil, err
+	}
+	if int64(d.buf.Len()) > *maxDecompressed {
+		return nil, decompressedTooLarge()
+	}
+	return d.buf.Bytes(), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// diffSide holds the records read from one side of a diff, the content hashes
+// of the values by key. Keys hold several hashes when they were produced more
+// than once in the window.
+type diffSide struct {
+	mu      sync.Mutex
+	records map[string][][sha256.Size]byte
+	count   int
+}
+
+// runDiff compares the topics of the consumer with -diff-topics on the
+// -diff-brokers cluster over the -from/-to time window, by key and content
+// hash. It exits with status 1 when the topics differ.
+func runDiff(c consumerConfig) {
+	target := c
+	if *diffBrokers != "" {
+		target.Brokers = *diffBrokers
+	}
+	targetTopics := c.topicNames
+	if *diffTopics != "" {
+		targetTopics = strings.Split(*diffTopics, ",")
+	}
+
+	source, err := readDiffSide(c, c.topicNames)
+	if err != nil {
+		fatal(err)
+	}
+	other, err := readDiffSide(target, targetTopics)
+	if err != nil {
+		fatal(err)
+	}
+
+	missing, extra, different := 0, 0, 0
+	for key, hashes := range source.records {
+		left := subtractHashes(hashes, other.records[key])
+		right := subtractHashes(other.records[key], hashes)
+		if key != "" && len(left) > 0 && len(right) > 0 {
+			log.Printf("Different key = %s: %d source and %d target versions don't match", key, len(left), len(right))
+			different++
+			continue
+		}
+		if len(left) > 0 {
+			log.Printf("Missing key = %s: %d records only in the source", key, len(left))
+			missing += len(left)
+		}
+		if len(right) > 0 {
+			log.Printf("Extra key = %s: %d records only in the target", key, len(right))
+			extra += len(right)
+		}
+	}
+	for key, hashes := range other.records {
+		if _, ok := source.records[key]; !ok {
+			log.Printf("Extra key = %s: %d records only in the target", key, len(hashes))
+			extra += len(hashes)
+		}
+	}
+
+	log.Printf("Compared %d source and %d target records: missing = %d, extra = %d, different keys = %d", source.count, other.count, missing, extra, different)
+	if missing+extra+different > 0 {
+		exit(exitConsumptionError, "differences found", nil)
+	}
+}
+
+// subtractHashes returns the hashes of a that are not in b, counting duplicates
+func subtractHashes(a, b [][sha256.Size]byte) [][sha256.Size]byte {
+	remaining := make(map[[sha256.Size]byte]int)
+	for _, hash := range b {
+		remaining[hash]++
+	}
+
+	var left [][sha256.Size]byte
+	for _, hash := range a {
+		if remaining[hash] > 0 {
+			remaining[hash]--
+			continue
+		}
+		left = append(left, hash)
+	}
+	return left
+}
+
+// readDiffSide reads the records of all partitions of the topics within the -from/-to window
+func readDiffSide(c consumerConfig, topics []string) (*diffSide, error) {
+	config, err := newSaramaConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sarama.NewClient(strings.Split(c.Brokers, ","), config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	side := &diffSide{records: make(map[string][][sha256.Size]byte)}
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, partition := range partitions {
+			wg.Add(1)
+			go func(topic string, partition int32) {
+				defer wg.Done()
+				if err := side.readPartition(client, consumer, topic, partition); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}(topic, partition)
+		}
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	log.Printf("Read %d records from %s on %s", side.count, strings.Join(topics, ","), c.Brokers)
+	return side, nil
+}
+
+// windowOffsets returns the offsets of the partition the -from/-to window
+// starts at and ends before
+func windowOffsets(client sarama.Client, topic string, partition int32) (int64, int64, error) {
+	start, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if !exportFrom.IsZero() {
+		start, err = offsetAt(client, topic, partition, exportFrom)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if !exportTo.IsZero() {
+		end, err = offsetAt(client, topic, partition, exportTo)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// readPartition adds the records of the partition within the -from/-to window
+func (side *diffSide) readPartition(client sarama.Client, consumer sarama.Consumer, topic string, partition int32) error {
+	start, end, err := windowOffsets(client, topic, partition)
+	if err != nil {
+		return err
+	}
+	if start >= end {
+		return nil
+	}
+
+	pc, err := consumer.ConsumePartition(topic, partition, start)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	var decompressor decompressor
+	idle := time.NewTimer(exportIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case message := <-pc.Messages():
+			if message.Offset >= end {
+				return nil
+			}
+
+			value, err := decompressor.decompress(*valueDecompress, message.Value)
+			if err != nil {
+				value = message.Value
+			}
+			hash := sha256.Sum256(value)
+
+			side.mu.Lock()
+			side.records[string(message.Key)] = append(side.records[string(message.Key)], hash)
+			side.count++
+			side.mu.Unlock()
+
+			if message.Offset+1 >= end {
+				return nil
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(exportIdleTimeout)
+		case <-idle.C:
+			log.Printf("No messages on topic = %s, partition = %d for %v, considering it complete", topic, partition, exportIdleTimeout)
+			return nil
+		}
+	}
+}
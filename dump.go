@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/hrak/kafka-consumergroup/consumergroup"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// recentErrorsSize is the number of errors of a consumer kept for the dump
+const recentErrorsSize = 10
+
+// Stages of a claimWorker
+const (
+	workerWaiting    = "waiting for messages"
+	workerInFlight   = "waiting for the in-flight limit"
+	workerScheduled  = "waiting for a claim slot"
+	workerProcessing = "processing"
+)
+
+// claimWorker is the stage of the goroutine consuming a claim, as dumped on
+// SIGQUIT to tell a stuck handler from a starved or throttled claim
+type claimWorker struct {
+	claim sarama.ConsumerGroupClaim
+
+	mu     sync.Mutex
+	stage  string
+	offset int64
+	since  time.Time
+}
+
+func newClaimWorker(claim sarama.ConsumerGroupClaim) *claimWorker {
+	return &claimWorker{claim: claim, stage: workerWaiting, offset: -1, since: time.Now()}
+}
+
+// set enters the stage for the message at the offset, -1 for none
+func (w *claimWorker) set(stage string, offset int64) {
+	w.mu.Lock()
+	w.stage, w.offset, w.since = stage, offset, time.Now()
+	w.mu.Unlock()
+}
+
+// appendState appends the stage, offset and time spent in the stage
+func (w *claimWorker) appendState(buf []byte, now time.Time) []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf = append(buf, w.stage...)
+	if w.offset >= 0 {
+		buf = append(buf, fmt.Sprintf(" offset %d", w.offset)...)
+	}
+	return append(buf, fmt.Sprintf(" for %v", now.Sub(w.since).Round(time.Millisecond))...)
+}
+
+// recentErrors keeps the last errors of a consumer
+type recentErrors struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+// record keeps the error with the current time, dropping the oldest beyond
+// recentErrorsSize
+func (r *recentErrors) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errors = append(r.errors, time.Now().Format(time.RFC3339)+" "+err.Error())
+	if len(r.errors) > recentErrorsSize {
+		r.errors = r.errors[len(r.errors)-recentErrorsSize:]
+	}
+}
+
+func (r *recentErrors) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.errors...)
+}
+
+// recordError counts the error of a consumergroup category by the
+// errors-<category> metric and keeps it for the dump
+func (consumer *Consumer) recordError(err error) {
+	metrics.GetOrRegisterCounter("errors-"+consumergroup.Category(err), consumer.registry).Inc(1)
+	consumer.lastErrors.record(err)
+}
+
+// writeDump writes a diagnostic snapshot of the running consumers and the
+// stacks of all goroutines, as requested with SIGQUIT, so a stuck consumer can
+// be debugged without restarting it
+func writeDump(w io.Writer) {
+	now := time.Now()
+	fmt.Fprintf(w, "=== Diagnostic dump at %s ===\n", now.Format(time.RFC3339))
+
+	runningMu.RLock()
+	var names []string
+	for name := range running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		running[name].writeDump(w, now)
+	}
+	runningMu.RUnlock()
+
+	fmt.Fprintf(w, "Goroutines:\n")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+	fmt.Fprintf(w, "=== End of diagnostic dump ===\n")
+}
+
+// writeDump writes the assignment, the progress of every claimed partition
+// and the recent errors of the consumer
+func (consumer *Consumer) writeDump(w io.Writer, now time.Time) {
+	status := consumer.status()
+	name := status.Name
+	if name == "" {
+		name = status.Group
+	}
+	fmt.Fprintf(w, "Consumer %s: group = %s, member = %s, generation = %d, paused = %t, caught up = %t, memory paused = %t\n", name, status.Group, status.MemberID, status.Generation, status.Paused, status.CaughtUp, status.MemoryPaused)
+	line := []byte(fmt.Sprintf("  in flight = %d, offset gaps = %d, commit failures = %d", status.InFlight, status.OffsetGaps, status.CommitFailures))
+	if status.Breaker != "" {
+		line = append(line, ", breaker = "+status.Breaker...)
+	}
+	if status.LastCommitError != "" {
+		line = append(line, ", last commit error = "+status.LastCommitError...)
+	}
+	w.Write(append(line, '\n'))
+
+	consumer.stateMu.Lock()
+	for _, p := range status.Partitions {
+		state := consumer.partitions[p.Topic][p.Partition]
+		if state == nil {
+			continue
+		}
+		line = []byte(fmt.Sprintf("  topic = %s, partition = %d, offset = %d, committed = %d, high water mark = %d, lag = %d, backlog paused = %t", p.Topic, p.Partition, p.Offset, state.committed, p.HighWaterMark, p.Lag, p.BacklogPaused))
+		if state.worker != nil {
+			messages := state.worker.claim.Messages()
+			line = append(line, fmt.Sprintf(", buffered = %d/%d, worker = ", len(messages), cap(messages))...)
+			line = state.worker.appendState(line, now)
+		}
+		w.Write(append(line, '\n'))
+	}
+	consumer.stateMu.Unlock()
+
+	if errors := consumer.lastErrors.list(); len(errors) > 0 {
+		fmt.Fprintf(w, "  recent errors:\n")
+		for _, err := range errors {
+			fmt.Fprintf(w, "    %s\n", err)
+		}
+	}
+}
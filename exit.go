@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/hrak/kafka-consumergroup/consumergroup"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Exit codes of the process, so scripts and orchestration tools can tell why
+// it stopped
+const (
+	// exitClean is a shutdown by a signal, the admin API, or reaching the
+	// -until boundary
+	exitClean = 0
+	// exitConsumptionError is a failure while consuming, such as a halting
+	// -on-topic-recreated policy, -strict-offsets or a lost -lease
+	exitConsumptionError = 1
+	// exitConfigError is an invalid flag or -config file, the exit code of
+	// the flag package for invalid flags
+	exitConfigError = 2
+	// exitAuthError is a failed authentication or authorization with the brokers
+	exitAuthError = 3
+)
+
+// runStarted is the start of the process as reported by -summary-json
+var runStarted = time.Now()
+
+// summaryOnce writes the -summary-json summary at most once, as a fatal error
+// of a consumer may race with the shutdown
+var summaryOnce sync.Once
+
+// runSummary is the summary written to -summary-json when the process exits
+type runSummary struct {
+	ExitCode   int               `json:"exit_code"`
+	Reason     string            `json:"reason"`
+	Error      string            `json:"error,omitempty"`
+	Started    time.Time         `json:"started"`
+	Ended      time.Time         `json:"ended"`
+	DurationMS int64             `json:"duration_ms"`
+	Consumers  []consumerSummary `json:"consumers"`
+}
+
+// consumerSummary is the final state of a consumer in the run summary
+type consumerSummary struct {
+	Name     string `json:"name,omitempty"`
+	Group    string `json:"group"`
+	Messages int64  `json:"messages"`
+	// Errors are the errors-<category> counters by category
+	Errors           map[string]int64  `json:"errors,omitempty"`
+	OffsetGaps       int64             `json:"offset_gaps"`
+	OffsetDuplicates int64             `json:"offset_duplicates"`
+	CommitFailures   int64             `json:"commit_failures"`
+	Partitions       []partitionStatus `json:"partitions"`
+}
+
+// writeSummary writes the run summary to -summary-json, once
+func writeSummary(code int, reason string, cause error) {
+	if *summaryJSON == "" {
+		return
+	}
+	summaryOnce.Do(func() {
+		ended := time.Now()
+		summary := runSummary{
+			ExitCode:   code,
+			Reason:     reason,
+			Started:    runStarted,
+			Ended:      ended,
+			DurationMS: int64(ended.Sub(runStarted) / time.Millisecond),
+			Consumers:  []consumerSummary{},
+		}
+		if cause != nil {
+			summary.Error = cause.Error()
+		}
+
+		runningMu.RLock()
+		var names []string
+		for name := range running {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			summary.Consumers = append(summary.Consumers, running[name].summary())
+		}
+		runningMu.RUnlock()
+
+		out, err := openDestination(*summaryJSON)
+		if err == nil {
+			err = json.NewEncoder(out).Encode(summary)
+			if out != os.Stdout && out != os.Stderr {
+				if cerr := out.Close(); err == nil {
+					err = cerr
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to write the -summary-json summary: %v", err)
+		}
+	})
+}
+
+// summary returns the final state of the consumer
+func (consumer *Consumer) summary() consumerSummary {
+	status := consumer.status()
+	summary := consumerSummary{
+		Name:             status.Name,
+		Group:            status.Group,
+		Messages:         consumer.messages.Count(),
+		OffsetGaps:       status.OffsetGaps,
+		OffsetDuplicates: status.OffsetDuplicates,
+		CommitFailures:   status.CommitFailures,
+		Partitions:       status.Partitions,
+	}
+	consumer.registry.Each(func(name string, metric interface{}) {
+		counter, ok := metric.(metrics.Counter)
+		if !ok || !strings.HasPrefix(name, "errors-") {
+			return
+		}
+		if summary.Errors == nil {
+			summary.Errors = make(map[string]int64)
+		}
+		summary.Errors[strings.TrimPrefix(name, "errors-")] = counter.Count()
+	})
+	return summary
+}
+
+// outputsOnce closes the outputs at most once, as a fatal error of a consumer
+// may race with the shutdown. outputsErr is the error flushing the output.
+var (
+	outputsOnce sync.Once
+	outputsErr  error
+)
+
+// closeOutputs flushes and closes the -correlate-out file, the output of the
+// printed messages and the sinks, so a compressed output isn't left truncated.
+// It returns the error flushing the output of the printed messages.
+func closeOutputs() error {
+	outputsOnce.Do(func() {
+		if err := correlations.close(); err != nil {
+			log.Printf("Error closing the -correlate-out file: %v", err)
+		}
+		merged.close()
+		if outputsErr = closeMessageOutput(); outputsErr != nil {
+			log.Printf("Error flushing the output: %v", outputsErr)
+		}
+		closeSinks(sinks)
+
+		runningMu.RLock()
+		for _, consumer := range running {
+			consumer.closeOwnSinks()
+		}
+		runningMu.RUnlock()
+	})
+	return outputsErr
+}
+
+// exit closes the outputs, writes the run summary and exits with the code
+func exit(code int, reason string, cause error) {
+	closeOutputs()
+	writeSummary(code, reason, cause)
+	os.Exit(code)
+}
+
+// exitOnConfigError exits with exitConfigError on a panic of the validation
+// of the flags and the -config file, deferred by init
+func exitOnConfigError() {
+	value := recover()
+	if value == nil {
+		return
+	}
+	err, ok := value.(error)
+	if !ok {
+		err = fmt.Errorf("%v", value)
+	}
+	log.Printf("Invalid configuration: %v", err)
+	exit(exitConfigError, "config error", err)
+}
+
+// startupExitCode returns the exit code for an error creating a consumer:
+// exitAuthError when the brokers rejected the credentials, exitConfigError
+// for an invalid Sarama configuration and exitConsumptionError otherwise
+func startupExitCode(err error) int {
+	if _, ok := err.(sarama.ConfigurationError); ok {
+		return exitConfigError
+	}
+	if consumergroup.Category(consumergroup.Categorize(err)) == consumergroup.CategoryAuth {
+		return exitAuthError
+	}
+	return exitConsumptionError
+}
+
+// fatal logs an error of the subcommand or of starting to consume and exits
+// with its startupExitCode
+func fatal(err error) {
+	reason := "startup error"
+	if command != "" {
+		reason = command + " error"
+	}
+	log.Print(err)
+	exit(startupExitCode(err), reason, err)
+}
+
+// fatalf logs the error of the consumer and exits with exitConsumptionError
+func (consumer *Consumer) fatalf(format string, v ...interface{}) {
+	err := fmt.Errorf(format, v...)
+	consumer.logger.Print(err)
+	exit(exitConsumptionError, "consumption error", err)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	// exportResumeFile is the sidecar file in the -export-dir recording the export progress
+	exportResumeFile = "export.resume.json"
+	// exportCheckpointInterval is how often the progress of a partition is recorded
+	exportCheckpointInterval = time.Second
+	// exportIdleTimeout is the time after which a partition that doesn't deliver
+	// messages anymore before reaching its end offset has its remaining offsets
+	// checked, as they may hold transaction markers only
+	exportIdleTimeout = 10 * time.Second
+)
+
+// exportProgress records how far a partition has been exported. Size is the
+// length of the data file at Offset, so a resumed export can drop lines
+// written after the last checkpoint and continue exactly where it stopped.
+type exportProgress struct {
+	Offset int64 `json:"offset"`
+	End    int64 `json:"end"`
+	Size   int64 `json:"size"`
+}
+
+// exportRecord is a single line of the exported NDJSON files
+type exportRecord struct {
+	Topic       string            `json:"topic"`
+	Partition   int32             `json:"partition"`
+	Offset      int64             `json:"offset"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Key         string            `json:"key,omitempty"`
+	KeyBase64   bool              `json:"key_base64,omitempty"`
+	Value       string            `json:"value"`
+	ValueBase64 bool              `json:"value_base64,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// exporter dumps topics to NDJSON files, one per partition
+type exporter struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+	dir      string
+	stop     chan struct{}
+
+	mu       sync.Mutex
+	progress map[string]map[int32]*exportProgress
+}
+
+// runExport exports the topics of the consumer, or the -from/-to time range
+// of them, to NDJSON files in -export-dir
+func runExport(c consumerConfig) {
+	config, err := newSaramaConfig(c)
+	if err != nil {
+		fatal(err)
+	}
+
+	client, err := sarama.NewClient(strings.Split(c.Brokers, ","), config)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		fatal(err)
+	}
+	defer consumer.Close()
+
+	dir := *exportDir
+	if *jobID != "" {
+		dir = filepath.Join(dir, *jobID)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatal(err)
+	}
+
+	e := &exporter{
+		client:   client,
+		consumer: consumer,
+		dir:      dir,
+		stop:     make(chan struct{}),
+		progress: make(map[string]map[int32]*exportProgress),
+	}
+	if err := e.load(); err != nil {
+		fatal(err)
+	}
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigterm
+		log.Println("Interrupted, the export can be resumed by running it again")
+		close(e.stop)
+	}()
+
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	var failed []string
+	for _, topic := range c.topicNames {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			fatal(err)
+		}
+
+		for _, partition := range partitions {
+			progress, err := e.partitionProgress(topic, partition, c.topicPositions[topic])
+			if err != nil {
+				fatal(err)
+			}
+
+			wg.Add(1)
+			go func(topic string, partition int32) {
+				defer wg.Done()
+				if err := e.exportPartition(topic, partition, progress); err != nil {
+					log.Printf("Error exporting topic = %s, partition = %d: %v", topic, partition, err)
+					failedMu.Lock()
+					failed = append(failed, fmt.Sprintf("%s/%d", topic, partition))
+					failedMu.Unlock()
+				}
+			}(topic, partition)
+		}
+	}
+	wg.Wait()
+
+	if err := e.save(); err != nil {
+		fatal(err)
+	}
+	if len(failed) > 0 {
+		fatal(fmt.Errorf("unable to export %s, run the export again to resume it", strings.Join(failed, ", ")))
+	}
+}
+
+// load reads the resume file of a previous export, if any
+func (e *exporter) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(e.dir, exportResumeFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &e.progress); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", exportResumeFile, err)
+	}
+	log.Printf("Resuming the export recorded in %s", filepath.Join(e.dir, exportResumeFile))
+	return nil
+}
+
+// save atomically replaces the resume file with the current progress
+func (e *exporter) save() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	data, err := json.MarshalIndent(e.progress, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(e.dir, exportResumeFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// partitionProgress returns the recorded progress of the partition, or the
+// start and end offsets of a new export of it
+func (e *exporter) partitionProgress(topic string, partition int32, position startPosition) (exportProgress, error) {
+	e.mu.Lock()
+	recorded := e.progress[topic][partition]
+	e.mu.Unlock()
+	if recorded != nil {
+		return *recorded, nil
+	}
+
+	var err error
+	progress := exportProgress{}
+
+	switch {
+	case !exportFrom.IsZero():
+		progress.Offset, err = offsetAt(e.client, topic, partition, exportFrom)
+	case position != startPosition{}:
+		progress.Offset, err = position.resolve(e.client, topic, partition)
+	default:
+		progress.Offset, err = e.client.GetOffset(topic, partition, sarama.OffsetOldest)
+	}
+	if err != nil {
+		return progress, err
+	}
+
+	if !exportTo.IsZero() {
+		progress.End, err = offsetAt(e.client, topic, partition, exportTo)
+	} else {
+		progress.End, err = e.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+	return progress, err
+}
+
+// offsetAt returns the first offset of the partition with a timestamp at or
+// after t, or the high water mark when there is none
+func offsetAt(client sarama.Client, topic string, partition int32, t time.Time) (int64, error) {
+	offset, err := client.GetOffset(topic, partition, t.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+	return offset, nil
+}
+
+// checkpoint records the progress of a partition and saves the resume file
+func (e *exporter) checkpoint(topic string, partition int32, progress exportProgress) error {
+	e.mu.Lock()
+	if e.progress[topic] == nil {
+		e.progress[topic] = make(map[int32]*exportProgress)
+	}
+	e.progress[topic][partition] = &progress
+	e.mu.Unlock()
+
+	return e.save()
+}
+
+// exportPartition appends the messages of the partition up to its end offset to its data file
+func (e *exporter) exportPartition(topic string, partition int32, progress exportProgress) error {
+	path := filepath.Join(e.dir, fmt.Sprintf("%s-%d.ndjson", topic, partition))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// drop anything written after the last checkpoint
+	if err := file.Truncate(progress.Size); err != nil {
+		return err
+	}
+	if _, err := file.Seek(progress.Size, 0); err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+
+	checkpoint := func() error {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		return e.checkpoint(topic, partition, progress)
+	}
+
+	if progress.Offset >= progress.End {
+		return checkpoint()
+	}
+	log.Printf("Exporting topic = %s, partition = %d, offsets %d to %d", topic, partition, progress.Offset, progress.End)
+
+	pc, err := e.consumer.ConsumePartition(topic, partition, progress.Offset)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	var decompressor decompressor
+	ticker := time.NewTicker(exportCheckpointInterval)
+	defer ticker.Stop()
+	idle := time.NewTimer(exportIdleTimeout)
+	defer idle.Stop()
+
+	for progress.Offset < progress.End {
+		select {
+		case message, ok := <-pc.Messages():
+			if !ok {
+				checkpoint()
+				return fmt.Errorf("consuming stopped at offset %d", progress.Offset)
+			}
+			if message.Offset >= progress.End {
+				progress.Offset = progress.End
+				continue
+			}
+
+			value, err := decompressor.decompress(*valueDecompress, message.Value)
+			if err != nil {
+				value = message.Value
+			}
+			line, err := json.Marshal(newExportRecord(message, value))
+			if err != nil {
+				return err
+			}
+			line = append(line, '\n')
+			if _, err := writer.Write(line); err != nil {
+				return err
+			}
+			progress.Offset = message.Offset + 1
+			progress.Size += int64(len(line))
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(exportIdleTimeout)
+		case <-ticker.C:
+			if err := checkpoint(); err != nil {
+				return err
+			}
+		case <-idle.C:
+			// complete when the remaining offsets hold no records to export
+			stats, err := explainGap(e.client, topic, partition, progress.Offset, progress.End)
+			if err != nil {
+				log.Printf("No messages on topic = %s, partition = %d for %v at offset %d, unable to check the remaining offsets: %v", topic, partition, exportIdleTimeout, progress.Offset, err)
+			} else if stats.other == 0 {
+				log.Printf("Exported topic = %s, partition = %d up to offset %d, the remaining offsets hold no records: %v", topic, partition, progress.Offset, stats)
+				progress.Offset = progress.End
+				continue
+			} else {
+				log.Printf("No messages on topic = %s, partition = %d for %v at offset %d, waiting for the remaining records: %v", topic, partition, exportIdleTimeout, progress.Offset, stats)
+			}
+			idle.Reset(exportIdleTimeout)
+		case <-e.stop:
+			return checkpoint()
+		}
+	}
+
+	log.Printf("Exported topic = %s, partition = %d", topic, partition)
+	return checkpoint()
+}
+
+func newExportRecord(message *sarama.ConsumerMessage, value []byte) exportRecord {
+	record := exportRecord{
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Timestamp: message.Timestamp,
+	}
+	record.Key, record.KeyBase64 = exportText(message.Key)
+	record.Value, record.ValueBase64 = exportText(value)
+
+	if len(message.Headers) > 0 {
+		record.Headers = make(map[string]string)
+		for _, header := range message.Headers {
+			if header != nil {
+				record.Headers[string(header.Key)] = string(header.Value)
+			}
+		}
+	}
+	return record
+}
+
+// exportText returns data as a string, base64 encoded when it isn't valid UTF-8
+func exportText(data []byte) (string, bool) {
+	if utf8.Valid(data) {
+		return string(data), false
+	}
+	return base64.StdEncoding.EncodeToString(data), true
+}
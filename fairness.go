@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// fairProgressInterval is the interval at which the timestamps of the claimed
+// partitions are compared for -fair-progress
+const fairProgressInterval = time.Second
+
+// fairProgressLoop balances the progress of the claimed partitions every
+// fairProgressInterval until the session ends
+func (consumer *Consumer) fairProgressLoop(session sarama.ConsumerGroupSession) {
+	ticker := time.NewTicker(fairProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			consumer.balanceProgress()
+		case <-session.Context().Done():
+			return
+		}
+	}
+}
+
+// balanceProgress pauses the claimed partitions whose last processed message
+// is more than -fair-progress ahead of the oldest processed message of a
+// partition with lag, so the fetches go to the lagging partitions and the
+// partitions progress at about the same event time. A paused partition is
+// resumed once it is no more than half of -fair-progress ahead, or no
+// partition lags anymore. Partitions paused by -pause-backlog or finished by
+// -until-offset are left alone.
+func (consumer *Consumer) balanceProgress() {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+
+	var behind time.Time
+	var laggardTopic string
+	var laggardPartition int32
+	for topic, partitions := range consumer.partitions {
+		for partition, state := range partitions {
+			lagging := state.offset >= 0 && state.highWaterMark > state.offset
+			if !lagging || state.timestamp.IsZero() {
+				continue
+			}
+			if behind.IsZero() || state.timestamp.Before(behind) {
+				behind = state.timestamp
+				laggardTopic, laggardPartition = topic, partition
+			}
+		}
+	}
+
+	// resuming a single partition would undo the pause of all partitions
+	breaker := consumer.breaker.current()
+	held := atomic.LoadInt32(&memoryPaused) == 1 || (breaker != "" && breaker != breakerClosed)
+
+	pause := make(map[string][]int32)
+	resume := make(map[string][]int32)
+	for topic, partitions := range consumer.partitions {
+		for partition, state := range partitions {
+			if consumer.bounds.isFinished(topic, partition) || state.backlogPaused || state.timestamp.IsZero() {
+				continue
+			}
+			ahead := time.Duration(0)
+			if !behind.IsZero() {
+				ahead = state.timestamp.Sub(behind)
+			}
+
+			switch {
+			case ahead > *fairProgress:
+				// paused again every time, as the breaker and -max-memory-mb resume all partitions
+				pause[topic] = append(pause[topic], partition)
+				if !state.fairPaused {
+					consumer.logger.Printf("Pausing topic = %s, partition = %d, %v ahead of topic = %s, partition = %d", topic, partition, ahead.Round(time.Second), laggardTopic, laggardPartition)
+					state.fairPaused = true
+				}
+			case state.fairPaused && ahead <= *fairProgress/2 && !held:
+				resume[topic] = append(resume[topic], partition)
+				consumer.logger.Printf("Resuming topic = %s, partition = %d, %v ahead", topic, partition, ahead.Round(time.Second))
+				state.fairPaused = false
+			case state.fairPaused:
+				pause[topic] = append(pause[topic], partition)
+			}
+		}
+	}
+
+	if len(pause) > 0 {
+		consumer.group.Pause(pause)
+	}
+	if len(resume) > 0 {
+		consumer.group.Resume(resume)
+	}
+}
+
+// fairPaused reports whether the partition is paused by -fair-progress
+func (consumer *Consumer) fairPaused(topic string, partition int32) bool {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	state := consumer.partitions[topic][partition]
+	return state != nil && state.fairPaused
+}
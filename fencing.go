@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// fencedCommit is returned when the coordinator rejected a commit because this
+// member no longer belongs to the current generation of the group. Retrying
+// the commit can't succeed, the member has to rejoin the group first.
+type fencedCommit struct {
+	err        sarama.KError
+	group      string
+	memberID   string
+	generation int32
+}
+
+func (f *fencedCommit) Error() string {
+	return fmt.Sprintf("commit of group %s fenced: %v", f.group, f.err)
+}
+
+// fencingErrors explain the commit errors that fence a member, with what to do about them
+var fencingErrors = map[sarama.KError]string{
+	sarama.ErrIllegalGeneration:   "the group rebalanced since this member joined, its partitions may be owned by another member now. Processing a batch taking longer than the rebalance timeout is the usual cause, lower -max-in-flight or speed up processing",
+	sarama.ErrUnknownMemberId:     "the coordinator removed this member after it missed heartbeats for the session timeout, e.g. because of long GC pauses or network issues. Check -max-memory-mb and the connectivity to the coordinator",
+	sarama.ErrRebalanceInProgress: "the group is rebalancing, the offsets are committed again after rejoining. When this happens often, look for members joining and leaving in rebalance-churn",
+	sarama.ErrFencedInstancedId:   "another process joined with the same group instance id, only one of them may run at a time",
+}
+
+// asFencedCommit returns the fencedCommit for a commit error that fences the member
+func asFencedCommit(kerr sarama.KError, group, memberID string, generation int32) (*fencedCommit, bool) {
+	if _, ok := fencingErrors[kerr]; !ok {
+		return nil, false
+	}
+	return &fencedCommit{err: kerr, group: group, memberID: memberID, generation: generation}, true
+}
+
+// reportFencing logs a fenced commit with its remediation, counts it in the
+// commits-fenced metric and ends the session, so the consumer rejoins the
+// group right away instead of waiting for the next heartbeat to fail
+func (consumer *Consumer) reportFencing(f *fencedCommit) {
+	consumer.fenced.Inc(1)
+	consumer.logger.Printf("Commit fenced: group = %s, member id = %s, generation = %d, error = %v. Cause: %s. The offsets processed since the last commit will be processed again", f.group, f.memberID, f.generation, f.err, fencingErrors[f.err])
+	consumer.rejoin()
+}
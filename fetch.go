@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// fetchTimeout limits the wait for the message of a locator
+const fetchTimeout = 10 * time.Second
+
+// locator identifies a single message as <topic>/<partition>/<offset>, the
+// format printed by -print-locator and read by the fetch subcommand
+type locator struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+// Parsed argument of the fetch subcommand
+var fetchLocator locator
+
+func (l locator) String() string {
+	return l.topic + "/" + strconv.FormatInt(int64(l.partition), 10) + "/" + strconv.FormatInt(l.offset, 10)
+}
+
+// appendLocator appends the locator of the message
+func appendLocator(buf []byte, message *sarama.ConsumerMessage) []byte {
+	buf = append(buf, message.Topic...)
+	buf = append(buf, '/')
+	buf = strconv.AppendInt(buf, int64(message.Partition), 10)
+	buf = append(buf, '/')
+	return strconv.AppendInt(buf, message.Offset, 10)
+}
+
+// parseLocator parses a <topic>/<partition>/<offset> locator. Topic names
+// can't contain slashes.
+func parseLocator(s string) (locator, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 || parts[0] == "" {
+		return locator{}, fmt.Errorf("invalid locator %q, expected <topic>/<partition>/<offset>", s)
+	}
+
+	partition, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil || partition < 0 {
+		return locator{}, fmt.Errorf("invalid partition in locator %q", s)
+	}
+	offset, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || offset < 0 {
+		return locator{}, fmt.Errorf("invalid offset in locator %q", s)
+	}
+	return locator{topic: parts[0], partition: int32(partition), offset: offset}, nil
+}
+
+// runFetch prints the single message at fetchLocator without joining a
+// consumer group, decompressed and formatted like consumed messages. It exits
+// with status 1 when the message doesn't exist.
+func runFetch(c consumerConfig) {
+	config, err := newSaramaConfig(c)
+	if err != nil {
+		fatal(err)
+	}
+
+	client, err := sarama.NewClient(strings.Split(c.Brokers, ","), config)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+
+	message, err := fetchMessage(client, fetchLocator)
+	if err != nil {
+		fatal(err)
+	}
+
+	var decompressor decompressor
+	value, err := decompressor.decompress(c.ValueDecompress, message.Value)
+	if err != nil {
+		log.Printf("Unable to decompress value at %s: %v", fetchLocator, err)
+		value = message.Value
+	}
+
+	openMessageOutput()
+	logger := log.New(log.Writer(), "", log.LstdFlags)
+	newMessagePrinter(logger, newChecksums(*checksum), "").print(message, value)
+	if err := closeOutputs(); err != nil {
+		exit(exitConsumptionError, "fetch error", err)
+	}
+}
+
+// fetchMessage reads the message at the locator from the partition leader
+func fetchMessage(client sarama.Client, l locator) (*sarama.ConsumerMessage, error) {
+	oldest, err := client.GetOffset(l.topic, l.partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, err
+	}
+	newest, err := client.GetOffset(l.topic, l.partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, err
+	}
+	if l.offset < oldest || l.offset >= newest {
+		return nil, fmt.Errorf("no message at %s, the partition holds offsets %d to %d", l, oldest, newest-1)
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	pc, err := consumer.ConsumePartition(l.topic, l.partition, l.offset)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	select {
+	case message := <-pc.Messages():
+		if message.Offset != l.offset {
+			// compacted away, or a transaction marker
+			return nil, fmt.Errorf("no message at %s, the next message is at offset %d", l, message.Offset)
+		}
+		return message, nil
+	case err := <-pc.Errors():
+		return nil, err
+	case <-time.After(fetchTimeout):
+		return nil, fmt.Errorf("no message at %s within %v", l, fetchTimeout)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+)
+
+// fixtureCapture writes a sample of the consumed messages to -capture-fixtures,
+// so tests can be built from real traffic. A nil capture writes nothing.
+type fixtureCapture struct {
+	dir      string
+	format   string
+	rate     float64
+	limit    int64
+	captured int64
+}
+
+// fixtures is the capture shared by all consumers, set with -capture-fixtures
+var fixtures *fixtureCapture
+
+func newFixtureCapture(dir, format string, rate float64, limit int64) (*fixtureCapture, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fixtureCapture{dir: dir, format: format, rate: rate, limit: limit}, nil
+}
+
+// capture writes the message as a fixture if it is sampled and the
+// -capture-max limit isn't reached yet
+func (c *fixtureCapture) capture(message *sarama.ConsumerMessage) error {
+	if c == nil || rand.Float64() >= c.rate {
+		return nil
+	}
+	if c.limit > 0 && atomic.AddInt64(&c.captured, 1) > c.limit {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%d-%d", message.Topic, message.Partition, message.Offset)
+	var data []byte
+	var err error
+	if c.format == "go" {
+		data, err = goFixture(message), nil
+		name += ".go"
+	} else {
+		data, err = jsonFixture(message)
+		name += ".json"
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.dir, name), data, 0644)
+}
+
+// fixture is a message captured as JSON. Keys, values and headers that aren't
+// valid UTF-8 are base64 encoded, with their *_base64 field set.
+type fixture struct {
+	Topic       string          `json:"topic"`
+	Partition   int32           `json:"partition"`
+	Offset      int64           `json:"offset"`
+	Timestamp   time.Time       `json:"timestamp"`
+	Key         *string         `json:"key"`
+	KeyBase64   bool            `json:"key_base64,omitempty"`
+	Value       *string         `json:"value"`
+	ValueBase64 bool            `json:"value_base64,omitempty"`
+	Headers     []fixtureHeader `json:"headers,omitempty"`
+}
+
+type fixtureHeader struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ValueBase64 bool   `json:"value_base64,omitempty"`
+}
+
+// fixtureBytes returns data as a string, base64 encoded when it isn't valid
+// UTF-8, and nil for nil data such as the value of a tombstone
+func fixtureBytes(data []byte) (*string, bool) {
+	if data == nil {
+		return nil, false
+	}
+	if utf8.Valid(data) {
+		s := string(data)
+		return &s, false
+	}
+	s := base64.StdEncoding.EncodeToString(data)
+	return &s, true
+}
+
+func jsonFixture(message *sarama.ConsumerMessage) ([]byte, error) {
+	return json.MarshalIndent(newFixture(message), "", "  ")
+}
+
+// newFixture returns the message as a fixture
+func newFixture(message *sarama.ConsumerMessage) fixture {
+	f := fixture{
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Timestamp: message.Timestamp,
+	}
+	f.Key, f.KeyBase64 = fixtureBytes(message.Key)
+	f.Value, f.ValueBase64 = fixtureBytes(message.Value)
+	for _, header := range message.Headers {
+		if header == nil {
+			continue
+		}
+		value, encoded := fixtureBytes(header.Value)
+		h := fixtureHeader{Key: string(header.Key), ValueBase64: encoded}
+		if value != nil {
+			h.Value = *value
+		}
+		f.Headers = append(f.Headers, h)
+	}
+	return f
+}
+
+// goFixture returns a Go source file declaring the message as a
+// *sarama.ConsumerMessage in package -capture-package
+func goFixture(message *sarama.ConsumerMessage) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by kafka-consumergroup -capture-fixtures from %s. DO NOT EDIT.\n\n", appendLocator(nil, message))
+	fmt.Fprintf(&buf, "package %s\n\n", *capturePackage)
+	fmt.Fprintf(&buf, "import (\n\t\"time\"\n\n\t\"github.com/Shopify/sarama\"\n)\n\n")
+	fmt.Fprintf(&buf, "var %s = &sarama.ConsumerMessage{\n", goFixtureName(message))
+	fmt.Fprintf(&buf, "\tTopic:     %q,\n", message.Topic)
+	fmt.Fprintf(&buf, "\tPartition: %d,\n", message.Partition)
+	fmt.Fprintf(&buf, "\tOffset:    %d,\n", message.Offset)
+	fmt.Fprintf(&buf, "\tTimestamp: time.Unix(0, %d),\n", message.Timestamp.UnixNano())
+	fmt.Fprintf(&buf, "\tKey:       %s,\n", goBytes(message.Key))
+	fmt.Fprintf(&buf, "\tValue:     %s,\n", goBytes(message.Value))
+	if len(message.Headers) > 0 {
+		buf.WriteString("\tHeaders: []*sarama.RecordHeader{\n")
+		for _, header := range message.Headers {
+			if header != nil {
+				fmt.Fprintf(&buf, "\t\t{Key: %s, Value: %s},\n", goBytes(header.Key), goBytes(header.Value))
+			}
+		}
+		buf.WriteString("\t},\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// goFixtureName returns an exported identifier for the message, e.g.
+// Message_orders_3_42 for offset 42 of partition 3 of topic orders
+func goFixtureName(message *sarama.ConsumerMessage) string {
+	name := []byte("Message_")
+	for _, r := range message.Topic {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			name = append(name, byte(r))
+		} else {
+			name = append(name, '_')
+		}
+	}
+	name = append(name, '_')
+	name = strconv.AppendInt(name, int64(message.Partition), 10)
+	name = append(name, '_')
+	name = strconv.AppendInt(name, message.Offset, 10)
+	return string(name)
+}
+
+// goBytes returns a Go expression for data, which keeps nil apart from empty
+func goBytes(data []byte) string {
+	if data == nil {
+		return "nil"
+	}
+	return "[]byte(" + strconv.Quote(string(data)) + ")"
+}
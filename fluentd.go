@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// fluentdTimeout bounds connecting to Fluentd and a round trip of the pending chunks
+const fluentdTimeout = 10 * time.Second
+
+// fluentdBatch is the number of bytes of records buffered before sending them
+const fluentdBatch = 1024 * 1024
+
+// fluentdSink ships the claimed messages to a Fluentd or Fluent Bit forward
+// input as events tagged by the -fluentd-tag template. The record of an event
+// is the -fluentd-record mapping, by default the value as message along with
+// the metadata and headers.
+//
+// Events are sent in chunks in the packed forward mode of the protocol, with
+// the chunk option asking Fluentd to acknowledge them. The commit barrier waits
+// for the acknowledgements, and chunks which weren't acknowledged are sent
+// again over a new connection, so Fluentd may receive duplicates.
+type fluentdSink struct {
+	addr   string
+	useTLS bool
+	tag    string
+	record fieldMapping
+
+	mu     sync.Mutex
+	conn   net.Conn
+	r      *bufio.Reader
+	chunks map[string][]byte
+	events map[string]int
+	size   int
+}
+
+// newFluentdSink returns the sink for a tcp:// or tls:// address
+func newFluentdSink(addr, tag, record string) (*fluentdSink, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" || (u.Scheme != "tcp" && u.Scheme != "tls") {
+		return nil, fmt.Errorf("invalid -fluentd-addr %q, expected tcp:// or tls://host:port", addr)
+	}
+	mapping, err := parseFieldMapping(record)
+	if err != nil {
+		return nil, err
+	}
+	s := &fluentdSink{
+		addr:   u.Host,
+		useTLS: u.Scheme == "tls",
+		tag:    tag,
+		record: mapping,
+		chunks: make(map[string][]byte),
+		events: make(map[string]int),
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "24224")
+	}
+	return s, nil
+}
+
+func (s *fluentdSink) name() string {
+	return "fluentd sink " + s.addr
+}
+
+func (s *fluentdSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	var record map[string]interface{}
+	if len(s.record) > 0 {
+		var err error
+		if record, err = s.record.row(message, value); err != nil {
+			return err
+		}
+	} else {
+		record = map[string]interface{}{
+			"message":   string(appendValue(nil, message, value)),
+			"topic":     message.Topic,
+			"partition": message.Partition,
+			"offset":    message.Offset,
+		}
+		if message.Key != nil {
+			record["key"] = string(message.Key)
+		}
+		if len(message.Headers) > 0 {
+			headers := make(map[string]interface{}, len(message.Headers))
+			for _, h := range message.Headers {
+				headers[string(h.Key)] = string(h.Value)
+			}
+			record["headers"] = headers
+		}
+	}
+
+	// an entry is an array of the event time and the record
+	entry := []byte{0x92, 0xd7, 0x00}
+	entry = binary.BigEndian.AppendUint32(entry, uint32(message.Timestamp.Unix()))
+	entry = binary.BigEndian.AppendUint32(entry, uint32(message.Timestamp.Nanosecond()))
+	entry = appendMsgpack(entry, record)
+	tag := expandSinkTemplate(s.tag, message)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// send before buffering, so a write retried after a failure isn't buffered twice
+	if s.size >= fluentdBatch {
+		if err := s.send(); err != nil {
+			return err
+		}
+	}
+	s.chunks[tag] = append(s.chunks[tag], entry...)
+	s.events[tag]++
+	s.size += len(entry)
+	return nil
+}
+
+// flush waits until Fluentd acknowledged every event, the barrier of a commit
+func (s *fluentdSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send()
+}
+
+// send sends the buffered events in a chunk per tag and waits for their
+// acknowledgements. On failure the connection is closed, and the chunks not
+// acknowledged are sent again by the next send.
+func (s *fluentdSink) send() error {
+	if len(s.chunks) == 0 {
+		return nil
+	}
+	if s.conn == nil {
+		conn, err := dialSink(s.addr, s.useTLS, fluentdTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn, s.r = conn, bufio.NewReader(conn)
+	}
+
+	tags := make([]string, 0, len(s.chunks))
+	for tag := range s.chunks {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	err := func() error {
+		for _, tag := range tags {
+			var id [16]byte
+			rand.Read(id[:])
+			chunk := base64.StdEncoding.EncodeToString(id[:])
+
+			// [tag, entries, {"chunk": id}]
+			msg := appendMsgpack([]byte{0x93}, tag)
+			msg = appendMsgpackHeader(msg, msgpackBinary, len(s.chunks[tag]))
+			msg = append(msg, s.chunks[tag]...)
+			msg = appendMsgpack(msg, map[string]interface{}{"chunk": chunk, "size": s.events[tag]})
+
+			s.conn.SetDeadline(time.Now().Add(fluentdTimeout))
+			if _, err := s.conn.Write(msg); err != nil {
+				return err
+			}
+			ack, err := readFluentdAck(s.r)
+			if err != nil {
+				return err
+			}
+			if ack != chunk {
+				return fmt.Errorf("fluentd acknowledged chunk %q instead of %q", ack, chunk)
+			}
+			s.size -= len(s.chunks[tag])
+			delete(s.chunks, tag)
+			delete(s.events, tag)
+		}
+		return nil
+	}()
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// readFluentdAck reads the {"ack": id} response of a chunk
+func readFluentdAck(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if b&0xf0 != 0x80 {
+		return "", fmt.Errorf("unexpected fluentd response type 0x%02x", b)
+	}
+	var ack string
+	for i := 0; i < int(b&0x0f); i++ {
+		key, err := readMsgpackString(r)
+		if err != nil {
+			return "", err
+		}
+		value, err := readMsgpackString(r)
+		if err != nil {
+			return "", err
+		}
+		if key == "ack" {
+			ack = value
+		}
+	}
+	return ack, nil
+}
+
+// readMsgpackString reads a msgpack string
+func readMsgpackString(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch {
+	case b&0xe0 == 0xa0:
+		n = int(b & 0x1f)
+	case b == 0xd9:
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		n = int(c)
+	case b == 0xda:
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+		n = int(binary.BigEndian.Uint16(size[:]))
+	default:
+		return "", fmt.Errorf("unexpected msgpack type 0x%02x instead of a string", b)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// appendMsgpack appends the msgpack encoding of a decoded JSON document or
+// record, maps with their keys sorted
+func appendMsgpack(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xc0)
+	case bool:
+		if v {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case string:
+		buf = appendMsgpackHeader(buf, msgpackString, len(v))
+		return append(buf, v...)
+	case []byte:
+		buf = appendMsgpackHeader(buf, msgpackBinary, len(v))
+		return append(buf, v...)
+	case int32:
+		return appendMsgpackInt(buf, int64(v))
+	case int64:
+		return appendMsgpackInt(buf, v)
+	case int:
+		return appendMsgpackInt(buf, int64(v))
+	case float64:
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(buf, i)
+		}
+		f, _ := v.Float64()
+		return appendMsgpack(buf, f)
+	case []interface{}:
+		buf = appendMsgpackHeader(buf, msgpackArray, len(v))
+		for _, element := range v {
+			buf = appendMsgpack(buf, element)
+		}
+		return buf
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf = appendMsgpackHeader(buf, msgpackMap, len(v))
+		for _, key := range keys {
+			buf = appendMsgpack(buf, key)
+			buf = appendMsgpack(buf, v[key])
+		}
+		return buf
+	}
+	return appendMsgpack(buf, fmt.Sprint(v))
+}
+
+// Msgpack types of appendMsgpackHeader
+const (
+	msgpackString = iota
+	msgpackBinary
+	msgpackArray
+	msgpackMap
+)
+
+// appendMsgpackHeader appends the type and length of a string, binary, array
+// or map in its most compact form
+func appendMsgpackHeader(buf []byte, typ int, n int) []byte {
+	switch {
+	case typ == msgpackString && n < 32:
+		return append(buf, 0xa0|byte(n))
+	case typ == msgpackArray && n < 16:
+		return append(buf, 0x90|byte(n))
+	case typ == msgpackMap && n < 16:
+		return append(buf, 0x80|byte(n))
+	case typ == msgpackString && n < 256:
+		return append(buf, 0xd9, byte(n))
+	case typ == msgpackBinary && n < 256:
+		return append(buf, 0xc4, byte(n))
+	}
+
+	// 16 and 32 bit lengths
+	first := map[int]byte{msgpackString: 0xda, msgpackBinary: 0xc5, msgpackArray: 0xdc, msgpackMap: 0xde}[typ]
+	if n < 65536 {
+		return binary.BigEndian.AppendUint16(append(buf, first), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, first+1), uint32(n))
+}
+
+// appendMsgpackInt appends an integer in its most compact form
+func appendMsgpackInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i < 128:
+		return append(buf, byte(i))
+	case i < 0 && i >= -32:
+		return append(buf, byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(i))
+}
+
+func (s *fluentdSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
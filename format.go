@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// messageTimeLayout matches the output of time.Time.String
+const messageTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// messagePrinter writes claimed messages in the same layout as the consumer
+// logger, to the logger, the compressed -out-compress output or the
+// -topic-outputs destination of their topic. Lines are formatted into a
+// buffer that is reused between messages, avoiding per-message allocations
+// and string conversions of the value on the hot path, so a printer must not
+// be shared between goroutines.
+type messagePrinter struct {
+	out    io.Writer
+	prefix string
+	buf    []byte
+
+	format  string
+	mode    string
+	csvBuf  bytes.Buffer
+	csv     *csv.Writer
+	columns []csvColumn
+	record  []string
+
+	checksums *checksums
+	// cluster is printed with every message of a consumer expanded from clusters
+	cluster string
+}
+
+func newMessagePrinter(logger *log.Logger, checksums *checksums, cluster string) *messagePrinter {
+	out := logger.Writer()
+	if messageOutput != nil {
+		out = messageOutput
+	}
+
+	p := &messagePrinter{
+		out:     out,
+		prefix:  logger.Prefix(),
+		format:  *outputFormat,
+		mode:    *printMode,
+		columns: csvColumns,
+		record:  make([]string, len(csvColumns)),
+
+		checksums: checksums,
+		cluster:   cluster,
+	}
+	p.csv = csv.NewWriter(&p.csvBuf)
+	return p
+}
+
+// output returns the writer of the messages of the topic
+func (p *messagePrinter) output(topic string) io.Writer {
+	if w, ok := topicOutputs[topic]; ok {
+		return w
+	}
+	return p.out
+}
+
+// print writes the message with the given, possibly decompressed, value. Like
+// the standard logger it ignores write errors.
+func (p *messagePrinter) print(message *sarama.ConsumerMessage, value []byte) {
+	switch p.format {
+	case "csv":
+		p.printCSV(message, value)
+		return
+	case "pretty":
+		p.printPretty(message, value)
+		return
+	}
+	if p.mode == "metadata" {
+		p.printMetadata(message, value)
+		return
+	}
+
+	buf := append(p.buf[:0], p.prefix...)
+	buf = appendLogTime(buf, time.Now())
+	buf = append(buf, "Message claimed: value = "...)
+	buf = appendPrintedValue(buf, message, value)
+	buf = append(buf, ", timestamp = "...)
+	buf = appendTimestamp(buf, message.Timestamp, messageTimeLayout)
+	buf = append(buf, ", topic = "...)
+	buf = append(buf, message.Topic...)
+	if *cloudEvents {
+		buf = appendCloudEvent(buf, message, ", ")
+	}
+	if *debeziumMode != "" {
+		buf = appendDebezium(buf, message, ", ")
+	}
+	if *printLocator {
+		buf = append(buf, ", locator = "...)
+		buf = appendLocator(buf, message)
+	}
+	if p.cluster != "" {
+		buf = append(buf, ", cluster = "...)
+		buf = append(buf, p.cluster...)
+	}
+	if p.checksums != nil {
+		sum, digest := p.checksums.sum(message, value)
+		buf = append(buf, ", partition = "...)
+		buf = strconv.AppendInt(buf, int64(message.Partition), 10)
+		buf = append(buf, ", offset = "...)
+		buf = strconv.AppendInt(buf, message.Offset, 10)
+		buf = append(buf, ", hash = "...)
+		buf = appendHex(buf, sum)
+		buf = append(buf, ", digest = "...)
+		buf = appendHex(buf, digest)
+	}
+	buf = append(buf, '\n')
+	p.buf = buf
+
+	p.output(message.Topic).Write(buf)
+}
+
+// appendTimestamp appends the message timestamp in the -time-format, or the
+// given layout of the output by default, in UTC with -utc
+func appendTimestamp(buf []byte, t time.Time, layout string) []byte {
+	if *utcTimes {
+		t = t.UTC()
+	}
+
+	switch *timeFormat {
+	case "":
+	case "rfc3339":
+		layout = time.RFC3339Nano
+	case "epoch":
+		return strconv.AppendInt(buf, t.Unix(), 10)
+	case "epoch-ms":
+		return strconv.AppendInt(buf, t.UnixNano()/int64(time.Millisecond), 10)
+	case "relative":
+		return appendRelative(buf, time.Since(t))
+	default:
+		layout = *timeFormat
+	}
+	return t.AppendFormat(buf, layout)
+}
+
+// appendRelative appends the age d rounded to its two largest units, e.g.
+// "3s ago", "2m5s ago" or "in 1h3m" for timestamps in the future
+func appendRelative(buf []byte, d time.Duration) []byte {
+	future := d < 0
+	if future {
+		d = -d
+		buf = append(buf, "in "...)
+	}
+
+	switch {
+	case d < time.Second:
+		d = d.Round(time.Millisecond)
+	case d < time.Hour:
+		d = d.Round(time.Second)
+	default:
+		d = d.Round(time.Minute)
+	}
+	s := d.String()
+	if d >= time.Hour {
+		// drop the seconds of "1h3m0s"
+		s = strings.TrimSuffix(s, "0s")
+	}
+	buf = append(buf, s...)
+
+	if !future {
+		buf = append(buf, " ago"...)
+	}
+	return buf
+}
+
+// appendLogTime appends the time like a log.LstdFlags logger does, which is
+// considerably cheaper than time.Time.AppendFormat
+func appendLogTime(buf []byte, t time.Time) []byte {
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+
+	buf = appendDigits(buf, year, 4)
+	buf = append(buf, '/')
+	buf = appendDigits(buf, int(month), 2)
+	buf = append(buf, '/')
+	buf = appendDigits(buf, day, 2)
+	buf = append(buf, ' ')
+	buf = appendDigits(buf, hour, 2)
+	buf = append(buf, ':')
+	buf = appendDigits(buf, min, 2)
+	buf = append(buf, ':')
+	buf = appendDigits(buf, sec, 2)
+	return append(buf, ' ')
+}
+
+// appendDigits appends i zero-padded to width digits
+func appendDigits(buf []byte, i int, width int) []byte {
+	var digits [20]byte
+	pos := len(digits)
+	for i >= 10 || width > 1 {
+		pos--
+		digits[pos] = byte('0' + i%10)
+		i /= 10
+		width--
+	}
+	pos--
+	digits[pos] = byte('0' + i)
+	return append(buf, digits[pos:]...)
+}
+
+// appendHex appends data as lowercase hex
+func appendHex(buf []byte, data []byte) []byte {
+	const digits = "0123456789abcdef"
+	for _, b := range data {
+		buf = append(buf, digits[b>>4], digits[b&0x0f])
+	}
+	return buf
+}
+
+// tombstoneValue is printed instead of the null value of a tombstone
+const tombstoneValue = "<tombstone>"
+
+// appendValue appends the value, or tombstoneValue for a tombstone
+func appendValue(buf []byte, message *sarama.ConsumerMessage, value []byte) []byte {
+	if message.Value == nil {
+		return append(buf, tombstoneValue...)
+	}
+	return append(buf, value...)
+}
+
+// appendPrintedValue appends the value like appendValue, cut after
+// -max-print-bytes with the number of bytes left out
+func appendPrintedValue(buf []byte, message *sarama.ConsumerMessage, value []byte) []byte {
+	if *maxPrintBytes <= 0 || len(value) <= *maxPrintBytes {
+		return appendValue(buf, message, value)
+	}
+	cut := truncateAt(value, *maxPrintBytes)
+	buf = append(buf, value[:cut]...)
+	buf = append(buf, "… ("...)
+	buf = strconv.AppendInt(buf, int64(len(value)-cut), 10)
+	return append(buf, " more bytes)"...)
+}
+
+// printMetadata writes everything but the value of the message, for scanning
+// the traffic of a topic without dumping its payloads
+func (p *messagePrinter) printMetadata(message *sarama.ConsumerMessage, value []byte) {
+	buf := append(p.buf[:0], p.prefix...)
+	buf = appendLogTime(buf, time.Now())
+	buf = append(buf, "Message claimed: topic = "...)
+	buf = append(buf, message.Topic...)
+	buf = append(buf, ", partition = "...)
+	buf = strconv.AppendInt(buf, int64(message.Partition), 10)
+	buf = append(buf, ", offset = "...)
+	buf = strconv.AppendInt(buf, message.Offset, 10)
+	buf = append(buf, ", timestamp = "...)
+	buf = appendTimestamp(buf, message.Timestamp, messageTimeLayout)
+	buf = append(buf, ", key = "...)
+	buf = append(buf, message.Key...)
+	buf = append(buf, ", headers = "...)
+	buf = appendHeaders(buf, message.Headers)
+	buf = append(buf, ", key size = "...)
+	buf = strconv.AppendInt(buf, int64(len(message.Key)), 10)
+	buf = append(buf, ", value size = "...)
+	buf = strconv.AppendInt(buf, int64(len(value)), 10)
+	if p.cluster != "" {
+		buf = append(buf, ", cluster = "...)
+		buf = append(buf, p.cluster...)
+	}
+	buf = append(buf, '\n')
+	p.buf = buf
+
+	p.output(message.Topic).Write(buf)
+}
+
+// appendHeaders appends the record headers as {name=value, ...}
+func appendHeaders(buf []byte, headers []*sarama.RecordHeader) []byte {
+	buf = append(buf, '{')
+	for i, header := range headers {
+		if i > 0 {
+			buf = append(buf, ", "...)
+		}
+		buf = append(buf, header.Key...)
+		buf = append(buf, '=')
+		buf = append(buf, header.Value...)
+	}
+	return append(buf, '}')
+}
+
+// csvMetadataColumns are the message metadata available as -csv-columns, hash
+// and digest require -checksum
+var csvMetadataColumns = []string{"topic", "partition", "offset", "timestamp", "key", "value", "headers", "value_size", "locator", "cluster", "hash", "digest"}
+
+// csvColumn is a column of the csv output, holding either message metadata or
+// the element at a JSON path in the value
+type csvColumn struct {
+	name string
+	path jsonPath
+	// header is the header of a ce:<attribute> column
+	header string
+}
+
+// Parsed -csv-columns flag
+var csvColumns []csvColumn
+
+// parseCSVColumns parses a comma separated list of metadata names and JSON paths
+func parseCSVColumns(spec string) ([]csvColumn, error) {
+	var columns []csvColumn
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if strings.HasPrefix(name, "$") {
+			path, err := parseJSONPath(name)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, csvColumn{name: name, path: path})
+			continue
+		}
+		if strings.HasPrefix(name, "ce:") && name != "ce:" {
+			columns = append(columns, csvColumn{name: name, header: cloudEventHeaderPrefix + strings.TrimPrefix(name, "ce:")})
+			continue
+		}
+
+		known := false
+		for _, metadata := range csvMetadataColumns {
+			known = known || name == metadata
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown csv column %q, expected a JSON path, ce:<attribute> or one of %s", name, strings.Join(csvMetadataColumns, ", "))
+		}
+		columns = append(columns, csvColumn{name: name})
+	}
+	return columns, nil
+}
+
+// writeCSVHeader writes the header row of the csv output
+func writeCSVHeader(w io.Writer, columns []csvColumn) error {
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.name
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	writer.Flush()
+	return writer.Error()
+}
+
+// printCSV writes the message as a single csv record
+func (p *messagePrinter) printCSV(message *sarama.ConsumerMessage, value []byte) {
+	var doc interface{}
+	decoded := false
+
+	var sum, digest []byte
+	if p.checksums != nil {
+		sum, digest = p.checksums.sum(message, value)
+	}
+
+	for i, column := range p.columns {
+		switch column.name {
+		case "topic":
+			p.record[i] = message.Topic
+		case "partition":
+			p.record[i] = strconv.FormatInt(int64(message.Partition), 10)
+		case "offset":
+			p.record[i] = strconv.FormatInt(message.Offset, 10)
+		case "timestamp":
+			p.record[i] = string(appendTimestamp(nil, message.Timestamp, time.RFC3339Nano))
+		case "key":
+			p.record[i] = string(message.Key)
+		case "value":
+			if p.mode == "all" {
+				p.record[i] = string(appendPrintedValue(nil, message, value))
+			}
+		case "headers":
+			p.record[i] = string(appendHeaders(nil, message.Headers))
+		case "value_size":
+			p.record[i] = strconv.Itoa(len(value))
+		case "locator":
+			p.record[i] = string(appendLocator(nil, message))
+		case "cluster":
+			p.record[i] = p.cluster
+		case "hash":
+			p.record[i] = hex.EncodeToString(sum)
+		case "digest":
+			p.record[i] = hex.EncodeToString(digest)
+		default:
+			if column.header != "" {
+				value, _ := header(message, column.header)
+				p.record[i] = string(value)
+				continue
+			}
+			if p.mode == "metadata" {
+				// JSON paths select parts of the value
+				p.record[i] = ""
+				continue
+			}
+			if !decoded {
+				doc, _ = decodeJSON(value)
+				decoded = true
+			}
+			element, _ := column.path.lookup(doc)
+			p.record[i] = jsonText(element)
+		}
+	}
+
+	// write the record with a single Write, as the output is shared between claims
+	p.csvBuf.Reset()
+	p.csv.Write(p.record)
+	p.csv.Flush()
+	p.output(message.Topic).Write(p.csvBuf.Bytes())
+}
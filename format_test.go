@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/golang/snappy"
+)
+
+func benchmarkMessage() *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 3,
+		Offset:    123456,
+		Key:       []byte("customer-42"),
+		Value:     bytes.Repeat([]byte(`{"id":42,"status":"shipped"}`), 8),
+		Timestamp: time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("trace-id"), Value: []byte("4bf92f3577b34da6")}},
+	}
+}
+
+func BenchmarkMessagePrinter(b *testing.B) {
+	message := benchmarkMessage()
+	printer := newMessagePrinter(log.New(ioutil.Discard, "", log.LstdFlags), nil, "")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(message.Value)))
+	for i := 0; i < b.N; i++ {
+		printer.print(message, message.Value)
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	value := benchmarkMessage().Value
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write(value)
+	w.Close()
+	encoder, err := zstdEncoder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	zstded := encoder.EncodeAll(value, nil)
+
+	for _, bench := range []struct {
+		name, mode string
+		value      []byte
+	}{
+		{"gzip", "gzip", gzipped.Bytes()},
+		{"snappy", "snappy", snappy.Encode(nil, value)},
+		{"zstd", "zstd", zstded},
+		{"auto", "auto", gzipped.Bytes()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var d decompressor
+			b.ReportAllocs()
+			b.SetBytes(int64(len(value)))
+			for i := 0; i < b.N; i++ {
+				decompressed, err := d.decompress(bench.mode, bench.value)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(decompressed) != len(value) {
+					b.Fatalf("decompressed %d bytes, want %d", len(decompressed), len(value))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// route forwards the messages matching it to Topic. Match selects the part of
+// the message to compare: "key", "header:<name>", "ce:<attribute>" of a
+// CloudEvent or a JSON path into the value such as "$.type". Without Equals,
+// a message matches when that part is present.
+type route struct {
+	Match  string `json:"match"`
+	Equals string `json:"equals"`
+	Topic  string `json:"topic"`
+
+	header string
+	path   jsonPath
+}
+
+// parse validates the route and parses its Match
+func (r *route) parse() error {
+	if r.Topic == "" {
+		return fmt.Errorf("route %q has no topic", r.Match)
+	}
+
+	switch {
+	case r.Match == "key":
+	case strings.HasPrefix(r.Match, "header:"):
+		r.header = strings.TrimPrefix(r.Match, "header:")
+		if r.header == "" {
+			return fmt.Errorf("route %q has no header name", r.Match)
+		}
+	case strings.HasPrefix(r.Match, "ce:"):
+		// the attributes of CloudEvents are headers in the binary content mode
+		if r.Match == "ce:" {
+			return fmt.Errorf("route %q has no attribute name", r.Match)
+		}
+		r.header = cloudEventHeaderPrefix + strings.TrimPrefix(r.Match, "ce:")
+	case strings.HasPrefix(r.Match, "$"):
+		path, err := parseJSONPath(r.Match)
+		if err != nil {
+			return err
+		}
+		r.path = path
+	default:
+		return fmt.Errorf("invalid route match %q, expected key, header:<name>, ce:<attribute> or a JSON path", r.Match)
+	}
+	return nil
+}
+
+// selects returns the part of the message the route compares
+func (r *route) selects(message *sarama.ConsumerMessage, doc func() interface{}) (string, bool) {
+	switch {
+	case r.Match == "key":
+		return string(message.Key), message.Key != nil
+	case r.header != "":
+		for _, header := range message.Headers {
+			if header != nil && string(header.Key) == r.header {
+				return string(header.Value), true
+			}
+		}
+		return "", false
+	}
+
+	element, ok := r.path.lookup(doc())
+	return jsonText(element), ok
+}
+
+func (r *route) matches(message *sarama.ConsumerMessage, doc func() interface{}) bool {
+	selected, ok := r.selects(message, doc)
+	if !ok {
+		return false
+	}
+	return r.Equals == "" || selected == r.Equals
+}
+
+// forwarding reports whether the consumer forwards messages instead of printing them
+func (c consumerConfig) forwarding() bool {
+	return c.ForwardTopic != "" || len(c.Routes) > 0
+}
+
+// destination returns the topic to forward the message to, the first matching
+// route wins and unmatched messages go to ForwardTopic. It returns false when
+// the message shouldn't be forwarded at all.
+func (c consumerConfig) destination(message *sarama.ConsumerMessage, value []byte) (string, bool) {
+	var doc interface{}
+	decoded := false
+	lazyDoc := func() interface{} {
+		if !decoded {
+			doc, _ = decodeJSON(value)
+			decoded = true
+		}
+		return doc
+	}
+
+	for i := range c.Routes {
+		if c.Routes[i].matches(message, lazyDoc) {
+			return c.Routes[i].Topic, true
+		}
+	}
+	return c.ForwardTopic, c.ForwardTopic != ""
+}
+
+// sourceClusterHeader is added to the messages forwarded by a consumer
+// expanded from clusters, naming the cluster the message was consumed from
+const sourceClusterHeader = "source-cluster"
+
+// forward produces the message unchanged to the given topic, tagged with the
+// cluster it was consumed from if any
+func forward(producer sarama.SyncProducer, topic string, message *sarama.ConsumerMessage, cluster string) error {
+	msg := &sarama.ProducerMessage{
+		Topic:     topic,
+		Timestamp: message.Timestamp,
+	}
+	if message.Value != nil {
+		// tombstones stay tombstones, deleting their key on the destination
+		msg.Value = sarama.ByteEncoder(message.Value)
+	}
+	if message.Key != nil {
+		msg.Key = sarama.ByteEncoder(message.Key)
+	}
+	for _, header := range message.Headers {
+		if header != nil {
+			msg.Headers = append(msg.Headers, *header)
+		}
+	}
+	if cluster != "" {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(sourceClusterHeader), Value: []byte(cluster)})
+	}
+
+	_, _, err := producer.SendMessage(msg)
+	return err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpMetadataToken is the token endpoint of the metadata server of GCP workloads
+const gcpMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpTimeout bounds a request to a GCP API
+const gcpTimeout = time.Minute
+
+// gcpServiceAccount is the key file of a service account
+type gcpServiceAccount struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// gcpTokenSource returns OAuth2 access tokens for the GCP APIs used by the
+// sinks: of the service account key file in GOOGLE_APPLICATION_CREDENTIALS,
+// or else of the metadata server of the instance the consumer runs on. Tokens
+// are cached until shortly before they expire.
+type gcpTokenSource struct {
+	scope   string
+	account *gcpServiceAccount
+	key     *rsa.PrivateKey
+	client  *http.Client
+	// anonymous requests aren't authorized, for emulators
+	anonymous bool
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newGCPTokenSource(scope string) (*gcpTokenSource, error) {
+	ts := &gcpTokenSource{scope: scope, client: &http.Client{Timeout: gcpTimeout}}
+
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		return ts, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account gcpServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("%s isn't a service account key file", path)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("no private key in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key in %s isn't an RSA key", path)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	ts.account, ts.key = &account, rsaKey
+	return ts, nil
+}
+
+// get returns a valid access token
+func (ts *gcpTokenSource) get() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Now().Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if ts.account != nil {
+		var assertion string
+		if assertion, err = ts.assertion(time.Now()); err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		if req, err = http.NewRequest(http.MethodPost, ts.account.TokenURI, strings.NewReader(form.Encode())); err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		if req, err = http.NewRequest(http.MethodGet, gcpMetadataToken+"?scopes="+url.QueryEscape(ts.scope), nil); err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	}
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("unable to get a GCP access token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no GCP access token returned")
+	}
+
+	ts.token = token.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return ts.token, nil
+}
+
+// assertion returns the JWT exchanged for an access token of the service account
+func (ts *gcpTokenSource) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.account.ClientEmail,
+		"scope": ts.scope,
+		"aud":   ts.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// do sends an authorized JSON request to a GCP API and decodes the response into out
+func (ts *gcpTokenSource) do(method, endpoint string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var token string
+	if !ts.anonymous {
+		if token, err = ts.get(); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if !ts.anonymous {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			// fetch a new token for the retry
+			ts.mu.Lock()
+			ts.token = ""
+			ts.mu.Unlock()
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -1,5 +1,31 @@
 module github.com/hrak/kafka-consumergroup
 
-go 1.12
+go 1.24
 
-require github.com/Shopify/sarama v1.21.0
+require (
+	github.com/Shopify/sarama v1.38.1
+	github.com/cespare/xxhash/v2 v2.1.2
+	github.com/eapache/go-xerial-snappy v0.0.0-20230111030713-bf00bc1b83b6
+	github.com/golang/snappy v0.0.4
+	github.com/itchyny/gojq v0.12.13
+	github.com/klauspost/compress v1.15.14
+	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/eapache/go-resiliency v1.3.0 // indirect
+	github.com/eapache/queue v1.1.0 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hashicorp/go-uuid v1.0.3 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	github.com/jcmturner/aescts/v2 v2.0.0 // indirect
+	github.com/jcmturner/dnsutils/v2 v2.0.0 // indirect
+	github.com/jcmturner/gofork v1.7.6 // indirect
+	github.com/jcmturner/gokrb5/v8 v8.4.3 // indirect
+	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
+	github.com/pierrec/lz4/v4 v4.1.17 // indirect
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
+	golang.org/x/net v0.5.0 // indirect
+)
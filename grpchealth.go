@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Serving statuses of grpc.health.v1.HealthCheckResponse
+const (
+	healthServing        = 1
+	healthNotServing     = 2
+	healthServiceUnknown = 3
+)
+
+// gRPC status codes returned in the grpc-status trailer
+const (
+	grpcOK            = 0
+	grpcInvalidArg    = 3
+	grpcNotFound      = 5
+	grpcUnimplemented = 12
+)
+
+// healthWatchInterval is how often a Watch call checks for a changed status
+const healthWatchInterval = time.Second
+
+// grpcHealthServer implements the grpc.health.v1.Health service over
+// cleartext HTTP/2, so service meshes and Kubernetes gRPC probes can check
+// the consumers natively. Only the framing and the two single-field messages
+// of the protocol are needed, which are encoded by hand.
+//
+// The service "" and "readiness" are serving while every consumer is in a
+// group session, "liveness" while the process runs, and the name of a
+// consumer of the -config file while that consumer is in a session. A
+// consumer that didn't catch up within -ready-max-lag or -ready-max-lag-time
+// yet, or breached its -lag-slo, isn't serving.
+type grpcHealthServer struct {
+	shutdown chan struct{}
+}
+
+// newGRPCHealthServer returns the server for the given address, the server
+// reports not serving once shutdown is closed
+func newGRPCHealthServer(addr string, shutdown chan struct{}) *http.Server {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Addr:      addr,
+		Handler:   &grpcHealthServer{shutdown: shutdown},
+		Protocols: &protocols,
+	}
+}
+
+func (h *grpcHealthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+
+	service, err := readHealthRequest(r.Body)
+	if err != nil {
+		setGRPCStatus(w, grpcInvalidArg)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/grpc.health.v1.Health/Check":
+		status := h.status(service)
+		if status == healthServiceUnknown {
+			setGRPCStatus(w, grpcNotFound)
+			return
+		}
+		writeHealthResponse(w, status)
+	case "/grpc.health.v1.Health/Watch":
+		h.watch(w, r, service)
+	default:
+		setGRPCStatus(w, grpcUnimplemented)
+		return
+	}
+	setGRPCStatus(w, grpcOK)
+}
+
+// setGRPCStatus sets the grpc-status trailer, the prefix makes it a trailer
+// even when no response message was written
+func setGRPCStatus(w http.ResponseWriter, code int) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+}
+
+// watch streams the status of the service whenever it changes, until the client goes away
+func (h *grpcHealthServer) watch(w http.ResponseWriter, r *http.Request, service string) {
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+
+	last := -1
+	for {
+		if status := h.status(service); status != last {
+			writeHealthResponse(w, status)
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			last = status
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// status returns the serving status of the service
+func (h *grpcHealthServer) status(service string) int {
+	select {
+	case <-h.shutdown:
+		return healthNotServing
+	default:
+	}
+
+	if service == "liveness" {
+		return healthServing
+	}
+
+	runningMu.RLock()
+	defer runningMu.RUnlock()
+
+	if service != "" && service != "readiness" {
+		consumer, ok := running[service]
+		if !ok {
+			return healthServiceUnknown
+		}
+		return servingStatus(consumer.serving())
+	}
+
+	ready := len(running) > 0
+	for _, consumer := range running {
+		ready = ready && consumer.serving()
+	}
+	return servingStatus(ready)
+}
+
+func servingStatus(serving bool) int {
+	if serving {
+		return healthServing
+	}
+	return healthNotServing
+}
+
+// serving reports whether the consumer is in a session, caught up as required
+// by -ready-max-lag and keeps up with its -lag-slo
+func (consumer *Consumer) serving() bool {
+	return consumer.inSession() && consumer.hasCaughtUp() && len(consumer.lagSLO.breachedTopics()) == 0
+}
+
+// inSession reports whether the consumer is currently a member of a group session
+func (consumer *Consumer) inSession() bool {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	return consumer.session != nil
+}
+
+// readHealthRequest reads the service of a length-prefixed HealthCheckRequest
+func readHealthRequest(body io.Reader) (string, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return "", err
+	}
+	if prefix[0] != 0 {
+		return "", errors.New("compressed grpc messages are not supported")
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(body, int64(binary.BigEndian.Uint32(prefix[1:]))))
+	if err != nil {
+		return "", err
+	}
+
+	// the only field is service = 1, a length-delimited string
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return "", errors.New("invalid health check request")
+		}
+		message = message[n:]
+
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(message)
+		case 2:
+			length, m := binary.Uvarint(message)
+			if m <= 0 || uint64(len(message)-m) < length {
+				return "", errors.New("invalid health check request")
+			}
+			if key>>3 == 1 {
+				return string(message[m : m+int(length)]), nil
+			}
+			n = m + int(length)
+		default:
+			return "", errors.New("invalid health check request")
+		}
+		if n <= 0 {
+			return "", errors.New("invalid health check request")
+		}
+		message = message[n:]
+	}
+	return "", nil
+}
+
+// writeHealthResponse writes a length-prefixed HealthCheckResponse with the status
+func writeHealthResponse(w io.Writer, status int) {
+	message := binary.AppendUvarint([]byte{0x08}, uint64(status))
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	w.Write(append(frame, message...))
+}
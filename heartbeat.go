@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// messageHeartbeat is a record published to -heartbeat-topic for a message
+// processed for longer than -heartbeat-interval. A slow message is followed
+// by heartbeats with a growing elapsed time until its offset moves on, a stuck
+// one never moves on.
+type messageHeartbeat struct {
+	Group     string    `json:"group"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Committed int64     `json:"committed_offset"`
+	Since     time.Time `json:"since"`
+	ElapsedMs int64     `json:"elapsed_ms"`
+	Host      string    `json:"host"`
+	MemberID  string    `json:"member_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// processing returns the offset of the message the worker is processing and
+// since when, ok is false while the worker isn't processing a message
+func (w *claimWorker) processing() (offset int64, since time.Time, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.offset, w.since, w.stage == workerProcessing
+}
+
+// heartbeatLoop reports the messages processed for longer than
+// -heartbeat-interval every -heartbeat-interval until the session ends
+func (consumer *Consumer) heartbeatLoop(session sarama.ConsumerGroupSession) {
+	ticker := time.NewTicker(*heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := consumer.heartbeat(session, time.Now()); err != nil {
+				consumer.logger.Printf("Unable to publish the heartbeats to %s: %v", *heartbeatTopic, err)
+			}
+		case <-session.Context().Done():
+			return
+		}
+	}
+}
+
+// heartbeat logs the messages processed for longer than -heartbeat-interval,
+// counts them in the heartbeats metric and publishes them to -heartbeat-topic.
+// The processing-longest-ms gauge is set to the longest time a message is
+// being processed, 0 while none is.
+func (consumer *Consumer) heartbeat(session sarama.ConsumerGroupSession, now time.Time) error {
+	settings := consumer.settings()
+	host, _ := os.Hostname()
+
+	var beats []messageHeartbeat
+	var longest time.Duration
+	consumer.stateMu.Lock()
+	for topic, partitions := range consumer.partitions {
+		for partition, state := range partitions {
+			if state.worker == nil {
+				continue
+			}
+			offset, since, ok := state.worker.processing()
+			if !ok {
+				continue
+			}
+			elapsed := now.Sub(since)
+			if elapsed > longest {
+				longest = elapsed
+			}
+			if elapsed < *heartbeatInterval {
+				continue
+			}
+			beats = append(beats, messageHeartbeat{
+				Group:     settings.Group,
+				Topic:     topic,
+				Partition: partition,
+				Offset:    offset,
+				Committed: state.committed,
+				Since:     since,
+				ElapsedMs: elapsed.Milliseconds(),
+				Host:      host,
+				MemberID:  session.MemberID(),
+				Timestamp: now,
+			})
+		}
+	}
+	consumer.stateMu.Unlock()
+
+	metrics.GetOrRegisterGauge("processing-longest-ms", consumer.registry).Update(longest.Milliseconds())
+	if len(beats) == 0 {
+		return nil
+	}
+	metrics.GetOrRegisterCounter("heartbeats", consumer.registry).Inc(int64(len(beats)))
+
+	sort.Slice(beats, func(i, j int) bool {
+		if beats[i].Topic != beats[j].Topic {
+			return beats[i].Topic < beats[j].Topic
+		}
+		return beats[i].Partition < beats[j].Partition
+	})
+	var messages []*sarama.ProducerMessage
+	for _, beat := range beats {
+		consumer.logger.Printf("Still processing topic = %s, partition = %d, offset = %d after %v", beat.Topic, beat.Partition, beat.Offset, (time.Duration(beat.ElapsedMs) * time.Millisecond).Round(time.Second))
+		if *heartbeatTopic == "" {
+			continue
+		}
+		record, err := json.Marshal(beat)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, &sarama.ProducerMessage{
+			Topic:     *heartbeatTopic,
+			Key:       sarama.StringEncoder(fmt.Sprintf("%s/%s/%d", beat.Group, beat.Topic, beat.Partition)),
+			Value:     sarama.ByteEncoder(record),
+			Timestamp: now,
+		})
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+	return consumer.producer.SendMessages(messages)
+}
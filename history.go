@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// historyScan holds the messages with the key of the history subcommand
+type historyScan struct {
+	key []byte
+
+	mu       sync.Mutex
+	messages []*sarama.ConsumerMessage
+	scanned  int
+}
+
+// runHistory prints every message of the topics with the historyKey within the
+// -from/-to window in the order of their timestamps, as the audit trail of a
+// single entity. Every partition is scanned, as the partitioner of the
+// producers is unknown. It exits with status 1 when no message was found.
+func runHistory(c consumerConfig) {
+	config, err := newSaramaConfig(c)
+	if err != nil {
+		fatal(err)
+	}
+
+	client, err := sarama.NewClient(strings.Split(c.Brokers, ","), config)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		fatal(err)
+	}
+	defer consumer.Close()
+
+	scan := &historyScan{key: []byte(*historyKey)}
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for _, topic := range c.topicNames {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			fatal(err)
+		}
+
+		for _, partition := range partitions {
+			wg.Add(1)
+			go func(topic string, partition int32) {
+				defer wg.Done()
+				if err := scan.readPartition(client, consumer, topic, partition); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}(topic, partition)
+		}
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		fatal(err)
+	default:
+	}
+
+	sort.Slice(scan.messages, func(i, j int) bool {
+		a, b := scan.messages[i], scan.messages[j]
+		switch {
+		case !a.Timestamp.Equal(b.Timestamp):
+			return a.Timestamp.Before(b.Timestamp)
+		case a.Topic != b.Topic:
+			return a.Topic < b.Topic
+		case a.Partition != b.Partition:
+			return a.Partition < b.Partition
+		}
+		return a.Offset < b.Offset
+	})
+
+	openMessageOutput()
+	logger := log.New(log.Writer(), "", log.LstdFlags)
+	printer := newMessagePrinter(logger, newChecksums(*checksum), "")
+	var decompressor decompressor
+	for _, message := range scan.messages {
+		value, err := decompressor.decompress(c.ValueDecompress, message.Value)
+		if err != nil {
+			log.Printf("Unable to decompress value at topic = %s, partition = %d, offset = %d: %v", message.Topic, message.Partition, message.Offset, err)
+			value = message.Value
+		}
+		printer.print(message, value)
+	}
+	if err := closeOutputs(); err != nil {
+		exit(exitConsumptionError, "history error", err)
+	}
+
+	log.Printf("Found %d messages with key = %s in %d records of %s", len(scan.messages), *historyKey, scan.scanned, strings.Join(c.topicNames, ","))
+	if len(scan.messages) == 0 {
+		exit(exitConsumptionError, "key not found", nil)
+	}
+}
+
+// readPartition adds the messages of the partition with the key within the
+// -from/-to window
+func (scan *historyScan) readPartition(client sarama.Client, consumer sarama.Consumer, topic string, partition int32) error {
+	start, end, err := windowOffsets(client, topic, partition)
+	if err != nil {
+		return err
+	}
+	if start >= end {
+		return nil
+	}
+
+	pc, err := consumer.ConsumePartition(topic, partition, start)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	idle := time.NewTimer(exportIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case message := <-pc.Messages():
+			if message.Offset >= end {
+				return nil
+			}
+
+			scan.mu.Lock()
+			if bytes.Equal(message.Key, scan.key) {
+				scan.messages = append(scan.messages, message)
+			}
+			scan.scanned++
+			scan.mu.Unlock()
+
+			if message.Offset+1 >= end {
+				return nil
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(exportIdleTimeout)
+		case <-idle.C:
+			log.Printf("No messages on topic = %s, partition = %d for %v, considering it complete", topic, partition, exportIdleTimeout)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// inFlightLimit bounds the number of messages that were handed to processing
+// but whose offsets aren't committed yet, across all claims of a consumer. A
+// nil limit is unlimited.
+type inFlightLimit struct {
+	max int
+
+	mu      sync.Mutex
+	count   int
+	changed chan struct{}
+}
+
+func newInFlightLimit(max int) *inFlightLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &inFlightLimit{max: max, changed: make(chan struct{})}
+}
+
+// acquire takes a slot for a message, calling full once whenever it has to
+// wait for committed messages to free one. It returns false when ctx is done first.
+func (l *inFlightLimit) acquire(ctx context.Context, full func()) bool {
+	if l == nil {
+		return true
+	}
+
+	notified := false
+	for {
+		l.mu.Lock()
+		if l.count < l.max {
+			l.count++
+			l.mu.Unlock()
+			return true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		if !notified {
+			full()
+			notified = true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// release frees the slots of n messages that were committed or abandoned
+func (l *inFlightLimit) release(n int) {
+	if l == nil || n == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	l.count -= n
+	close(l.changed)
+	l.changed = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// current returns the number of messages in flight
+func (l *inFlightLimit) current() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
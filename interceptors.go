@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"plugin"
+	"strings"
+
+	"github.com/hrak/kafka-consumergroup/consumergroup"
+)
+
+// interceptors are loaded from the -interceptors plugins and invoked for every
+// claimed message before it is printed or forwarded
+var interceptors []consumergroup.Interceptor
+
+// loadInterceptors opens a comma separated list of Go plugins, each exporting
+// an Interceptor variable implementing consumergroup.Interceptor
+func loadInterceptors(paths string) ([]consumergroup.Interceptor, error) {
+	var loaded []consumergroup.Interceptor
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+
+		p, err := plugin.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		symbol, err := p.Lookup("Interceptor")
+		if err != nil {
+			return nil, err
+		}
+
+		switch interceptor := symbol.(type) {
+		case *consumergroup.Interceptor:
+			loaded = append(loaded, *interceptor)
+		case consumergroup.Interceptor:
+			loaded = append(loaded, interceptor)
+		default:
+			return nil, fmt.Errorf("the Interceptor of plugin %s doesn't implement consumergroup.Interceptor", path)
+		}
+	}
+	return loaded, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// journaldSocket is the socket of the native protocol of the systemd journal
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldSink writes the claimed messages to the systemd journal with the
+// native protocol, the value as MESSAGE and the metadata and headers as the
+// KAFKA_TOPIC, KAFKA_PARTITION, KAFKA_OFFSET, KAFKA_KEY and KAFKA_HEADER_<NAME>
+// fields, queryable with journalctl KAFKA_TOPIC=orders.
+//
+// Every message is a datagram the journal received once it was sent, so there
+// is nothing to flush. The journal drops datagrams over the socket buffer size
+// of some hundred kilobytes, those messages fail their write.
+type journaldSink struct {
+	priority string
+	app      string
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+	buf  bytes.Buffer
+}
+
+func newJournaldSink(severity, app string) (*journaldSink, error) {
+	sev, ok := syslogSeverities[severity]
+	if !ok {
+		return nil, fmt.Errorf("unknown -syslog-severity %q", severity)
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to the journal: %v", err)
+	}
+	return &journaldSink{priority: strconv.Itoa(sev), app: app, conn: conn}, nil
+}
+
+func (s *journaldSink) name() string {
+	return "journald sink"
+}
+
+func (s *journaldSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf.Reset()
+	s.field("MESSAGE", appendValue(nil, message, value))
+	s.field("PRIORITY", []byte(s.priority))
+	s.field("SYSLOG_IDENTIFIER", []byte(s.app))
+	s.field("KAFKA_TOPIC", []byte(message.Topic))
+	s.field("KAFKA_PARTITION", []byte(strconv.Itoa(int(message.Partition))))
+	s.field("KAFKA_OFFSET", []byte(strconv.FormatInt(message.Offset, 10)))
+	if message.Key != nil {
+		s.field("KAFKA_KEY", message.Key)
+	}
+	for _, h := range message.Headers {
+		if name := journaldFieldName("KAFKA_HEADER_" + string(h.Key)); name != "" {
+			s.field(name, h.Value)
+		}
+	}
+
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write the message at topic = %s, partition = %d, offset = %d of %d bytes: %v", message.Topic, message.Partition, message.Offset, s.buf.Len(), err)
+	}
+	return nil
+}
+
+// field appends a field, in the binary encoding for values with newlines
+func (s *journaldSink) field(name string, value []byte) {
+	s.buf.WriteString(name)
+	if bytes.IndexByte(value, '\n') < 0 {
+		s.buf.WriteByte('=')
+	} else {
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+		s.buf.WriteByte('\n')
+		s.buf.Write(size[:])
+	}
+	s.buf.Write(value)
+	s.buf.WriteByte('\n')
+}
+
+// journaldFieldName returns name as a journal field name, uppercase letters,
+// digits and underscores of at most 64 characters, or "" if it can't be one
+func journaldFieldName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+	if len(name) > 64 {
+		return ""
+	}
+	return name
+}
+
+func (s *journaldSink) flush(point commitPoint) error {
+	return nil
+}
+
+func (s *journaldSink) close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/itchyny/gojq"
+)
+
+// jqVariables are the metadata of the message a -jq expression can refer to
+var jqVariables = []string{"$topic", "$partition", "$offset", "$key", "$headers"}
+
+// jqFilter is the compiled -jq expression
+var jqFilter *gojq.Code
+
+// compileJQ compiles a jq expression with the jqVariables
+func compileJQ(expression string) (*gojq.Code, error) {
+	query, err := gojq.Parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -jq expression: %v", err)
+	}
+	return gojq.Compile(query, gojq.WithVariables(jqVariables))
+}
+
+// applyJQ runs the jq expression on the value of the message. It reports
+// false when the message is filtered out: when the expression has no result,
+// or its first result is false or null. A result of true keeps the value, and
+// any other result replaces it, encoded as JSON. Tombstones are evaluated as
+// null, and values that aren't JSON are filtered out.
+func applyJQ(ctx context.Context, code *gojq.Code, message *sarama.ConsumerMessage, value []byte) ([]byte, bool, error) {
+	var doc interface{}
+	if message.Value != nil {
+		var err error
+		if doc, err = decodeJSON(value); err != nil {
+			return nil, false, nil
+		}
+	}
+	var key interface{}
+	if message.Key != nil {
+		key = string(message.Key)
+	}
+	headers := make(map[string]interface{}, len(message.Headers))
+	for _, h := range message.Headers {
+		if h != nil {
+			headers[string(h.Key)] = string(h.Value)
+		}
+	}
+
+	result, ok := code.RunWithContext(ctx, doc, message.Topic, int(message.Partition), message.Offset, key, headers).Next()
+	if !ok {
+		return nil, false, nil
+	}
+	switch result := result.(type) {
+	case error:
+		return nil, false, result
+	case nil:
+		return nil, false, nil
+	case bool:
+		return value, result, nil
+	}
+	data, err := gojq.Marshal(result)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
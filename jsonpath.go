@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a parsed JSON path such as $.order.items[0].id, made of object
+// keys (string) and array indexes (int)
+type jsonPath []interface{}
+
+// parseJSONPath parses a path starting with $ made of .key and [index] steps
+func parseJSONPath(path string) (jsonPath, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSON path %q must start with $", path)
+	}
+
+	var steps jsonPath
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("empty key in JSON path %q", path)
+			}
+			steps = append(steps, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in JSON path %q", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index %q in JSON path %q", rest[1:end], path)
+			}
+			steps = append(steps, index)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in JSON path %q", rest[0], path)
+		}
+	}
+
+	return steps, nil
+}
+
+// lookup returns the element at the path in a document decoded by decodeJSON
+func (p jsonPath) lookup(doc interface{}) (interface{}, bool) {
+	for _, step := range p {
+		switch step := step.(type) {
+		case string:
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = object[step]; !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := doc.([]interface{})
+			if !ok || step >= len(array) {
+				return nil, false
+			}
+			doc = array[step]
+		}
+	}
+	return doc, true
+}
+
+// decodeJSON decodes a message value, keeping numbers as json.Number so they
+// are printed exactly as they were produced
+func decodeJSON(value []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// encodeJSON encodes an element of a decoded document as compact JSON,
+// without escaping HTML characters as json.Marshal does
+func encodeJSON(element interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(element); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonText formats an element of a decoded document as text: strings without
+// quotes, null as an empty string and objects and arrays as compact JSON
+func jsonText(element interface{}) string {
+	switch element := element.(type) {
+	case nil:
+		return ""
+	case string:
+		return element
+	case json.Number:
+		return element.String()
+	case bool:
+		return strconv.FormatBool(element)
+	}
+
+	data, err := json.Marshal(element)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// projection is a parsed -project list of JSON paths
+type projection []jsonPath
+
+// valueProjection is the parsed -project flag
+var valueProjection projection
+
+// parseProjection parses a comma separated list of JSON paths
+func parseProjection(spec string) (projection, error) {
+	var p projection
+	for _, path := range strings.Split(spec, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		steps, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(steps) == 0 {
+			return nil, fmt.Errorf("-project path %q selects the whole value", path)
+		}
+		p = append(p, steps)
+	}
+	return p, nil
+}
+
+// apply returns the JSON value reduced to the elements at the paths, in the
+// shape of the original document: objects keep the projected keys, and arrays
+// the projected elements in the order of their indexes. Values that aren't
+// JSON documents are returned unchanged.
+func (p projection) apply(value []byte) []byte {
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return value
+	}
+
+	// objects are map[string]interface{} and arrays map[int]interface{} until
+	// every path is inserted
+	var projected interface{}
+	for _, path := range p {
+		element, ok := path.lookup(doc)
+		if !ok {
+			continue
+		}
+		projected = projectElement(projected, path, element)
+	}
+	if projected == nil {
+		projected = map[string]interface{}{}
+	}
+
+	data, err := encodeJSON(projectedArrays(projected))
+	if err != nil {
+		return value
+	}
+	return data
+}
+
+// projectElement inserts the element at the path into the projected node
+func projectElement(node interface{}, path jsonPath, element interface{}) interface{} {
+	if len(path) == 0 {
+		return element
+	}
+	switch step := path[0].(type) {
+	case string:
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			object = make(map[string]interface{})
+		}
+		object[step] = projectElement(object[step], path[1:], element)
+		return object
+	case int:
+		array, ok := node.(map[int]interface{})
+		if !ok {
+			array = make(map[int]interface{})
+		}
+		array[step] = projectElement(array[step], path[1:], element)
+		return array
+	}
+	return node
+}
+
+// projectedArrays replaces the arrays of the projected node by slices
+func projectedArrays(node interface{}) interface{} {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			node[key] = projectedArrays(child)
+		}
+	case map[int]interface{}:
+		indexes := make([]int, 0, len(node))
+		for index := range node {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		array := make([]interface{}, len(indexes))
+		for i, index := range indexes {
+			array[i] = projectedArrays(node[index])
+		}
+		return array
+	}
+	return node
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// lagCheckInterval is the interval at which the lag of the claimed partitions
+// is compared with -lag-slo
+const lagCheckInterval = 10 * time.Second
+
+// lagAlertTimeout bounds a request to -lag-alert-webhook and the other webhooks
+const lagAlertTimeout = 5 * time.Second
+
+// parseLagSLO parses a comma separated list of topic=lag pairs, the topic *
+// applies to every topic without a pair of its own
+func parseLagSLO(spec string) (map[string]int64, error) {
+	thresholds := make(map[string]int64)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid lag SLO %q, expected topic=lag", pair)
+		}
+		lag, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil || lag <= 0 {
+			return nil, fmt.Errorf("invalid lag SLO for topic %s, expected a positive number", kv[0])
+		}
+		thresholds[kv[0]] = lag
+	}
+	return thresholds, nil
+}
+
+// lagMonitor tracks for how long the lag of every topic exceeds its -lag-slo
+// threshold. A topic that exceeded it for -lag-slo-for is breached until its
+// lag drops below the threshold again. A nil monitor never breaches.
+type lagMonitor struct {
+	thresholds map[string]int64
+
+	mu       sync.Mutex
+	exceeded map[string]time.Time
+	breached map[string]bool
+}
+
+func newLagMonitor(thresholds map[string]int64) *lagMonitor {
+	if len(thresholds) == 0 {
+		return nil
+	}
+	return &lagMonitor{
+		thresholds: thresholds,
+		exceeded:   make(map[string]time.Time),
+		breached:   make(map[string]bool),
+	}
+}
+
+// threshold returns the maximum lag of the topic, 0 for topics without one
+func (m *lagMonitor) threshold(topic string) int64 {
+	if threshold, ok := m.thresholds[topic]; ok {
+		return threshold
+	}
+	return m.thresholds["*"]
+}
+
+// lagAlert is the JSON body posted to -lag-alert-webhook
+type lagAlert struct {
+	State     string    `json:"state"`
+	Consumer  string    `json:"consumer,omitempty"`
+	Group     string    `json:"group"`
+	Topic     string    `json:"topic"`
+	Lag       int64     `json:"lag"`
+	Threshold int64     `json:"threshold"`
+	Since     time.Time `json:"since"`
+}
+
+// update records the current lag of the topics and returns the alerts of the
+// topics that were breached or recovered
+func (m *lagMonitor) update(lags map[string]int64, now time.Time) []lagAlert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var alerts []lagAlert
+	for topic, lag := range lags {
+		threshold := m.threshold(topic)
+		if threshold == 0 {
+			continue
+		}
+		since, exceeded := m.exceeded[topic]
+
+		switch {
+		case lag > threshold && !exceeded:
+			m.exceeded[topic] = now
+		case lag > threshold && !m.breached[topic] && now.Sub(since) >= *lagSLOFor:
+			m.breached[topic] = true
+			alerts = append(alerts, lagAlert{State: "breached", Topic: topic, Lag: lag, Threshold: threshold, Since: since})
+		case lag <= threshold && exceeded:
+			delete(m.exceeded, topic)
+			if m.breached[topic] {
+				delete(m.breached, topic)
+				alerts = append(alerts, lagAlert{State: "recovered", Topic: topic, Lag: lag, Threshold: threshold, Since: since})
+			}
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Topic < alerts[j].Topic })
+	return alerts
+}
+
+// breachedTopics returns the topics whose lag SLO is currently breached
+func (m *lagMonitor) breachedTopics() []string {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var topics []string
+	for topic := range m.breached {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// lagLoop compares the lag of the claimed partitions with -lag-slo until the
+// session ends
+func (consumer *Consumer) lagLoop(session sarama.ConsumerGroupSession) {
+	ticker := time.NewTicker(lagCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-session.Context().Done():
+			return
+		}
+
+		lags, err := consumer.topicLags()
+		if err != nil {
+			consumer.logger.Printf("Unable to determine the lag: %v", err)
+			continue
+		}
+		for _, alert := range consumer.lagSLO.update(lags, time.Now()) {
+			consumer.alertLag(alert)
+		}
+	}
+}
+
+// topicLags returns the lag of this instance per topic, the sum over its
+// claimed partitions of the messages after the processed offset. The newest
+// offsets are looked up, so a stuck consumer shows its growing lag.
+func (consumer *Consumer) topicLags() (map[string]int64, error) {
+	processed := make(map[string]map[int32]int64)
+	consumer.stateMu.Lock()
+	for topic, partitions := range consumer.partitions {
+		processed[topic] = make(map[int32]int64)
+		for partition, state := range partitions {
+			offset := state.offset
+			if offset < 0 {
+				offset = state.committed
+			}
+			processed[topic][partition] = offset
+		}
+	}
+	consumer.stateMu.Unlock()
+
+	lags := make(map[string]int64)
+	for topic, partitions := range processed {
+		for partition, offset := range partitions {
+			if offset < 0 {
+				// nothing processed or committed yet
+				continue
+			}
+			newest, err := consumer.client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, err
+			}
+			if newest > offset {
+				lags[topic] += newest - offset
+			}
+		}
+		if _, ok := lags[topic]; !ok {
+			lags[topic] = 0
+		}
+	}
+	return lags, nil
+}
+
+// alertLag logs the alert and posts it to -lag-alert-webhook
+func (consumer *Consumer) alertLag(alert lagAlert) {
+	settings := consumer.settings()
+	alert.Consumer, alert.Group = settings.Name, settings.Group
+
+	if alert.State == "breached" {
+		consumer.logger.Printf("Lag SLO breached: topic = %s, lag = %d, threshold = %d, since = %s, reporting not ready", alert.Topic, alert.Lag, alert.Threshold, alert.Since.Format(time.RFC3339))
+	} else {
+		consumer.logger.Printf("Lag SLO recovered: topic = %s, lag = %d, threshold = %d", alert.Topic, alert.Lag, alert.Threshold)
+	}
+
+	if *lagAlertWebhook == "" {
+		return
+	}
+	if err := postAlert(*lagAlertWebhook, alert); err != nil {
+		consumer.logger.Printf("Unable to post the lag alert: %v", err)
+	}
+}
+
+// postAlert posts the alert as JSON to the webhook URL
+func postAlert(url string, alert interface{}) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: lagAlertTimeout}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return errors.New(response.Status)
+	}
+	return nil
+}
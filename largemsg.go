@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// claimCheckTimeout limits the download of a claim-check payload
+	claimCheckTimeout = 30 * time.Second
+	// maxChunks limits the chunks of a single message, guarding against corrupt headers
+	maxChunks = 10000
+)
+
+var claimCheckClient = &http.Client{Timeout: claimCheckTimeout}
+
+// header returns the value of the first header of the message with the given name
+func header(message *sarama.ConsumerMessage, name string) ([]byte, bool) {
+	for _, h := range message.Headers {
+		if h != nil && string(h.Key) == name {
+			return h.Value, true
+		}
+	}
+	return nil, false
+}
+
+// withValue returns a copy of the message with another value
+func withValue(message *sarama.ConsumerMessage, value []byte) *sarama.ConsumerMessage {
+	copied := *message
+	copied.Value = value
+	return &copied
+}
+
+// claimCheck resolves the claim check of the message under the retry policy of
+// its topic. When that fails, -on-large-message-failure is applied and false
+// is returned, the message must not be processed then. It returns false as
+// well when ctx is done.
+func (consumer *Consumer) claimCheck(ctx context.Context, message *sarama.ConsumerMessage) (*sarama.ConsumerMessage, bool) {
+	var resolved *sarama.ConsumerMessage
+	err := consumer.settings().retryPolicy(message.Topic).Do(ctx, func() (err error) {
+		resolved, err = resolveClaimCheck(message)
+		return err
+	})
+	if ctx.Err() != nil {
+		return message, false
+	}
+	if err != nil {
+		consumer.failLargeMessage([]*sarama.ConsumerMessage{message}, fmt.Errorf("unable to resolve the claim check at topic = %s, partition = %d, offset = %d: %v", message.Topic, message.Partition, message.Offset, err))
+		return message, false
+	}
+	return resolved, true
+}
+
+// failLargeMessage counts a message whose claim check failed or whose chunks
+// didn't all arrive in the large-message-failures metric and applies
+// -on-large-message-failure to it, given as the message or its chunks
+func (consumer *Consumer) failLargeMessage(messages []*sarama.ConsumerMessage, err error) {
+	metrics.GetOrRegisterCounter("large-message-failures", consumer.registry).Inc(1)
+
+	switch *onLargeMsgFailure {
+	case "skip":
+		consumer.logger.Printf("Skipping a large message: %v", err)
+	case "dead-letter":
+		topic := *deadLetterTopic
+		if *shadow {
+			topic += shadowTopicSuffix
+		}
+		consumer.logger.Printf("Dead-lettering a large message to %s: %v", topic, err)
+		for _, message := range messages {
+			if err := forward(consumer.producer, topic, message, consumer.settings().cluster); err != nil {
+				consumer.fatalf("unable to dead-letter topic = %s, partition = %d, offset = %d to %s: %v", message.Topic, message.Partition, message.Offset, topic, err)
+			}
+		}
+	default:
+		consumer.fatalf("%v", err)
+	}
+}
+
+// resolveClaimCheck substitutes the payload stored at the location in the
+// -claim-check-header of the message, if it has one. Locations are http or
+// https URLs, or file URLs below the -claim-check-dir.
+func resolveClaimCheck(message *sarama.ConsumerMessage) (*sarama.ConsumerMessage, error) {
+	if *claimCheckHeader == "" {
+		return message, nil
+	}
+	location, ok := header(message, *claimCheckHeader)
+	if !ok {
+		return message, nil
+	}
+
+	u, err := url.Parse(string(location))
+	if err != nil {
+		return nil, fmt.Errorf("invalid claim-check location at topic = %s, partition = %d, offset = %d: %v", message.Topic, message.Partition, message.Offset, err)
+	}
+
+	var payload []byte
+	switch u.Scheme {
+	case "http", "https":
+		response, err := claimCheckClient.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unable to fetch the claim-check payload %s: %s", u, response.Status)
+		}
+		if payload, err = readClaimCheck(response.Body); err != nil {
+			return nil, fmt.Errorf("unable to fetch the claim-check payload %s: %v", u, err)
+		}
+	case "file":
+		path, err := claimCheckPath(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if payload, err = readClaimCheck(f); err != nil {
+			return nil, fmt.Errorf("unable to read the claim-check payload %s: %v", u, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported claim-check location %s, expected an http, https or file URL", u)
+	}
+	return withValue(message, payload), nil
+}
+
+// readClaimCheck reads a payload of at most -claim-check-max-bytes
+func readClaimCheck(r io.Reader) ([]byte, error) {
+	payload, err := ioutil.ReadAll(io.LimitReader(r, *claimCheckMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) > *claimCheckMaxBytes {
+		return nil, fmt.Errorf("payload exceeds -claim-check-max-bytes %d", *claimCheckMaxBytes)
+	}
+	return payload, nil
+}
+
+// claimCheckPath returns the path of a file URL with its symbolic links
+// resolved, provided it is below the -claim-check-dir. Otherwise any file
+// readable by the consumer, such as its credentials, could be substituted.
+func claimCheckPath(path string) (string, error) {
+	if *claimCheckDir == "" {
+		return "", fmt.Errorf("file claim-check locations require a -claim-check-dir")
+	}
+	dir, err := filepath.EvalSymlinks(*claimCheckDir)
+	if err != nil {
+		return "", err
+	}
+	if path, err = filepath.EvalSymlinks(filepath.Clean(path)); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("claim-check location %s is outside of the -claim-check-dir", path)
+	}
+	return path, nil
+}
+
+// chunkAssembler reassembles the messages a producer split into chunks,
+// identified by the -chunk-headers. The chunks of a message must be produced
+// to the same partition, so an assembler serves a single claim. Messages
+// whose chunks didn't all arrive within -chunk-timeout, or the oldest ones
+// beyond -chunk-max-pending, are given up on and passed to fail.
+type chunkAssembler struct {
+	idHeader, indexHeader, countHeader string
+	fail                               func(chunks []*sarama.ConsumerMessage, err error)
+
+	groups map[string]*chunkGroup
+}
+
+// chunkGroup holds the chunks received so far of a message
+type chunkGroup struct {
+	chunks   []*sarama.ConsumerMessage
+	received int
+	// first is the time the first chunk arrived
+	first time.Time
+}
+
+// newChunkAssembler returns nil without -chunk-headers
+func newChunkAssembler(fail func(chunks []*sarama.ConsumerMessage, err error)) *chunkAssembler {
+	if *chunkHeaders == "" {
+		return nil
+	}
+	names := strings.Split(*chunkHeaders, ",")
+	return &chunkAssembler{
+		idHeader:    names[0],
+		indexHeader: names[1],
+		countHeader: names[2],
+		fail:        fail,
+		groups:      make(map[string]*chunkGroup),
+	}
+}
+
+// expire gives up on the messages whose first chunk arrived before
+// -chunk-timeout, and on the oldest ones while more than max are held
+func (a *chunkAssembler) expire(now time.Time, max int) {
+	for id, group := range a.groups {
+		if now.Sub(group.first) > *chunkTimeout {
+			delete(a.groups, id)
+			a.giveUp(id, group, fmt.Sprintf("not all chunks arrived within -chunk-timeout %v", *chunkTimeout))
+		}
+	}
+	for len(a.groups) > max {
+		var oldest string
+		for id, group := range a.groups {
+			if oldest == "" || group.first.Before(a.groups[oldest].first) {
+				oldest = id
+			}
+		}
+		group := a.groups[oldest]
+		delete(a.groups, oldest)
+		a.giveUp(oldest, group, fmt.Sprintf("the -chunk-max-pending %d incomplete messages are held already", *chunkMaxPending))
+	}
+}
+
+// giveUp passes the chunks received of an incomplete message to fail
+func (a *chunkAssembler) giveUp(id string, group *chunkGroup, reason string) {
+	var chunks []*sarama.ConsumerMessage
+	for _, chunk := range group.chunks {
+		if chunk != nil {
+			chunks = append(chunks, chunk)
+		}
+	}
+	first := chunks[0]
+	a.fail(chunks, fmt.Errorf("giving up on chunked message %s at topic = %s, partition = %d from offset %d with %d of %d chunks: %s", id, first.Topic, first.Partition, first.Offset, group.received, len(group.chunks), reason))
+}
+
+// add passes a message through the assembler. Messages without the chunk
+// headers are returned unchanged. A chunk is held until all chunks of its
+// message arrived, then the reassembled message is returned, carrying the
+// metadata of the last chunk. It returns nil while the message is incomplete.
+func (a *chunkAssembler) add(message *sarama.ConsumerMessage) (*sarama.ConsumerMessage, error) {
+	if a == nil {
+		return message, nil
+	}
+	id, ok := header(message, a.idHeader)
+	if !ok {
+		return message, nil
+	}
+
+	index, err := chunkNumber(message, a.indexHeader)
+	if err != nil {
+		return nil, err
+	}
+	count, err := chunkNumber(message, a.countHeader)
+	if err != nil {
+		return nil, err
+	}
+	if count < 1 || count > maxChunks || index >= count {
+		return nil, fmt.Errorf("invalid chunk %d of %d at topic = %s, partition = %d, offset = %d", index, count, message.Topic, message.Partition, message.Offset)
+	}
+
+	now := time.Now()
+	max := *chunkMaxPending
+	if a.groups[string(id)] == nil {
+		// room for a new message
+		max--
+	}
+	a.expire(now, max)
+	group := a.groups[string(id)]
+	if group == nil {
+		// the late chunks of an expired message start over, and expire as well
+		group = &chunkGroup{chunks: make([]*sarama.ConsumerMessage, count), first: now}
+		a.groups[string(id)] = group
+	}
+	if len(group.chunks) != count {
+		return nil, fmt.Errorf("chunk count of message %s changed to %d at topic = %s, partition = %d, offset = %d", id, count, message.Topic, message.Partition, message.Offset)
+	}
+	if group.chunks[index] == nil {
+		group.received++
+	}
+	group.chunks[index] = message
+	if group.received < count {
+		return nil, nil
+	}
+
+	delete(a.groups, string(id))
+	size := 0
+	for _, chunk := range group.chunks {
+		size += len(chunk.Value)
+	}
+	value := make([]byte, 0, size)
+	for _, chunk := range group.chunks {
+		value = append(value, chunk.Value...)
+	}
+	return withValue(message, value), nil
+}
+
+// pending reports whether chunks of an incomplete message are held. Offsets
+// must not be marked meanwhile, so the chunks are delivered again after a
+// restart, until the message is given up on.
+func (a *chunkAssembler) pending() bool {
+	return a != nil && len(a.groups) > 0
+}
+
+// chunkNumber parses a numeric chunk header
+func chunkNumber(message *sarama.ConsumerMessage, name string) (int, error) {
+	value, ok := header(message, name)
+	if !ok {
+		return 0, fmt.Errorf("missing chunk header %s at topic = %s, partition = %d, offset = %d", name, message.Topic, message.Partition, message.Offset)
+	}
+	n, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk header %s at topic = %s, partition = %d, offset = %d: %v", name, message.Topic, message.Partition, message.Offset, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// produceTimestampHeader carries the time a message was produced by the
+// produce subcommand, in nanoseconds since the epoch
+const produceTimestampHeader = "x-produce-timestamp"
+
+// latencySampleSize is the number of latencies kept to compute percentiles
+const latencySampleSize = 100000
+
+// latencyBuckets are the upper bounds of the histogram printed in summaries
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// latencies keeps a histogram and a reservoir sample of observed latencies
+type latencies struct {
+	mu      sync.Mutex
+	count   int64
+	buckets []int64
+	sample  []time.Duration
+	random  *rand.Rand
+}
+
+func newLatencies() *latencies {
+	return &latencies{
+		buckets: make([]int64, len(latencyBuckets)+1),
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (l *latencies) observe(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count++
+	l.buckets[sort.Search(len(latencyBuckets), func(i int) bool { return latency < latencyBuckets[i] })]++
+
+	if len(l.sample) < latencySampleSize {
+		l.sample = append(l.sample, latency)
+	} else if i := l.random.Int63n(l.count); i < latencySampleSize {
+		l.sample[i] = latency
+	}
+}
+
+// percentiles returns the requested percentiles, or nil when nothing was observed
+func (l *latencies) percentiles(ps ...float64) []time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.sample) == 0 {
+		return nil
+	}
+	sort.Slice(l.sample, func(i, j int) bool { return l.sample[i] < l.sample[j] })
+
+	result := make([]time.Duration, len(ps))
+	for i, p := range ps {
+		result[i] = l.sample[int(float64(len(l.sample)-1)*p)]
+	}
+	return result
+}
+
+// histogram returns the bucket counts formatted on a single line
+func (l *latencies) histogram() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var parts []string
+	for i, count := range l.buckets {
+		label := ">=" + latencyBuckets[len(latencyBuckets)-1].String()
+		if i < len(latencyBuckets) {
+			label = "<" + latencyBuckets[i].String()
+		}
+		parts = append(parts, fmt.Sprintf("%s: %d", label, count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// produceTimestamp returns the time the message was produced by the produce
+// subcommand, as embedded in its headers
+func produceTimestamp(message *sarama.ConsumerMessage) (time.Time, bool) {
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == produceTimestampHeader {
+			nanos, err := strconv.ParseInt(string(header.Value), 10, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return time.Unix(0, nanos), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir holds the credentials Kubernetes mounts into every pod
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// leaseTimeLayout is the MicroTime layout of the Lease timestamps
+	leaseTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// errLeaseConflict is returned when another replica updated the Lease first
+var errLeaseConflict = errors.New("lease was updated concurrently")
+
+// lease is the subset of a coordination.k8s.io/v1 Lease used for leader election
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// leaderElector elects a single leader among the replicas of a Deployment
+// through a Kubernetes Lease, like the client-go leader election. Expiry is
+// judged by the local time the Lease was last seen changing, so the clocks of
+// the replicas don't need to agree.
+type leaderElector struct {
+	client *http.Client
+	url    string
+	// tokenPath is read for every request, as projected service account
+	// tokens are rotated by the kubelet
+	tokenPath string
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+
+	observed     leaseSpec
+	observedTime time.Time
+}
+
+// newLeaderElector returns an elector for the Lease with the given name, using
+// the service account credentials of the pod to access the API server
+func newLeaderElector(name, namespace, identity string, duration time.Duration) (*leaderElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("leader election requires running in a Kubernetes pod")
+	}
+
+	if _, err := ioutil.ReadFile(serviceAccountDir + "/token"); err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	if namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	return &leaderElector{
+		client: &http.Client{
+			Timeout:   duration / 2,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		url:       "https://" + host + ":" + port,
+		tokenPath: serviceAccountDir + "/token",
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+		duration:  duration,
+	}, nil
+}
+
+// acquire blocks until this replica holds the Lease
+func (e *leaderElector) acquire() {
+	log.Printf("Waiting to acquire lease %s/%s as %s", e.namespace, e.name, e.identity)
+	for {
+		leader, err := e.tryAcquireOrRenew(context.Background())
+		if err != nil && err != errLeaseConflict {
+			log.Printf("Unable to acquire lease %s/%s: %v", e.namespace, e.name, err)
+		}
+		if leader {
+			log.Printf("Acquired lease %s/%s, starting to consume", e.namespace, e.name)
+			return
+		}
+		time.Sleep(e.duration / 3)
+	}
+}
+
+// renew keeps renewing the Lease every third of its duration, retrying
+// failures every tenth of it, and calls lost once another replica took it or
+// it couldn't be renewed within two thirds of its duration, the renew
+// deadline. A standby may take over the Lease once its duration passed, so
+// the remaining third leaves the leader the time to stop consuming first, like
+// the RenewDeadline of client-go.
+func (e *leaderElector) renew(lost func()) {
+	renewed := time.Now()
+	wait := e.duration / 3
+	for {
+		deadline := renewed.Add(e.duration * 2 / 3)
+		if until := time.Until(deadline); wait > until {
+			wait = until
+		}
+		time.Sleep(wait)
+
+		// the Lease is renewed as of the start of the request at best
+		started := time.Now()
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		leader, err := e.tryAcquireOrRenew(ctx)
+		cancel()
+		if leader && time.Now().Before(deadline) {
+			renewed = started
+			wait = e.duration / 3
+			continue
+		}
+		if err != nil {
+			log.Printf("Unable to renew lease %s/%s: %v", e.namespace, e.name, err)
+		}
+		if err == nil && !leader || !time.Now().Before(deadline) {
+			lost()
+			return
+		}
+		wait = e.duration / 10
+	}
+}
+
+// release gives up the Lease so a standby replica can take over right away
+func (e *leaderElector) release() {
+	ctx := context.Background()
+	current, err := e.get(ctx)
+	if err != nil || current == nil || current.Spec.HolderIdentity != e.identity {
+		return
+	}
+	current.Spec.HolderIdentity = ""
+	current.Spec.LeaseDurationSeconds = 1
+	if err := e.put(ctx, current); err != nil {
+		log.Printf("Unable to release lease %s/%s: %v", e.namespace, e.name, err)
+	}
+}
+
+// tryAcquireOrRenew takes the Lease when it is free or expired, or renews it
+// when held by this replica. It reports whether this replica is the leader.
+func (e *leaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now()
+	spec := leaseSpec{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int(e.duration / time.Second),
+		AcquireTime:          now.UTC().Format(leaseTimeLayout),
+		RenewTime:            now.UTC().Format(leaseTimeLayout),
+	}
+
+	current, err := e.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	if current == nil {
+		if err := e.create(ctx, spec); err != nil {
+			return false, err
+		}
+		e.observed = spec
+		e.observedTime = now
+		return true, nil
+	}
+
+	if !reflect.DeepEqual(current.Spec, e.observed) {
+		e.observed = current.Spec
+		e.observedTime = now
+	}
+
+	held := current.Spec.HolderIdentity
+	expiry := time.Duration(current.Spec.LeaseDurationSeconds) * time.Second
+	if held != "" && held != e.identity && e.observedTime.Add(expiry).After(now) {
+		return false, nil
+	}
+
+	if held == e.identity {
+		spec.AcquireTime = current.Spec.AcquireTime
+		spec.LeaseTransitions = current.Spec.LeaseTransitions
+	} else {
+		spec.LeaseTransitions = current.Spec.LeaseTransitions + 1
+	}
+	current.Spec = spec
+	if err := e.put(ctx, current); err != nil {
+		return false, err
+	}
+	e.observed = spec
+	e.observedTime = now
+	return true, nil
+}
+
+func (e *leaderElector) leaseURL() string {
+	return fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", e.url, e.namespace)
+}
+
+// get returns the Lease, or nil when it doesn't exist yet
+func (e *leaderElector) get(ctx context.Context) (*lease, error) {
+	var current lease
+	status, err := e.do(ctx, http.MethodGet, e.leaseURL()+"/"+e.name, nil, &current)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &current, nil
+}
+
+func (e *leaderElector) create(ctx context.Context, spec leaseSpec) error {
+	l := &lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   leaseMetadata{Name: e.name, Namespace: e.namespace},
+		Spec:       spec,
+	}
+	_, err := e.do(ctx, http.MethodPost, e.leaseURL(), l, nil)
+	return err
+}
+
+// put replaces the Lease, failing with errLeaseConflict when its resourceVersion is outdated
+func (e *leaderElector) put(ctx context.Context, l *lease) error {
+	_, err := e.do(ctx, http.MethodPut, e.leaseURL()+"/"+e.name, l, nil)
+	return err
+}
+
+// do sends a request to the API server, decoding the response into out when given
+func (e *leaderElector) do(ctx context.Context, method, url string, in, out interface{}) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+
+	token, err := ioutil.ReadFile(e.tokenPath)
+	if err != nil {
+		return 0, err
+	}
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := e.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, err
+	}
+	switch {
+	case response.StatusCode == http.StatusConflict:
+		return response.StatusCode, errLeaseConflict
+	case response.StatusCode >= 300:
+		return response.StatusCode, fmt.Errorf("%s %s: %s: %s", method, url, response.Status, bytes.TrimSpace(data))
+	}
+	if out != nil {
+		return response.StatusCode, json.Unmarshal(data, out)
+	}
+	return response.StatusCode, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// lokiTimeout bounds a push to Loki
+const lokiTimeout = time.Minute
+
+// lokiLabelName matches the valid names of Loki labels
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// lokiStream is a stream of a push request, the entries of a label set
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	// Values are pairs of a timestamp in nanoseconds and a line
+	Values [][2]string `json:"values"`
+}
+
+// lokiSink pushes the claimed messages to Grafana Loki as log lines, labeled
+// by the -loki-labels mapping of the message metadata, headers or elements of
+// the value. Lines are batched up to -loki-batch-bytes, and pushed at the
+// latest by the commit barrier.
+//
+// Batches Loki rejects as invalid, such as with lines older than it accepts,
+// are logged and dropped like log shippers do, as pushing them again fails
+// the same way. Other failures keep the batch for the next attempt.
+type lokiSink struct {
+	endpoint   string
+	tenant     string
+	labels     fieldMapping
+	batchBytes int
+	client     *http.Client
+
+	mu      sync.Mutex
+	streams map[string]*lokiStream
+	size    int
+}
+
+// newLokiSink returns the sink for the base URL of Loki, with optional basic
+// auth credentials as its user info
+func newLokiSink(lokiURL, labels, tenant string, batchBytes int) (*lokiSink, error) {
+	u, err := url.Parse(lokiURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -loki-url %q", lokiURL)
+	}
+	mapping, err := parseFieldMapping(labels)
+	if err != nil {
+		return nil, err
+	}
+	if len(mapping) == 0 {
+		return nil, fmt.Errorf("-loki-labels must map at least one label")
+	}
+	for _, field := range mapping {
+		if !lokiLabelName.MatchString(field.name) {
+			return nil, fmt.Errorf("invalid Loki label name %q", field.name)
+		}
+	}
+	if batchBytes <= 0 {
+		return nil, fmt.Errorf("-loki-batch-bytes must be positive")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/loki/api/v1/push"
+
+	return &lokiSink{
+		endpoint:   u.String(),
+		tenant:     tenant,
+		labels:     mapping,
+		batchBytes: batchBytes,
+		client:     &http.Client{Timeout: lokiTimeout},
+		streams:    make(map[string]*lokiStream),
+	}, nil
+}
+
+func (s *lokiSink) name() string {
+	return "loki sink " + s.endpoint
+}
+
+func (s *lokiSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	fields, err := s.labels.row(message, value)
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string, len(fields))
+	names := make([]string, 0, len(fields))
+	for name, element := range fields {
+		// Loki drops labels with empty values
+		if text := jsonText(element); text != "" {
+			labels[name] = text
+			names = append(names, name)
+		}
+	}
+	if len(labels) == 0 {
+		return fmt.Errorf("no labels for the message at topic = %s, partition = %d, offset = %d", message.Topic, message.Partition, message.Offset)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&key, "%s=%q,", name, labels[name])
+	}
+	line := string(appendValue(nil, message, value))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// push before buffering, so a write retried after a failure isn't buffered twice
+	if s.size >= s.batchBytes {
+		if err := s.push(); err != nil {
+			return err
+		}
+	}
+	stream, ok := s.streams[key.String()]
+	if !ok {
+		stream = &lokiStream{Stream: labels}
+		s.streams[key.String()] = stream
+	}
+	stream.Values = append(stream.Values, [2]string{strconv.FormatInt(message.Timestamp.UnixNano(), 10), line})
+	s.size += len(line)
+	return nil
+}
+
+// flush pushes the buffered lines, the barrier of a commit
+func (s *lokiSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.push()
+}
+
+// push pushes the buffered lines in a single request
+func (s *lokiSink) push() error {
+	if len(s.streams) == 0 {
+		return nil
+	}
+	streams := make([]*lokiStream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	body, err := json.Marshal(map[string]interface{}{"streams": streams})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", s.tenant)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		log.Printf("Loki rejected a batch of %d bytes, dropping it: %s: %s", s.size, resp.Status, strings.TrimSpace(string(data)))
+	default:
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	s.streams = make(map[string]*lokiStream)
+	s.size = 0
+	return nil
+}
+
+func (s *lokiSink) close() error {
+	return s.flush(commitPoint{})
+}
@@ -5,96 +5,1027 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/hrak/kafka-consumergroup/consumergroup"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 // Sarma configuration options
 var (
 	brokers   = flag.String("brokers", os.Getenv("KAFKA_PEERS"), "Kafka brokers to connect to, as a comma separated list")
-	version   = flag.String("version", "2.1.1", "Kafka cluster version")
+	version   = flag.String("version", autoVersion, "Kafka cluster version, or auto to negotiate it with the brokers")
 	group     = flag.String("group", "", "Kafka consumer group definition")
-	topics    = flag.String("topics", "", "Kafka topics to be consumed, as a comma seperated list")
+	topics    = flag.String("topics", "", "Kafka topics to be consumed, as a comma seperated list. Append @oldest, @newest, @<offset>, @-<n> or @-<duration> to a topic to override its starting position, which is applied once per group and recorded in the metadata of the committed offsets")
 	verbose   = flag.Bool("verbose", false, "Verbose Sarama logging")
 	certFile  = flag.String("certificate", "", "The optional certificate file for client authentication")
 	keyFile   = flag.String("key", "", "The optional key file for client authentication")
 	caFile    = flag.String("ca", "", "The optional certificate authority file for TLS client authentication")
 	verifySsl = flag.Bool("verify", false, "Optional verify ssl certificates chain")
+
+	tokenID        = flag.String("token-id", "", "Optional id of a Kafka delegation token to authenticate with over SASL/SCRAM, along with -token-hmac")
+	tokenHMAC      = flag.String("token-hmac", os.Getenv("KAFKA_TOKEN_HMAC"), "HMAC of the -token-id delegation token, defaults to the KAFKA_TOKEN_HMAC environment variable")
+	tokenFile      = flag.String("token-file", "", "Optional JSON file holding the token_id, hmac and expiry of a delegation token, re-read every -token-refresh so a renewed token applies to new connections")
+	tokenMechanism = flag.String("token-mechanism", sarama.SASLTypeSCRAMSHA512, "SASL mechanism of the delegation token: SCRAM-SHA-256 or SCRAM-SHA-512")
+	tokenRefresh   = flag.Duration("token-refresh", time.Minute, "Interval between reads of -token-file, shortened as the token approaches its expiry")
+
+	vaultAddr          = flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "Address of the Vault server of -vault-path, defaults to the VAULT_ADDR environment variable")
+	vaultToken         = flag.String("vault-token", os.Getenv("VAULT_TOKEN"), "Vault token reading -vault-path, defaults to the VAULT_TOKEN environment variable")
+	vaultPath          = flag.String("vault-path", "", "Optional path of a Vault secret holding a username and password for SASL, or a certificate, private_key and ca for TLS, e.g. secret/data/kafka")
+	vaultSASLMechanism = flag.String("vault-sasl-mechanism", sarama.SASLTypePlaintext, "SASL mechanism of the username and password of -vault-path: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512")
+	vaultRefresh       = flag.Duration("vault-refresh", 5*time.Minute, "Maximum interval between renewals or reads of -vault-path, reconnecting the consumers when the credentials changed")
+
+	confluentCloud = flag.Bool("confluent-cloud", false, "Connect to Confluent Cloud: TLS, SASL/PLAIN with -api-key and -api-secret, its Kafka version unless -version is given, and the recommended timeouts. Only -brokers needs to be given besides")
+	apiKey         = flag.String("api-key", os.Getenv("CONFLUENT_API_KEY"), "API key of -confluent-cloud, defaults to the CONFLUENT_API_KEY environment variable")
+	apiSecret      = flag.String("api-secret", os.Getenv("CONFLUENT_API_SECRET"), "API secret of -confluent-cloud, defaults to the CONFLUENT_API_SECRET environment variable")
+
+	eventHubs                 = flag.Bool("eventhubs", false, "Connect to the Kafka endpoint of Azure Event Hubs: TLS, SASL/PLAIN with -eventhubs-connection-string, -brokers derived from its endpoint unless given, and settings working around the differences of the endpoint")
+	eventHubsConnectionString = flag.String("eventhubs-connection-string", os.Getenv("EVENTHUBS_CONNECTION_STRING"), "Connection string of the Event Hubs namespace of -eventhubs, defaults to the EVENTHUBS_CONNECTION_STRING environment variable")
+
+	adminAddr      = flag.String("admin-addr", "", "Optional address to serve the admin API on, e.g. :8081")
+	adminToken     = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token required by the admin API, defaults to the ADMIN_TOKEN environment variable")
+	adminDebug     = flag.Bool("admin-debug", false, "Serve the net/http/pprof profiles under /debug/pprof/ and the expvar variables under /debug/vars of the admin API")
+	grpcHealthAddr = flag.String("grpc-health-addr", "", "Optional address to serve the grpc.health.v1 service on over cleartext HTTP/2, e.g. :8082")
+	scalerAddr     = flag.String("scaler-addr", "", "Optional address to serve the lag of the groups on /lag for the metrics-api scaler of KEDA, e.g. :8083")
+	summaryJSON    = flag.String("summary-json", "", "Optional file, stdout, stderr or fd:<n> to write a JSON summary of the run to on exit, with the exit code and why, the duration and the final state of every consumer")
+	configPath     = flag.String("config", "", "Optional JSON file defining several named consumers to run in this process")
+	jobID          = flag.String("job-id", "", "Optional id of a repeated task such as a backfill, namespacing the consumer group as <group>.<job-id> so every run of the job resumes where the previous one stopped, and the export subcommand writes to <export-dir>/<job-id>")
+	memberUserData = flag.String("member-user-data", "", "Optional user data included in the group join metadata of this member, e.g. the hostname")
+	isolationLevel = flag.String("isolation-level", "read_uncommitted", "Isolation level of the fetches: read_uncommitted, or read_committed to skip the records of aborted transactions")
+
+	duration        = flag.Duration("duration", 30*time.Second, "Duration of the bench and produce subcommands")
+	last            = flag.Int64("last", 0, "Start every claimed partition this many messages before its high water mark, unless overridden per topic in -topics. Applied once per group")
+	rewind          = flag.Duration("rewind", 0, "Start every claimed partition at the first message produced this long ago, e.g. 2h, unless overridden per topic in -topics. Applied once per group")
+	valueDecompress = flag.String("value-decompress", "none", "Decompress message values compressed by the producer: none, auto, gzip, snappy or zstd")
+	maxDecompressed = flag.Int64("value-decompress-max-bytes", 64<<20, "Maximum size of a value decompressed by -value-decompress, larger values such as decompression bombs fail to decompress")
+	outCompress     = flag.String("out-compress", "none", "Write claimed messages to stdout compressed with gzip or zstd instead of logging them")
+	topicOutputSpec = flag.String("topic-outputs", "", "Optional comma separated topic=destination pairs writing the claimed messages of topics to their own destination: stdout, stderr, fd:<n> or a file to append to, e.g. orders=stdout,audit=/var/log/audit.ndjson,events=fd:3")
+	forwardTopic    = flag.String("forward-topic", "", "Forward claimed messages to this topic instead of printing them")
+	printLocator    = flag.Bool("print-locator", false, "Print the <topic>/<partition>/<offset> locator of every message, which the fetch subcommand retrieves it by")
+	outputFormat    = flag.String("output", "log", "Output format of claimed messages: log, csv written to stdout, or pretty for colorized and indented output to read interactively")
+	utcTimes        = flag.Bool("utc", false, "Print message timestamps in UTC instead of the local time zone")
+	printMode       = flag.String("print", "all", "Parts of the messages to print: all, or metadata to omit the values and print the topic, partition, offset, key, headers, sizes and timestamp only")
+	timeFormat      = flag.String("time-format", "", "Format of the printed message timestamps: a Go layout such as 2006-01-02T15:04:05Z07:00, rfc3339, epoch, epoch-ms, or relative such as 3s ago. Defaults to a format per -output")
+	checksum        = flag.String("checksum", "none", "Print a hash of the key and value of every message and a rolling digest of its partition: none, sha256 or xxhash")
+	mock            = flag.String("mock", "", "Optional file of JSON messages in the -capture-fixtures format, directory of -capture-fixtures or generate, to feed the consumer from instead of connecting to Kafka, for offline development and tests")
+	csvColumnsSpec  = flag.String("csv-columns", "topic,partition,offset,timestamp,key,value", "Columns of the csv output, as a comma separated list of topic, partition, offset, timestamp, key, value, headers, value_size, locator, cluster and JSON paths into the value such as $.order.id")
+	cloudEvents     = flag.Bool("cloudevents", false, "Decode CloudEvents in the structured JSON and the binary content modes, printing their attributes and handing their data to the handlers, with the attributes available as ce:<attribute> in -csv-columns, routes and sink mappings")
+	debeziumMode    = flag.String("debezium", "", "Decode the Debezium change events of CDC topics, handing the row after the change to the handlers with after, where deletes are tombstones, or the changed columns with diff")
+	debeziumOps     = flag.String("debezium-ops", "", "Optional comma separated operations of the Debezium change events to process: c, u, d, r, t and m for create, update, delete, snapshot read, truncate and message")
+	jqExpression    = flag.String("jq", "", "Optional jq expression filtering and reshaping the JSON values, e.g. 'select(.user.country == \"NL\") | {id, total}'. Messages are dropped when it yields nothing, false or null, kept when it yields true, and printed or written to the sinks with its first result otherwise")
+	projectSpec     = flag.String("project", "", "Optional comma separated JSON paths such as $.order.id,$.order.total reducing the JSON values to these elements before they are printed or written to the sinks")
+)
+
+// Offset commits
+var (
+	commitInterval = flag.Duration("commit-interval", time.Second, "Interval between commits of the processed offsets")
+	commitJitter   = flag.Duration("commit-jitter", 200*time.Millisecond, "Maximum random delay added to every -commit-interval, spreading the commits of the group members")
+	commitRetries  = flag.Int("commit-retries", 3, "Number of times a failed commit is retried with an exponential backoff")
+	auditTopic     = flag.String("audit-topic", "", "Optional topic to publish the committed offset of every claimed partition to every -audit-interval")
+	auditInterval  = flag.Duration("audit-interval", time.Minute, "Interval between the records published to -audit-topic")
+)
+
+// Heartbeats of slow messages
+var (
+	heartbeatInterval = flag.Duration("heartbeat-interval", 0, "Log the messages processed for longer than this every interval, so slow handlers can be told from stuck ones. 0 disables it")
+	heartbeatTopic    = flag.String("heartbeat-topic", "", "Optional topic to publish a record of every message processed for longer than -heartbeat-interval to, every -heartbeat-interval")
+)
+
+// Processing of the claims
+var (
+	includeTombstones   = flag.Bool("include-tombstones", true, "Process tombstones, the messages with a null value that delete their key on compacted topics")
+	onlyTombstones      = flag.Bool("only-tombstones", false, "Process tombstones only, skipping all other messages")
+	claimCheckHeader    = flag.String("claim-check-header", "", "Optional header holding the http, https or file URL of the payload of a message, which is fetched and substituted before processing")
+	claimCheckDir       = flag.String("claim-check-dir", "", "Optional directory the file URLs of -claim-check-header may read payloads from. File URLs are rejected without it")
+	claimCheckMaxBytes  = flag.Int64("claim-check-max-bytes", 64<<20, "Maximum size of a claim-check payload")
+	chunkHeaders        = flag.String("chunk-headers", "", "Optional id, index and count headers of messages split into chunks by the producer, e.g. chunk-id,chunk-index,chunk-count. The chunks are reassembled before processing")
+	chunkTimeout        = flag.Duration("chunk-timeout", 10*time.Minute, "Give up on a chunked message whose chunks didn't all arrive within this time after its first one, handling it according to -on-large-message-failure")
+	chunkMaxPending     = flag.Int("chunk-max-pending", 1000, "Maximum number of incomplete chunked messages held per partition, giving up on the oldest one beyond it")
+	onLargeMsgFailure   = flag.String("on-large-message-failure", "fail", "What to do with a message whose claim check can't be resolved after the retries of its topic, or whose chunks didn't all arrive: fail exits, skip skips it and dead-letter produces it, or its chunks, to -dead-letter-topic")
+	replaySpeedSpec     = flag.String("replay-speed", "asap", "Pace of processing the messages by their timestamps, to reproduce the load pattern of the original traffic when replaying: asap, realtime, or a factor such as 2x or 0.5x")
+	churnWindow         = flag.Duration("churn-window", 10*time.Minute, "Claims changing again within this time after their last change are logged as a warning, as another member may be flapping. Rebalances are eager, every one of them revokes all claims")
+	maxMemoryMB         = flag.Int("max-memory-mb", 0, "Pause fetching on all consumers while the heap exceeds this many MiB, and resume once garbage collection brought it below 80% of it. 0 disables it")
+	maxInFlight         = flag.Int("max-in-flight", 0, "Maximum number of messages processed but not committed yet across all partitions, committing early when reached. 0 is unlimited")
+	maxConcurrentClaims = flag.Int("max-concurrent-claims", 0, "Maximum number of claims processing a message at the same time, 0 is unlimited")
+	breakerFailures     = flag.Int("breaker-failures", 0, "Open a circuit breaker after this many consecutive failures to forward a message, pausing all partitions until a probe succeeds. 0 disables it")
+	breakerCooldown     = flag.Duration("breaker-cooldown", 30*time.Second, "Time the circuit breaker stays open before probing with a single message")
+	interceptorPlugins  = flag.String("interceptors", "", "Go plugins exporting an Interceptor implementing consumergroup.Interceptor, as a comma separated list, invoked in order for every message before it is printed or forwarded")
+	debugTransactions   = flag.Bool("debug-transactions", false, "Fetch the records skipped at every offset gap and log how many were transaction markers or aborted records")
+	debugFetch          = flag.Bool("debug-fetch", false, "Periodically fetch every claimed partition at its processed offset and log the broker, fetch size, records per batch, log start offset, high water mark and preferred read replica, along with the fetch statistics of the consumer per broker")
+	untilOffset         = flag.Int64("until-offset", -1, "Stop consuming every partition before this offset, for bounded replays. -1 disables it")
+	untilTimeSpec       = flag.String("until-timestamp", "", "Optional RFC3339 time to stop consuming every partition at, before the first message produced at or after it")
+	untilIdle           = flag.Bool("until-idle", false, "Keep running once every claimed partition reached -until-offset or -until-timestamp, instead of exiting")
+	maxMessageAge       = flag.Duration("max-message-age", 0, "Messages with a timestamp older than this are counted as stale and handled according to -on-stale-message. 0 disables it")
+	onStaleMessage      = flag.String("on-stale-message", "count", "What to do with messages older than -max-message-age: count them only, skip them or dead-letter them to -dead-letter-topic")
+	maxHandleBytes      = flag.Int("max-handle-bytes", 0, "Messages with a decompressed value larger than this many bytes are handled according to -on-oversized-message. 0 disables it")
+	onOversizedMessage  = flag.String("on-oversized-message", "truncate", "What to do with messages larger than -max-handle-bytes: truncate their values, skip them or dead-letter them to -dead-letter-topic")
+	maxPrintBytes       = flag.Int("max-print-bytes", 0, "Cut printed values after this many bytes, noting how many bytes were left out. 0 is unlimited")
+	outbox              = flag.Bool("outbox", false, "Consume transactional outbox topics keyed by the aggregate id: skip events whose -outbox-id-header was processed already, process the events of an aggregate one at a time, and use the event ids as the idempotency keys of the sinks")
+	outboxIDHeader      = flag.String("outbox-id-header", "id", "Header holding the event id of outbox events")
+	outboxWindow        = flag.Int("outbox-window", 100000, "Number of the most recently processed outbox event ids remembered to skip duplicates")
+	deadLetterTopic     = flag.String("dead-letter-topic", "", "Topic the stale, oversized and failed large messages are produced to under -on-stale-message, -on-oversized-message or -on-large-message-failure dead-letter")
+	onOffsetOutOfRange  = flag.String("on-offset-out-of-range", "newest", "What to do when a committed offset was removed by retention: reset to the oldest or newest offset, or fail")
+	onTopicRecreated    = flag.String("on-topic-recreated", "oldest", "What to do when a committed offset is past the end of its partition because the topic was recreated: reset to the oldest or newest offset, or halt")
+	strictOffsets       = flag.Bool("strict-offsets", false, "Exit without marking the message when an offset gap or repeat is detected on a partition")
+	pauseBacklog        = flag.Int("pause-backlog", 0, "Pause fetching a partition while this many of its messages are buffered, and resume once half of them are processed. 0 disables it")
+	fairProgress        = flag.Duration("fair-progress", 0, "Pause the claimed partitions whose processed messages are more than this ahead of the oldest processed message of a lagging partition, until they are within half of it, so all partitions progress at about the same event time. 0 disables it")
+	topicWeights        = flag.String("topic-weights", "", "Share of the -max-concurrent-claims slots of each topic when claims wait for one, as a comma separated list of topic=weight pairs. Topics default to a weight of 1")
+
+	// Parsed -until-timestamp flag
+	untilTime time.Time
+	// Parsed -replay-speed flag, 0 for asap
+	replaySpeed float64
+)
+
+// Options of the produce subcommand
+var (
+	produceRate    = flag.Float64("rate", 0, "Messages per second to produce, 0 produces as fast as possible")
+	produceSize    = flag.Int("size", 100, "Size in bytes of the random values to produce")
+	produceKeys    = flag.Int("keys", 0, "Number of distinct keys to produce, 0 produces messages without key")
+	produceHeaders = flag.String("headers", "", "Headers to add to every produced message, as a comma separated list of key=value pairs")
+)
+
+// Options of the export subcommand
+var (
+	exportDir      = flag.String("export-dir", ".", "Directory the export subcommand writes its NDJSON and resume files to")
+	exportFromSpec = flag.String("from", "", "Optional RFC3339 time to start the export, diff or history at, instead of the oldest offset or the position given in -topics")
+	exportToSpec   = flag.String("to", "", "Optional RFC3339 time to end the export, diff or history at, instead of the high water mark at the start")
+
+	exportFrom time.Time
+	exportTo   time.Time
+)
+
+// Options of the fetch subcommand
+var (
+	fetchTopic     = flag.String("topic", "", "Topic of the message to fetch, instead of a locator")
+	fetchPartition = flag.Int("partition", -1, "Partition of the message to fetch, instead of a locator")
+	fetchOffset    = flag.Int64("offset", -1, "Offset of the message to fetch, instead of a locator")
+)
+
+// Options of the history subcommand
+var (
+	historyKey = flag.String("message-key", "", "Key of the messages the history subcommand prints, instead of the key given after the flags")
+)
+
+// Options of the diff subcommand
+var (
+	diffBrokers = flag.String("diff-brokers", "", "Brokers of the cluster to compare the topics with, defaults to -brokers")
+	diffTopics  = flag.String("diff-topics", "", "Topics to compare the topics with, as a comma separated list, defaults to -topics")
 )
 
+// Metrics
+var (
+	statsdAddr     = flag.String("statsd-addr", "", "Optional statsd or dogstatsd address to flush the Sarama and consumer metrics to, e.g. localhost:8125")
+	statsdPrefix   = flag.String("statsd-prefix", "kafka_consumergroup.", "Prefix of the metric names sent to -statsd-addr")
+	statsdTags     = flag.String("statsd-tags", "", "Tags added to every metric sent to -statsd-addr, as a comma separated list of dogstatsd tags such as env:prod")
+	statsdInterval = flag.Duration("statsd-interval", 10*time.Second, "Interval between flushes to -statsd-addr")
+)
+
+// Fixture capture
+var (
+	captureFixtures = flag.String("capture-fixtures", "", "Optional directory to write a sample of the consumed messages to as test fixtures, one file per message")
+	captureFormat   = flag.String("capture-format", "json", "Format of the captured fixtures: json, or go for a Go file declaring a *sarama.ConsumerMessage")
+	capturePackage  = flag.String("capture-package", "fixtures", "Package of the Go fixtures under -capture-format go")
+	captureSample   = flag.Float64("capture-sample", 0.01, "Share of the consumed messages captured to -capture-fixtures, between 0 and 1")
+	captureMax      = flag.Int64("capture-max", 100, "Maximum number of messages captured to -capture-fixtures, 0 is unlimited")
+)
+
+// Correlation timelines
+var (
+	correlateHeader  = flag.String("correlate", "", "Optional correlation id header to group the printed messages of every topic by, printing the messages of a business transaction together as a timeline once none arrived for -correlate-timeout")
+	correlateTimeout = flag.Duration("correlate-timeout", 30*time.Second, "Time without messages after which a -correlate timeline is complete")
+	correlateMax     = flag.Int("correlate-max", 10000, "Maximum number of open -correlate timelines, the least recently updated timeline is completed beyond it")
+	correlateOut     = flag.String("correlate-out", "", "Optional file, stdout, stderr or fd:<n> to export the -correlate timelines to as JSON lines instead of printing them")
+)
+
+// Ordering by timestamp
+var (
+	mergeWindow = flag.Duration("merge-window", 0, "Print the messages of all claimed partitions in the order of their timestamps, holding every message until a message this much newer arrived or for this long. 0 prints them as they are processed")
+	mergeMax    = flag.Int("merge-max", 10000, "Maximum number of messages held by -merge-window, the oldest is printed beyond it")
+)
+
+// Event time
+var (
+	trackWatermarks = flag.Bool("watermarks", false, "Track the event-time watermark of every topic, the oldest of the newest timestamps of its claimed partitions, as the watermark-for-topic-<topic> and watermark-delay-ms-for-topic-<topic> metrics")
+	allowedLateness = flag.Duration("allowed-lateness", 0, "Messages older than the -watermarks watermark of their topic by more than this are counted by the late-messages metrics")
+)
+
+// Shadow mode
+var (
+	shadow               = flag.Bool("shadow", false, "Consume as the group with a -shadow suffix, forwarding to topics with a -shadow suffix, and report the processing against -shadow-max-latency and -shadow-max-failure-rate, to test new handler logic against production traffic")
+	shadowMaxLatency     = flag.Duration("shadow-max-latency", 0, "Expected maximum p99 latency of processing a message under -shadow, 0 disables the expectation")
+	shadowMaxFailureRate = flag.Float64("shadow-max-failure-rate", 0, "Expected maximum share of the messages under -shadow that fail to be processed, between 0 and 1")
+	shadowReportInterval = flag.Duration("shadow-report-interval", time.Minute, "Interval between the reports logged under -shadow")
+)
+
+// Lag alerting
+var (
+	lagSLOSpec      = flag.String("lag-slo", "", "Optional maximum lag of the partitions claimed by this instance per topic, as a comma separated list of topic=lag pairs. * applies to all other topics")
+	lagSLOFor       = flag.Duration("lag-slo-for", 5*time.Minute, "Time the lag of a topic must exceed -lag-slo before the SLO is breached, which is logged, posted to -lag-alert-webhook and reported as not ready")
+	lagAlertWebhook = flag.String("lag-alert-webhook", "", "Optional URL the breached and recovered lag SLOs are posted to as JSON")
+	readyMaxLag     = flag.Int64("ready-max-lag", 0, "Optional maximum lag of every topic claimed by this instance, in messages, before it first reports ready, 0 disables the requirement")
+	readyMaxLagTime = flag.Duration("ready-max-lag-time", 0, "Optional maximum age of the last processed message of every partition with lag before this instance first reports ready, 0 disables the requirement")
+
+	// Parsed -lag-slo flag
+	lagSLO map[string]int64
+)
+
+// Partition count changes
+var (
+	partitionCheckInterval = flag.Duration("partition-check-interval", time.Minute, "Interval at which the metadata of the topics is refreshed to report changes of their number of partitions. 0 disables it")
+	partitionChangeWebhook = flag.String("partition-change-webhook", "", "Optional URL the changes of the number of partitions of the topics are posted to as JSON")
+)
+
+// Partition assignment
+var (
+	pinningFile  = flag.String("pinning-file", "", "Optional JSON file of rules pinning partitions to the members carrying a label, e.g. [{\"topic\": \"orders\", \"partitions\": [0], \"label\": \"db-primary\"}], applied when this member leads the group. Rebalances are eager, cooperative-sticky isn't supported by Sarama v1.38.1")
+	memberLabels = flag.String("member-labels", "", "Optional comma separated labels of this member matched by the -pinning-file rules, e.g. db-primary,zone-a")
+	weightsSpec  = flag.String("partition-weights", "", "Optional weights of the partitions, as a comma separated list of topic=weight and topic/partition=weight pairs, and lag to weigh the other partitions by their lag. Distributes the partitions by weight when this member leads the group. Rebalances are eager, cooperative-sticky isn't supported by Sarama v1.38.1")
+
+	// Strategy of -pinning-file
+	pinning *pinningStrategy
+	// Parsed -partition-weights flag
+	assignmentWeights *partitionWeights
+)
+
+// Sinks
+var (
+	parquetDir          = flag.String("parquet-dir", "", "Optional local directory or s3://bucket/prefix to write the claimed messages to as Parquet files, partitioned by topic, date and hour")
+	parquetRowGroupSize = flag.Int("parquet-row-group-size", 100000, "Number of rows per row group of the Parquet files")
+	parquetCompression  = flag.String("parquet-compression", "snappy", "Compression of the Parquet pages: none, snappy, gzip or zstd")
+	schemaRegistryURL   = flag.String("schema-registry", "", "Optional URL of a schema registry, the latest Avro or JSON Schema of the <topic>-value subject defines the columns of the Parquet files")
+	s3Endpoint          = flag.String("s3-endpoint", "", "Optional S3 compatible endpoint such as MinIO for s3:// destinations, addressed path-style")
+	s3Region            = flag.String("s3-region", "", "Region of the s3:// destinations, defaults to the AWS_REGION environment variable")
+
+	bigQueryTable       = flag.String("bigquery-table", "", "Optional BigQuery table to stream the claimed messages into, as project.dataset.table. {topic} is replaced by the topic")
+	bigQueryColumns     = flag.String("bigquery-columns", "", "Optional columns of the BigQuery rows, as a comma separated list of column=source pairs with sources topic, partition, offset, timestamp, key, value, header:<name> or JSON paths into the value such as $.order.id. Defaults to the fields of JSON object values")
+	bigQueryBatchSize   = flag.Int("bigquery-batch-size", 500, "Maximum number of rows per BigQuery insert, rows are inserted once this many are buffered or on the next commit")
+	bigQuerySkipInvalid = flag.Bool("bigquery-skip-invalid", false, "Log and skip the rows BigQuery rejects instead of failing their batch and the commit")
+
+	redisURL       = flag.String("redis-url", "", "Optional redis:// or rediss:// URL of a Redis server to apply the claimed messages to, such as redis://:password@localhost:6379/0. The password defaults to the REDIS_PASSWORD environment variable")
+	redisMode      = flag.String("redis-mode", "set", "How messages are applied to Redis: set the key to the value and delete it for tombstones, invalidate (delete) the key, or publish the value")
+	redisKeyPrefix = flag.String("redis-key-prefix", "", "Prefix of the Redis keys, prepended to the message keys")
+	redisChannel   = flag.String("redis-channel", "{topic}", "Channel the values are published to with -redis-mode publish, {topic}, {partition} and {key} are replaced by those of the message")
+	redisTTL       = flag.Duration("redis-ttl", 0, "Optional expiry of the keys set with -redis-mode set")
+
+	natsURL      = flag.String("nats-url", "", "Optional nats:// or tls:// URL of a NATS server to republish the claimed messages to, with optional user:password or token credentials")
+	natsSubject  = flag.String("nats-subject", "kafka.{topic}", "Subject the messages are published to on NATS, {topic}, {partition} and {key} are replaced by those of the message")
+	mqttURL      = flag.String("mqtt-url", "", "Optional mqtt:// or mqtts:// URL of an MQTT broker to republish the claimed messages to, with optional user:password credentials")
+	mqttTopic    = flag.String("mqtt-topic", "kafka/{topic}", "Topic the messages are published to on MQTT, {topic}, {partition} and {key} are replaced by those of the message")
+	mqttQoS      = flag.Int("mqtt-qos", 1, "Quality of service of the MQTT messages, 0 or 1")
+	mqttRetain   = flag.Bool("mqtt-retain", false, "Publish the MQTT messages as retained, so subscribers receive the last message of every topic on subscribing")
+	mqttClientID = flag.String("mqtt-client-id", "", "Optional client identifier of the MQTT connection, assigned by the broker by default")
+
+	sqsQueueURL = flag.String("sqs-queue-url", "", "Optional URL of an SQS queue to forward the claimed messages to, with the headers as message attributes")
+	snsTopicARN = flag.String("sns-topic-arn", "", "Optional ARN of an SNS topic to publish the claimed messages to, with the headers as message attributes")
+	snsEndpoint = flag.String("sns-endpoint", "", "Optional SNS compatible endpoint such as LocalStack for -sns-topic-arn")
+
+	syslogAddr     = flag.String("syslog-addr", "", "Optional udp://, tcp:// or tls:// address of a syslog server to write the claimed messages to in the RFC 5424 format")
+	syslogFacility = flag.String("syslog-facility", "local0", "Facility of the syslog messages, such as user or local0 to local7")
+	syslogSeverity = flag.String("syslog-severity", "info", "Severity of the syslog and journal messages: emerg, alert, crit, err, warning, notice, info or debug")
+	syslogApp      = flag.String("syslog-app", "kafka-consumergroup", "Application name of the syslog messages and identifier of the journal messages")
+	journald       = flag.Bool("journald", false, "Write the claimed messages to the systemd journal, with the message metadata and headers as fields")
+
+	lokiURL        = flag.String("loki-url", "", "Optional base URL of Grafana Loki to push the claimed messages to as log lines, with optional basic auth credentials")
+	lokiLabels     = flag.String("loki-labels", "topic=topic", "Labels of the Loki streams, as a comma separated list of label=source pairs with sources topic, partition, key, header:<name> or JSON paths into the value such as $.level")
+	lokiTenant     = flag.String("loki-tenant", "", "Optional tenant of a multi-tenant Loki, sent as X-Scope-OrgID")
+	lokiBatchBytes = flag.Int("loki-batch-bytes", 1024*1024, "Size of the lines buffered before pushing them to Loki, they are pushed on every commit as well")
+	fluentdAddr    = flag.String("fluentd-addr", "", "Optional tcp:// or tls:// address of a Fluentd or Fluent Bit forward input to ship the claimed messages to")
+	fluentdTag     = flag.String("fluentd-tag", "kafka.{topic}", "Tag of the Fluentd events, {topic}, {partition} and {key} are replaced by those of the message")
+	fluentdRecord  = flag.String("fluentd-record", "", "Optional record of the Fluentd events, as a comma separated list of field=source pairs like -bigquery-columns. Defaults to the value as message with the metadata and headers")
+
+	clickHouseURL       = flag.String("clickhouse-url", "", "Optional URL of the HTTP interface of ClickHouse to insert the claimed messages into, with optional user:password credentials")
+	clickHouseTable     = flag.String("clickhouse-table", "default.{topic}", "ClickHouse table the rows of a topic are inserted into, {topic} is replaced by the topic")
+	clickHouseTables    = flag.String("clickhouse-tables", "", "Optional ClickHouse tables of topics overriding -clickhouse-table, as a comma separated list of topic=table pairs")
+	clickHouseColumns   = flag.String("clickhouse-columns", "", "Optional columns of the ClickHouse rows, as a comma separated list of column=source pairs like -bigquery-columns. Defaults to the fields of JSON object values")
+	clickHouseBatchSize = flag.Int("clickhouse-batch-size", 10000, "Maximum number of rows per ClickHouse insert, rows are inserted once this many are buffered or on the next commit")
+
+	pubSubTopic = flag.String("pubsub-topic", "", "Optional Google Pub/Sub topic to republish the claimed messages to, as projects/<project>/topics/<topic>. {topic} is replaced by the Kafka topic")
+
+	metricFields = flag.String("metric-fields", "", "Metrics extracted from the claimed messages for -influx-url and -graphite-addr, as a comma separated list of metric=source pairs with numeric sources such as $.cpu.load or partition")
+	metricTags   = flag.String("metric-tags", "", "Optional tags of the extracted metrics, as a comma separated list of tag=source pairs such as host=header:host,region=$.region")
+	metricName   = flag.String("metric-name", "{topic}", "Measurement of the extracted metrics in InfluxDB, or prefix of their Graphite series. {topic}, {partition} and {key} are replaced by those of the message")
+	influxURL    = flag.String("influx-url", "", "Optional base URL of InfluxDB to write the -metric-fields to, authorized with the INFLUX_TOKEN environment variable")
+	influxOrg    = flag.String("influx-org", "", "Organization of the -influx-bucket")
+	influxBucket = flag.String("influx-bucket", "", "Bucket the metrics are written to in InfluxDB, or database/retention-policy for InfluxDB 1.8")
+	graphiteAddr = flag.String("graphite-addr", "", "Optional host:port of the plaintext protocol of Graphite to write the -metric-fields to")
+)
+
+// Kubernetes leader election
+var (
+	leaseName      = flag.String("lease", "", "Optional name of a Kubernetes Lease, only the replica holding it consumes while the others stand by")
+	leaseNamespace = flag.String("lease-namespace", "", "Namespace of the -lease, defaults to the namespace of the pod")
+	leaseIdentity  = flag.String("lease-identity", os.Getenv("HOSTNAME"), "Identity of this replica in the -lease, defaults to the HOSTNAME environment variable")
+	leaseDuration  = flag.Duration("lease-duration", 15*time.Second, "Time after which a -lease that isn't renewed can be taken over by a standby replica")
+)
+
+// Subcommands, given as the first argument before the flags
+var commands = map[string]string{
+	"bench":   "consume as fast as possible without printing and report the throughput",
+	"produce": "produce random messages to the topics to generate traffic",
+	"export":  "dump the topics to NDJSON files which can be resumed when interrupted",
+	"diff":    "compare the topics with -diff-topics on -diff-brokers by key and content hash",
+	"fetch":   "print the single message at the <topic>/<partition>/<offset> locator given after the flags, or at -topic, -partition and -offset",
+	"history": "print every message of the topics with the key given after the flags or -message-key within -from and -to, in the order of their timestamps",
+}
+
+// groupless are the subcommands that don't join the consumer group
+var groupless = map[string]bool{
+	"produce": true,
+	"export":  true,
+	"diff":    true,
+	"fetch":   true,
+	"history": true,
+}
+
+// Subcommand to run, empty when consuming normally
+var command string
+
+// Consumers to run, from either the -config file or the command line flags
+var consumers []consumerConfig
+
+// Running consumers by name, shared with the admin API
+var (
+	runningMu sync.RWMutex
+	running   = make(map[string]*Consumer)
+)
+
+// saramaOutput receives the Sarama log, which can be toggled through the admin API
+var saramaOutput = &toggleWriter{out: os.Stdout}
+
+// consumerRetryBackoff is the time to wait before rejoining the group after a failed session
+const consumerRetryBackoff = time.Second
+
 func init() {
+	defer exitOnConfigError()
+	flag.Usage = usage
+	if len(os.Args) > 1 {
+		if _, ok := commands[os.Args[1]]; ok {
+			command = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
 	flag.Parse()
 
-	if len(*brokers) == 0 {
-		panic("no Kafka brokers defined, please set the -brokers flag or the KAFKA_PEERS environment variable")
+	if command == "fetch" {
+		if flag.NArg() > 0 {
+			var err error
+			if fetchLocator, err = parseLocator(flag.Arg(0)); err != nil {
+				panic(err)
+			}
+		} else {
+			if *fetchTopic == "" || *fetchPartition < 0 || *fetchOffset < 0 {
+				panic("the fetch subcommand requires a locator or -topic, -partition and -offset")
+			}
+			fetchLocator = locator{topic: *fetchTopic, partition: int32(*fetchPartition), offset: *fetchOffset}
+		}
+		if *topics == "" {
+			*topics = fetchLocator.topic
+		}
+	}
+
+	if *confluentCloud {
+		if err := checkConfluentCloud(); err != nil {
+			panic(err)
+		}
+	}
+	if *eventHubs {
+		if err := checkEventHubs(); err != nil {
+			panic(err)
+		}
+	}
+
+	if *configPath != "" {
+		file, err := loadConfig(*configPath)
+		if err != nil {
+			panic(err)
+		}
+		consumers = file.Consumers
+		switch file.LogLevel {
+		case "debug":
+			*verbose = true
+		case "info":
+			*verbose = false
+		}
+	} else {
+		if len(*brokers) == 0 && *mock == "" {
+			panic("no Kafka brokers defined, please set the -brokers flag or the KAFKA_PEERS environment variable")
+		}
+
+		if len(*group) == 0 && !groupless[command] && *mock == "" {
+			panic("no Kafka consumer group defined, please set the -group flag")
+		}
+
+		if len(*topics) == 0 {
+			panic("no topics defined, please set the -topics flag")
+		}
+
+		consumers = []consumerConfig{flagConsumerConfig()}
+	}
+
+	if *last < 0 {
+		panic("-last must not be negative")
+	}
+
+	if *auditInterval <= 0 {
+		panic("-audit-interval must be positive")
+	}
+
+	if *fairProgress < 0 {
+		panic("-fair-progress must not be negative")
+	}
+
+	if *heartbeatInterval < 0 {
+		panic("-heartbeat-interval must not be negative")
+	}
+	if *heartbeatTopic != "" && *heartbeatInterval == 0 {
+		panic("-heartbeat-topic requires -heartbeat-interval")
+	}
+
+	if *commitInterval <= 0 || *commitJitter < 0 || *commitRetries < 0 {
+		panic("-commit-interval must be positive, -commit-jitter and -commit-retries must not be negative")
+	}
+
+	if *rewind < 0 {
+		panic("-rewind must not be negative")
+	}
+
+	if *last > 0 && *rewind > 0 {
+		panic("-last and -rewind can't be combined")
+	}
+
+	if command != "" && len(consumers) > 1 {
+		panic("the " + command + " subcommand runs a single consumer, please select one with the flags instead of -config")
+	}
+	if *mock != "" && (command != "" || len(consumers) > 1) {
+		panic("-mock runs a single consumer without a subcommand, please select one with the flags instead of -config")
+	}
+
+	if *produceRate < 0 || *produceSize < 0 || *produceKeys < 0 {
+		panic("-rate, -size and -keys must not be negative")
+	}
+	if _, err := parseHeaders(*produceHeaders); err != nil {
+		panic(err)
+	}
+
+	if *exportFromSpec != "" {
+		var err error
+		if exportFrom, err = time.Parse(time.RFC3339, *exportFromSpec); err != nil {
+			panic(fmt.Sprintf("invalid -from time, expected RFC3339: %v", err))
+		}
+	}
+	if *exportToSpec != "" {
+		var err error
+		if exportTo, err = time.Parse(time.RFC3339, *exportToSpec); err != nil {
+			panic(fmt.Sprintf("invalid -to time, expected RFC3339: %v", err))
+		}
+	}
+
+	if *untilTimeSpec != "" {
+		var err error
+		if untilTime, err = time.Parse(time.RFC3339, *untilTimeSpec); err != nil {
+			panic(fmt.Sprintf("invalid -until-timestamp, expected RFC3339: %v", err))
+		}
+	}
+
+	if *leaseName != "" && (*leaseIdentity == "" || *leaseDuration < 3*time.Second) {
+		panic("-lease requires a -lease-identity and a -lease-duration of at least 3s")
+	}
+
+	switch *onTopicRecreated {
+	case "oldest", "newest", "halt":
+	default:
+		panic("-on-topic-recreated must be oldest, newest or halt")
+	}
+	var err error
+	if replaySpeed, err = parseReplaySpeed(*replaySpeedSpec); err != nil {
+		panic(err)
+	}
+
+	if *onlyTombstones && !*includeTombstones {
+		panic("-only-tombstones can't be combined with -include-tombstones=false")
+	}
+
+	if *chunkHeaders != "" && len(strings.Split(*chunkHeaders, ",")) != 3 {
+		panic("-chunk-headers must name the id, index and count headers")
+	}
+	if *claimCheckMaxBytes <= 0 || *chunkTimeout <= 0 || *chunkMaxPending <= 0 {
+		panic("-claim-check-max-bytes, -chunk-timeout and -chunk-max-pending must be positive")
+	}
+	switch *onLargeMsgFailure {
+	case "fail", "skip":
+	case "dead-letter":
+		if *deadLetterTopic == "" {
+			panic("-on-large-message-failure dead-letter requires a -dead-letter-topic")
+		}
+	default:
+		panic("-on-large-message-failure must be fail, skip or dead-letter")
 	}
 
-	if len(*group) == 0 {
-		panic("no Kafka consumer group defined, please set the -group flag")
+	switch *onStaleMessage {
+	case "count", "skip":
+	case "dead-letter":
+		if *deadLetterTopic == "" {
+			panic("-on-stale-message dead-letter requires a -dead-letter-topic")
+		}
+	default:
+		panic("-on-stale-message must be count, skip or dead-letter")
+	}
+	switch *onOversizedMessage {
+	case "truncate", "skip":
+	case "dead-letter":
+		if *deadLetterTopic == "" {
+			panic("-on-oversized-message dead-letter requires a -dead-letter-topic")
+		}
+	default:
+		panic("-on-oversized-message must be truncate, skip or dead-letter")
+	}
+	if *outbox && (*outboxIDHeader == "" || *outboxWindow <= 0) {
+		panic("-outbox requires an -outbox-id-header and a positive -outbox-window")
+	}
+	if *maxHandleBytes < 0 || *maxPrintBytes < 0 {
+		panic("-max-handle-bytes and -max-print-bytes must not be negative")
+	}
+	switch *onOffsetOutOfRange {
+	case "oldest", "newest", "fail":
+	default:
+		panic("-on-offset-out-of-range must be oldest, newest or fail")
+	}
+
+	if *lagSLOSpec != "" {
+		var err error
+		if lagSLO, err = parseLagSLO(*lagSLOSpec); err != nil {
+			panic(err)
+		}
+		if *lagSLOFor < 0 {
+			panic("-lag-slo-for must not be negative")
+		}
+	}
+	if *partitionCheckInterval < 0 {
+		panic("-partition-check-interval must not be negative")
+	}
+	if *partitionChangeWebhook != "" && *partitionCheckInterval == 0 {
+		panic("-partition-change-webhook requires -partition-check-interval")
+	}
+	if *readyMaxLag < 0 || *readyMaxLagTime < 0 {
+		panic("-ready-max-lag and -ready-max-lag-time must not be negative")
+	}
+
+	if *pinningFile != "" {
+		if pinning, err = newPinningStrategy(*pinningFile); err != nil {
+			panic(err)
+		}
+	}
+	if *weightsSpec != "" {
+		if pinning != nil {
+			panic("-partition-weights can't be combined with -pinning-file")
+		}
+		if assignmentWeights, err = parsePartitionWeights(*weightsSpec); err != nil {
+			panic(err)
+		}
+	}
+
+	if *shadow && (*shadowReportInterval <= 0 || *shadowMaxLatency < 0 || *shadowMaxFailureRate < 0 || *shadowMaxFailureRate > 1) {
+		panic("-shadow-report-interval must be positive, -shadow-max-latency must not be negative and -shadow-max-failure-rate must be between 0 and 1")
+	}
+
+	if *captureFixtures != "" {
+		if *captureFormat != "json" && *captureFormat != "go" {
+			panic("-capture-format must be json or go")
+		}
+		if *captureSample <= 0 || *captureSample > 1 || *captureMax < 0 {
+			panic("-capture-sample must be between 0 and 1 and -capture-max must not be negative")
+		}
+	}
+
+	if *correlateHeader != "" && (*correlateTimeout <= 0 || *correlateMax <= 0) {
+		panic("-correlate-timeout and -correlate-max must be positive")
+	}
+	if *correlateOut != "" && *correlateHeader == "" {
+		panic("-correlate-out requires -correlate")
+	}
+
+	if *allowedLateness < 0 {
+		panic("-allowed-lateness must not be negative")
+	}
+	if *allowedLateness > 0 && !*trackWatermarks {
+		panic("-allowed-lateness requires -watermarks")
+	}
+
+	if *mergeWindow < 0 || *mergeMax <= 0 {
+		panic("-merge-window must not be negative and -merge-max must be positive")
+	}
+
+	if *tokenID != "" || *tokenFile != "" {
+		if tokens, err = newDelegationToken(*tokenID, *tokenHMAC, *tokenFile); err != nil {
+			panic(err)
+		}
+		if _, err := scramHash(sarama.SASLMechanism(*tokenMechanism)); err != nil {
+			panic(err)
+		}
+		if *tokenRefresh <= 0 {
+			panic("-token-refresh must be positive")
+		}
 	}
 
-	if len(*topics) == 0 {
-		panic("no topics defined, please set the -topics flag")
+	if *vaultPath != "" {
+		switch *vaultSASLMechanism {
+		case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		default:
+			panic("-vault-sasl-mechanism must be PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512")
+		}
+		if tokens != nil {
+			panic("-vault-path can't be combined with a delegation token")
+		}
+		if *vaultRefresh <= 0 {
+			panic("-vault-refresh must be positive")
+		}
+		if vault, err = newVaultSecret(*vaultAddr, *vaultToken, *vaultPath); err != nil {
+			panic(err)
+		}
+	}
+
+	if *statsdAddr != "" && *statsdInterval <= 0 {
+		panic("-statsd-interval must be positive")
+	}
+
+	if command == "history" {
+		if flag.NArg() > 0 {
+			*historyKey = flag.Arg(0)
+		}
+		if *historyKey == "" {
+			panic("the history subcommand requires a key or -message-key")
+		}
+	}
+
+	if command == "diff" && *diffBrokers == "" && *diffTopics == "" {
+		panic("the diff subcommand requires -diff-brokers, -diff-topics or both")
+	}
+
+	if *adminDebug && *adminAddr == "" {
+		panic("-admin-debug requires -admin-addr")
+	}
+	if *adminAddr != "" && *adminToken == "" {
+		panic("the admin API requires a token, please set the -admin-token flag or the ADMIN_TOKEN environment variable")
+	}
+
+	for i := range consumers {
+		if err := consumers[i].validate(); err != nil {
+			panic(err)
+		}
+	}
+
+	if !validValueDecompress(*valueDecompress) {
+		panic("invalid -value-decompress, expected one of none, auto, gzip, snappy or zstd")
+	}
+	if *maxDecompressed <= 0 {
+		panic("-value-decompress-max-bytes must be positive")
+	}
+
+	if !validOutCompress(*outCompress) {
+		panic("invalid -out-compress, expected one of none, gzip or zstd")
+	}
+
+	if *interceptorPlugins != "" {
+		var err error
+		if interceptors, err = loadInterceptors(*interceptorPlugins); err != nil {
+			panic(err)
+		}
+	}
+
+	if !validChecksum(*checksum) {
+		panic("invalid -checksum, expected one of none, sha256 or xxhash")
+	}
+
+	switch *debeziumMode {
+	case "", "after", "diff":
+	default:
+		panic("invalid -debezium, expected after or diff")
+	}
+	if *debeziumOps != "" {
+		if *debeziumMode == "" {
+			panic("-debezium-ops requires -debezium")
+		}
+		var err error
+		if debeziumOpFilter, err = parseDebeziumOps(*debeziumOps); err != nil {
+			panic(err)
+		}
+	}
+
+	if *jqExpression != "" {
+		var err error
+		if jqFilter, err = compileJQ(*jqExpression); err != nil {
+			panic(err)
+		}
+	}
+
+	if *projectSpec != "" {
+		var err error
+		if valueProjection, err = parseProjection(*projectSpec); err != nil {
+			panic(err)
+		}
+	}
+
+	if *printMode != "all" && *printMode != "metadata" {
+		panic("invalid -print, expected all or metadata")
+	}
+
+	switch *outputFormat {
+	case "log":
+	case "csv":
+		var err error
+		csvColumns, err = parseCSVColumns(*csvColumnsSpec)
+		if err != nil {
+			panic(err)
+		}
+	case "pretty":
+		prettyColors = os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+	default:
+		panic("invalid -output, expected log, csv or pretty")
+	}
+}
+
+// openMessageOutput opens the -out-compress output and the -topic-outputs
+// destinations, and writes the header of the csv output to them
+func openMessageOutput() {
+	var err error
+	messageOutput, err = openOutput(*outCompress, os.Stdout)
+	if err != nil {
+		fatal(err)
+	}
+	if *outputFormat != "log" && messageOutput == nil {
+		messageOutput = &lockedWriter{w: outputFile(os.Stdout)}
+	}
+	outputs := []io.WriteCloser{messageOutput}
+	if *topicOutputSpec != "" {
+		var opened []io.WriteCloser
+		if topicOutputs, opened, err = openTopicOutputs(*topicOutputSpec, *outCompress); err != nil {
+			fatal(err)
+		}
+		outputs = append(outputs, opened...)
+	}
+	if *outputFormat == "csv" {
+		for _, w := range outputs {
+			if err := writeCSVHeader(w, csvColumns); err != nil {
+				fatal(err)
+			}
+		}
+	}
+}
+
+// closeMessageOutput flushes and closes the outputs of openMessageOutput
+func closeMessageOutput() error {
+	err := closeTopicOutputs()
+	if messageOutput != nil {
+		if cerr := messageOutput.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-10s %s\n", name, commands[name])
 	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nWithout a command the topics are consumed and every message is logged.\n\nFlags:\n")
+	flag.PrintDefaults()
 }
 
 func main() {
 	log.Println("Starting Sarama consumer")
 
-	if *verbose {
-		sarama.Logger = log.New(os.Stdout, "[sarama] ", log.LstdFlags)
+	saramaOutput.set(*verbose)
+	sarama.Logger = log.New(saramaOutput, "[sarama] ", log.LstdFlags)
+
+	if tokens != nil && tokens.path != "" {
+		go tokens.refresh()
+	}
+	if vault != nil {
+		go vault.rotate()
 	}
 
-	version, err := sarama.ParseKafkaVersion(*version)
-	if err != nil {
-		panic(err)
+	switch command {
+	case "bench":
+		runBench(consumers[0])
+	case "produce":
+		runProduce(consumers[0])
+	case "export":
+		runExport(consumers[0])
+	case "diff":
+		runDiff(consumers[0])
+	case "fetch":
+		runFetch(consumers[0])
+	case "history":
+		runHistory(consumers[0])
+	}
+	if command != "" {
+		exit(exitClean, command+" finished", nil)
 	}
 
-	config := sarama.NewConfig()
-	tlsConfig := createTLSConfiguration()
-	if tlsConfig != nil {
-		config.Net.TLS.Enable = true
-		config.Net.TLS.Config = tlsConfig
+	openMessageOutput()
+
+	var err error
+	if fixtures, err = newFixtureCapture(*captureFixtures, *captureFormat, *captureSample, *captureMax); err != nil {
+		fatal(err)
 	}
-	config.Version = version
+	if err := openSinks(); err != nil {
+		fatal(err)
+	}
+	if correlations, err = newCorrelationTracker(*correlateHeader, *correlateTimeout, *correlateMax, *correlateOut); err != nil {
+		fatal(err)
+	}
+	merged = newTimestampMerger(*mergeWindow, *mergeMax)
 
-	consumer := Consumer{
-		ready: make(chan bool, 0),
+	if *mock != "" {
+		runMock(consumers[0])
+		return
 	}
 
-	ctx := context.Background()
-	client, err := sarama.NewConsumerGroup(strings.Split(*brokers, ","), *group, config)
-	if err != nil {
-		panic(err)
+	stopping := make(chan struct{})
+	if *grpcHealthAddr != "" {
+		go func() {
+			log.Fatal(newGRPCHealthServer(*grpcHealthAddr, stopping).ListenAndServe())
+		}()
+		log.Printf("gRPC health service listening on %s", *grpcHealthAddr)
+	}
+
+	var elector *leaderElector
+	lost := make(chan struct{})
+	if *leaseName != "" {
+		elector, err = newLeaderElector(*leaseName, *leaseNamespace, *leaseIdentity, *leaseDuration)
+		if err != nil {
+			fatal(err)
+		}
+		elector.acquire()
+		go elector.renew(func() { close(lost) })
+	}
+
+	runningMu.Lock()
+	for _, c := range consumers {
+		consumer, err := newConsumer(c)
+		if err != nil {
+			runningMu.Unlock()
+			log.Printf("Unable to start the consumer of group %s: %v", c.Group, err)
+			exit(startupExitCode(err), "startup error", err)
+		}
+		running[c.Name] = consumer
+
+		go consumer.consume()
 	}
+	runningMu.Unlock()
 
-	go client.Consume(ctx, strings.Split(*topics, ","), &consumer)
+	finished := make(chan struct{})
+	go func() {
+		waitRunning(func(consumer *Consumer) chan struct{} { return consumer.finished })
+		close(finished)
+	}()
 
-	<-consumer.ready // Wait till the consumer has been set up
+	// Wait till the consumers have been set up
+	waitRunning(func(consumer *Consumer) chan struct{} { return consumer.ready })
 	log.Println("Sarama consumer up and running")
 
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	admin := newAdminServer(*adminToken)
+	if *adminAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, admin))
+		}()
+		log.Printf("Admin API listening on %s", *adminAddr)
+	}
+	if *scalerAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*scalerAddr, newScalerServer()))
+		}()
+		log.Printf("Lag for autoscaling served on %s/lag", *scalerAddr)
+	}
+
+	if *maxMemoryMB > 0 {
+		go guardMemory(uint64(*maxMemoryMB) << 20)
+	}
+
+	if *statsdAddr != "" {
+		reporter, err := newStatsdReporter(*statsdAddr, *statsdPrefix, *statsdTags)
+		if err != nil {
+			fatal(err)
+		}
+		go reporter.run(*statsdInterval)
+	}
 
-	<-sigterm
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 
-	client.Close()
+	var reason string
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGQUIT {
+				writeDump(os.Stderr)
+				continue
+			}
+			if sig != syscall.SIGHUP {
+				reason = "received " + sig.String()
+				break wait
+			}
+			if *configPath == "" {
+				log.Println("Received SIGHUP without a -config file, nothing to reload")
+				continue
+			}
+			reload()
+		case <-admin.shutdown:
+			log.Println("Shutdown requested through the admin API")
+			reason = "admin shutdown"
+			break wait
+		case <-finished:
+			log.Println("Every claimed partition reached its -until boundary")
+			if !*untilIdle {
+				reason = "until boundary reached"
+				break wait
+			}
+			finished = nil
+		case <-lost:
+			log.Printf("Lost lease %s, stopping to consume", *leaseName)
+			reason = "lease lost"
+			break wait
+		}
+	}
+
+	close(stopping)
+	// a read lock, so a consumer exiting on a fatal error meanwhile can write the -summary-json summary
+	runningMu.RLock()
+	for _, consumer := range running {
+		consumer.Close()
+	}
+	runningMu.RUnlock()
+	closeOutputs()
+
+	if elector != nil {
+		select {
+		case <-lost:
+			// exit with an error so the replica is restarted as a standby
+			exit(exitConsumptionError, reason, nil)
+		default:
+			elector.release()
+		}
+	}
+	exit(exitClean, reason, nil)
+}
+
+// waitRunning returns once the channel of every running consumer is closed.
+// The consumers restarted meanwhile by a vault rotation or a reload are
+// waited for instead of the ones they replaced, whose channels may never close.
+func waitRunning(channel func(consumer *Consumer) chan struct{}) {
+	for {
+		runningMu.RLock()
+		started := len(running) > 0
+		var waiting chan struct{}
+		for _, consumer := range running {
+			select {
+			case <-channel(consumer):
+			default:
+				waiting = channel(consumer)
+			}
+		}
+		runningMu.RUnlock()
+
+		if started && waiting == nil {
+			return
+		}
+		// check again after a while, as the consumer may be replaced
+		select {
+		case <-waiting:
+		case <-time.After(time.Second):
+		}
+	}
 }
 
-func createTLSConfiguration() (t *tls.Config) {
-	if *certFile != "" && *keyFile != "" && *caFile != "" {
-		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+func createTLSConfiguration(c consumerConfig) (t *tls.Config) {
+	if c.Certificate != "" && c.Key != "" && c.CA != "" {
+		cert, err := tls.LoadX509KeyPair(c.Certificate, c.Key)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		caCert, err := ioutil.ReadFile(*caFile)
+		caCert, err := ioutil.ReadFile(c.CA)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -105,7 +1036,7 @@ func createTLSConfiguration() (t *tls.Config) {
 		t = &tls.Config{
 			Certificates:       []tls.Certificate{cert},
 			RootCAs:            caCertPool,
-			InsecureSkipVerify: *verifySsl,
+			InsecureSkipVerify: c.Verify,
 		}
 	}
 	// will be nil by default if nothing is provided
@@ -114,26 +1045,757 @@ func createTLSConfiguration() (t *tls.Config) {
 
 // Consumer represents a Sarama consumer group consumer
 type Consumer struct {
-	ready chan bool
+	logger    *log.Logger
+	ready     chan struct{}
+	readyOnce sync.Once
+	client    sarama.Client
+	group     sarama.ConsumerGroup
+	producer  sarama.SyncProducer
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	// config is replaced on reload for settings that don't require reconnecting
+	mu     sync.RWMutex
+	config consumerConfig
+
+	// state of the current session, as exposed through the admin API
+	stateMu    sync.Mutex
+	session    sarama.ConsumerGroupSession
+	partitions map[string]map[int32]*partitionState
+	paused     bool
+	resumed    chan struct{}
+	// endSession cancels the context of the current Consume call, see rejoin
+	endSession context.CancelFunc
+	// caughtUp is set once the lag was within -ready-max-lag and -ready-max-lag-time
+	caughtUp bool
+	// lastErrors are the recent errors of the sessions, claims and group, as dumped on SIGQUIT
+	lastErrors *recentErrors
+
+	commitMu        sync.Mutex
+	commitFailures  metrics.Counter
+	lastCommitError string
+
+	// registry holds the Sarama metrics and messages, as flushed to -statsd-addr
+	registry   metrics.Registry
+	messages   metrics.Counter
+	outOfRange metrics.Counter
+	pastEnd    metrics.Counter
+	stale      metrics.Counter
+	oversized  metrics.Counter
+	duplicates metrics.Counter
+	churn      metrics.Counter
+	fenced     metrics.Counter
+	generation metrics.Gauge
+
+	start     *startPositions
+	scheduler *claimScheduler
+	audit     *offsetAudit
+	breaker   *circuitBreaker
+	lagSLO    *lagMonitor
+	shadow    *shadowReport
+	pacer     *replayPacer
+	outbox    *outboxTracker
+
+	// sinks are those of the flags, or the own sinks of a consumer of the -config
+	// file, which are closed along with it
+	sinks     []sink
+	ownSinks  bool
+	sinksOnce sync.Once
+
+	membership membershipWatchdog
+	// watermarks tracks the event time of the topics with -watermarks
+	watermarks *watermarkTracker
+	// inFlight limits the processed messages that aren't committed yet,
+	// commitNow requests a commit before the next -commit-interval
+	inFlight  *inFlightLimit
+	commitNow chan struct{}
+	// bounds is set with -until-offset or -until-timestamp, finished is
+	// closed once every claimed partition reached its end
+	bounds       *untilBounds
+	finished     chan struct{}
+	finishedOnce sync.Once
+	checksums    *checksums
+}
+
+// newSaramaConfig returns the Sarama configuration for the given consumer
+func newSaramaConfig(c consumerConfig) (*sarama.Config, error) {
+	version := fallbackVersion
+	if c.Version != autoVersion {
+		var err error
+		if version, err = sarama.ParseKafkaVersion(c.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	config := sarama.NewConfig()
+	tlsConfig := createTLSConfiguration(c)
+	if tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	config.Version = version
+	if c.MemberUserData != "" {
+		config.Consumer.Group.Member.UserData = []byte(c.MemberUserData)
+	}
+	if *memberLabels != "" {
+		config.Consumer.Group.Member.UserData = encodeMemberLabels(*memberLabels, c.MemberUserData)
+	}
+	if pinning != nil {
+		// members without -pinning-file still agree on range, e.g. during a rollout
+		config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{pinning, sarama.BalanceStrategyRange}
+	}
+	if c.IsolationLevel == "read_committed" {
+		config.Consumer.IsolationLevel = sarama.ReadCommitted
+	}
+	if tokens != nil {
+		if err := tokens.configure(config); err != nil {
+			return nil, err
+		}
+	}
+	if vault != nil {
+		if err := vault.configure(config, c.Verify); err != nil {
+			return nil, err
+		}
+	}
+	if *confluentCloud {
+		configureConfluentCloud(config)
+	}
+	if *eventHubs {
+		configureEventHubs(config)
+	}
+	if c.Version == autoVersion {
+		// negotiated once the client authenticates like the real connections
+		negotiated, err := negotiateVersion(strings.Split(c.Brokers, ","), config)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = negotiated
+	}
+
+	return config, nil
+}
+
+// newConsumer connects the consumer group client for the given configuration
+func newConsumer(c consumerConfig) (*Consumer, error) {
+	config, err := newSaramaConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.forwarding() || c.AuditTopic != "" || *heartbeatTopic != "" || deadLettering() {
+		config.Producer.Return.Successes = true
+	}
+	// offsets are committed by commitLoop, which retries failed commits
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	// out of range offsets and deleted topics are handled by watchErrors, which
+	// rejoins the group so checkCommittedOffsets applies the configured policy
+	config.Consumer.Return.Errors = true
+	config.Consumer.Group.ResetInvalidOffsets = false
+	var weighted *weightedStrategy
+	if assignmentWeights != nil {
+		weighted = newWeightedStrategy(assignmentWeights)
+		config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{weighted, sarama.BalanceStrategyRange}
+	}
+
+	client, err := sarama.NewClient(strings.Split(c.Brokers, ","), config)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := sarama.NewConsumerGroupFromClient(c.Group, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	var producer sarama.SyncProducer
+	if c.forwarding() || c.AuditTopic != "" || *heartbeatTopic != "" || deadLettering() {
+		producer, err = sarama.NewSyncProducerFromClient(client)
+		if err != nil {
+			group.Close()
+			client.Close()
+			return nil, err
+		}
+	}
+
+	consumer := newConsumerFromClient(c, config, client, group, producer)
+	if c.Sinks != nil {
+		if consumer.sinks, err = openConsumerSinks(c.Sinks); err != nil {
+			if producer != nil {
+				producer.Close()
+			}
+			group.Close()
+			client.Close()
+			return nil, err
+		}
+		consumer.ownSinks = true
+	}
+	if weighted != nil {
+		weighted.consumer = consumer
+	}
+	return consumer, nil
+}
+
+// newConsumerFromClient returns the consumer processing the claims of group
+func newConsumerFromClient(c consumerConfig, config *sarama.Config, client sarama.Client, group sarama.ConsumerGroup, producer sarama.SyncProducer) *Consumer {
+	prefix := ""
+	if c.Name != "" {
+		prefix = "[" + c.Name + "] "
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logger := log.New(os.Stderr, prefix, log.LstdFlags)
+
+	return &Consumer{
+		config:   c,
+		logger:   logger,
+		ready:    make(chan struct{}),
+		client:   client,
+		group:    group,
+		producer: producer,
+		ctx:      ctx,
+		cancel:   cancel,
+		start:    newStartPositions(client, c.topicPositions, logger),
+
+		scheduler:  newClaimScheduler(c.MaxConcurrentClaims, c.topicWeights),
+		audit:      newOffsetAudit(),
+		watermarks: newWatermarkTracker(*trackWatermarks, *allowedLateness, config.MetricRegistry),
+		breaker:    newCircuitBreaker(*breakerFailures, *breakerCooldown),
+		lagSLO:     newLagMonitor(lagSLO),
+		caughtUp:   *readyMaxLag == 0 && *readyMaxLagTime == 0,
+		lastErrors: &recentErrors{},
+		shadow:     newShadowReport(*shadow),
+		pacer:      newReplayPacer(replaySpeed),
+		outbox:     newOutboxTracker(*outbox, *outboxIDHeader, *outboxWindow, logger),
+		bounds:     newUntilBounds(client),
+		inFlight:   newInFlightLimit(*maxInFlight),
+		commitNow:  make(chan struct{}, 1),
+		finished:   make(chan struct{}),
+		checksums:  newChecksums(*checksum),
+		sinks:      sinks,
+
+		registry:   config.MetricRegistry,
+		messages:   metrics.GetOrRegisterCounter("messages-consumed", config.MetricRegistry),
+		outOfRange: metrics.GetOrRegisterCounter("offsets-out-of-range", config.MetricRegistry),
+		pastEnd:    metrics.GetOrRegisterCounter("offsets-past-end", config.MetricRegistry),
+		stale:      metrics.GetOrRegisterCounter("stale-messages", config.MetricRegistry),
+		oversized:  metrics.GetOrRegisterCounter("oversized-messages", config.MetricRegistry),
+		duplicates: metrics.GetOrRegisterCounter("outbox-duplicates", config.MetricRegistry),
+		churn:      metrics.GetOrRegisterCounter("rebalance-churn", config.MetricRegistry),
+		fenced:     metrics.GetOrRegisterCounter("commits-fenced", config.MetricRegistry),
+		generation: metrics.GetOrRegisterGauge("group-generation", config.MetricRegistry),
+
+		commitFailures: metrics.GetOrRegisterCounter("commit-failures", config.MetricRegistry),
+	}
+}
+
+// consume joins the consumer group and keeps consuming across rebalances
+// until the consumer is closed
+func (consumer *Consumer) consume() {
+	consumer.logTopicConfigs()
+	go consumer.watchErrors()
+	if *partitionCheckInterval > 0 {
+		go consumer.partitionCountLoop()
+	}
+	if consumer.shadow != nil {
+		go consumer.shadowLoop()
+	}
+
+	for {
+		ctx, endSession := context.WithCancel(consumer.ctx)
+		consumer.stateMu.Lock()
+		consumer.endSession = endSession
+		consumer.stateMu.Unlock()
+
+		err := consumer.group.Consume(ctx, consumer.settings().topicNames, consumer)
+		endSession()
+		if err == sarama.ErrClosedConsumerGroup || consumer.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			consumer.logger.Printf("Error from consumer: %v", err)
+			categorized := consumergroup.Categorize(err)
+			consumer.recordError(categorized)
+			if consumergroup.Category(categorized) == consumergroup.CategoryAuth {
+				// retrying doesn't fix the credentials or ACLs
+				exit(exitAuthError, "auth error", err)
+			}
+			time.Sleep(consumerRetryBackoff)
+		}
+	}
+}
+
+// settings returns the current configuration of the consumer
+func (consumer *Consumer) settings() consumerConfig {
+	consumer.mu.RLock()
+	defer consumer.mu.RUnlock()
+	return consumer.config
+}
+
+// apply replaces the settings that can be changed without reconnecting
+func (consumer *Consumer) apply(c consumerConfig) {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	consumer.config = c
+}
+
+// pause stops the delivery of messages to ConsumeClaim until resume is called
+func (consumer *Consumer) pause() {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+
+	if !consumer.paused {
+		consumer.paused = true
+		consumer.resumed = make(chan struct{})
+		consumer.logger.Println("Consumer paused")
+	}
+}
+
+// resume continues the delivery of messages after pause
+func (consumer *Consumer) resume() {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+
+	if consumer.paused {
+		consumer.paused = false
+		close(consumer.resumed)
+		consumer.logger.Println("Consumer resumed")
+	}
+}
+
+// waitWhilePaused blocks while the consumer is paused. It returns false when
+// the session ends before the consumer is resumed.
+func (consumer *Consumer) waitWhilePaused(session sarama.ConsumerGroupSession) bool {
+	consumer.stateMu.Lock()
+	paused, resumed := consumer.paused, consumer.resumed
+	consumer.stateMu.Unlock()
+
+	if !paused {
+		return true
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-session.Context().Done():
+		return false
+	}
+}
+
+// processGuarded processes the message through the circuit breaker. While
+// the breaker is open all partitions are paused and the message is retried
+// once the breaker lets a probe through, until the session ends.
+func (consumer *Consumer) processGuarded(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, decompressor *decompressor, printer *messagePrinter) error {
+	if consumer.breaker == nil {
+		return consumer.process(session, message, decompressor, printer)
+	}
+
+	for consumer.breaker.allow(session.Context()) {
+		err := consumer.process(session, message, decompressor, printer)
+		if err == nil {
+			if consumer.breaker.success() {
+				consumer.logger.Println("Circuit breaker closed, resuming all partitions")
+				if atomic.LoadInt32(&memoryPaused) == 0 {
+					consumer.group.ResumeAll()
+				}
+			}
+			return nil
+		}
+		if consumer.breaker.failure() {
+			consumer.logger.Printf("Circuit breaker opened after %d consecutive failures, pausing all partitions for %v", *breakerFailures, *breakerCooldown)
+			consumer.group.PauseAll()
+		}
+	}
+	return nil
+}
+
+// process passes the message through the interceptors and prints or forwards it
+func (consumer *Consumer) process(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, decompressor *decompressor, printer *messagePrinter) (err error) {
+	if len(interceptors) > 0 {
+		msg := &consumergroup.ConsumedMessage{ConsumerMessage: message, GenerationID: session.GenerationID()}
+		if !consumergroup.Intercept(session.Context(), interceptors, msg) {
+			return nil
+		}
+		message = msg.ConsumerMessage
+	}
+
+	if tombstone := message.Value == nil; tombstone && !*includeTombstones || !tombstone && *onlyTombstones {
+		return nil
+	}
+
+	id, duplicate := consumer.outbox.begin(message)
+	if duplicate {
+		consumer.duplicates.Inc(1)
+		return nil
+	}
+	defer func(message *sarama.ConsumerMessage) {
+		consumer.outbox.end(message, id, err == nil)
+	}(message)
+
+	settings := consumer.settings()
+	value, err := decompressor.decompress(settings.ValueDecompress, message.Value)
+	if err != nil {
+		consumer.logger.Printf("Unable to decompress value at topic = %s, partition = %d, offset = %d: %v", message.Topic, message.Partition, message.Offset, err)
+		value = message.Value
+	}
+	message, value, handled, err := consumer.checkSize(message, value)
+	if handled {
+		return err
+	}
+	forwarded := message
+	if *cloudEvents {
+		// the handlers and routes see structured events in the binary content mode
+		message, value = cloudEventMessage(message, value)
+	}
+	if *debeziumMode != "" {
+		var ok bool
+		if message, value, ok = debeziumMessage(message, value); !ok {
+			return nil
+		}
+	}
+	if jqFilter != nil {
+		result, ok, err := applyJQ(session.Context(), jqFilter, message, value)
+		if err != nil {
+			consumer.logger.Printf("Unable to evaluate -jq on topic = %s, partition = %d, offset = %d: %v", message.Topic, message.Partition, message.Offset, err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		if !settings.forwarding() {
+			value = result
+		}
+	}
+	if valueProjection != nil && message.Value != nil && !settings.forwarding() {
+		value = valueProjection.apply(value)
+	}
+
+	if !settings.forwarding() {
+		if len(consumer.sinks) == 0 {
+			if !correlations.add(message, value) && !merged.add(message, value) {
+				printer.mode = settings.Print
+				printer.print(message, value)
+			}
+			return nil
+		}
+		err := settings.retryPolicy(message.Topic).Do(session.Context(), func() error {
+			return writeSinks(consumer.sinks, message, value)
+		})
+		if err != nil {
+			consumer.logger.Printf("Unable to write topic = %s, partition = %d, offset = %d to the sinks: %v", message.Topic, message.Partition, message.Offset, err)
+			return &consumergroup.SinkError{Sink: "the sinks", Topic: message.Topic, Partition: message.Partition, Offset: message.Offset, Err: err}
+		}
+		return nil
+	}
+	if topic, ok := settings.destination(message, value); ok {
+		if *shadow {
+			topic += shadowTopicSuffix
+		}
+		err := settings.retryPolicy(message.Topic).Do(session.Context(), func() error {
+			return forward(consumer.producer, topic, forwarded, settings.cluster)
+		})
+		if err != nil {
+			consumer.logger.Printf("Unable to forward topic = %s, partition = %d, offset = %d to %s: %v", message.Topic, message.Partition, message.Offset, topic, err)
+			return &consumergroup.SinkError{Sink: topic, Topic: message.Topic, Partition: message.Partition, Offset: message.Offset, Err: err}
+		}
+	}
+	return nil
+}
+
+// throttleBacklog pauses fetching the partition of the claim once PauseBacklog
+// of its messages are buffered, so a slow handler doesn't hold up the fetches of
+// the other partitions and exceed MaxProcessingTime. The partition is resumed
+// once the backlog is halved. It returns whether the partition is paused.
+func (consumer *Consumer) throttleBacklog(claim sarama.ConsumerGroupClaim, paused bool) bool {
+	threshold := consumer.settings().PauseBacklog
+	backlog := len(claim.Messages())
+	partitions := map[string][]int32{claim.Topic(): {claim.Partition()}}
+
+	switch {
+	case !paused && threshold > 0 && backlog >= threshold:
+		consumer.group.Pause(partitions)
+		consumer.logger.Printf("Pausing topic = %s, partition = %d, backlog = %d", claim.Topic(), claim.Partition(), backlog)
+		paused = true
+	case paused && backlog <= threshold/2:
+		if !consumer.fairPaused(claim.Topic(), claim.Partition()) {
+			consumer.group.Resume(partitions)
+		}
+		consumer.logger.Printf("Resuming topic = %s, partition = %d, backlog = %d", claim.Topic(), claim.Partition(), backlog)
+		paused = false
+	default:
+		return paused
+	}
+
+	consumer.stateMu.Lock()
+	if state := consumer.partitions[claim.Topic()][claim.Partition()]; state != nil {
+		state.backlogPaused = paused
+	}
+	consumer.stateMu.Unlock()
+	return paused
+}
+
+// Close shuts down the consumer group and its client
+func (consumer *Consumer) Close() {
+	consumer.cancel()
+	if consumer.shadow != nil {
+		consumer.logShadowReport()
+	}
+	consumer.group.Close()
+	if consumer.producer != nil {
+		consumer.producer.Close()
+	}
+	consumer.client.Close()
+	consumer.closeOwnSinks()
+}
+
+// closeOwnSinks closes the sinks of a consumer with sinks of its own, once
+func (consumer *Consumer) closeOwnSinks() {
+	if consumer.ownSinks {
+		consumer.sinksOnce.Do(func() {
+			closeSinks(consumer.sinks)
+		})
+	}
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
+func (consumer *Consumer) Setup(session sarama.ConsumerGroupSession) error {
+	consumer.logger.Printf("Joined consumer group %s: member id = %s, generation = %d, claims = %v", consumer.settings().Group, session.MemberID(), session.GenerationID(), session.Claims())
+	consumer.watchMembership(session.GenerationID(), session.Claims())
+	consumer.generation.Update(int64(session.GenerationID()))
+
+	if len(consumer.settings().topicPositions) > 0 && len(session.Claims()) > 0 {
+		committed, err := consumer.committedBlocks(session.Claims())
+		if err != nil {
+			return err
+		}
+		for topic, partitions := range committed {
+			for partition, block := range partitions {
+				// a job resumes at its committed offsets, the start positions only
+				// apply to its first run. Otherwise a position applies once per group.
+				if block.Offset >= 0 && (*jobID != "" || block.Metadata == consumer.start.metadata(topic)) {
+					consumer.start.skip(topic, partition)
+				}
+			}
+		}
+	}
+	seeked, err := consumer.start.apply(session)
+	if err != nil {
+		return err
+	}
+	reset, err := consumer.checkCommittedOffsets(session, seeked)
+	if err != nil {
+		return err
+	}
+	for topic, partitions := range reset {
+		if seeked[topic] == nil {
+			seeked[topic] = make(map[int32]int64)
+		}
+		for partition, offset := range partitions {
+			seeked[topic][partition] = offset
+		}
+	}
+
+	consumer.stateMu.Lock()
+	consumer.session = session
+	consumer.partitions = make(map[string]map[int32]*partitionState)
+	for topic, partitions := range session.Claims() {
+		consumer.partitions[topic] = make(map[int32]*partitionState)
+		for _, partition := range partitions {
+			state := &partitionState{offset: -1, highWaterMark: -1, committed: -1}
+			if offset, ok := seeked[topic][partition]; ok {
+				// commit the new start position even before any message is processed
+				state.offset = offset
+			}
+			consumer.partitions[topic][partition] = state
+		}
+	}
+	consumer.stateMu.Unlock()
+	consumer.watermarks.assign(session.Claims())
+
+	go consumer.commitLoop(session)
+	go consumer.topologyLoop(session)
+	if *debugFetch {
+		go consumer.debugFetchLoop(session)
+	}
+	if consumer.lagSLO != nil {
+		go consumer.lagLoop(session)
+	}
+	if !consumer.hasCaughtUp() {
+		go consumer.catchUpLoop(session)
+	}
+	if consumer.settings().AuditTopic != "" {
+		go consumer.auditLoop(session)
+	}
+	if *heartbeatInterval > 0 {
+		go consumer.heartbeatLoop(session)
+	}
+	if *fairProgress > 0 {
+		go consumer.fairProgressLoop(session)
+	}
+
 	// Mark the consumer as ready
-	close(consumer.ready)
+	consumer.readyOnce.Do(func() { close(consumer.ready) })
 	return nil
 }
 
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
 func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
+	consumer.commitWithRetry(context.Background())
+
+	consumer.stateMu.Lock()
+	for _, partitions := range consumer.partitions {
+		for _, state := range partitions {
+			// whether committed or not, the messages of the session are no longer in flight
+			consumer.inFlight.release(state.pending)
+		}
+	}
+	consumer.session = nil
+	consumer.partitions = nil
+	consumer.stateMu.Unlock()
+
 	return nil
 }
 
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
 func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		log.Printf("Message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
+	var decompressor decompressor
+	printer := newMessagePrinter(consumer.logger, consumer.checksums, consumer.settings().cluster)
+	assembler := newChunkAssembler(consumer.failLargeMessage)
+
+	expected := claim.InitialOffset()
+	if passed, err := consumer.passedBound(claim.Topic(), claim.Partition(), expected); err != nil {
+		return err
+	} else if passed {
+		waitFinished(session, claim)
+		return nil
+	}
+
+	backlogPaused := false
+	defer func() {
+		if backlogPaused {
+			consumer.group.Resume(map[string][]int32{claim.Topic(): {claim.Partition()}})
+		}
+	}()
+
+	worker := newClaimWorker(claim)
+	consumer.stateMu.Lock()
+	if state := consumer.partitions[claim.Topic()][claim.Partition()]; state != nil {
+		state.worker = worker
+	}
+	consumer.stateMu.Unlock()
+
+	for {
+		worker.set(workerWaiting, -1)
+		message, ok := <-claim.Messages()
+		if !ok {
+			break
+		}
+		worker.set(workerProcessing, message.Offset)
+
+		if !consumer.waitWhilePaused(session) {
+			return nil
+		}
+		if passed, err := consumer.passedBound(message.Topic, message.Partition, message.Offset); err != nil {
+			return err
+		} else if passed {
+			// the partition stays paused
+			backlogPaused = false
+			waitFinished(session, claim)
+			return nil
+		}
+		backlogPaused = consumer.throttleBacklog(claim, backlogPaused)
+		if !consumer.pacer.wait(session.Context(), message.Timestamp) {
+			return nil
+		}
+
+		strict := consumer.settings().StrictOffsets
+		err := consumer.audit.check(message, expected)
+		if gap, ok := err.(*offsetGap); ok && (*debugTransactions || strict) {
+			// a strict consumer only halts on a gap that lost records
+			err = consumer.explainGap(gap)
+		}
+		if err != nil {
+			if explained, ok := err.(*explainedGap); strict && (!ok || explained.lost()) {
+				consumer.fatalf("%v", err)
+			}
+			consumer.logger.Print(err)
+		}
+		expected = message.Offset + 1
+		consumer.watermarks.observe(message)
+
+		message, err = assembler.add(message)
+		if err != nil {
+			consumer.logger.Print(err)
+			continue
+		}
+		if message == nil {
+			// more chunks to come
+			continue
+		}
+		message, resolved := consumer.claimCheck(session.Context(), message)
+		if session.Context().Err() != nil {
+			return nil
+		}
+
+		if err := fixtures.capture(message); err != nil {
+			consumer.logger.Printf("Unable to capture topic = %s, partition = %d, offset = %d: %v", message.Topic, message.Partition, message.Offset, err)
+		}
+
+		worker.set(workerInFlight, message.Offset)
+		if !consumer.inFlight.acquire(session.Context(), consumer.commitSoon) {
+			return nil
+		}
+		worker.set(workerScheduled, message.Offset)
+		if !consumer.scheduler.acquire(session.Context(), message.Topic) {
+			consumer.inFlight.release(1)
+			return nil
+		}
+		worker.set(workerProcessing, message.Offset)
+
+		// a message whose claim check failed was skipped or dead-lettered
+		handled := !resolved
+		if !handled {
+			handled, err = consumer.checkAge(message)
+		}
+		if !handled {
+			started := time.Now()
+			err = consumer.processGuarded(session, message, &decompressor, printer)
+			consumer.shadow.observe(time.Since(started), err)
+		}
+		if err != nil {
+			consumer.scheduler.release()
+			consumer.inFlight.release(1)
+			if consumergroup.Category(err) == "" {
+				err = &consumergroup.HandlerError{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset, Err: err}
+			}
+			// recorded by watchErrors, as the group returns the errors of the claims
+			return err
+		}
+		if session.Context().Err() != nil {
+			// the session ended while the breaker was open, leave the message unmarked
+			consumer.scheduler.release()
+			consumer.inFlight.release(1)
+			return nil
+		}
+		consumer.scheduler.release()
+		consumer.messages.Inc(1)
+		if assembler.pending() {
+			// the offset can't move past the chunks of an incomplete message
+			consumer.inFlight.release(1)
+			continue
+		}
 		session.MarkMessage(message, "")
+
+		consumer.stateMu.Lock()
+		if state := consumer.partitions[message.Topic][message.Partition]; state != nil {
+			state.offset = message.Offset + 1
+			state.highWaterMark = claim.HighWaterMarkOffset()
+			state.timestamp = message.Timestamp
+			// in flight until the offset is committed
+			state.pending++
+		} else {
+			consumer.inFlight.release(1)
+		}
+		consumer.stateMu.Unlock()
 	}
 
 	return nil
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// The init of the package parses the flags, so the testing flags are
+// registered before it runs and -mock and -topics pass its validation
+var _ = func() bool {
+	testing.Init()
+	os.Args = append(os.Args, "-mock", os.DevNull, "-topics", "test")
+	return true
+}()
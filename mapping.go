@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// mappedField is a field of the rows of a sink, taken from the message
+// metadata or from an element of the JSON value
+type mappedField struct {
+	name string
+	// source is topic, partition, offset, timestamp, key, value or header, or empty for path
+	source string
+	// header is the name of the header of the header source
+	header string
+	path   jsonPath
+}
+
+// fieldMapping maps the messages to the rows of a sink
+type fieldMapping []mappedField
+
+// parseFieldMapping parses a comma separated list of name=source pairs, with
+// sources topic, partition, offset, timestamp, key, value, header:<name>,
+// ce:<attribute> of CloudEvents or JSON paths into the value such as $.order.id
+func parseFieldMapping(spec string) (fieldMapping, error) {
+	var mapping fieldMapping
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid field mapping %q, expected name=source", pair)
+		}
+
+		field := mappedField{name: kv[0]}
+		switch source := strings.TrimSpace(kv[1]); source {
+		case "topic", "partition", "offset", "timestamp", "key", "value":
+			field.source = source
+		default:
+			if strings.HasPrefix(source, "header:") {
+				field.source, field.header = "header", strings.TrimPrefix(source, "header:")
+				break
+			}
+			if strings.HasPrefix(source, "ce:") {
+				// the attributes of CloudEvents are headers in the binary content mode
+				field.source, field.header = "header", cloudEventHeaderPrefix+strings.TrimPrefix(source, "ce:")
+				break
+			}
+			path, err := parseJSONPath(source)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source of field %s, expected topic, partition, offset, timestamp, key, value, header:<name>, ce:<attribute> or a JSON path: %v", kv[0], err)
+			}
+			field.path = path
+		}
+		mapping = append(mapping, field)
+	}
+	return mapping, nil
+}
+
+// row returns the fields of the message. Without a mapping they are the
+// fields of the value, which must be a JSON object. Fields at a JSON path
+// missing from the value are left out.
+func (m fieldMapping) row(message *sarama.ConsumerMessage, value []byte) (map[string]interface{}, error) {
+	var doc interface{}
+	decoded := false
+	decode := func() error {
+		if decoded {
+			return nil
+		}
+		decoded = true
+		var err error
+		if doc, err = decodeJSON(value); err != nil {
+			return fmt.Errorf("value isn't JSON: %v", err)
+		}
+		return nil
+	}
+
+	if len(m) == 0 {
+		if err := decode(); err != nil {
+			return nil, err
+		}
+		fields, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("value isn't a JSON object")
+		}
+		return fields, nil
+	}
+
+	fields := make(map[string]interface{}, len(m))
+	for _, field := range m {
+		switch field.source {
+		case "topic":
+			fields[field.name] = message.Topic
+		case "partition":
+			fields[field.name] = message.Partition
+		case "offset":
+			fields[field.name] = message.Offset
+		case "timestamp":
+			fields[field.name] = message.Timestamp.UTC().Format(time.RFC3339Nano)
+		case "key":
+			if message.Key != nil {
+				fields[field.name] = string(message.Key)
+			}
+		case "value":
+			if value != nil {
+				fields[field.name] = string(value)
+			}
+		case "header":
+			for _, h := range message.Headers {
+				if string(h.Key) == field.header {
+					fields[field.name] = string(h.Value)
+					break
+				}
+			}
+		default:
+			if err := decode(); err != nil {
+				return nil, err
+			}
+			if element, ok := field.path.lookup(doc); ok {
+				fields[field.name] = element
+			}
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// memoryCheckInterval is how often the memory guard reads the heap size
+const memoryCheckInterval = time.Second
+
+// memoryResumeRatio is the share of -max-memory-mb the heap must fall below
+// before fetching resumes, so the guard doesn't flap around the limit
+const memoryResumeRatio = 0.8
+
+var (
+	// memoryPaused is 1 while the memory guard paused fetching
+	memoryPaused int32
+	// heapBytes is the heap size read last by the memory guard
+	heapBytes uint64
+	// memoryPauses counts the times the memory guard paused fetching
+	memoryPauses int64
+)
+
+// guardMemory pauses fetching on all consumers while the heap exceeds limit
+// bytes, forcing a garbage collection, and resumes once it fell below the
+// resume ratio. It runs forever.
+func guardMemory(limit uint64) {
+	var stats runtime.MemStats
+	for range time.Tick(memoryCheckInterval) {
+		runtime.ReadMemStats(&stats)
+		atomic.StoreUint64(&heapBytes, stats.HeapAlloc)
+
+		paused := atomic.LoadInt32(&memoryPaused) == 1
+		switch {
+		case !paused && stats.HeapAlloc > limit:
+			log.Printf("Heap of %d MiB exceeds -max-memory-mb, pausing all partitions", stats.HeapAlloc>>20)
+			atomic.StoreInt32(&memoryPaused, 1)
+			atomic.AddInt64(&memoryPauses, 1)
+			forEachRunning(func(consumer *Consumer) { consumer.group.PauseAll() })
+			// return the memory of the released messages to the OS right away
+			debug.FreeOSMemory()
+		case paused && float64(stats.HeapAlloc) < memoryResumeRatio*float64(limit):
+			log.Printf("Heap down to %d MiB, resuming all partitions", stats.HeapAlloc>>20)
+			atomic.StoreInt32(&memoryPaused, 0)
+			forEachRunning(func(consumer *Consumer) {
+				// an open circuit breaker keeps its partitions paused
+				if consumer.breaker.current() != breakerOpen {
+					consumer.group.ResumeAll()
+				}
+			})
+		case paused:
+			runtime.GC()
+		}
+	}
+}
+
+// forEachRunning calls fn for every running consumer
+func forEachRunning(fn func(consumer *Consumer)) {
+	runningMu.RLock()
+	defer runningMu.RUnlock()
+	for _, consumer := range running {
+		fn(consumer)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// merged orders the printed messages by -merge-window, nil without it
+var merged *timestampMerger
+
+// timestampMerger prints the messages of all claimed partitions in the order
+// of their timestamps, as far as they arrive within the window of each other.
+// A message is held until a message at least the window newer arrived, or it
+// was held for the window, so partitions that fall quiet don't hold up the
+// others. Messages older than the last printed one are printed right away and
+// counted as late. The order is best effort: the offsets of held messages are
+// committed, so a crash loses them from the output.
+type timestampMerger struct {
+	window time.Duration
+	max    int
+
+	mu      sync.Mutex
+	held    mergeHeap
+	newest  time.Time
+	printed time.Time
+	total   int64
+	late    int64
+	printer *messagePrinter
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// mergedMessage is a held message with its printed value
+type mergedMessage struct {
+	message *sarama.ConsumerMessage
+	value   []byte
+	added   time.Time
+}
+
+// mergeHeap orders the held messages by timestamp, then by topic, partition
+// and offset
+type mergeHeap []*mergedMessage
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].message, h[j].message
+	switch {
+	case !a.Timestamp.Equal(b.Timestamp):
+		return a.Timestamp.Before(b.Timestamp)
+	case a.Topic != b.Topic:
+		return a.Topic < b.Topic
+	case a.Partition != b.Partition:
+		return a.Partition < b.Partition
+	}
+	return a.Offset < b.Offset
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergedMessage)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// newTimestampMerger returns the merger of -merge-window, or nil when window
+// is 0
+func newTimestampMerger(window time.Duration, max int) *timestampMerger {
+	if window == 0 {
+		return nil
+	}
+	m := &timestampMerger{
+		window:  window,
+		max:     max,
+		printer: newMessagePrinter(log.New(log.Writer(), "", log.LstdFlags), nil, ""),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go m.flushLoop()
+	return m
+}
+
+// add holds the message until it can be printed in order, and reports false
+// without -merge-window
+func (m *timestampMerger) add(message *sarama.ConsumerMessage, value []byte) bool {
+	if m == nil {
+		return false
+	}
+	// the value may be a buffer of the decompressor, reused for the next message
+	if value != nil {
+		value = append([]byte(nil), value...)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.total++
+	if message.Timestamp.Before(m.printed) {
+		m.late++
+		m.printer.print(message, value)
+		return true
+	}
+	heap.Push(&m.held, &mergedMessage{message: message, value: value, added: time.Now()})
+	if message.Timestamp.After(m.newest) {
+		m.newest = message.Timestamp
+	}
+	m.flush(time.Now())
+	return true
+}
+
+// flushLoop prints the messages held for the window until close is called
+func (m *timestampMerger) flushLoop() {
+	defer close(m.stopped)
+
+	interval := m.window / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			m.flush(now)
+			m.mu.Unlock()
+		}
+	}
+}
+
+// flush prints the held messages, oldest first, that are the window older
+// than the newest message, were held for the window, or exceed -merge-max. It
+// must be called with the lock held.
+func (m *timestampMerger) flush(now time.Time) {
+	for len(m.held) > 0 {
+		oldest := m.held[0]
+		if oldest.message.Timestamp.After(m.newest.Add(-m.window)) && now.Sub(oldest.added) < m.window && len(m.held) <= m.max {
+			return
+		}
+		m.print(heap.Pop(&m.held).(*mergedMessage))
+	}
+}
+
+// print must be called with the lock held
+func (m *timestampMerger) print(held *mergedMessage) {
+	if held.message.Timestamp.After(m.printed) {
+		m.printed = held.message.Timestamp
+	}
+	m.printer.print(held.message, held.value)
+}
+
+// close prints the held messages and logs how many arrived late
+func (m *timestampMerger) close() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	<-m.stopped
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.held) > 0 {
+		m.print(heap.Pop(&m.held).(*mergedMessage))
+	}
+	log.Printf("Merged %d messages by timestamp, %d arrived later than -merge-window and were printed out of order", m.total, m.late)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// metricTimeout bounds a write to InfluxDB or Graphite
+const metricTimeout = time.Minute
+
+// metricBatch is the number of bytes of points buffered before writing them
+const metricBatch = 1024 * 1024
+
+// metricPoint is a point of time series extracted from a message
+type metricPoint struct {
+	name   string
+	tags   [][2]string
+	fields [][2]string
+	time   time.Time
+}
+
+// metricExtractor extracts the numeric -metric-fields of the JSON values as
+// time series, tagged with the -metric-tags, named after -metric-name and
+// timestamped with the timestamps of the messages
+type metricExtractor struct {
+	name   string
+	fields fieldMapping
+	tags   fieldMapping
+}
+
+func newMetricExtractor(name, fields, tags string) (*metricExtractor, error) {
+	fieldMapping, err := parseFieldMapping(fields)
+	if err != nil {
+		return nil, err
+	}
+	if len(fieldMapping) == 0 {
+		return nil, fmt.Errorf("-metric-fields must map at least one metric")
+	}
+	tagMapping, err := parseFieldMapping(tags)
+	if err != nil {
+		return nil, err
+	}
+	return &metricExtractor{name: name, fields: fieldMapping, tags: tagMapping}, nil
+}
+
+// point returns the point of the message, or nil when none of its fields is numeric
+func (e *metricExtractor) point(message *sarama.ConsumerMessage, value []byte) (*metricPoint, error) {
+	fields, err := e.fields.row(message, value)
+	if err != nil {
+		return nil, err
+	}
+	p := &metricPoint{name: expandSinkTemplate(e.name, message), time: message.Timestamp}
+	for _, field := range e.fields {
+		var number string
+		switch v := fields[field.name].(type) {
+		case json.Number:
+			number = v.String()
+		case int32, int64:
+			number = fmt.Sprint(v)
+		case bool:
+			number = "0"
+			if v {
+				number = "1"
+			}
+		case string:
+			// numbers in strings, such as of headers
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+			number = v
+		default:
+			continue
+		}
+		p.fields = append(p.fields, [2]string{field.name, number})
+	}
+	if len(p.fields) == 0 {
+		return nil, nil
+	}
+
+	tags, err := e.tags.row(message, value)
+	if err != nil {
+		return nil, err
+	}
+	for name, element := range tags {
+		if text := jsonText(element); text != "" {
+			p.tags = append(p.tags, [2]string{name, text})
+		}
+	}
+	sort.Slice(p.tags, func(i, j int) bool { return p.tags[i][0] < p.tags[j][0] })
+	return p, nil
+}
+
+// influxSink writes the metrics extracted from the claimed messages to the
+// InfluxDB v2 write API, also served by InfluxDB 1.8 and later. Points are
+// buffered and written at the latest by the commit barrier. Batches InfluxDB
+// rejects as invalid, such as with conflicting field types, are logged and
+// dropped as writing them again fails the same way.
+type influxSink struct {
+	endpoint  string
+	token     string
+	extractor *metricExtractor
+	client    *http.Client
+
+	mu    sync.Mutex
+	lines bytes.Buffer
+}
+
+// newInfluxSink returns the sink for the base URL of InfluxDB, authorized with
+// the INFLUX_TOKEN environment variable
+func newInfluxSink(influxURL, org, bucket string, extractor *metricExtractor) (*influxSink, error) {
+	u, err := url.Parse(influxURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -influx-url %q", influxURL)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("-influx-bucket must be given with -influx-url")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	u.RawQuery = url.Values{"org": {org}, "bucket": {bucket}, "precision": {"ns"}}.Encode()
+
+	return &influxSink{
+		endpoint:  u.String(),
+		token:     os.Getenv("INFLUX_TOKEN"),
+		extractor: extractor,
+		client:    &http.Client{Timeout: metricTimeout},
+	}, nil
+}
+
+func (s *influxSink) name() string {
+	return "influx sink " + s.endpoint
+}
+
+func (s *influxSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	p, err := s.extractor.point(message, value)
+	if err != nil || p == nil {
+		return err
+	}
+
+	// the line protocol, with every field a float so the field types never conflict
+	escape := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	line := strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`).Replace(p.name)
+	for _, tag := range p.tags {
+		line += "," + escape.Replace(tag[0]) + "=" + escape.Replace(tag[1])
+	}
+	for i, field := range p.fields {
+		separator := ","
+		if i == 0 {
+			separator = " "
+		}
+		number, _ := strconv.ParseFloat(field[1], 64)
+		line += separator + escape.Replace(field[0]) + "=" + strconv.FormatFloat(number, 'g', -1, 64)
+	}
+	line += " " + strconv.FormatInt(p.time.UnixNano(), 10) + "\n"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// write before buffering, so a write retried after a failure isn't buffered twice
+	if s.lines.Len() >= metricBatch {
+		if err := s.send(); err != nil {
+			return err
+		}
+	}
+	s.lines.WriteString(line)
+	return nil
+}
+
+// flush writes the buffered points, the barrier of a commit
+func (s *influxSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send()
+}
+
+// send writes the buffered points in a single request
+func (s *influxSink) send() error {
+	if s.lines.Len() == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(s.lines.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusUnauthorized:
+		log.Printf("InfluxDB rejected a batch of %d bytes, dropping it: %s: %s", s.lines.Len(), resp.Status, strings.TrimSpace(string(data)))
+	default:
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	s.lines.Reset()
+	return nil
+}
+
+func (s *influxSink) close() error {
+	return s.flush(commitPoint{})
+}
+
+// graphiteSink writes the metrics extracted from the claimed messages to the
+// plaintext protocol of Graphite, as a series <name>.<field> per field with
+// the tags of Graphite 1.1. Points are buffered and sent at the latest by the
+// commit barrier, and sent again over a new connection after a failure.
+type graphiteSink struct {
+	addr      string
+	extractor *metricExtractor
+
+	mu      sync.Mutex
+	conn    net.Conn
+	pending bytes.Buffer
+}
+
+func newGraphiteSink(addr string, extractor *metricExtractor) (*graphiteSink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid -graphite-addr %q, expected host:port", addr)
+	}
+	return &graphiteSink{addr: addr, extractor: extractor}, nil
+}
+
+func (s *graphiteSink) name() string {
+	return "graphite sink " + s.addr
+}
+
+func (s *graphiteSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	p, err := s.extractor.point(message, value)
+	if err != nil || p == nil {
+		return err
+	}
+
+	// spaces, semicolons and tildes separate the parts of a tagged series
+	escape := strings.NewReplacer(" ", "_", ";", "_", "~", "_", "\n", "_")
+	var tags string
+	for _, tag := range p.tags {
+		tags += ";" + escape.Replace(tag[0]) + "=" + escape.Replace(tag[1])
+	}
+	var lines bytes.Buffer
+	for _, field := range p.fields {
+		fmt.Fprintf(&lines, "%s.%s%s %s %d\n", escape.Replace(p.name), escape.Replace(field[0]), tags, field[1], p.time.Unix())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// send before buffering, so a write retried after a failure isn't buffered twice
+	if s.pending.Len() >= metricBatch {
+		if err := s.send(); err != nil {
+			return err
+		}
+	}
+	lines.WriteTo(&s.pending)
+	return nil
+}
+
+// flush sends the buffered points, the barrier of a commit
+func (s *graphiteSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send()
+}
+
+// send sends the buffered points. On failure the connection is closed, and
+// the points are sent again by the next send.
+func (s *graphiteSink) send() error {
+	if s.pending.Len() == 0 {
+		return nil
+	}
+	if s.conn == nil {
+		var err error
+		if s.conn, err = dialSink(s.addr, false, metricTimeout); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(metricTimeout))
+	if _, err := s.conn.Write(s.pending.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	s.pending.Reset()
+	return nil
+}
+
+func (s *graphiteSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
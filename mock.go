@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// mockGenerate as -mock generates random messages like the produce subcommand
+const mockGenerate = "generate"
+
+// runMock feeds the messages of -mock through the claims of the consumer
+// without connecting to Kafka. Interceptors, filters, output formats,
+// forwarding and the other processing run unchanged, forwarded messages are
+// logged instead of produced. It returns once every message is processed.
+func runMock(c consumerConfig) {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	producer := &mockProducer{logger: logger}
+	consumer := newConsumerFromClient(c, sarama.NewConfig(), nil, mockGroup{}, producer)
+	// offsets are never committed, so nothing is released from -max-in-flight
+	consumer.inFlight = nil
+	if c.Sinks != nil {
+		var err error
+		if consumer.sinks, err = openConsumerSinks(c.Sinks); err != nil {
+			fatal(err)
+		}
+		consumer.ownSinks = true
+	}
+
+	var source mockSource
+	if *mock == mockGenerate {
+		source = generateMockMessages(c.topicNames)
+	} else {
+		messages, err := loadMockMessages(*mock, c.topicNames)
+		if err != nil {
+			fatal(err)
+		}
+		source = replayMockMessages(messages)
+	}
+
+	runningMu.Lock()
+	running[c.Name] = consumer
+	runningMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGQUIT {
+				cancel()
+				return
+			}
+			writeDump(os.Stderr)
+		}
+	}()
+
+	session := &mockSession{ctx: ctx, claims: make(map[string][]int32), marked: make(map[string]map[int32]int64)}
+	for topic, partitions := range source.initial {
+		for partition := range partitions {
+			session.claims[topic] = append(session.claims[topic], partition)
+		}
+	}
+	consumer.stateMu.Lock()
+	consumer.session = session
+	consumer.partitions = make(map[string]map[int32]*partitionState)
+	consumer.stateMu.Unlock()
+	consumer.watermarks.assign(session.claims)
+
+	claims := make(map[string]map[int32]*mockClaim)
+	var wg sync.WaitGroup
+	for topic, partitions := range source.initial {
+		claims[topic] = make(map[int32]*mockClaim)
+		consumer.partitions[topic] = make(map[int32]*partitionState)
+		for partition, initial := range partitions {
+			claim := &mockClaim{topic: topic, partition: partition, initial: initial, messages: make(chan *sarama.ConsumerMessage, 256)}
+			claims[topic][partition] = claim
+			consumer.partitions[topic][partition] = &partitionState{offset: -1, highWaterMark: -1, committed: -1}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := consumer.ConsumeClaim(session, claim); err != nil {
+					logger.Printf("Error consuming topic = %s, partition = %d: %v", claim.topic, claim.partition, err)
+					consumer.recordError(err)
+				}
+			}()
+		}
+	}
+
+	if *heartbeatInterval > 0 {
+		go consumer.heartbeatLoop(session)
+	}
+
+	log.Printf("Mock consuming %v from %s", c.topicNames, *mock)
+	started := time.Now()
+	delivered := source.run(ctx, func(message *sarama.ConsumerMessage) {
+		claims[message.Topic][message.Partition].messages <- message
+	})
+	for _, partitions := range claims {
+		for _, claim := range partitions {
+			close(claim.messages)
+		}
+	}
+	wg.Wait()
+	closeOutputs()
+
+	log.Printf("Mock delivered %d messages in %v, %d processed and %d forwarded", delivered, time.Since(started).Round(time.Millisecond), consumer.messages.Count(), producer.count())
+	for _, line := range session.markedOffsets() {
+		log.Printf("Marked %s", line)
+	}
+	exit(exitClean, "mock finished", nil)
+}
+
+// mockSource delivers the messages of -mock to the claims
+type mockSource struct {
+	// initial is the offset of the first message of every claimed partition
+	initial map[string]map[int32]int64
+	// run delivers messages until there are no more or ctx is done, and
+	// returns the number of delivered messages
+	run func(ctx context.Context, deliver func(*sarama.ConsumerMessage)) int64
+}
+
+// replayMockMessages delivers the messages in order
+func replayMockMessages(messages []*sarama.ConsumerMessage) mockSource {
+	initial := make(map[string]map[int32]int64)
+	for _, message := range messages {
+		if initial[message.Topic] == nil {
+			initial[message.Topic] = make(map[int32]int64)
+		}
+		if _, ok := initial[message.Topic][message.Partition]; !ok {
+			initial[message.Topic][message.Partition] = message.Offset
+		}
+	}
+
+	return mockSource{
+		initial: initial,
+		run: func(ctx context.Context, deliver func(*sarama.ConsumerMessage)) int64 {
+			var delivered int64
+			for _, message := range messages {
+				if ctx.Err() != nil {
+					break
+				}
+				deliver(message)
+				delivered++
+			}
+			return delivered
+		},
+	}
+}
+
+// generateMockMessages delivers random messages to partition 0 of the topics
+// for -duration, at -rate and with the -size, -keys and -headers of the
+// produce subcommand
+func generateMockMessages(topics []string) mockSource {
+	headers, err := parseHeaders(*produceHeaders)
+	if err != nil {
+		fatal(err)
+	}
+
+	initial := make(map[string]map[int32]int64)
+	for _, topic := range topics {
+		initial[topic] = map[int32]int64{0: 0}
+	}
+
+	return mockSource{
+		initial: initial,
+		run: func(ctx context.Context, deliver func(*sarama.ConsumerMessage)) int64 {
+			random := rand.New(rand.NewSource(time.Now().UnixNano()))
+			deadline := time.After(*duration)
+			offsets := make(map[string]int64)
+			started := time.Now()
+
+			var generated int64
+			for ; ; generated++ {
+				select {
+				case <-ctx.Done():
+					return generated
+				case <-deadline:
+					return generated
+				default:
+				}
+				if *produceRate > 0 {
+					next := started.Add(time.Duration(float64(generated) / *produceRate * float64(time.Second)))
+					if wait := time.Until(next); wait > 0 {
+						time.Sleep(wait)
+					}
+				}
+
+				topic := topics[generated%int64(len(topics))]
+				message := &sarama.ConsumerMessage{
+					Topic:     topic,
+					Offset:    offsets[topic],
+					Timestamp: time.Now(),
+					Value:     randomPayload(random, *produceSize),
+				}
+				offsets[topic]++
+				for i := range headers {
+					message.Headers = append(message.Headers, &headers[i])
+				}
+				if *produceKeys > 0 {
+					message.Key = []byte(fmt.Sprintf("key-%d", random.Intn(*produceKeys)))
+				}
+				deliver(message)
+			}
+		},
+	}
+}
+
+// loadMockMessages reads the messages of the topics from a file of JSON
+// objects in the -capture-fixtures format, or from a directory of such files.
+// Messages without an offset after the previous one of their partition are
+// numbered consecutively, and those without a timestamp are stamped now.
+func loadMockMessages(path string, topics []string) ([]*sarama.ConsumerMessage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures []fixture
+	if info.IsDir() {
+		files, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			decoded, err := readFixtures(file)
+			if err != nil {
+				return nil, err
+			}
+			fixtures = append(fixtures, decoded...)
+		}
+		sort.SliceStable(fixtures, func(i, j int) bool {
+			if fixtures[i].Topic != fixtures[j].Topic {
+				return fixtures[i].Topic < fixtures[j].Topic
+			}
+			if fixtures[i].Partition != fixtures[j].Partition {
+				return fixtures[i].Partition < fixtures[j].Partition
+			}
+			return fixtures[i].Offset < fixtures[j].Offset
+		})
+	} else if fixtures, err = readFixtures(path); err != nil {
+		return nil, err
+	}
+
+	consumed := make(map[string]bool)
+	for _, topic := range topics {
+		consumed[topic] = true
+	}
+
+	var messages []*sarama.ConsumerMessage
+	next := make(map[string]map[int32]int64)
+	for _, f := range fixtures {
+		if !consumed[f.Topic] {
+			continue
+		}
+		message, err := f.message()
+		if err != nil {
+			return nil, fmt.Errorf("invalid message of topic %s at offset %d: %v", f.Topic, f.Offset, err)
+		}
+
+		if next[f.Topic] == nil {
+			next[f.Topic] = make(map[int32]int64)
+		}
+		if offset, ok := next[f.Topic][f.Partition]; ok && message.Offset < offset {
+			message.Offset = offset
+		}
+		next[f.Topic][f.Partition] = message.Offset + 1
+		if message.Timestamp.IsZero() {
+			message.Timestamp = time.Now()
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("no messages of topics %s in %s", strings.Join(topics, ", "), path)
+	}
+	return messages, nil
+}
+
+// readFixtures decodes the consecutive JSON objects of the file
+func readFixtures(path string) ([]fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var fixtures []fixture
+	decoder := json.NewDecoder(file)
+	for {
+		var f fixture
+		if err := decoder.Decode(&f); err == io.EOF {
+			return fixtures, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		fixtures = append(fixtures, f)
+	}
+}
+
+// message converts the fixture back to the message it was captured from
+func (f fixture) message() (*sarama.ConsumerMessage, error) {
+	message := &sarama.ConsumerMessage{
+		Topic:     f.Topic,
+		Partition: f.Partition,
+		Offset:    f.Offset,
+		Timestamp: f.Timestamp,
+	}
+	var err error
+	if message.Key, err = fixtureData(f.Key, f.KeyBase64); err != nil {
+		return nil, err
+	}
+	if message.Value, err = fixtureData(f.Value, f.ValueBase64); err != nil {
+		return nil, err
+	}
+	for _, h := range f.Headers {
+		value, err := fixtureData(&h.Value, h.ValueBase64)
+		if err != nil {
+			return nil, err
+		}
+		message.Headers = append(message.Headers, &sarama.RecordHeader{Key: []byte(h.Key), Value: value})
+	}
+	return message, nil
+}
+
+// fixtureData reverses fixtureBytes
+func fixtureData(s *string, encoded bool) ([]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+	if encoded {
+		return base64.StdEncoding.DecodeString(*s)
+	}
+	return []byte(*s), nil
+}
+
+// mockSession is the group session of -mock, which records the marked offsets
+type mockSession struct {
+	ctx    context.Context
+	claims map[string][]int32
+
+	mu     sync.Mutex
+	marked map[string]map[int32]int64
+}
+
+func (s *mockSession) Claims() map[string][]int32 { return s.claims }
+func (s *mockSession) MemberID() string           { return "mock" }
+func (s *mockSession) GenerationID() int32        { return 1 }
+func (s *mockSession) Commit()                    {}
+func (s *mockSession) Context() context.Context   { return s.ctx }
+
+func (s *mockSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.marked[topic] == nil {
+		s.marked[topic] = make(map[int32]int64)
+	}
+	s.marked[topic][partition] = offset
+}
+
+func (s *mockSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	s.MarkOffset(topic, partition, offset, metadata)
+}
+
+func (s *mockSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+// markedOffsets returns the marked offset of every partition, sorted
+func (s *mockSession) markedOffsets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+	for topic, partitions := range s.marked {
+		for partition, offset := range partitions {
+			lines = append(lines, fmt.Sprintf("topic = %s, partition = %d, offset = %d", topic, partition, offset))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// mockClaim is a claim of -mock, fed by runMock
+type mockClaim struct {
+	topic     string
+	partition int32
+	initial   int64
+	messages  chan *sarama.ConsumerMessage
+}
+
+func (c *mockClaim) Topic() string                            { return c.topic }
+func (c *mockClaim) Partition() int32                         { return c.partition }
+func (c *mockClaim) InitialOffset() int64                     { return c.initial }
+func (c *mockClaim) HighWaterMarkOffset() int64               { return -1 }
+func (c *mockClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// mockGroup stands in for the consumer group of -mock, pausing and resuming
+// partitions has no effect as the claims are fed directly
+type mockGroup struct{}
+
+func (mockGroup) Consume(context.Context, []string, sarama.ConsumerGroupHandler) error { return nil }
+func (mockGroup) Errors() <-chan error                                                 { return nil }
+func (mockGroup) Close() error                                                         { return nil }
+func (mockGroup) Pause(map[string][]int32)                                             {}
+func (mockGroup) Resume(map[string][]int32)                                            {}
+func (mockGroup) PauseAll()                                                            {}
+func (mockGroup) ResumeAll()                                                           {}
+
+// mockProducer logs the messages forwarded under -mock instead of producing
+// them. Transactions aren't used by the consumer and aren't implemented.
+type mockProducer struct {
+	sarama.SyncProducer
+
+	logger   *log.Logger
+	mu       sync.Mutex
+	produced int64
+}
+
+func (p *mockProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	var key, value []byte
+	if msg.Key != nil {
+		key, _ = msg.Key.Encode()
+	}
+	if msg.Value != nil {
+		value, _ = msg.Value.Encode()
+	}
+
+	p.mu.Lock()
+	offset := p.produced
+	p.produced++
+	p.mu.Unlock()
+
+	p.logger.Printf("Mock produced to topic = %s: key = %s, value size = %d, headers = %d", msg.Topic, key, len(value), len(msg.Headers))
+	return 0, offset, nil
+}
+
+func (p *mockProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		p.SendMessage(msg)
+	}
+	return nil
+}
+
+func (p *mockProducer) Close() error { return nil }
+
+func (p *mockProducer) count() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.produced
+}
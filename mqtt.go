@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// mqttTimeout bounds connecting to the broker and a round trip of the pending messages
+const mqttTimeout = 10 * time.Second
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect  = 1
+	mqttConnAck  = 2
+	mqttPublish  = 3
+	mqttPubAck   = 4
+	mqttPingReq  = 12
+	mqttPingResp = 13
+)
+
+// mqttConnectCodes explain the return codes of a refused connection
+var mqttConnectCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttSink republishes the claimed messages to MQTT topics, mapped by the
+// -mqtt-topic template from the topic, partition and key of the message, to
+// bridge Kafka to edge brokers.
+//
+// The commit barrier sends the pending messages followed by a PINGREQ, and
+// waits for the PINGRESP and, at QoS 1, the PUBACK of every message. The
+// messages are kept until then, and sent again over a new connection after
+// a failure, so subscribers may receive duplicates.
+type mqttSink struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	clientID string
+	topic    string
+	qos      int
+	retain   bool
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	// unacked are the messages not acknowledged yet
+	unacked []mqttMessage
+}
+
+// mqttMessage is a message to publish
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// newMQTTSink returns the sink for an mqtt:// or mqtts:// URL with optional
+// user:password credentials. Without a client id the broker assigns one.
+func newMQTTSink(mqttURL, topic string, qos int, retain bool, clientID string) (*mqttSink, error) {
+	u, err := url.Parse(mqttURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "mqtt" && u.Scheme != "mqtts" {
+		return nil, fmt.Errorf("invalid -mqtt-url %q, expected mqtt:// or mqtts://", mqttURL)
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("-mqtt-topic must not be empty")
+	}
+	if qos != 0 && qos != 1 {
+		return nil, fmt.Errorf("-mqtt-qos must be 0 or 1")
+	}
+
+	s := &mqttSink{
+		addr:     u.Host,
+		useTLS:   u.Scheme == "mqtts",
+		clientID: clientID,
+		topic:    topic,
+		qos:      qos,
+		retain:   retain,
+	}
+	if u.Port() == "" {
+		port := "1883"
+		if s.useTLS {
+			port = "8883"
+		}
+		s.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	return s, nil
+}
+
+func (s *mqttSink) name() string {
+	return "mqtt sink " + s.addr
+}
+
+func (s *mqttSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	topic := expandSinkTemplate(s.topic, message)
+	if topic == "" || len(topic) > 0xffff || strings.ContainsAny(topic, "+#\x00") {
+		return fmt.Errorf("invalid MQTT topic %q for the message at topic = %s, partition = %d, offset = %d", topic, message.Topic, message.Partition, message.Offset)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// sync before buffering, so a write retried after a failure isn't buffered twice
+	if len(s.unacked) >= sinkPipeline {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+	s.unacked = append(s.unacked, mqttMessage{topic: topic, payload: value})
+	return nil
+}
+
+// flush waits until the broker acknowledged every message, the barrier of a commit
+func (s *mqttSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync()
+}
+
+// sync sends the pending messages and a PINGREQ, and waits for their
+// acknowledgements. On failure the connection is closed, and the messages are
+// sent again by the next sync.
+func (s *mqttSink) sync() error {
+	if len(s.unacked) == 0 {
+		return nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	for i, m := range s.unacked {
+		flags := byte(s.qos << 1)
+		if s.retain {
+			flags |= 1
+		}
+		var body bytes.Buffer
+		writeMQTTString(&body, m.topic)
+		if s.qos > 0 {
+			// packet identifiers only need to be unique among the unacknowledged
+			id := i + 1
+			body.Write([]byte{byte(id >> 8), byte(id)})
+		}
+		body.Write(m.payload)
+		writeMQTTPacket(&data, mqttPublish<<4|flags, body.Bytes())
+	}
+	writeMQTTPacket(&data, mqttPingReq<<4, nil)
+
+	err := func() error {
+		s.conn.SetDeadline(time.Now().Add(mqttTimeout))
+		if _, err := s.conn.Write(data.Bytes()); err != nil {
+			return err
+		}
+		acks := 0
+		if s.qos == 0 {
+			acks = len(s.unacked)
+		}
+		for pong := false; !pong || acks < len(s.unacked); {
+			typ, _, err := readMQTTPacket(s.r)
+			if err != nil {
+				return err
+			}
+			switch typ {
+			case mqttPubAck:
+				acks++
+			case mqttPingResp:
+				pong = true
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	s.unacked = nil
+	return nil
+}
+
+// connect connects with a clean session unless connected already
+func (s *mqttSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	conn, err := dialSink(s.addr, s.useTLS, mqttTimeout)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+
+	// clean session, and keep alive disabled as the connection is idle between commits
+	var body bytes.Buffer
+	writeMQTTString(&body, "MQTT")
+	flags := byte(0x02)
+	if s.username != "" {
+		flags |= 0x80
+	}
+	if s.password != "" {
+		flags |= 0x40
+	}
+	body.Write([]byte{4, flags, 0, 0})
+	writeMQTTString(&body, s.clientID)
+	if s.username != "" {
+		writeMQTTString(&body, s.username)
+	}
+	if s.password != "" {
+		writeMQTTString(&body, s.password)
+	}
+	var packet bytes.Buffer
+	writeMQTTPacket(&packet, mqttConnect<<4, body.Bytes())
+
+	err = func() error {
+		conn.SetDeadline(time.Now().Add(mqttTimeout))
+		if _, err := conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+		typ, ack, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+		if typ != mqttConnAck || len(ack) != 2 {
+			return fmt.Errorf("unexpected MQTT packet type %d instead of CONNACK", typ)
+		}
+		if ack[1] != 0 {
+			reason, ok := mqttConnectCodes[ack[1]]
+			if !ok {
+				reason = fmt.Sprintf("return code %d", ack[1])
+			}
+			return fmt.Errorf("MQTT connection refused: %s", reason)
+		}
+		return nil
+	}()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.r = conn, r
+	return nil
+}
+
+// writeMQTTString writes a length prefixed UTF-8 string
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	buf.Write([]byte{byte(len(s) >> 8), byte(len(s))})
+	buf.WriteString(s)
+}
+
+// writeMQTTPacket writes a control packet with its fixed header
+func writeMQTTPacket(buf *bytes.Buffer, header byte, body []byte) {
+	buf.WriteByte(header)
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+	buf.Write(body)
+}
+
+// readMQTTPacket reads a control packet, returning its type and body
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, uint(0)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("invalid MQTT remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+func (s *mqttSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sync()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
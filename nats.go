@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// natsTimeout bounds connecting to NATS and a round trip of the pending messages
+const natsTimeout = 10 * time.Second
+
+// natsIdle is the time after which an idle connection is replaced before
+// publishing, as the server closes connections not answering its pings
+const natsIdle = time.Minute
+
+// natsSink republishes the claimed messages to NATS subjects, mapped by the
+// -nats-subject template from the topic, partition and key of the message,
+// with the Kafka headers as NATS headers.
+//
+// Core NATS acknowledges no publish, so the commit barrier sends the pending
+// messages followed by a PING and waits for the PONG: the server processed
+// every message before it. The messages are kept until then, and sent again
+// over a new connection after a failure, so subscribers may receive duplicates.
+type natsSink struct {
+	addr    string
+	useTLS  bool
+	user    string
+	pass    string
+	token   string
+	subject string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	headers bool
+	used    time.Time
+	// unacked are the messages not confirmed by a PONG yet
+	unacked []natsMessage
+}
+
+// natsMessage is a message to publish, with its encoded headers if any
+type natsMessage struct {
+	subject string
+	header  []byte
+	payload []byte
+}
+
+// newNATSSink returns the sink for a nats:// or tls:// URL with optional
+// user:password or token credentials
+func newNATSSink(natsURL, subject string) (*natsSink, error) {
+	u, err := url.Parse(natsURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("invalid -nats-url %q, expected nats:// or tls://", natsURL)
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("-nats-subject must not be empty")
+	}
+
+	s := &natsSink{addr: u.Host, useTLS: u.Scheme == "tls", subject: subject}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			s.user, s.pass = u.User.Username(), pass
+		} else {
+			s.token = u.User.Username()
+		}
+	}
+	return s, nil
+}
+
+func (s *natsSink) name() string {
+	return "nats sink " + s.addr
+}
+
+func (s *natsSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	subject := expandSinkTemplate(s.subject, message)
+	if !validNATSSubject(subject) {
+		return fmt.Errorf("invalid NATS subject %q for the message at topic = %s, partition = %d, offset = %d", subject, message.Topic, message.Partition, message.Offset)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// sync before buffering, so a write retried after a failure isn't buffered twice
+	if len(s.unacked) >= sinkPipeline {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+
+	var header bytes.Buffer
+	for _, h := range message.Headers {
+		key := string(h.Key)
+		if key == "" || strings.ContainsAny(key, ": \t\r\n") {
+			continue
+		}
+		if header.Len() == 0 {
+			header.WriteString("NATS/1.0\r\n")
+		}
+		fmt.Fprintf(&header, "%s: %s\r\n", key, strings.NewReplacer("\r", " ", "\n", " ").Replace(string(h.Value)))
+	}
+	if header.Len() > 0 {
+		header.WriteString("\r\n")
+	}
+
+	s.unacked = append(s.unacked, natsMessage{subject: subject, header: header.Bytes(), payload: value})
+	return nil
+}
+
+// validNATSSubject reports whether messages can be published to the subject:
+// dot separated, non-empty tokens without whitespace or wildcards
+func validNATSSubject(subject string) bool {
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// flush waits until the server processed every message, the barrier of a commit
+func (s *natsSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync()
+}
+
+// sync sends the pending messages and a PING, and waits for the PONG. On
+// failure the connection is closed, and the messages are sent again by the
+// next sync.
+func (s *natsSink) sync() error {
+	if len(s.unacked) == 0 {
+		return nil
+	}
+	if s.conn != nil && time.Since(s.used) > natsIdle {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	// headers are dropped for servers not supporting them
+	var data bytes.Buffer
+	for _, m := range s.unacked {
+		if len(m.header) > 0 && s.headers {
+			fmt.Fprintf(&data, "HPUB %s %d %d\r\n", m.subject, len(m.header), len(m.header)+len(m.payload))
+			data.Write(m.header)
+		} else {
+			fmt.Fprintf(&data, "PUB %s %d\r\n", m.subject, len(m.payload))
+		}
+		data.Write(m.payload)
+		data.WriteString("\r\n")
+	}
+	data.WriteString("PING\r\n")
+
+	err := func() error {
+		s.conn.SetDeadline(time.Now().Add(natsTimeout))
+		if _, err := s.conn.Write(data.Bytes()); err != nil {
+			return err
+		}
+		return s.awaitPong()
+	}()
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	s.used = time.Now()
+	s.unacked = nil
+	return nil
+}
+
+// awaitPong reads the protocol messages of the server until a PONG
+func (s *natsSink) awaitPong() error {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+		}
+	}
+}
+
+// connect connects and authenticates unless connected already
+func (s *natsSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	conn, err := dialSink(s.addr, s.useTLS, natsTimeout)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	s.conn, s.r = conn, r
+
+	err = func() error {
+		conn.SetDeadline(time.Now().Add(natsTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "INFO ") {
+			return fmt.Errorf("unexpected NATS greeting %q", strings.TrimSpace(line))
+		}
+		var info struct {
+			Headers bool `json:"headers"`
+		}
+		if err := json.Unmarshal([]byte(line[5:]), &info); err != nil {
+			return fmt.Errorf("invalid NATS INFO: %v", err)
+		}
+		s.headers = info.Headers
+
+		options := map[string]interface{}{
+			"verbose":  false,
+			"pedantic": false,
+			"name":     "kafka-consumergroup",
+			"lang":     "go",
+			"version":  "1.0.0",
+			"protocol": 1,
+			"headers":  info.Headers,
+		}
+		if s.user != "" {
+			options["user"], options["pass"] = s.user, s.pass
+		}
+		if s.token != "" {
+			options["auth_token"] = s.token
+		}
+		connect, _ := json.Marshal(options)
+		if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+			return err
+		}
+		return s.awaitPong()
+	}()
+	if err != nil {
+		conn.Close()
+		s.conn = nil
+		return err
+	}
+	s.used = time.Now()
+	return nil
+}
+
+func (s *natsSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sync()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
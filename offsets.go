@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// startPosition describes where consumption of a topic should start, as given
+// by the @position suffix of a -topics entry
+type startPosition struct {
+	// offset is either an absolute offset, sarama.OffsetOldest or sarama.OffsetNewest
+	offset int64
+	// last, when non-zero, starts this many messages before the high water mark
+	last int64
+	// rewind, when non-zero, starts at the first message produced this long ago
+	rewind time.Duration
+}
+
+// parseTopics parses the -topics flag. Every entry may carry an optional
+// @oldest, @newest, @<offset>, @-<n> or @-<duration> suffix overriding the
+// starting position of that topic, e.g. "orders@oldest,payments@-2h,audit@-1000".
+func parseTopics(spec string) ([]string, map[string]startPosition, error) {
+	var topics []string
+	positions := make(map[string]startPosition)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		topic, position := entry, ""
+		if i := strings.LastIndex(entry, "@"); i >= 0 {
+			topic, position = entry[:i], entry[i+1:]
+		}
+		if topic == "" {
+			return nil, nil, fmt.Errorf("missing topic name in %q", entry)
+		}
+		topics = append(topics, topic)
+
+		if position == "" {
+			continue
+		}
+		pos, err := parseStartPosition(position)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid position for topic %s: %v", topic, err)
+		}
+		positions[topic] = pos
+	}
+
+	return topics, positions, nil
+}
+
+func parseStartPosition(position string) (startPosition, error) {
+	switch position {
+	case "oldest":
+		return startPosition{offset: sarama.OffsetOldest}, nil
+	case "newest":
+		return startPosition{offset: sarama.OffsetNewest}, nil
+	}
+
+	n, err := strconv.ParseInt(position, 10, 64)
+	if err != nil {
+		if rewind, err := time.ParseDuration(position); err == nil && rewind < 0 {
+			return startPosition{rewind: -rewind}, nil
+		}
+		return startPosition{}, fmt.Errorf("expected oldest, newest, an offset, -N or -<duration>, got %q", position)
+	}
+	if n < 0 {
+		return startPosition{last: -n}, nil
+	}
+	return startPosition{offset: n}, nil
+}
+
+// String returns the position as given in -topics
+func (p startPosition) String() string {
+	switch {
+	case p.rewind > 0:
+		return "-" + p.rewind.String()
+	case p.last > 0:
+		return "-" + strconv.FormatInt(p.last, 10)
+	case p.offset == sarama.OffsetOldest:
+		return "oldest"
+	case p.offset == sarama.OffsetNewest:
+		return "newest"
+	}
+	return strconv.FormatInt(p.offset, 10)
+}
+
+// resolve translates the position into an absolute offset for the given partition
+func (p startPosition) resolve(client sarama.Client, topic string, partition int32) (int64, error) {
+	if p.rewind > 0 {
+		return offsetAt(client, topic, partition, time.Now().Add(-p.rewind))
+	}
+	if p.last == 0 && p.offset >= 0 {
+		return p.offset, nil
+	}
+
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+	if p.offset == sarama.OffsetOldest {
+		return oldest, nil
+	}
+
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+	if p.last == 0 {
+		return newest, nil
+	}
+
+	offset := newest - p.last
+	if offset < oldest {
+		offset = oldest
+	}
+	return offset, nil
+}
+
+// seek moves the next offset to be consumed for a partition, either forwards
+// or backwards, relative to the offset committed by the group
+func seek(session sarama.ConsumerGroupSession, topic string, partition int32, offset int64) {
+	session.MarkOffset(topic, partition, offset, "")
+	session.ResetOffset(topic, partition, offset, "")
+}
+
+// startPositionMetadata prefixes the start position recorded in the metadata
+// of the committed offsets
+const startPositionMetadata = "kafka-consumergroup start="
+
+// startPositions applies the per-topic starting positions once per group to
+// every partition. The position applied is recorded in the metadata of the
+// offsets committed for the partition, so the members the partition moves to
+// in a rebalance and restarted processes don't apply it again. The record is
+// cleared once the position is no longer configured, and a changed position
+// is applied again.
+type startPositions struct {
+	client    sarama.Client
+	positions map[string]startPosition
+	seeked    map[string]map[int32]bool
+	logger    *log.Logger
+}
+
+func newStartPositions(client sarama.Client, positions map[string]startPosition, logger *log.Logger) *startPositions {
+	return &startPositions{
+		client:    client,
+		positions: positions,
+		seeked:    make(map[string]map[int32]bool),
+		logger:    logger,
+	}
+}
+
+// metadata returns the metadata of the offsets committed for the topic,
+// recording its start position
+func (s *startPositions) metadata(topic string) string {
+	position, ok := s.positions[topic]
+	if !ok {
+		return ""
+	}
+	return startPositionMetadata + position.String()
+}
+
+// skip keeps the partition at its committed offset, as if it was seeked before
+func (s *startPositions) skip(topic string, partition int32) {
+	if s.seeked[topic] == nil {
+		s.seeked[topic] = make(map[int32]bool)
+	}
+	s.seeked[topic][partition] = true
+}
+
+// apply seeks the partitions claimed by the session that weren't seeked before
+// and returns the offsets it seeked them to. It must be called from the Setup
+// of the consumer group handler.
+func (s *startPositions) apply(session sarama.ConsumerGroupSession) (map[string]map[int32]int64, error) {
+	seeked := make(map[string]map[int32]int64)
+	for topic, partitions := range session.Claims() {
+		position, ok := s.positions[topic]
+		if !ok {
+			continue
+		}
+		if s.seeked[topic] == nil {
+			s.seeked[topic] = make(map[int32]bool)
+		}
+
+		for _, partition := range partitions {
+			if s.seeked[topic][partition] {
+				continue
+			}
+
+			offset, err := position.resolve(s.client, topic, partition)
+			if err != nil {
+				return nil, err
+			}
+			seek(session, topic, partition, offset)
+			s.seeked[topic][partition] = true
+			if seeked[topic] == nil {
+				seeked[topic] = make(map[int32]int64)
+			}
+			seeked[topic][partition] = offset
+			s.logger.Printf("Starting topic = %s, partition = %d at offset %d", topic, partition, offset)
+		}
+	}
+
+	return seeked, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// outboxLockStripes is the number of locks the aggregates are spread over
+const outboxLockStripes = 256
+
+// outboxTracker handles the events of transactional outbox topics, whose key
+// is the id of the aggregate the event belongs to. It skips the events whose
+// id header was processed already, as the relays publishing outbox tables
+// deliver at least once, and processes the events of an aggregate one at a
+// time. Aggregates showing up on another partition are logged, as the order of
+// their events is lost.
+type outboxTracker struct {
+	idHeader string
+	logger   *log.Logger
+
+	mu sync.Mutex
+	// processed are the ids of the most recently processed events
+	processed *recentKeys
+	// partitions are the partitions of the most recently seen aggregates
+	partitions *recentKeys
+
+	locks [outboxLockStripes]sync.Mutex
+}
+
+// newOutboxTracker returns the tracker of -outbox remembering window event
+// ids and aggregates, or nil when disabled
+func newOutboxTracker(enabled bool, idHeader string, window int, logger *log.Logger) *outboxTracker {
+	if !enabled {
+		return nil
+	}
+	return &outboxTracker{
+		idHeader:   idHeader,
+		logger:     logger,
+		processed:  newRecentKeys(window),
+		partitions: newRecentKeys(window),
+	}
+}
+
+// begin returns the id of the event, and reports whether it was processed
+// already. Otherwise it locks the aggregate of the event until end is called.
+func (t *outboxTracker) begin(message *sarama.ConsumerMessage) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	id, ok := header(message, t.idHeader)
+	if !ok || len(id) == 0 {
+		t.logger.Printf("Outbox event at topic = %s, partition = %d, offset = %d has no %s header, it can't be deduplicated", message.Topic, message.Partition, message.Offset, t.idHeader)
+	}
+	aggregate := string(message.Key)
+
+	t.mu.Lock()
+	if partition, seen := t.partitions.get(message.Topic + "/" + aggregate); seen && partition.(int32) != message.Partition {
+		t.logger.Printf("Outbox aggregate %s moved from partition %d to topic = %s, partition = %d, its events may be out of order", aggregate, partition, message.Topic, message.Partition)
+	}
+	t.partitions.put(message.Topic+"/"+aggregate, message.Partition)
+	t.mu.Unlock()
+
+	// duplicates of an event belong to the same aggregate, so they are checked
+	// once the event processed before them is remembered
+	lock := t.lock(aggregate)
+	lock.Lock()
+	t.mu.Lock()
+	_, duplicate := t.processed.get(string(id))
+	t.mu.Unlock()
+	if len(id) > 0 && duplicate {
+		lock.Unlock()
+		return string(id), true
+	}
+	return string(id), false
+}
+
+// end unlocks the aggregate of the event, and remembers its id when it was
+// processed successfully
+func (t *outboxTracker) end(message *sarama.ConsumerMessage, id string, processed bool) {
+	if t == nil {
+		return
+	}
+	t.lock(string(message.Key)).Unlock()
+	if processed && id != "" {
+		t.mu.Lock()
+		t.processed.put(id, nil)
+		t.mu.Unlock()
+	}
+}
+
+// lock returns the lock of the aggregate
+func (t *outboxTracker) lock(aggregate string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(aggregate))
+	return &t.locks[h.Sum32()%outboxLockStripes]
+}
+
+// recentKeys holds the values of the most recently used keys, evicting the
+// least recently used key beyond its capacity
+type recentKeys struct {
+	capacity int
+	elements map[string]*list.Element
+	order    *list.List
+}
+
+type recentKey struct {
+	key   string
+	value interface{}
+}
+
+func newRecentKeys(capacity int) *recentKeys {
+	return &recentKeys{capacity: capacity, elements: make(map[string]*list.Element), order: list.New()}
+}
+
+func (r *recentKeys) get(key string) (interface{}, bool) {
+	element, ok := r.elements[key]
+	if !ok {
+		return nil, false
+	}
+	r.order.MoveToFront(element)
+	return element.Value.(*recentKey).value, true
+}
+
+func (r *recentKeys) put(key string, value interface{}) {
+	if element, ok := r.elements[key]; ok {
+		element.Value.(*recentKey).value = value
+		r.order.MoveToFront(element)
+		return
+	}
+	r.elements[key] = r.order.PushFront(&recentKey{key: key, value: value})
+	if r.order.Len() > r.capacity {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.elements, oldest.Value.(*recentKey).key)
+	}
+}
+
+// idempotencyKey returns the key the sinks deduplicate their writes of the
+// message by: the id of an outbox event under -outbox, or else its locator
+func idempotencyKey(message *sarama.ConsumerMessage) string {
+	if *outbox {
+		if id, ok := header(message, *outboxIDHeader); ok && len(id) > 0 {
+			return string(id)
+		}
+	}
+	return string(appendLocator(nil, message))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// messageOutput receives the claimed messages instead of the consumer logger
+// when set, it is shared by all claims and closed on shutdown
+var messageOutput io.WriteCloser
+
+// topicOutputs are the -topic-outputs destinations of the claimed messages of
+// their topics, instead of messageOutput or the consumer logger
+var topicOutputs map[string]io.WriteCloser
+
+// validOutCompress reports whether mode is a supported -out-compress setting
+func validOutCompress(mode string) bool {
+	switch mode {
+	case "", "none", "gzip", "zstd":
+		return true
+	}
+	return false
+}
+
+// openOutput returns a writer compressing to w with the given -out-compress
+// mode, or nil when the output is not compressed
+func openOutput(mode string, w io.Writer) (io.WriteCloser, error) {
+	switch mode {
+	case "", "none":
+		return nil, nil
+	case "gzip":
+		return &lockedWriter{w: gzip.NewWriter(w)}, nil
+	case "zstd":
+		encoder, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &lockedWriter{w: encoder}, nil
+	}
+	return nil, fmt.Errorf("unknown output compression %q", mode)
+}
+
+// lockedWriter serializes the writes of concurrent claims to a writer
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// Close flushes and closes the underlying writer
+func (l *lockedWriter) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+// openTopicOutputs opens the destinations of a -topic-outputs list of
+// topic=destination pairs, where a destination is stdout, stderr, fd:<n> of
+// a descriptor inherited from the parent process, or a file the messages are
+// appended to. Topics with the same destination share its writer, and
+// stdout is shared with the -out-compress output. It returns the writers
+// opened, which the csv header is written to.
+func openTopicOutputs(spec, mode string) (map[string]io.WriteCloser, []io.WriteCloser, error) {
+	outputs := make(map[string]io.WriteCloser)
+	destinations := make(map[string]io.WriteCloser)
+	var opened []io.WriteCloser
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, nil, fmt.Errorf("invalid -topic-outputs entry %q, expected topic=destination", pair)
+		}
+		if _, ok := outputs[kv[0]]; ok {
+			return nil, nil, fmt.Errorf("duplicate -topic-outputs topic %q", kv[0])
+		}
+
+		w, ok := destinations[kv[1]]
+		if !ok && kv[1] == "stdout" && messageOutput != nil {
+			w, ok = messageOutput, true
+		}
+		if !ok {
+			file, err := openDestination(kv[1])
+			if err != nil {
+				return nil, nil, err
+			}
+			if w, err = openOutput(mode, file); err != nil {
+				return nil, nil, err
+			}
+			if w == nil {
+				w = &lockedWriter{w: outputFile(file)}
+			} else {
+				w = &fileOutput{WriteCloser: w, file: outputFile(file)}
+			}
+			opened = append(opened, w)
+		}
+		destinations[kv[1]] = w
+		outputs[kv[0]] = w
+	}
+	return outputs, opened, nil
+}
+
+// openDestination opens a -topic-outputs destination
+func openDestination(destination string) (*os.File, error) {
+	switch {
+	case destination == "stdout":
+		return os.Stdout, nil
+	case destination == "stderr":
+		return os.Stderr, nil
+	case strings.HasPrefix(destination, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(destination, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid -topic-outputs destination %q, expected fd:<n>", destination)
+		}
+		file := os.NewFile(uintptr(fd), destination)
+		if file == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		// fail at startup rather than on the first message when the descriptor isn't open
+		if _, err := file.Stat(); err != nil {
+			return nil, fmt.Errorf("unable to use the -topic-outputs destination %s: %v", destination, err)
+		}
+		return file, nil
+	}
+	return os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// standardStream is stdout or stderr as an output. Closing it leaves the
+// stream open, as the logger and -summary-json write to it until the exit.
+type standardStream struct {
+	io.Writer
+}
+
+func (standardStream) Close() error {
+	return nil
+}
+
+// outputFile returns the file as an output, one that isn't closed for stdout
+// and stderr
+func outputFile(file *os.File) io.WriteCloser {
+	if file == os.Stdout || file == os.Stderr {
+		return standardStream{file}
+	}
+	return file
+}
+
+// fileOutput is a compressed output of a file, closing the file after
+// flushing the compressed stream
+type fileOutput struct {
+	io.WriteCloser
+	file io.Closer
+}
+
+func (f *fileOutput) Close() error {
+	err := f.WriteCloser.Close()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// closeTopicOutputs flushes and closes the -topic-outputs destinations other
+// than the shared messageOutput
+func closeTopicOutputs() error {
+	closed := make(map[io.WriteCloser]bool)
+	var err error
+	for _, w := range topicOutputs {
+		if w == messageOutput || closed[w] {
+			continue
+		}
+		closed[w] = true
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// parquetMagic starts and ends every Parquet file
+const parquetMagic = "PAR1"
+
+// Physical types of Parquet columns
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Converted types annotating the physical types, parquetPlain for none
+const (
+	parquetPlain           = -1
+	parquetUTF8            = 0
+	parquetDate            = 6
+	parquetTimestampMillis = 9
+	parquetTimestampMicros = 10
+	parquetJSON            = 19
+)
+
+// Encodings, page types and repetition types used by the writer
+const (
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetDataPage      = 0
+	parquetOptional      = 1
+)
+
+// parquetCodecs are the supported -parquet-compression codecs by their Parquet id
+var parquetCodecs = map[string]int32{
+	"none":   0,
+	"snappy": 1,
+	"gzip":   2,
+	"zstd":   6,
+}
+
+// parquetColumn is an optional column of a flat Parquet schema
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32
+}
+
+// parquetWriter writes rows to a Parquet file with a flat schema of optional
+// columns. Rows are buffered until a row group is complete, which is written
+// as a single PLAIN encoded data page per column. Only what the Parquet sink
+// needs of the format is implemented, without statistics or dictionaries.
+type parquetWriter struct {
+	w            io.Writer
+	offset       int64
+	columns      []parquetColumn
+	codec        int32
+	rowGroupSize int
+
+	chunks    []*parquetChunk
+	rows      int
+	rowGroups []parquetRowGroup
+	numRows   int64
+}
+
+// parquetChunk buffers the values of a column in the current row group
+type parquetChunk struct {
+	levels []byte
+	values []byte
+	bools  []bool
+}
+
+// parquetRowGroup is the metadata of a written row group
+type parquetRowGroup struct {
+	columns []parquetChunkMeta
+	size    int64
+	rows    int64
+}
+
+// parquetChunkMeta is the metadata of a written column chunk
+type parquetChunkMeta struct {
+	offset       int64
+	uncompressed int64
+	compressed   int64
+	values       int64
+}
+
+// newParquetWriter writes the magic number and returns the writer
+func newParquetWriter(w io.Writer, columns []parquetColumn, codec int32, rowGroupSize int) (*parquetWriter, error) {
+	if _, err := io.WriteString(w, parquetMagic); err != nil {
+		return nil, err
+	}
+	pw := &parquetWriter{
+		w:            w,
+		offset:       int64(len(parquetMagic)),
+		columns:      columns,
+		codec:        codec,
+		rowGroupSize: rowGroupSize,
+	}
+	pw.resetChunks()
+	return pw, nil
+}
+
+func (pw *parquetWriter) resetChunks() {
+	pw.chunks = make([]*parquetChunk, len(pw.columns))
+	for i := range pw.chunks {
+		pw.chunks[i] = &parquetChunk{}
+	}
+	pw.rows = 0
+}
+
+// writeRow appends a row with a value per column, values that are nil or
+// don't convert to the type of their column are written as null
+func (pw *parquetWriter) writeRow(values []interface{}) error {
+	for i, column := range pw.columns {
+		chunk := pw.chunks[i]
+		if chunk.append(column.typ, values[i]) {
+			chunk.levels = append(chunk.levels, 1)
+		} else {
+			chunk.levels = append(chunk.levels, 0)
+		}
+	}
+	pw.rows++
+	if pw.rows >= pw.rowGroupSize {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// append appends the PLAIN encoding of the value, it returns false for null
+func (chunk *parquetChunk) append(typ int32, value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	var scratch [8]byte
+	switch typ {
+	case parquetBoolean:
+		b, ok := value.(bool)
+		if !ok {
+			return false
+		}
+		chunk.bools = append(chunk.bools, b)
+	case parquetInt32:
+		i, ok := parquetInt(value)
+		if !ok {
+			return false
+		}
+		binary.LittleEndian.PutUint32(scratch[:], uint32(int32(i)))
+		chunk.values = append(chunk.values, scratch[:4]...)
+	case parquetInt64:
+		i, ok := parquetInt(value)
+		if !ok {
+			return false
+		}
+		binary.LittleEndian.PutUint64(scratch[:], uint64(i))
+		chunk.values = append(chunk.values, scratch[:8]...)
+	case parquetFloat:
+		f, ok := parquetFloat64(value)
+		if !ok {
+			return false
+		}
+		binary.LittleEndian.PutUint32(scratch[:], math.Float32bits(float32(f)))
+		chunk.values = append(chunk.values, scratch[:4]...)
+	case parquetDouble:
+		f, ok := parquetFloat64(value)
+		if !ok {
+			return false
+		}
+		binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(f))
+		chunk.values = append(chunk.values, scratch[:8]...)
+	default:
+		var data []byte
+		switch value := value.(type) {
+		case []byte:
+			data = value
+		case string:
+			data = []byte(value)
+		case json.Number:
+			data = []byte(value)
+		default:
+			var err error
+			if data, err = json.Marshal(value); err != nil {
+				return false
+			}
+		}
+		binary.LittleEndian.PutUint32(scratch[:], uint32(len(data)))
+		chunk.values = append(chunk.values, scratch[:4]...)
+		chunk.values = append(chunk.values, data...)
+	}
+	return true
+}
+
+// parquetInt converts a decoded JSON or Avro number to an integer
+func parquetInt(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int64:
+		return value, true
+	case int32:
+		return int64(value), true
+	case int:
+		return int64(value), true
+	case float64:
+		return int64(value), true
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i, true
+		}
+		f, err := value.Float64()
+		return int64(f), err == nil
+	}
+	return 0, false
+}
+
+// parquetFloat64 converts a decoded JSON or Avro number to a float
+func parquetFloat64(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// flushRowGroup writes the buffered rows as a row group
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{rows: int64(pw.rows)}
+	for i, column := range pw.columns {
+		chunk := pw.chunks[i]
+		if column.typ == parquetBoolean {
+			chunk.values = packBools(chunk.bools)
+		}
+
+		page := appendLevels(nil, chunk.levels)
+		page = append(page, chunk.values...)
+		compressed, err := parquetCompress(pw.codec, page)
+		if err != nil {
+			return err
+		}
+
+		var header thriftWriter
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(compressed)))
+		header.beginStruct(5)
+		header.i32(1, int32(pw.rows))
+		header.i32(2, parquetEncodingPlain)
+		header.i32(3, parquetEncodingRLE)
+		header.i32(4, parquetEncodingRLE)
+		header.endStruct()
+		header.end()
+
+		meta := parquetChunkMeta{
+			offset:       pw.offset,
+			uncompressed: int64(len(header.buf) + len(page)),
+			compressed:   int64(len(header.buf) + len(compressed)),
+			values:       int64(pw.rows),
+		}
+		if err := pw.write(header.buf); err != nil {
+			return err
+		}
+		if err := pw.write(compressed); err != nil {
+			return err
+		}
+		group.columns = append(group.columns, meta)
+		group.size += meta.uncompressed
+	}
+
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.numRows += group.rows
+	pw.resetChunks()
+	return nil
+}
+
+func (pw *parquetWriter) write(data []byte) error {
+	n, err := pw.w.Write(data)
+	pw.offset += int64(n)
+	return err
+}
+
+// close writes the buffered rows and the footer, it doesn't close the underlying writer
+func (pw *parquetWriter) close() error {
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+
+	var footer thriftWriter
+	footer.i32(1, 1)
+	footer.listHeader(2, thriftStruct, len(pw.columns)+1)
+	footer.beginElement()
+	footer.binary(4, []byte("schema"))
+	footer.i32(5, int32(len(pw.columns)))
+	footer.endStruct()
+	for _, column := range pw.columns {
+		footer.beginElement()
+		footer.i32(1, column.typ)
+		footer.i32(3, parquetOptional)
+		footer.binary(4, []byte(column.name))
+		if column.converted != parquetPlain {
+			footer.i32(6, column.converted)
+		}
+		footer.endStruct()
+	}
+	footer.i64(3, pw.numRows)
+	footer.listHeader(4, thriftStruct, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		footer.beginElement()
+		footer.listHeader(1, thriftStruct, len(group.columns))
+		for i, chunk := range group.columns {
+			column := pw.columns[i]
+			footer.beginElement()
+			footer.i64(2, chunk.offset)
+			footer.beginStruct(3)
+			footer.i32(1, column.typ)
+			footer.listHeader(2, thriftI32, 2)
+			footer.varint(parquetEncodingPlain)
+			footer.varint(parquetEncodingRLE)
+			footer.listHeader(3, thriftBinary, 1)
+			footer.bytes([]byte(column.name))
+			footer.i32(4, pw.codec)
+			footer.i64(5, chunk.values)
+			footer.i64(6, chunk.uncompressed)
+			footer.i64(7, chunk.compressed)
+			footer.i64(9, chunk.offset)
+			footer.endStruct()
+			footer.endStruct()
+		}
+		footer.i64(2, group.size)
+		footer.i64(3, group.rows)
+		footer.endStruct()
+	}
+	footer.binary(6, []byte("kafka-consumergroup"))
+	footer.end()
+
+	if err := pw.write(footer.buf); err != nil {
+		return err
+	}
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(footer.buf)))
+	if err := pw.write(trailer[:]); err != nil {
+		return err
+	}
+	return pw.write([]byte(parquetMagic))
+}
+
+// appendLevels appends the definition levels in the RLE encoding with a bit
+// width of 1, prefixed by their length
+func appendLevels(buf []byte, levels []byte) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	for i := 0; i < len(levels); {
+		run := 1
+		for i+run < len(levels) && levels[i+run] == levels[i] {
+			run++
+		}
+		buf = binary.AppendUvarint(buf, uint64(run)<<1)
+		buf = append(buf, levels[i])
+		i += run
+	}
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+	return buf
+}
+
+// packBools returns the PLAIN encoding of booleans, one bit each
+func packBools(bools []bool) []byte {
+	packed := make([]byte, (len(bools)+7)/8)
+	for i, b := range bools {
+		if b {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return packed
+}
+
+// parquetCompress compresses a page with the codec
+// zstdEncoder returns the encoder shared by the parquet writers, whose
+// EncodeAll is safe for concurrent use
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+func parquetCompress(codec int32, page []byte) ([]byte, error) {
+	switch codec {
+	case parquetCodecs["snappy"]:
+		return snappy.Encode(nil, page), nil
+	case parquetCodecs["gzip"]:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(page)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case parquetCodecs["zstd"]:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(page, nil), nil
+	case parquetCodecs["none"]:
+		return page, nil
+	}
+	return nil, fmt.Errorf("unknown parquet codec %d", codec)
+}
+
+// Types of the Thrift compact protocol
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the structures of the Parquet metadata in the Thrift
+// compact protocol. Fields must be written in the order of their ids.
+type thriftWriter struct {
+	buf []byte
+	// last field id written in each open struct
+	last []int16
+}
+
+func (w *thriftWriter) fieldHeader(id int16, typ byte) {
+	if len(w.last) == 0 {
+		w.last = []int16{0}
+	}
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.varint(int64(id))
+	}
+	*last = id
+}
+
+// varint appends a zigzag encoded integer
+func (w *thriftWriter) varint(v int64) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(v<<1^v>>63))
+}
+
+// bytes appends a length prefixed binary
+func (w *thriftWriter) bytes(v []byte) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.fieldHeader(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.fieldHeader(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) binary(id int16, v []byte) {
+	w.fieldHeader(id, thriftBinary)
+	w.bytes(v)
+}
+
+// listHeader starts a list field of size elements of the type
+func (w *thriftWriter) listHeader(id int16, elem byte, size int) {
+	w.fieldHeader(id, thriftList)
+	if size < 15 {
+		w.buf = append(w.buf, byte(size)<<4|elem)
+		return
+	}
+	w.buf = append(w.buf, 0xf0|elem)
+	w.buf = binary.AppendUvarint(w.buf, uint64(size))
+}
+
+// beginStruct starts a struct field, ended by endStruct
+func (w *thriftWriter) beginStruct(id int16) {
+	w.fieldHeader(id, thriftStruct)
+	w.last = append(w.last, 0)
+}
+
+// beginElement starts a struct element of a list, ended by endStruct
+func (w *thriftWriter) beginElement() {
+	if len(w.last) == 0 {
+		w.last = []int16{0}
+	}
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) endStruct() {
+	w.buf = append(w.buf, 0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+// end ends the top level struct
+func (w *thriftWriter) end() {
+	w.buf = append(w.buf, 0)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// thriftReader decodes the Thrift compact protocol into structs of fields by
+// id, lists, int64 and []byte values
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		panic("invalid varint")
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := int(r.uvarint())
+		v := r.buf[r.pos : r.pos+n]
+		r.pos += n
+		return v
+	case thriftList:
+		header := r.byte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		fields := make(map[int16]interface{})
+		var id int16
+		for {
+			header := r.byte()
+			if header == 0 {
+				return fields
+			}
+			if delta := int16(header >> 4); delta != 0 {
+				id += delta
+			} else {
+				id = int16(r.varint())
+			}
+			fields[id] = r.value(header & 0x0f)
+		}
+	}
+	panic(fmt.Sprintf("unsupported thrift type %d", typ))
+}
+
+// readParquet reads back a file of the parquetWriter, returning the names of
+// the columns and the rows, with int64, float64, bool, []byte or nil values
+func readParquet(t *testing.T, data []byte) ([]string, [][]interface{}) {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte(parquetMagic)) || !bytes.HasSuffix(data, []byte(parquetMagic)) {
+		t.Fatalf("missing the magic number")
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := (&thriftReader{buf: data[len(data)-8-size : len(data)-8]}).value(thriftStruct).(map[int16]interface{})
+
+	var names []string
+	var types []int64
+	for _, element := range footer[2].([]interface{})[1:] {
+		fields := element.(map[int16]interface{})
+		names = append(names, string(fields[4].([]byte)))
+		types = append(types, fields[1].(int64))
+	}
+
+	var rows [][]interface{}
+	for _, group := range footer[4].([]interface{}) {
+		groupFields := group.(map[int16]interface{})
+		groupRows := make([][]interface{}, groupFields[3].(int64))
+		for i := range groupRows {
+			groupRows[i] = make([]interface{}, len(names))
+		}
+		for c, chunk := range groupFields[1].([]interface{}) {
+			meta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			r := &thriftReader{buf: data, pos: int(meta[9].(int64))}
+			header := r.value(thriftStruct).(map[int16]interface{})
+			compressed := data[r.pos : r.pos+int(header[3].(int64))]
+			page := decompressParquet(t, int32(meta[4].(int64)), compressed)
+			if len(page) != int(header[2].(int64)) {
+				t.Fatalf("column %s: page of %d bytes, expected %d", names[c], len(page), header[2])
+			}
+
+			levels, values := readLevels(t, page, len(groupRows))
+			for i := range groupRows {
+				if levels[i] == 0 {
+					continue
+				}
+				var value interface{}
+				switch types[c] {
+				case parquetBoolean:
+					// the values are bit packed over the defined rows only
+					value = values[0]&1 == 1
+					values[0] >>= 1
+					if levelsBefore(levels, i)%8 == 7 {
+						values = values[1:]
+					}
+				case parquetInt32:
+					value = int64(int32(binary.LittleEndian.Uint32(values)))
+					values = values[4:]
+				case parquetInt64:
+					value = int64(binary.LittleEndian.Uint64(values))
+					values = values[8:]
+				case parquetFloat:
+					value = float64(math.Float32frombits(binary.LittleEndian.Uint32(values)))
+					values = values[4:]
+				case parquetDouble:
+					value = math.Float64frombits(binary.LittleEndian.Uint64(values))
+					values = values[8:]
+				default:
+					n := int(binary.LittleEndian.Uint32(values))
+					value = values[4 : 4+n]
+					values = values[4+n:]
+				}
+				groupRows[i][c] = value
+			}
+		}
+		rows = append(rows, groupRows...)
+	}
+	if int64(len(rows)) != footer[3].(int64) {
+		t.Fatalf("read %d rows, the footer has %d", len(rows), footer[3])
+	}
+	return names, rows
+}
+
+// levelsBefore returns the number of defined rows before row i
+func levelsBefore(levels []byte, i int) int {
+	n := 0
+	for _, level := range levels[:i] {
+		n += int(level)
+	}
+	return n
+}
+
+// readLevels decodes the RLE definition levels of n rows at the start of the
+// page and returns them with the values following them
+func readLevels(t *testing.T, page []byte, n int) ([]byte, []byte) {
+	t.Helper()
+	size := int(binary.LittleEndian.Uint32(page))
+	r := &thriftReader{buf: page[4 : 4+size]}
+	var levels []byte
+	for r.pos < len(r.buf) {
+		header := r.uvarint()
+		if header&1 != 0 {
+			t.Fatalf("unexpected bit packed run of definition levels")
+		}
+		level := r.byte()
+		for i := uint64(0); i < header>>1; i++ {
+			levels = append(levels, level)
+		}
+	}
+	if len(levels) != n {
+		t.Fatalf("read %d definition levels, expected %d", len(levels), n)
+	}
+	return levels, page[4+size:]
+}
+
+func decompressParquet(t *testing.T, codec int32, data []byte) []byte {
+	t.Helper()
+	var page []byte
+	var err error
+	switch codec {
+	case parquetCodecs["none"]:
+		page = data
+	case parquetCodecs["snappy"]:
+		page, err = snappy.Decode(nil, data)
+	case parquetCodecs["gzip"]:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			page, err = ioutil.ReadAll(r)
+		}
+	case parquetCodecs["zstd"]:
+		var decoder *zstd.Decoder
+		if decoder, err = zstdDecoder(); err == nil {
+			page, err = decoder.DecodeAll(data, nil)
+		}
+	default:
+		t.Fatalf("unknown codec %d", codec)
+	}
+	if err != nil {
+		t.Fatalf("unable to decompress a page: %v", err)
+	}
+	return page
+}
+
+func TestParquetWriterRoundTrip(t *testing.T) {
+	columns := []parquetColumn{
+		{name: "flag", typ: parquetBoolean, converted: parquetPlain},
+		{name: "count", typ: parquetInt32, converted: parquetPlain},
+		{name: "id", typ: parquetInt64, converted: parquetPlain},
+		{name: "ratio", typ: parquetFloat, converted: parquetPlain},
+		{name: "amount", typ: parquetDouble, converted: parquetPlain},
+		{name: "name", typ: parquetByteArray, converted: parquetUTF8},
+	}
+	rows := [][]interface{}{
+		{true, int64(1), int64(1) << 40, 0.5, 1.25, []byte("a")},
+		{nil, nil, nil, nil, nil, nil},
+		{false, int64(-3), int64(-7), -2.0, 3.5, []byte("")},
+		{true, int64(7), int64(9), 1.0, -0.125, []byte("ccc")},
+		{true, nil, int64(0), nil, 1e100, nil},
+	}
+
+	for codecName, codec := range parquetCodecs {
+		t.Run(codecName, func(t *testing.T) {
+			var buf bytes.Buffer
+			// a row group of 2 rows writes 3 row groups, the last one by close
+			w, err := newParquetWriter(&buf, columns, codec, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, row := range rows {
+				if err := w.writeRow(row); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			names, got := readParquet(t, buf.Bytes())
+			if want := []string{"flag", "count", "id", "ratio", "amount", "name"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("columns = %v, want %v", names, want)
+			}
+			if !reflect.DeepEqual(got, rows) {
+				t.Errorf("rows = %v, want %v", got, rows)
+			}
+		})
+	}
+}
+
+func TestParquetSinkRetriesPendingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newParquetSink(dir, "snappy", 100, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	write := func(offset int64) {
+		message := &sarama.ConsumerMessage{Topic: "orders", Partition: 0, Offset: offset, Timestamp: ts, Key: []byte("k"), Value: []byte("v")}
+		if err := s.write(message, message.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(0)
+	write(1)
+	// a directory in the way of the rename makes the first flush fail
+	var blocked string
+	for _, f := range s.files {
+		blocked = strings.TrimSuffix(f.tmp.Name(), ".tmp")
+	}
+	if err := os.Mkdir(blocked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flush(commitPoint{}); err == nil {
+		t.Fatal("flush succeeded with the rename blocked")
+	}
+
+	// the messages after the failure go to a new file
+	write(2)
+	if err := os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flush(commitPoint{}); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "orders", "date=2024-05-01", "hour=13", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".parquet") {
+			t.Fatalf("unexpected file %s", path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, rows := readParquet(t, data)
+		for _, row := range rows {
+			if !reflect.DeepEqual(row[3:], []interface{}{[]byte("k"), []byte("v")}) {
+				t.Errorf("row = %v, want key k and value v", row)
+			}
+			offsets = append(offsets, row[1].(int64))
+		}
+	}
+	if len(paths) != 2 || len(offsets) != 3 || offsets[0]+offsets[1]+offsets[2] != 3 {
+		t.Errorf("files = %v with offsets %v, want 2 files with offsets 0, 1 and 2", paths, offsets)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// parquetMetadataColumns precede the columns of the value in every file
+var parquetMetadataColumns = []parquetColumn{
+	{name: "_partition", typ: parquetInt32, converted: parquetPlain},
+	{name: "_offset", typ: parquetInt64, converted: parquetPlain},
+	{name: "_timestamp", typ: parquetInt64, converted: parquetTimestampMillis},
+	{name: "_key", typ: parquetByteArray, converted: parquetPlain},
+}
+
+// parquetSink writes the claimed messages to Parquet files below -parquet-dir,
+// a local directory or an s3://bucket/prefix, laid out for data lakes as
+// <topic>/date=<yyyy-mm-dd>/hour=<hh> by the UTC timestamps of the messages.
+//
+// With a -schema-registry the columns are the fields of the latest Avro or
+// JSON Schema of the <topic>-value subject, and Avro values serialized with
+// the registry are decoded with their writer schema. Without a schema the raw
+// value is written to a value column.
+//
+// Every commit barrier completes the open files: local files are renamed
+// from their .tmp name once complete, and files for S3 are staged in the
+// temporary directory and uploaded. A long -commit-interval makes for fewer,
+// larger files.
+type parquetSink struct {
+	dir          string
+	s3           *s3Location
+	registry     *schemaRegistry
+	codec        int32
+	rowGroupSize int
+
+	mu    sync.Mutex
+	files map[string]*parquetFile
+	// pending are the files with their footer written that are yet to be
+	// renamed or uploaded, retried by the next flush
+	pending []*parquetFile
+	// err is the failure to write the footer of a file. Its rows are in no
+	// file, so no offset may be committed anymore.
+	err error
+}
+
+// parquetFile is an open file of a partition directory
+type parquetFile struct {
+	// key is the object key, or the path relative to the local directory
+	key    string
+	tmp    *os.File
+	writer *parquetWriter
+	table  *parquetTable
+}
+
+// parquetTable is the layout of the files of a topic
+type parquetTable struct {
+	columns []parquetColumn
+	// format of the values the columns are read from: avro, json or raw
+	format string
+}
+
+func newParquetSink(dir, compression string, rowGroupSize int, registryURL, s3Endpoint, s3Region string) (*parquetSink, error) {
+	codec, ok := parquetCodecs[compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown -parquet-compression %q, expected none, snappy, gzip or zstd", compression)
+	}
+	if rowGroupSize <= 0 {
+		return nil, fmt.Errorf("-parquet-row-group-size must be positive")
+	}
+
+	s := &parquetSink{
+		dir:          dir,
+		codec:        codec,
+		rowGroupSize: rowGroupSize,
+		files:        make(map[string]*parquetFile),
+	}
+	if strings.HasPrefix(dir, "s3://") {
+		var err error
+		if s.s3, err = parseS3Location(dir, s3Endpoint, s3Region); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if registryURL != "" {
+		s.registry = newSchemaRegistry(registryURL)
+	}
+	return s, nil
+}
+
+func (s *parquetSink) name() string {
+	return "parquet sink " + s.dir
+}
+
+func (s *parquetSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := message.Timestamp.UTC()
+	dir := fmt.Sprintf("%s/date=%s/hour=%s", message.Topic, ts.Format("2006-01-02"), ts.Format("15"))
+	f, ok := s.files[dir]
+	if !ok {
+		var err error
+		if f, err = s.open(message.Topic, dir); err != nil {
+			return err
+		}
+		s.files[dir] = f
+	}
+	return f.writer.writeRow(s.row(f.table, message, value))
+}
+
+// open starts a new file in the partition directory with the current schema of the topic
+func (s *parquetSink) open(topic, dir string) (*parquetFile, error) {
+	table, err := s.table(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &parquetFile{
+		key:   fmt.Sprintf("%s/part-%d-%08x.parquet", dir, time.Now().UnixNano(), rand.Uint32()),
+		table: table,
+	}
+	if s.s3 != nil {
+		f.tmp, err = ioutil.TempFile("", "parquet-*")
+	} else {
+		path := filepath.Join(s.dir, filepath.FromSlash(f.key))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			f.tmp, err = os.Create(path + ".tmp")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.writer, err = newParquetWriter(f.tmp, table.columns, s.codec, s.rowGroupSize); err != nil {
+		f.tmp.Close()
+		os.Remove(f.tmp.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// table returns the layout of the files of the topic, by the latest schema of
+// its value subject
+func (s *parquetSink) table(topic string) (*parquetTable, error) {
+	raw := &parquetTable{
+		columns: append(parquetMetadataColumns[:len(parquetMetadataColumns):len(parquetMetadataColumns)], parquetColumn{name: "value", typ: parquetByteArray, converted: parquetPlain}),
+		format:  "raw",
+	}
+	if s.registry == nil {
+		return raw, nil
+	}
+
+	schema, err := s.registry.latest(topic)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up the schema of topic %s: %v", topic, err)
+	}
+	if schema == nil {
+		return raw, nil
+	}
+
+	var columns []parquetColumn
+	table := &parquetTable{}
+	switch schema.SchemaType {
+	case "AVRO":
+		t, err := parseAvroSchema(schema.Schema)
+		if err != nil {
+			return nil, err
+		}
+		columns, err = avroParquetColumns(t)
+		if err != nil {
+			return nil, err
+		}
+		table.format = "avro"
+	case "JSON":
+		if columns, err = jsonSchemaParquetColumns(schema.Schema); err != nil {
+			return nil, err
+		}
+		table.format = "json"
+	default:
+		log.Printf("Schema type %s of topic %s isn't supported by the parquet sink, writing the raw values", schema.SchemaType, topic)
+		return raw, nil
+	}
+	table.columns = append(parquetMetadataColumns[:len(parquetMetadataColumns):len(parquetMetadataColumns)], columns...)
+	return table, nil
+}
+
+// row returns the values of the columns of the table for the message
+func (s *parquetSink) row(table *parquetTable, message *sarama.ConsumerMessage, value []byte) []interface{} {
+	row := make([]interface{}, 0, len(table.columns))
+	row = append(row, int64(message.Partition), message.Offset, message.Timestamp.UnixNano()/int64(time.Millisecond), nilBytes(message.Key))
+	if table.format == "raw" {
+		return append(row, nilBytes(value))
+	}
+
+	fields, err := s.decode(table.format, value)
+	if err != nil {
+		log.Printf("Unable to decode the value at topic = %s, partition = %d, offset = %d, writing its metadata only: %v", message.Topic, message.Partition, message.Offset, err)
+	}
+	for _, column := range table.columns[len(row):] {
+		row = append(row, fields[column.name])
+	}
+	return row
+}
+
+// decode decodes an Avro or JSON value to its fields
+func (s *parquetSink) decode(format string, value []byte) (map[string]interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	var doc interface{}
+	id, payload, wire := registryWireFormat(value)
+	switch {
+	case format == "avro" && wire:
+		t, err := s.registry.avroSchema(id)
+		if err != nil {
+			return nil, err
+		}
+		r := &avroReader{data: payload}
+		if doc, err = r.decode(t); err != nil {
+			return nil, err
+		}
+	case wire:
+		value = payload
+		fallthrough
+	default:
+		var err error
+		if doc, err = decodeJSON(value); err != nil {
+			return nil, err
+		}
+	}
+
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("value isn't an object")
+	}
+	return fields, nil
+}
+
+// nilBytes returns nil for a nil slice, which is written as null
+func nilBytes(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return b
+}
+
+// flush completes every open file and moves the completed files to their
+// final location, the barrier of a commit. The files whose move fails stay
+// pending and are retried by the next flush, while the messages written in
+// the meantime go to new files.
+func (s *parquetSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for dir, f := range s.files {
+		// no row may be written after the footer, not even when it fails
+		delete(s.files, dir)
+		if err := s.finish(f); err != nil {
+			f.tmp.Close()
+			os.Remove(f.tmp.Name())
+			s.err = fmt.Errorf("unable to write the footer of %s: %v", f.key, err)
+			break
+		}
+		s.pending = append(s.pending, f)
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	for len(s.pending) > 0 {
+		f := s.pending[0]
+		if err := s.move(f); err != nil {
+			return fmt.Errorf("unable to complete %s: %v", f.key, err)
+		}
+		s.pending = s.pending[1:]
+	}
+	return nil
+}
+
+// finish writes the footer of the file and syncs it
+func (s *parquetSink) finish(f *parquetFile) error {
+	if err := f.writer.close(); err != nil {
+		return err
+	}
+	return f.tmp.Sync()
+}
+
+// move moves a finished file to its final location: a local file is renamed
+// from its .tmp name, a file for S3 is uploaded and removed
+func (s *parquetSink) move(f *parquetFile) error {
+	if s.s3 == nil {
+		// synced already, closing again on a retry fails harmlessly
+		f.tmp.Close()
+		return os.Rename(f.tmp.Name(), strings.TrimSuffix(f.tmp.Name(), ".tmp"))
+	}
+
+	if _, err := f.tmp.Seek(0, 0); err != nil {
+		return err
+	}
+	if err := s.s3.putFile(f.key, f.tmp); err != nil {
+		return err
+	}
+	f.tmp.Close()
+	return os.Remove(f.tmp.Name())
+}
+
+func (s *parquetSink) close() error {
+	return s.flush(commitPoint{})
+}
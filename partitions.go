@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// partitionCountChange is the JSON body posted to -partition-change-webhook
+type partitionCountChange struct {
+	Consumer  string    `json:"consumer,omitempty"`
+	Group     string    `json:"group"`
+	Topic     string    `json:"topic"`
+	Previous  int       `json:"previous"`
+	Current   int       `json:"current"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// partitionCountLoop refreshes the metadata of the topics every
+// -partition-check-interval until the consumer is closed, reporting the
+// topics whose number of partitions changed. Sarama rebalances the group on
+// its own when it notices, but silently: the partitioner of the producers now
+// maps keys to other partitions, which breaks the ordering per key across the
+// change.
+func (consumer *Consumer) partitionCountLoop() {
+	ticker := time.NewTicker(*partitionCheckInterval)
+	defer ticker.Stop()
+
+	counts := make(map[string]int)
+	for {
+		consumer.checkPartitionCounts(counts)
+
+		select {
+		case <-ticker.C:
+		case <-consumer.ctx.Done():
+			return
+		}
+	}
+}
+
+// checkPartitionCounts compares the number of partitions of every topic with
+// counts, reports the changes and updates counts
+func (consumer *Consumer) checkPartitionCounts(counts map[string]int) {
+	settings := consumer.settings()
+	if err := consumer.client.RefreshMetadata(settings.topicNames...); err != nil {
+		consumer.logger.Printf("Unable to refresh the metadata of %v: %v", settings.topicNames, err)
+		return
+	}
+
+	for _, topic := range settings.topicNames {
+		partitions, err := consumer.client.Partitions(topic)
+		if err != nil {
+			consumer.logger.Printf("Unable to look up the partitions of topic = %s: %v", topic, err)
+			continue
+		}
+		metrics.GetOrRegisterGauge("partitions-for-topic-"+topic, consumer.registry).Update(int64(len(partitions)))
+
+		previous, known := counts[topic]
+		counts[topic] = len(partitions)
+		if !known || previous == len(partitions) {
+			continue
+		}
+		consumer.reportPartitionCountChange(partitionCountChange{
+			Consumer:  settings.Name,
+			Group:     settings.Group,
+			Topic:     topic,
+			Previous:  previous,
+			Current:   len(partitions),
+			Timestamp: time.Now(),
+		})
+	}
+}
+
+// reportPartitionCountChange logs the change, counts it in the
+// partition-count-changes metric and posts it to -partition-change-webhook
+func (consumer *Consumer) reportPartitionCountChange(change partitionCountChange) {
+	metrics.GetOrRegisterCounter("partition-count-changes", consumer.registry).Inc(1)
+	consumer.logger.Printf("Partition count changed: topic = %s, previous = %d, current = %d. The group rebalances, and keys hashed by the partitioner of the producers map to other partitions from now on, so messages of a key may be processed out of order across the change", change.Topic, change.Previous, change.Current)
+
+	if *partitionChangeWebhook == "" {
+		return
+	}
+	if err := postAlert(*partitionChangeWebhook, change); err != nil {
+		consumer.logger.Printf("Unable to post the partition count change: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// pinningStrategyName is the protocol name of the pinning strategy in the group
+const pinningStrategyName = "pinning"
+
+// pinningRule pins partitions of a topic to the members carrying a label, all
+// partitions of the topic when Partitions is empty
+type pinningRule struct {
+	Topic      string  `json:"topic"`
+	Partitions []int32 `json:"partitions"`
+	Label      string  `json:"label"`
+}
+
+// matches reports whether the rule pins the partition
+func (r pinningRule) matches(topic string, partition int32) bool {
+	if r.Topic != topic {
+		return false
+	}
+	if len(r.Partitions) == 0 {
+		return true
+	}
+	for _, p := range r.Partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPinningRules reads the JSON array of rules of a -pinning-file
+func loadPinningRules(path string) ([]pinningRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []pinningRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	for i, rule := range rules {
+		if rule.Topic == "" || rule.Label == "" {
+			return nil, fmt.Errorf("%s: rule %d requires a topic and a label", path, i)
+		}
+	}
+	return rules, nil
+}
+
+// labeledUserData is the user data of a member joining with -member-labels,
+// wrapping its -member-user-data
+type labeledUserData struct {
+	Labels   []string `json:"labels"`
+	UserData string   `json:"user-data,omitempty"`
+}
+
+// encodeMemberLabels returns the user data announcing the labels of this member
+func encodeMemberLabels(labels, userData string) []byte {
+	m := labeledUserData{UserData: userData}
+	for _, label := range strings.Split(labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			m.Labels = append(m.Labels, label)
+		}
+	}
+	data, _ := json.Marshal(m)
+	return data
+}
+
+// decodeMemberLabels returns the labels in the user data of a member, none
+// when it didn't join with -member-labels
+func decodeMemberLabels(userData []byte) map[string]bool {
+	var m labeledUserData
+	if json.Unmarshal(userData, &m) != nil {
+		return nil
+	}
+	labels := make(map[string]bool, len(m.Labels))
+	for _, label := range m.Labels {
+		labels[label] = true
+	}
+	return labels
+}
+
+// pinningStrategy is a sarama.BalanceStrategy assigning the partitions matched
+// by a -pinning-file rule to the members carrying its label, for workloads
+// with locality requirements. The other partitions, and pinned partitions
+// without a member carrying the label, are spread over the least loaded
+// members. Only the group leader plans the assignment, it re-reads the file
+// on every rebalance so changed rules apply on the next one.
+type pinningStrategy struct {
+	path string
+
+	mu    sync.Mutex
+	rules []pinningRule
+}
+
+func newPinningStrategy(path string) (*pinningStrategy, error) {
+	rules, err := loadPinningRules(path)
+	if err != nil {
+		return nil, err
+	}
+	return &pinningStrategy{path: path, rules: rules}, nil
+}
+
+func (s *pinningStrategy) Name() string {
+	return pinningStrategyName
+}
+
+// reload returns the current rules, keeping the previous ones when the file
+// can't be read
+func (s *pinningStrategy) reload() []pinningRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules, err := loadPinningRules(s.path)
+	if err != nil {
+		log.Printf("Unable to reload the pinning rules, keeping the previous ones: %v", err)
+		return s.rules
+	}
+	s.rules = rules
+	return rules
+}
+
+func (s *pinningStrategy) Plan(members map[string]sarama.ConsumerGroupMemberMetadata, topics map[string][]int32) (sarama.BalanceStrategyPlan, error) {
+	rules := s.reload()
+
+	labels := make(map[string]map[string]bool, len(members))
+	subscribers := make(map[string][]string)
+	for memberID, meta := range members {
+		labels[memberID] = decodeMemberLabels(meta.UserData)
+		for _, topic := range meta.Topics {
+			subscribers[topic] = append(subscribers[topic], memberID)
+		}
+	}
+
+	topicNames := make([]string, 0, len(topics))
+	for topic := range topics {
+		topicNames = append(topicNames, topic)
+	}
+	sort.Strings(topicNames)
+
+	plan := make(sarama.BalanceStrategyPlan, len(members))
+	assigned := make(map[string]int, len(members))
+	unpinned := make(map[string][]int32)
+	for _, topic := range topicNames {
+		candidates := subscribers[topic]
+		sort.Strings(candidates)
+		for _, partition := range topics[topic] {
+			member := ""
+			for _, rule := range rules {
+				if !rule.matches(topic, partition) {
+					continue
+				}
+				var labeled []string
+				for _, candidate := range candidates {
+					if labels[candidate][rule.Label] {
+						labeled = append(labeled, candidate)
+					}
+				}
+				if member = leastAssigned(labeled, assigned); member == "" {
+					log.Printf("No member of the group carries label %s, assigning topic = %s, partition = %d to any member", rule.Label, topic, partition)
+				}
+				break
+			}
+			if member == "" {
+				unpinned[topic] = append(unpinned[topic], partition)
+				continue
+			}
+			plan.Add(member, topic, partition)
+			assigned[member]++
+		}
+	}
+
+	for _, topic := range topicNames {
+		for _, partition := range unpinned[topic] {
+			if member := leastAssigned(subscribers[topic], assigned); member != "" {
+				plan.Add(member, topic, partition)
+				assigned[member]++
+			}
+		}
+	}
+	return plan, nil
+}
+
+// leastAssigned returns the member with the fewest partitions assigned so far,
+// the first one of the sorted members on ties
+func leastAssigned(members []string, assigned map[string]int) string {
+	best := ""
+	for _, member := range members {
+		if best == "" || assigned[member] < assigned[best] {
+			best = member
+		}
+	}
+	return best
+}
+
+func (s *pinningStrategy) AssignmentData(memberID string, topics map[string][]int32, generationID int32) ([]byte, error) {
+	return nil, nil
+}
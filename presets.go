@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// confluentCloudVersion is the Kafka version assumed for Confluent Cloud
+// unless -version is given
+const confluentCloudVersion = "2.8.0"
+
+// flagPassed reports whether the flag was given on the command line
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		passed = passed || f.Name == name
+	})
+	return passed
+}
+
+// checkConfluentCloud validates -confluent-cloud and defaults -version to the
+// version of Confluent Cloud
+func checkConfluentCloud() error {
+	if *apiKey == "" || *apiSecret == "" {
+		return errors.New("-confluent-cloud requires -api-key and -api-secret, or the CONFLUENT_API_KEY and CONFLUENT_API_SECRET environment variables")
+	}
+	if *tokenID != "" || *tokenFile != "" || *vaultPath != "" {
+		return errors.New("-confluent-cloud authenticates with its API key, it can't be combined with a delegation token or -vault-path")
+	}
+	if !flagPassed("version") {
+		*version = confluentCloudVersion
+	}
+	return nil
+}
+
+// configureConfluentCloud configures TLS with the system roots, SASL/PLAIN with
+// the API key and the timeouts recommended for Confluent Cloud, whose brokers
+// are reached over the internet and rebalance more slowly than a local cluster
+func configureConfluentCloud(config *sarama.Config) {
+	config.Net.TLS.Enable = true
+	if config.Net.TLS.Config == nil {
+		config.Net.TLS.Config = &tls.Config{}
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User, config.Net.SASL.Password = *apiKey, *apiSecret
+
+	config.Net.DialTimeout = 30 * time.Second
+	config.Net.KeepAlive = 30 * time.Second
+	config.Metadata.Retry.Max = 10
+	config.Metadata.Retry.Backoff = 500 * time.Millisecond
+	config.Consumer.Group.Session.Timeout = 45 * time.Second
+	config.Consumer.Group.Heartbeat.Interval = 3 * time.Second
+}
+
+// eventHubsVersion is the Kafka version assumed for the Kafka endpoint of
+// Azure Event Hubs unless -version is given
+const eventHubsVersion = "1.0.0"
+
+// eventHubsUser is the SASL user name the Kafka endpoint of Event Hubs expects
+// along with a connection string as password
+const eventHubsUser = "$ConnectionString"
+
+// checkEventHubs validates -eventhubs, derives -brokers from the endpoint of
+// the connection string unless given, and defaults -version
+func checkEventHubs() error {
+	if *eventHubsConnectionString == "" {
+		return errors.New("-eventhubs requires -eventhubs-connection-string or the EVENTHUBS_CONNECTION_STRING environment variable")
+	}
+	if *confluentCloud || *tokenID != "" || *tokenFile != "" || *vaultPath != "" {
+		return errors.New("-eventhubs authenticates with its connection string, it can't be combined with -confluent-cloud, a delegation token or -vault-path")
+	}
+	if *brokers == "" {
+		namespace, err := eventHubsNamespace(*eventHubsConnectionString)
+		if err != nil {
+			return err
+		}
+		*brokers = namespace + ":9093"
+	}
+	if !flagPassed("version") {
+		*version = eventHubsVersion
+	}
+	return nil
+}
+
+// eventHubsNamespace returns the host of the Endpoint of a connection string
+// such as Endpoint=sb://orders.servicebus.windows.net/;SharedAccessKeyName=...
+func eventHubsNamespace(connectionString string) (string, error) {
+	for _, part := range strings.Split(connectionString, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "Endpoint") {
+			endpoint, err := url.Parse(kv[1])
+			if err != nil || endpoint.Hostname() == "" {
+				return "", fmt.Errorf("invalid Endpoint %q in the Event Hubs connection string", kv[1])
+			}
+			return endpoint.Hostname(), nil
+		}
+	}
+	return "", errors.New("no Endpoint in the Event Hubs connection string")
+}
+
+// configureEventHubs configures TLS and SASL/PLAIN with the connection string,
+// and works around the differences of the Kafka endpoint of Event Hubs: it
+// closes connections idle for 240 seconds, so metadata is refreshed well
+// before, and it limits requests to about 1 MB.
+func configureEventHubs(config *sarama.Config) {
+	config.Net.TLS.Enable = true
+	if config.Net.TLS.Config == nil {
+		config.Net.TLS.Config = &tls.Config{}
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User, config.Net.SASL.Password = eventHubsUser, *eventHubsConnectionString
+
+	config.Metadata.RefreshFrequency = 3 * time.Minute
+	config.Consumer.Group.Session.Timeout = 30 * time.Second
+	config.Consumer.Group.Heartbeat.Interval = 3 * time.Second
+	config.Producer.MaxMessageBytes = 1046528
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+)
+
+// prettyMaxValue is the number of bytes of a value the pretty output shows
+const prettyMaxValue = 2048
+
+// prettyTimeLayout is the layout of the timestamps in the pretty output
+const prettyTimeLayout = "2006-01-02 15:04:05.000 MST"
+
+// ANSI escape sequences of the pretty output
+const (
+	colorReset     = "\x1b[0m"
+	colorTopic     = "\x1b[1;36m"
+	colorPartition = "\x1b[33m"
+	colorDim       = "\x1b[2m"
+)
+
+// prettyColors is set when the pretty output goes to a terminal and NO_COLOR isn't set
+var prettyColors bool
+
+// isTerminal reports whether the file is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// printPretty writes the message as a colorized header line with the offset
+// right-aligned, followed by the value, indented when it is JSON and
+// truncated when it is long
+func (p *messagePrinter) printPretty(message *sarama.ConsumerMessage, value []byte) {
+	buf := append(p.buf[:0], p.prefix...)
+	buf = appendColored(buf, colorTopic, message.Topic)
+	buf = append(buf, ' ')
+	buf = appendColored(buf, colorPartition, "["+strconv.FormatInt(int64(message.Partition), 10)+"]")
+	buf = append(buf, ' ')
+
+	offset := strconv.FormatInt(message.Offset, 10)
+	for i := len(offset); i < 10; i++ {
+		buf = append(buf, ' ')
+	}
+	buf = append(buf, offset...)
+	buf = append(buf, "  "...)
+
+	buf = appendColored(buf, colorDim, string(appendTimestamp(nil, message.Timestamp.Local(), prettyTimeLayout)))
+	if message.Key != nil {
+		buf = append(buf, "  key = "...)
+		buf = append(buf, message.Key...)
+	}
+	if p.cluster != "" {
+		buf = append(buf, "  cluster = "...)
+		buf = append(buf, p.cluster...)
+	}
+	if *cloudEvents && p.mode != "metadata" {
+		buf = appendCloudEvent(buf, message, "  ")
+	}
+	if *debeziumMode != "" && p.mode != "metadata" {
+		buf = appendDebezium(buf, message, "  ")
+	}
+	if p.mode == "metadata" {
+		buf = append(buf, "  headers = "...)
+		buf = appendHeaders(buf, message.Headers)
+		buf = append(buf, '\n')
+		buf = appendColored(buf, colorDim, "("+strconv.Itoa(len(value))+" bytes)")
+		buf = append(buf, '\n')
+		p.buf = buf
+		p.output(message.Topic).Write(buf)
+		return
+	}
+	buf = append(buf, '\n')
+
+	if message.Value == nil {
+		buf = appendColored(buf, colorDim, tombstoneValue)
+		buf = append(buf, '\n')
+		p.buf = buf
+		p.output(message.Topic).Write(buf)
+		return
+	}
+
+	var indented bytes.Buffer
+	if json.Valid(value) && json.Indent(&indented, value, "", "  ") == nil {
+		value = indented.Bytes()
+	}
+	limit := prettyMaxValue
+	if *maxPrintBytes > 0 && *maxPrintBytes < limit {
+		limit = *maxPrintBytes
+	}
+	if len(value) > limit {
+		cut := truncateAt(value, limit)
+		buf = append(buf, value[:cut]...)
+		buf = appendColored(buf, colorDim, "… ("+strconv.Itoa(len(value)-cut)+" more bytes)")
+	} else {
+		buf = append(buf, value...)
+	}
+	buf = append(buf, '\n')
+	p.buf = buf
+
+	p.output(message.Topic).Write(buf)
+}
+
+// appendColored appends s in the given color when colors are enabled
+func appendColored(buf []byte, color string, s string) []byte {
+	if !prettyColors {
+		return append(buf, s...)
+	}
+	buf = append(buf, color...)
+	buf = append(buf, s...)
+	return append(buf, colorReset...)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const payloadAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// parseHeaders parses the -headers flag, a comma separated list of key=value pairs
+func parseHeaders(spec string) ([]sarama.RecordHeader, error) {
+	var headers []sarama.RecordHeader
+	for _, pair := range strings.Split(spec, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid header %q, expected key=value", pair)
+		}
+		headers = append(headers, sarama.RecordHeader{Key: []byte(kv[0]), Value: []byte(kv[1])})
+	}
+	return headers, nil
+}
+
+// runProduce generates traffic to the topics of the consumer for -duration
+func runProduce(c consumerConfig) {
+	headers, err := parseHeaders(*produceHeaders)
+	if err != nil {
+		fatal(err)
+	}
+
+	config, err := newSaramaConfig(c)
+	if err != nil {
+		fatal(err)
+	}
+
+	producer, err := sarama.NewAsyncProducer(strings.Split(c.Brokers, ","), config)
+	if err != nil {
+		fatal(err)
+	}
+
+	var failed int64
+	go func() {
+		for err := range producer.Errors() {
+			if atomic.AddInt64(&failed, 1) == 1 {
+				log.Printf("Error producing message: %v", err)
+			}
+		}
+	}()
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	deadline := time.After(*duration)
+
+	log.Printf("Producing to %v for %v", c.topicNames, *duration)
+	started := time.Now()
+	var produced int64
+
+produce:
+	for ; ; produced++ {
+		if *produceRate > 0 {
+			next := started.Add(time.Duration(float64(produced) / *produceRate * float64(time.Second)))
+			if wait := time.Until(next); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-deadline:
+					break produce
+				case <-sigterm:
+					break produce
+				}
+			}
+		}
+
+		msg := &sarama.ProducerMessage{
+			Topic: c.topicNames[produced%int64(len(c.topicNames))],
+			Value: sarama.ByteEncoder(randomPayload(random, *produceSize)),
+		}
+		msg.Headers = append(headers[:len(headers):len(headers)], sarama.RecordHeader{
+			Key:   []byte(produceTimestampHeader),
+			Value: []byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
+		})
+		if *produceKeys > 0 {
+			msg.Key = sarama.StringEncoder(fmt.Sprintf("key-%d", random.Intn(*produceKeys)))
+		}
+
+		select {
+		case producer.Input() <- msg:
+		case <-deadline:
+			break produce
+		case <-sigterm:
+			break produce
+		}
+	}
+
+	if err := producer.Close(); err != nil {
+		log.Printf("Error closing producer: %v", err)
+	}
+
+	elapsed := time.Since(started)
+	log.Printf("Produced %d messages in %v (%.0f msgs/s), %d failed", produced, elapsed.Round(time.Millisecond), float64(produced)/elapsed.Seconds(), atomic.LoadInt64(&failed))
+}
+
+// randomPayload returns size random alphanumeric bytes
+func randomPayload(random *rand.Rand, size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = payloadAlphabet[random.Intn(len(payloadAlphabet))]
+	}
+	return payload
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+)
+
+// pubSubScope is the OAuth2 scope of publishing to Pub/Sub
+const pubSubScope = "https://www.googleapis.com/auth/pubsub"
+
+// pubSubEndpoint is the base URL of the Pub/Sub API
+const pubSubEndpoint = "https://pubsub.googleapis.com/v1"
+
+// pubSubBatchSize and pubSubBatchBytes are the limits of a publish request
+const (
+	pubSubBatchSize  = 1000
+	pubSubBatchBytes = 9 * 1024 * 1024
+)
+
+// pubSubMessage is a message of a publish request
+type pubSubMessage struct {
+	Data        string            `json:"data,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+// pubSubSink republishes the claimed messages to Google Pub/Sub topics, for
+// migrations off Kafka. The key of a message is its ordering key, so
+// subscriptions with message ordering receive the messages of a key in order,
+// and the headers and the Kafka topic, partition and offset are attributes.
+//
+// Messages are published in batches per topic, and at the latest by the
+// commit barrier, so offsets are committed once Pub/Sub accepted their
+// messages. Failed batches stay buffered and are published again, so
+// subscribers may receive duplicates.
+type pubSubSink struct {
+	endpoint string
+	// topic is projects/<project>/topics/<topic>, {topic} is replaced by the topic
+	topic  string
+	tokens *gcpTokenSource
+
+	mu       sync.Mutex
+	messages map[string][]pubSubMessage
+	buffered int
+	size     int
+}
+
+// newPubSubSink returns the sink publishing to the topic template, through
+// the emulator in PUBSUB_EMULATOR_HOST when set
+func newPubSubSink(topic string) (*pubSubSink, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" {
+		return nil, fmt.Errorf("invalid -pubsub-topic %q, expected projects/<project>/topics/<topic>", topic)
+	}
+
+	s := &pubSubSink{endpoint: pubSubEndpoint, topic: topic, messages: make(map[string][]pubSubMessage)}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		s.endpoint = "http://" + host + "/v1"
+		s.tokens = &gcpTokenSource{anonymous: true, client: &http.Client{Timeout: gcpTimeout}}
+		return s, nil
+	}
+	var err error
+	if s.tokens, err = newGCPTokenSource(pubSubScope); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *pubSubSink) name() string {
+	return "pubsub sink " + s.topic
+}
+
+func (s *pubSubSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	m := pubSubMessage{
+		Data: base64.StdEncoding.EncodeToString(value),
+		Attributes: map[string]string{
+			"kafka_topic":     message.Topic,
+			"kafka_partition": strconv.Itoa(int(message.Partition)),
+			"kafka_offset":    strconv.FormatInt(message.Offset, 10),
+		},
+	}
+	for _, h := range message.Headers {
+		key := string(h.Key)
+		// attribute keys up to 256 bytes, not prefixed with goog, and UTF-8 values
+		if key == "" || len(key) > 256 || strings.HasPrefix(strings.ToLower(key), "goog") || !utf8.Valid(h.Value) {
+			continue
+		}
+		m.Attributes[key] = string(h.Value)
+	}
+	if message.Key != nil {
+		m.OrderingKey = string(message.Key)
+		if len(message.Key) > 1024 || !utf8.Valid(message.Key) {
+			m.OrderingKey = sha256Hex(message.Key)
+		}
+	}
+	topic := strings.Replace(s.topic, "{topic}", message.Topic, -1)
+	size := m.size()
+	if size > pubSubBatchBytes {
+		return fmt.Errorf("message at topic = %s, partition = %d, offset = %d exceeds the size Pub/Sub allows with %d bytes", message.Topic, message.Partition, message.Offset, size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// publish before buffering, so a write retried after a failure isn't buffered twice
+	if s.buffered >= pubSubBatchSize || s.size+size > pubSubBatchBytes {
+		if err := s.publish(); err != nil {
+			return err
+		}
+	}
+	s.messages[topic] = append(s.messages[topic], m)
+	s.buffered++
+	s.size += size
+	return nil
+}
+
+// flush publishes the buffered messages, the barrier of a commit
+func (s *pubSubSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.publish()
+}
+
+// publish publishes the buffered messages of every topic, the messages of a
+// failed request stay buffered for the next attempt
+func (s *pubSubSink) publish() error {
+	for topic, messages := range s.messages {
+		endpoint := s.endpoint + "/" + topic + ":publish"
+		if err := s.tokens.do("POST", endpoint, map[string]interface{}{"messages": messages}, nil); err != nil {
+			return fmt.Errorf("unable to publish to %s: %v", topic, err)
+		}
+		for _, m := range messages {
+			s.size -= m.size()
+		}
+		s.buffered -= len(messages)
+		delete(s.messages, topic)
+	}
+	return nil
+}
+
+// size returns the size the message counts with towards the limit of a request
+func (m pubSubMessage) size() int {
+	size := len(m.Data) + len(m.OrderingKey)
+	for k, v := range m.Attributes {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+func (s *pubSubSink) close() error {
+	return s.flush(commitPoint{})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// catchUpCheckInterval is the interval at which the lag is compared with
+// -ready-max-lag and -ready-max-lag-time until the consumer caught up
+const catchUpCheckInterval = 5 * time.Second
+
+// catchUpLoop compares the lag of the claimed partitions with -ready-max-lag
+// and -ready-max-lag-time until the consumer caught up or the session ends.
+// Once caught up the consumer reports ready for the rest of its lifetime, the
+// backlogs of later spikes and rebalances are reported by -lag-slo instead.
+func (consumer *Consumer) catchUpLoop(session sarama.ConsumerGroupSession) {
+	ticker := time.NewTicker(catchUpCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		lag, age, err := consumer.catchUpLag(time.Now())
+		switch {
+		case err != nil:
+			consumer.logger.Printf("Unable to determine the lag: %v", err)
+		case (*readyMaxLag == 0 || lag <= *readyMaxLag) && (*readyMaxLagTime == 0 || age <= *readyMaxLagTime):
+			consumer.stateMu.Lock()
+			consumer.caughtUp = true
+			consumer.stateMu.Unlock()
+			consumer.logger.Printf("Caught up with the high water marks: lag = %d, age = %v, reporting ready", lag, age.Round(time.Millisecond))
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-session.Context().Done():
+			return
+		}
+	}
+}
+
+// catchUpLag returns the largest lag of the topics claimed by this instance,
+// as summed over their partitions by topicLags, and the largest age of the
+// last processed message of a partition with lag, the maximum duration for a
+// partition with lag without a processed message. Partitions without a
+// processed or committed offset are left out.
+func (consumer *Consumer) catchUpLag(now time.Time) (int64, time.Duration, error) {
+	type position struct {
+		offset    int64
+		timestamp time.Time
+	}
+	positions := make(map[string]map[int32]position)
+	consumer.stateMu.Lock()
+	for topic, partitions := range consumer.partitions {
+		positions[topic] = make(map[int32]position)
+		for partition, state := range partitions {
+			offset := state.offset
+			if offset < 0 {
+				offset = state.committed
+			}
+			positions[topic][partition] = position{offset: offset, timestamp: state.timestamp}
+		}
+	}
+	consumer.stateMu.Unlock()
+
+	var maxLag int64
+	var maxAge time.Duration
+	for topic, partitions := range positions {
+		var lag int64
+		for partition, p := range partitions {
+			if p.offset < 0 {
+				continue
+			}
+			newest, err := consumer.client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return 0, 0, err
+			}
+			if newest <= p.offset {
+				continue
+			}
+			lag += newest - p.offset
+			age := time.Duration(math.MaxInt64)
+			if !p.timestamp.IsZero() {
+				age = now.Sub(p.timestamp)
+			}
+			if age > maxAge {
+				maxAge = age
+			}
+		}
+		if lag > maxLag {
+			maxLag = lag
+		}
+	}
+	return maxLag, maxAge, nil
+}
+
+// hasCaughtUp reports whether the consumer caught up with the high water marks
+// as required by -ready-max-lag and -ready-max-lag-time
+func (consumer *Consumer) hasCaughtUp() bool {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	return consumer.caughtUp
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/hrak/kafka-consumergroup/consumergroup"
+)
+
+// checkCommittedOffsets compares the offsets committed by the group with the
+// offsets available in the claimed partitions. A committed offset past the end
+// of its partition means the topic was deleted and recreated, and is handled
+// according to -on-topic-recreated. A committed offset before the start of its
+// partition was removed by retention, and is handled according to
+// -on-offset-out-of-range. Sarama would otherwise silently reset both to the
+// newest offset. Partitions in skip were already seeked by the start
+// positions. It returns the offsets it seeked the partitions to.
+func (consumer *Consumer) checkCommittedOffsets(session sarama.ConsumerGroupSession, skip map[string]map[int32]int64) (map[string]map[int32]int64, error) {
+	if len(session.Claims()) == 0 {
+		return nil, nil
+	}
+
+	committed, err := consumer.committedOffsets(session.Claims())
+	if err != nil {
+		return nil, err
+	}
+
+	seeked := make(map[string]map[int32]int64)
+	for topic, partitions := range committed {
+		for partition, offset := range partitions {
+			if _, ok := skip[topic][partition]; ok || offset < 0 {
+				continue
+			}
+			oldest, err := consumer.client.GetOffset(topic, partition, sarama.OffsetOldest)
+			if err != nil {
+				return nil, err
+			}
+			newest, err := consumer.client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, err
+			}
+
+			var policy, reason string
+			switch {
+			case offset > newest:
+				policy = *onTopicRecreated
+				reason = fmt.Sprintf("is past the end of topic = %s, partition = %d at %d, the topic was likely recreated", topic, partition, newest)
+				consumer.pastEnd.Inc(1)
+			case offset < oldest:
+				policy = *onOffsetOutOfRange
+				reason = fmt.Sprintf("is before the start of topic = %s, partition = %d at %d, the messages were removed by retention", topic, partition, oldest)
+				consumer.outOfRange.Inc(1)
+			default:
+				continue
+			}
+
+			if policy == "halt" || policy == "fail" {
+				consumer.fatalf("Committed offset %d %s", offset, reason)
+			}
+			position := startPosition{offset: sarama.OffsetNewest}
+			if policy == "oldest" {
+				position.offset = sarama.OffsetOldest
+			}
+			reset, err := position.resolve(consumer.client, topic, partition)
+			if err != nil {
+				return nil, err
+			}
+			seek(session, topic, partition, reset)
+			if seeked[topic] == nil {
+				seeked[topic] = make(map[int32]int64)
+			}
+			seeked[topic][partition] = reset
+			consumer.logger.Printf("Committed offset %d %s, resetting to the %s offset %d", offset, reason, policy, reset)
+		}
+	}
+	return seeked, nil
+}
+
+// committedOffsets fetches the offsets committed by the group for the given
+// partitions, -1 for partitions without a committed offset
+func (consumer *Consumer) committedOffsets(claims map[string][]int32) (map[string]map[int32]int64, error) {
+	blocks, err := consumer.committedBlocks(claims)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]map[int32]int64)
+	for topic, partitions := range blocks {
+		offsets[topic] = make(map[int32]int64)
+		for partition, block := range partitions {
+			offsets[topic][partition] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+// offsetFetchVersion returns the version of the OffsetFetch request for the
+// Kafka version of the cluster, the newest one up to 7 it supports, as Kafka
+// 4.0 removed the oldest versions
+func offsetFetchVersion(version sarama.KafkaVersion) int16 {
+	switch {
+	case version.IsAtLeast(sarama.V2_5_0_0):
+		return 7
+	case version.IsAtLeast(sarama.V2_4_0_0):
+		return 6
+	case version.IsAtLeast(sarama.V2_1_0_0):
+		return 5
+	case version.IsAtLeast(sarama.V2_0_0_0):
+		return 4
+	case version.IsAtLeast(sarama.V0_11_0_0):
+		return 3
+	case version.IsAtLeast(sarama.V0_10_2_0):
+		return 2
+	}
+	return 1
+}
+
+// committedBlocks fetches the offsets committed by the group for the given
+// partitions along with their metadata
+func (consumer *Consumer) committedBlocks(claims map[string][]int32) (map[string]map[int32]*sarama.OffsetFetchResponseBlock, error) {
+	request := &sarama.OffsetFetchRequest{
+		Version:       offsetFetchVersion(consumer.client.Config().Version),
+		ConsumerGroup: consumer.settings().Group,
+	}
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			request.AddPartition(topic, partition)
+		}
+	}
+
+	coordinator, err := consumer.client.Coordinator(request.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		consumer.client.RefreshCoordinator(request.ConsumerGroup)
+		return nil, err
+	}
+	// since version 2 errors of the whole group are reported at the top level
+	if response.Err != sarama.ErrNoError {
+		if response.Err == sarama.ErrNotCoordinatorForConsumer || response.Err == sarama.ErrConsumerCoordinatorNotAvailable {
+			consumer.client.RefreshCoordinator(request.ConsumerGroup)
+		}
+		return nil, response.Err
+	}
+
+	blocks := make(map[string]map[int32]*sarama.OffsetFetchResponseBlock)
+	for topic, partitions := range claims {
+		blocks[topic] = make(map[int32]*sarama.OffsetFetchResponseBlock)
+		for _, partition := range partitions {
+			block := response.GetBlock(topic, partition)
+			if block == nil {
+				return nil, fmt.Errorf("no committed offset returned for topic = %s, partition = %d", topic, partition)
+			}
+			if block.Err != sarama.ErrNoError {
+				return nil, fmt.Errorf("unable to fetch the committed offset of topic = %s, partition = %d: %v", topic, partition, block.Err)
+			}
+			blocks[topic][partition] = block
+		}
+	}
+	return blocks, nil
+}
+
+// watchErrors drains the errors of the partition consumers until the group is
+// closed. A partition consumer that hit an out of range offset is shut down by
+// Sarama, so the consumer rejoins the group to run checkCommittedOffsets again.
+// A topic that disappeared is logged once instead of retrying silently.
+func (consumer *Consumer) watchErrors() {
+	missing := make(map[string]bool)
+	for err := range consumer.group.Errors() {
+		consumer.recordError(consumergroup.Categorize(err))
+		cerr, ok := err.(*sarama.ConsumerError)
+		if !ok {
+			sarama.Logger.Println(err)
+			continue
+		}
+
+		switch cerr.Err {
+		case sarama.ErrOffsetOutOfRange:
+			consumer.logger.Printf("Offset out of range at topic = %s, partition = %d, rejoining the group", cerr.Topic, cerr.Partition)
+			consumer.rejoin()
+		case sarama.ErrUnknownTopicOrPartition:
+			if !missing[cerr.Topic] {
+				missing[cerr.Topic] = true
+				consumer.logger.Printf("Topic %s no longer exists, waiting for it to be recreated", cerr.Topic)
+			}
+			if *onTopicRecreated == "halt" {
+				consumer.fatalf("Topic %s was deleted", cerr.Topic)
+			}
+		default:
+			sarama.Logger.Println(err)
+		}
+	}
+}
+
+// rejoin ends the current session, the consumer joins the group again right away
+func (consumer *Consumer) rejoin() {
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	if consumer.endSession != nil {
+		consumer.endSession()
+	}
+}
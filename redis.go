@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// redisTimeout bounds connecting to Redis and a round trip of the pipeline
+const redisTimeout = 10 * time.Second
+
+// redisSink applies the claimed messages to Redis, so the changes of a
+// compacted topic drive a cache directly. Under -redis-mode
+//
+//	set         SET <prefix><key> <value>, or DEL <prefix><key> for a tombstone
+//	invalidate  DEL <prefix><key>, so the application reloads the key
+//	publish     PUBLISH <channel> <value>
+//
+// Commands are pipelined, and kept until Redis acknowledged them by the
+// commit barrier, which sends them again over a new connection after a
+// failure. SET and DEL are idempotent, published messages may be duplicated.
+type redisSink struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+
+	mode    string
+	prefix  string
+	channel string
+	ttl     time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	// unacked are the encoded commands Redis didn't acknowledge yet
+	unacked bytes.Buffer
+	pending int
+}
+
+// newRedisSink returns the sink for a redis:// or rediss:// URL such as
+// redis://:password@localhost:6379/0
+func newRedisSink(redisURL, mode, prefix, channel string, ttl time.Duration) (*redisSink, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid -redis-url %q, expected redis:// or rediss://", redisURL)
+	}
+	switch mode {
+	case "set", "invalidate", "publish":
+	default:
+		return nil, fmt.Errorf("-redis-mode must be set, invalidate or publish")
+	}
+
+	s := &redisSink{
+		addr:    u.Host,
+		useTLS:  u.Scheme == "rediss",
+		mode:    mode,
+		prefix:  prefix,
+		channel: channel,
+		ttl:     ttl,
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if s.password == "" {
+		s.password = os.Getenv("REDIS_PASSWORD")
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q in -redis-url", db)
+		}
+	}
+	return s, nil
+}
+
+func (s *redisSink) name() string {
+	return "redis sink " + s.addr
+}
+
+func (s *redisSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// sync before buffering, so a write retried after a failure isn't buffered twice
+	if s.pending >= sinkPipeline {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+
+	if s.mode == "publish" {
+		s.command([]byte("PUBLISH"), []byte(expandSinkTemplate(s.channel, message)), value)
+		return nil
+	}
+
+	if message.Key == nil {
+		return fmt.Errorf("message at topic = %s, partition = %d, offset = %d has no key", message.Topic, message.Partition, message.Offset)
+	}
+	key := append([]byte(s.prefix), message.Key...)
+	switch {
+	case s.mode == "invalidate", message.Value == nil:
+		s.command([]byte("DEL"), key)
+	case s.ttl > 0:
+		s.command([]byte("SET"), key, value, []byte("PX"), []byte(strconv.FormatInt(int64(s.ttl/time.Millisecond), 10)))
+	default:
+		s.command([]byte("SET"), key, value)
+	}
+	return nil
+}
+
+// command buffers a command until it is sent by sync
+func (s *redisSink) command(args ...[]byte) {
+	writeRedisCommand(&s.unacked, args...)
+	s.pending++
+}
+
+// writeRedisCommand writes a command in the RESP encoding to buf
+func writeRedisCommand(buf *bytes.Buffer, args ...[]byte) {
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n", len(arg))
+		buf.Write(arg)
+		buf.WriteString("\r\n")
+	}
+}
+
+// flush waits until Redis acknowledged every command, the barrier of a commit
+func (s *redisSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync()
+}
+
+// sync sends the unacknowledged commands and reads their replies. On failure
+// the connection is closed, and the commands are sent again by the next sync.
+func (s *redisSink) sync() error {
+	if s.pending == 0 {
+		return nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	err := func() error {
+		s.conn.SetDeadline(time.Now().Add(redisTimeout))
+		if _, err := s.conn.Write(s.unacked.Bytes()); err != nil {
+			return err
+		}
+		var replyErr error
+		for i := 0; i < s.pending; i++ {
+			if err := readRedisReply(s.r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return err
+				}
+				replyErr = err
+			}
+		}
+		return replyErr
+	}()
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	s.unacked.Reset()
+	s.pending = 0
+	return nil
+}
+
+// connect connects and authenticates unless connected already
+func (s *redisSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	conn, err := dialSink(s.addr, s.useTLS, redisTimeout)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+
+	var setup [][][]byte
+	if s.password != "" {
+		if s.username != "" {
+			setup = append(setup, [][]byte{[]byte("AUTH"), []byte(s.username), []byte(s.password)})
+		} else {
+			setup = append(setup, [][]byte{[]byte("AUTH"), []byte(s.password)})
+		}
+	}
+	if s.db != 0 {
+		setup = append(setup, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(s.db))})
+	}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	for _, args := range setup {
+		var buf bytes.Buffer
+		writeRedisCommand(&buf, args...)
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			conn.Close()
+			return err
+		}
+		if err := readRedisReply(r); err != nil {
+			conn.Close()
+			return fmt.Errorf("%s failed: %v", args[0], err)
+		}
+	}
+
+	s.conn, s.r = conn, r
+	return nil
+}
+
+// redisError is an error reply of Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// readRedisReply reads a reply, returning error replies as redisError
+func readRedisReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return errors.New("empty Redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return nil
+		}
+		_, err = io.CopyN(ioutil.Discard, r, int64(n+2))
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := readRedisReply(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid Redis reply %q", line)
+}
+
+func (s *redisSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sync()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
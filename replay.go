@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseReplaySpeed parses -replay-speed into the factor the original pace of
+// the messages is sped up by, 0 for asap
+func parseReplaySpeed(spec string) (float64, error) {
+	switch spec {
+	case "asap":
+		return 0, nil
+	case "realtime":
+		return 1, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(spec, "x"), 64)
+	if err != nil || !strings.HasSuffix(spec, "x") || speed <= 0 {
+		return 0, fmt.Errorf("invalid -replay-speed %q, expected asap, realtime or a positive factor such as 2x", spec)
+	}
+	return speed, nil
+}
+
+// replayPacer delays the messages according to their timestamps, so a replay
+// reproduces the load pattern of the original traffic at -replay-speed. The
+// timestamp of the first message is anchored to the time it was processed,
+// and every later message waits until its distance from that timestamp,
+// divided by the speed, has passed. Messages of all claims share the anchor.
+// A nil pacer doesn't delay anything.
+type replayPacer struct {
+	speed float64
+
+	mu      sync.Mutex
+	started time.Time
+	first   time.Time
+}
+
+func newReplayPacer(speed float64) *replayPacer {
+	if speed <= 0 {
+		return nil
+	}
+	return &replayPacer{speed: speed}
+}
+
+// wait blocks until the message with the given timestamp is due. It returns
+// false when ctx is done first.
+func (p *replayPacer) wait(ctx context.Context, timestamp time.Time) bool {
+	if p == nil || timestamp.IsZero() {
+		return true
+	}
+
+	p.mu.Lock()
+	if p.started.IsZero() {
+		p.started, p.first = time.Now(), timestamp
+	}
+	due := p.started.Add(time.Duration(float64(timestamp.Sub(p.first)) / p.speed))
+	p.mu.Unlock()
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
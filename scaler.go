@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// scalerLag is the lag served on -scaler-addr in the format of the
+// metrics-api scaler of KEDA, which reads the value at its valueLocation,
+// e.g. lag or groups.0.topics.orders.lag
+type scalerLag struct {
+	// Lag and Partitions are the sums over the groups
+	Lag        int64      `json:"lag"`
+	Partitions int        `json:"partitions"`
+	Groups     []groupLag `json:"groups"`
+}
+
+// groupLag is the lag of the group of a consumer
+type groupLag struct {
+	Name       string              `json:"name,omitempty"`
+	Group      string              `json:"group"`
+	Lag        int64               `json:"lag"`
+	Partitions int                 `json:"partitions"`
+	Topics     map[string]topicLag `json:"topics"`
+}
+
+type topicLag struct {
+	Lag        int64 `json:"lag"`
+	Partitions int   `json:"partitions"`
+}
+
+// newScalerServer returns the handler of -scaler-addr, serving the lag of the
+// groups of the running consumers on /lag, or of the consumer named by the
+// consumer query parameter. The lag is that of the whole group rather than
+// of this instance, from the committed offsets of all partitions of its
+// topics, so the deployment can autoscale on it from any of its replicas.
+func newScalerServer() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lag", func(w http.ResponseWriter, r *http.Request) {
+		consumers, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		result := scalerLag{Groups: []groupLag{}}
+		for _, consumer := range consumers {
+			lag, err := consumer.groupLag()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			result.Lag += lag.Lag
+			result.Partitions += lag.Partitions
+			result.Groups = append(result.Groups, lag)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+	return mux
+}
+
+// groupLag returns the lag of the group of the consumer over all partitions
+// of its topics. Partitions without a committed offset count as no lag.
+func (consumer *Consumer) groupLag() (groupLag, error) {
+	settings := consumer.settings()
+	topics := make(map[string][]int32)
+	for _, topic := range settings.topicNames {
+		partitions, err := consumer.client.Partitions(topic)
+		if err != nil {
+			return groupLag{}, err
+		}
+		topics[topic] = partitions
+	}
+
+	lags, err := consumer.partitionLags(topics)
+	if err != nil {
+		return groupLag{}, err
+	}
+
+	result := groupLag{Name: settings.Name, Group: settings.Group, Topics: make(map[string]topicLag)}
+	for topic, partitions := range topics {
+		t := topicLag{Partitions: len(partitions)}
+		for _, lag := range lags[topic] {
+			t.Lag += lag
+		}
+		result.Topics[topic] = t
+		result.Lag += t.Lag
+		result.Partitions += t.Partitions
+	}
+	return result, nil
+}
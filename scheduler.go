@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// claimScheduler limits the number of claims processing a message at the same
+// time. While claims wait for a slot, slots are granted to topics in proportion
+// to their weight using stride scheduling, so a noisy low weight topic can't
+// starve a critical one sharing the same group. A nil scheduler is unlimited.
+type claimScheduler struct {
+	mu      sync.Mutex
+	free    int
+	weights map[string]int
+	pass    map[string]float64
+	vtime   float64
+	waiting map[string][]chan struct{}
+}
+
+func newClaimScheduler(slots int, weights map[string]int) *claimScheduler {
+	if slots <= 0 {
+		return nil
+	}
+	return &claimScheduler{
+		free:    slots,
+		weights: weights,
+		pass:    make(map[string]float64),
+		waiting: make(map[string][]chan struct{}),
+	}
+}
+
+// parseTopicWeights parses a comma separated list of topic=weight pairs
+func parseTopicWeights(spec string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid topic weight %q, expected topic=weight", pair)
+		}
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight for topic %s, expected a positive number", kv[0])
+		}
+		weights[kv[0]] = weight
+	}
+	return weights, nil
+}
+
+func (s *claimScheduler) weight(topic string) float64 {
+	if weight, ok := s.weights[topic]; ok {
+		return float64(weight)
+	}
+	return 1
+}
+
+// grant charges a slot to the topic, must be called with the lock held
+func (s *claimScheduler) grant(topic string) {
+	if s.pass[topic] < s.vtime {
+		// don't let a topic that was idle catch up on the slots it didn't use
+		s.pass[topic] = s.vtime
+	}
+	s.vtime = s.pass[topic]
+	s.pass[topic] += 1 / s.weight(topic)
+}
+
+// acquire waits for a processing slot for a message of the topic. It returns
+// false when ctx is done first.
+func (s *claimScheduler) acquire(ctx context.Context, topic string) bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.grant(topic)
+		s.mu.Unlock()
+		return true
+	}
+	granted := make(chan struct{}, 1)
+	s.waiting[topic] = append(s.waiting[topic], granted)
+	s.mu.Unlock()
+
+	select {
+	case <-granted:
+		return true
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, ch := range s.waiting[topic] {
+		if ch == granted {
+			s.waiting[topic] = append(s.waiting[topic][:i], s.waiting[topic][i+1:]...)
+			return false
+		}
+	}
+	// the slot was granted while giving up, pass it on
+	s.releaseLocked()
+	return false
+}
+
+// release returns the slot taken by acquire
+func (s *claimScheduler) release() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+// releaseLocked hands the slot to the waiting topic that is furthest behind its share
+func (s *claimScheduler) releaseLocked() {
+	next := ""
+	for topic, waiters := range s.waiting {
+		if len(waiters) == 0 {
+			continue
+		}
+		pass := s.pass[topic]
+		if pass < s.vtime {
+			pass = s.vtime
+		}
+		if next == "" || pass < s.pass[next] || (pass == s.pass[next] && topic < next) {
+			next = topic
+			s.pass[topic] = pass
+		}
+	}
+
+	if next == "" {
+		s.free++
+		return
+	}
+
+	granted := s.waiting[next][0]
+	s.waiting[next] = s.waiting[next][1:]
+	s.grant(next)
+	granted <- struct{}{}
+}
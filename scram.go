@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// scramClient implements the client side of a SCRAM exchange (RFC 5802) for
+// Sarama. The user name and password are taken from credentials when the
+// exchange begins, so rotated credentials apply to every new connection.
+type scramClient struct {
+	hash        func() hash.Hash
+	credentials func() (string, string)
+	// extensions are appended to the client first message, such as
+	// tokenauth=true for delegation tokens
+	extensions string
+
+	step            int
+	nonce           string
+	gs2Header       string
+	clientFirstBare string
+	password        string
+	saltedPassword  []byte
+	authMessage     string
+}
+
+// scramHash returns the hash of a SCRAM mechanism
+func scramHash(mechanism sarama.SASLMechanism) (func() hash.Hash, error) {
+	switch mechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		return sha256.New, nil
+	case sarama.SASLTypeSCRAMSHA512:
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported SCRAM mechanism %s, expected %s or %s", mechanism, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512)
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	c.nonce = base64.RawStdEncoding.EncodeToString(nonce)
+
+	if c.credentials != nil {
+		userName, password = c.credentials()
+	}
+	c.gs2Header = "n,,"
+	if authzID != "" {
+		c.gs2Header = "n,a=" + scramName(authzID) + ","
+	}
+	c.clientFirstBare = "n=" + scramName(userName) + ",r=" + c.nonce
+	if c.extensions != "" {
+		c.clientFirstBare += "," + c.extensions
+	}
+	c.password = password
+	c.step = 0
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.gs2Header + c.clientFirstBare, nil
+	case 2:
+		return c.clientFinal(challenge)
+	case 3:
+		return "", c.verifyServerFinal(challenge)
+	}
+	return "", errors.New("scram: unexpected step of the exchange")
+}
+
+func (c *scramClient) Done() bool {
+	return c.step >= 3
+}
+
+// clientFinal answers the server first message with the client proof
+func (c *scramClient) clientFinal(serverFirst string) (string, error) {
+	attributes := scramAttributes(serverFirst)
+	if message, ok := attributes["e"]; ok {
+		return "", fmt.Errorf("scram: server error %s", message)
+	}
+	if !strings.HasPrefix(attributes["r"], c.nonce) {
+		return "", errors.New("scram: server nonce doesn't extend the client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return "", fmt.Errorf("scram: invalid salt: %v", err)
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations <= 0 {
+		return "", fmt.Errorf("scram: invalid iteration count %q", attributes["i"])
+	}
+
+	c.saltedPassword = c.saltPassword(salt, iterations)
+
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(c.gs2Header)) + ",r=" + attributes["r"]
+	c.authMessage = c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	clientKey := c.hmac(c.saltedPassword, "Client Key")
+	storedKey := c.hash()
+	storedKey.Write(clientKey)
+	signature := c.hmac(storedKey.Sum(nil), c.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks the signature of the server, proving that it knows the credentials too
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	attributes := scramAttributes(serverFinal)
+	if message, ok := attributes["e"]; ok {
+		return fmt.Errorf("scram: server error %s", message)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+	if err != nil {
+		return fmt.Errorf("scram: invalid server signature: %v", err)
+	}
+	expected := c.hmac(c.hmac(c.saltedPassword, "Server Key"), c.authMessage)
+	if !hmac.Equal(signature, expected) {
+		return errors.New("scram: server signature mismatch")
+	}
+	return nil
+}
+
+// saltPassword derives the salted password with PBKDF2, whose output is a
+// single block for SCRAM as it has the size of the hash
+func (c *scramClient) saltPassword(salt []byte, iterations int) []byte {
+	mac := hmac.New(c.hash, []byte(c.password))
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], 1)
+	mac.Write(salt)
+	mac.Write(index[:])
+	u := mac.Sum(nil)
+
+	salted := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+	return salted
+}
+
+func (c *scramClient) hmac(key []byte, message string) []byte {
+	mac := hmac.New(c.hash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramName escapes a user name as the saslname of RFC 5802
+func scramName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// scramAttributes parses the comma separated attribute=value pairs of a server message
+func scramAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+	for _, pair := range strings.Split(message, ",") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			attributes[kv[0]] = kv[1]
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// shadowGroupSuffix is appended to the group of a consumer under -shadow, so
+// it consumes the production traffic without moving the offsets of the group
+const shadowGroupSuffix = "-shadow"
+
+// shadowTopicSuffix is appended to the topics a consumer under -shadow
+// forwards to, so it doesn't produce duplicates to the production topics
+const shadowTopicSuffix = "-shadow"
+
+// shadowReport compares the processing of a consumer under -shadow with the
+// -shadow-max-latency and -shadow-max-failure-rate expectations. A nil report
+// doesn't observe anything.
+type shadowReport struct {
+	latencies *latencies
+	processed int64
+	failed    int64
+	slow      int64
+}
+
+func newShadowReport(enabled bool) *shadowReport {
+	if !enabled {
+		return nil
+	}
+	return &shadowReport{latencies: newLatencies()}
+}
+
+// observe records the processing of a message that took latency and failed with err
+func (r *shadowReport) observe(latency time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.processed, 1)
+	if err != nil {
+		atomic.AddInt64(&r.failed, 1)
+	}
+	if *shadowMaxLatency > 0 && latency > *shadowMaxLatency {
+		atomic.AddInt64(&r.slow, 1)
+	}
+	r.latencies.observe(latency)
+}
+
+// violations returns the expectations that the observed processing doesn't meet
+func (r *shadowReport) violations(processed, failed int64, p99 time.Duration) []string {
+	var violations []string
+	if *shadowMaxLatency > 0 && p99 > *shadowMaxLatency {
+		violations = append(violations, fmt.Sprintf("p99 latency %v exceeds -shadow-max-latency %v", p99, *shadowMaxLatency))
+	}
+	if processed > 0 && float64(failed)/float64(processed) > *shadowMaxFailureRate {
+		violations = append(violations, fmt.Sprintf("failure rate %.4f exceeds -shadow-max-failure-rate %.4f", float64(failed)/float64(processed), *shadowMaxFailureRate))
+	}
+	return violations
+}
+
+// shadowLoop logs the shadow report every -shadow-report-interval until the
+// consumer is closed
+func (consumer *Consumer) shadowLoop() {
+	ticker := time.NewTicker(*shadowReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			consumer.logShadowReport()
+		case <-consumer.ctx.Done():
+			return
+		}
+	}
+}
+
+// logShadowReport logs the processing observed since the consumer started,
+// and a warning for every expectation it doesn't meet
+func (consumer *Consumer) logShadowReport() {
+	r := consumer.shadow
+	processed, failed, slow := atomic.LoadInt64(&r.processed), atomic.LoadInt64(&r.failed), atomic.LoadInt64(&r.slow)
+	if processed == 0 {
+		consumer.logger.Println("Shadow report: no messages processed yet")
+		return
+	}
+
+	var p50, p99 time.Duration
+	if p := r.latencies.percentiles(0.50, 0.99); p != nil {
+		p50, p99 = p[0], p[1]
+	}
+	consumer.logger.Printf("Shadow report: processed = %d, failed = %d, slow = %d, p50 = %v, p99 = %v", processed, failed, slow, p50, p99)
+	for _, violation := range r.violations(processed, failed, p99) {
+		consumer.logger.Printf("Warning: shadow expectation not met: %s", violation)
+	}
+}
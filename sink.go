@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// commitPoint is the position a commit proposes: the next offset to consume of
+// every partition that progressed since the previous commit
+type commitPoint struct {
+	Group      string
+	Generation int32
+	Offsets    map[string]map[int32]int64
+}
+
+// sink is an output the claimed messages are written to instead of being
+// printed. Sinks batching their writes, such as files uploaded to object
+// storage, take part in a commit barrier: before the offsets of a commit point
+// are committed every sink flushes what was written to it so far, and a sink
+// failing to flush fails the commit, which is retried along with the flush.
+// So the committed offsets never get ahead of the data the sinks persisted.
+//
+// Sinks are shared by the claims of all consumers without sinks of their own
+// and must be safe for concurrent use.
+type sink interface {
+	// name identifies the sink in logs
+	name() string
+	// write writes the message with its possibly decompressed value
+	write(message *sarama.ConsumerMessage, value []byte) error
+	// flush persists every message written so far, at least up to point
+	flush(point commitPoint) error
+	// close flushes and releases the sink on shutdown
+	close() error
+}
+
+// sinkPipeline is the number of messages the sinks connected to a server
+// buffer before waiting for their acknowledgements
+const sinkPipeline = 1000
+
+// sinks receive the claimed messages instead of the printer when set, unless
+// a consumer of the -config file has sinks of its own
+var sinks []sink
+
+// sinkFlags are the flags a consumer of the -config file can set in its sinks
+// setting
+var sinkFlags = map[string]bool{
+	"parquet-dir": true, "parquet-compression": true, "parquet-row-group-size": true, "s3-endpoint": true, "s3-region": true,
+	"bigquery-table": true, "bigquery-columns": true, "bigquery-batch-size": true, "bigquery-skip-invalid": true,
+	"redis-url": true, "redis-mode": true, "redis-key-prefix": true, "redis-channel": true, "redis-ttl": true,
+	"nats-url": true, "nats-subject": true,
+	"mqtt-url": true, "mqtt-topic": true, "mqtt-qos": true, "mqtt-retain": true, "mqtt-client-id": true,
+	"sqs-queue-url": true, "sns-topic-arn": true, "sns-endpoint": true, "pubsub-topic": true,
+	"syslog-addr": true, "syslog-facility": true, "syslog-severity": true, "syslog-app": true, "journald": true,
+	"loki-url": true, "loki-labels": true, "loki-tenant": true, "loki-batch-bytes": true,
+	"fluentd-addr": true, "fluentd-tag": true, "fluentd-record": true,
+	"clickhouse-url": true, "clickhouse-table": true, "clickhouse-tables": true, "clickhouse-columns": true, "clickhouse-batch-size": true,
+	"influx-url": true, "influx-org": true, "influx-bucket": true, "graphite-addr": true,
+	"metric-name": true, "metric-fields": true, "metric-tags": true,
+}
+
+// sinkFlagsMu serializes openConsumerSinks, which sets the sink flags while
+// opening the sinks
+var sinkFlagsMu sync.Mutex
+
+// openSinks opens the sinks enabled by the flags
+func openSinks() error {
+	var err error
+	sinks, err = newSinks()
+	return err
+}
+
+// openConsumerSinks opens the sinks of a consumer of the -config file. Its
+// settings override the sink flags of the same name, so a flag set to an empty
+// value disables a sink of the command line.
+func openConsumerSinks(settings map[string]string) ([]sink, error) {
+	sinkFlagsMu.Lock()
+	defer sinkFlagsMu.Unlock()
+
+	previous := make(map[string]string)
+	defer func() {
+		for name, value := range previous {
+			flag.Set(name, value)
+		}
+	}()
+	for name, value := range settings {
+		if !sinkFlags[name] {
+			return nil, fmt.Errorf("unknown sink setting %q", name)
+		}
+		previous[name] = flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid sink setting %s: %v", name, err)
+		}
+	}
+	return newSinks()
+}
+
+// newSinks opens the sinks enabled by the current values of the sink flags
+func newSinks() (opened []sink, err error) {
+	defer func() {
+		if err != nil {
+			closeSinks(opened)
+		}
+	}()
+	if *parquetDir != "" {
+		s, err := newParquetSink(*parquetDir, *parquetCompression, *parquetRowGroupSize, *schemaRegistryURL, *s3Endpoint, *s3Region)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *bigQueryTable != "" {
+		s, err := newBigQuerySink(*bigQueryTable, *bigQueryColumns, *bigQueryBatchSize, *bigQuerySkipInvalid)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *redisURL != "" {
+		s, err := newRedisSink(*redisURL, *redisMode, *redisKeyPrefix, *redisChannel, *redisTTL)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *natsURL != "" {
+		s, err := newNATSSink(*natsURL, *natsSubject)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *mqttURL != "" {
+		s, err := newMQTTSink(*mqttURL, *mqttTopic, *mqttQoS, *mqttRetain, *mqttClientID)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *sqsQueueURL != "" {
+		s, err := newSQSSink(*sqsQueueURL)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *snsTopicARN != "" {
+		s, err := newSNSSink(*snsTopicARN, *snsEndpoint)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *syslogAddr != "" {
+		s, err := newSyslogSink(*syslogAddr, *syslogFacility, *syslogSeverity, *syslogApp)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *journald {
+		s, err := newJournaldSink(*syslogSeverity, *syslogApp)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *lokiURL != "" {
+		s, err := newLokiSink(*lokiURL, *lokiLabels, *lokiTenant, *lokiBatchBytes)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *fluentdAddr != "" {
+		s, err := newFluentdSink(*fluentdAddr, *fluentdTag, *fluentdRecord)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *clickHouseURL != "" {
+		s, err := newClickHouseSink(*clickHouseURL, *clickHouseTable, *clickHouseTables, *clickHouseColumns, *clickHouseBatchSize)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *pubSubTopic != "" {
+		s, err := newPubSubSink(*pubSubTopic)
+		if err != nil {
+			return opened, err
+		}
+		opened = append(opened, s)
+	}
+	if *influxURL != "" || *graphiteAddr != "" {
+		extractor, err := newMetricExtractor(*metricName, *metricFields, *metricTags)
+		if err != nil {
+			return opened, err
+		}
+		if *influxURL != "" {
+			s, err := newInfluxSink(*influxURL, *influxOrg, *influxBucket, extractor)
+			if err != nil {
+				return opened, err
+			}
+			opened = append(opened, s)
+		}
+		if *graphiteAddr != "" {
+			s, err := newGraphiteSink(*graphiteAddr, extractor)
+			if err != nil {
+				return opened, err
+			}
+			opened = append(opened, s)
+		}
+	}
+	return opened, nil
+}
+
+// writeSinks writes the message to every sink
+func writeSinks(sinks []sink, message *sarama.ConsumerMessage, value []byte) error {
+	for _, s := range sinks {
+		if err := s.write(message, value); err != nil {
+			return fmt.Errorf("unable to write to %s: %v", s.name(), err)
+		}
+	}
+	return nil
+}
+
+// flushSinks is the commit barrier, it returns once every sink flushed up to point
+func flushSinks(sinks []sink, point commitPoint) error {
+	for _, s := range sinks {
+		if err := s.flush(point); err != nil {
+			return fmt.Errorf("unable to flush %s: %v", s.name(), err)
+		}
+	}
+	return nil
+}
+
+// closeSinks closes every sink once the consumers committed for the last time
+func closeSinks(sinks []sink) {
+	for _, s := range sinks {
+		if err := s.close(); err != nil {
+			log.Printf("Error closing %s: %v", s.name(), err)
+		}
+	}
+}
+
+// dialSink connects to the TCP address of a sink, over TLS if useTLS is set
+func dialSink(addr string, useTLS bool, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !useTLS {
+		return dialer.Dial("tcp", addr)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+}
+
+// expandSinkTemplate replaces {topic}, {partition} and {key} in the template
+// of a destination by those of the message
+func expandSinkTemplate(template string, message *sarama.ConsumerMessage) string {
+	return strings.NewReplacer(
+		"{topic}", message.Topic,
+		"{partition}", strconv.Itoa(int(message.Partition)),
+		"{key}", string(message.Key),
+	).Replace(template)
+}
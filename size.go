@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+)
+
+// originalSizeHeader carries the size of a value truncated by -max-handle-bytes
+const originalSizeHeader = "x-original-size"
+
+// checkSize counts the message when its value exceeds -max-handle-bytes and
+// applies -on-oversized-message to it. It returns the message and value to
+// process, copies with the value truncated under truncate, and reports whether
+// the message was handled and must not be processed.
+func (consumer *Consumer) checkSize(message *sarama.ConsumerMessage, value []byte) (*sarama.ConsumerMessage, []byte, bool, error) {
+	if *maxHandleBytes <= 0 || len(value) <= *maxHandleBytes {
+		return message, value, false, nil
+	}
+	consumer.oversized.Inc(1)
+
+	switch *onOversizedMessage {
+	case "skip":
+		return message, value, true, nil
+	case "dead-letter":
+		topic := *deadLetterTopic
+		if *shadow {
+			topic += shadowTopicSuffix
+		}
+		if err := forward(consumer.producer, topic, message, consumer.settings().cluster); err != nil {
+			consumer.logger.Printf("Unable to dead-letter topic = %s, partition = %d, offset = %d to %s: %v", message.Topic, message.Partition, message.Offset, topic, err)
+			return message, value, true, err
+		}
+		return message, value, true, nil
+	}
+
+	// forwarded copies carry the truncated, decompressed value and its original size
+	truncated := *message
+	truncated.Value = value[:truncateAt(value, *maxHandleBytes)]
+	truncated.Headers = append(append([]*sarama.RecordHeader(nil), message.Headers...), &sarama.RecordHeader{
+		Key:   []byte(originalSizeHeader),
+		Value: []byte(strconv.Itoa(len(value))),
+	})
+	return &truncated, truncated.Value, false, nil
+}
+
+// truncateAt returns the length of the value cut to at most max bytes, without
+// splitting a UTF-8 encoded rune
+func truncateAt(value []byte, max int) int {
+	if len(value) <= max {
+		return len(value)
+	}
+	cut := max
+	for i := 0; i < utf8.UTFMax && cut > 0 && !utf8.RuneStart(value[cut]); i++ {
+		cut--
+	}
+	return cut
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+)
+
+// awsBatchSize is the maximum number of messages of an SQS or SNS batch
+const awsBatchSize = 10
+
+// awsBatchBytes is the maximum size of an SQS or SNS batch, and so of a message
+const awsBatchBytes = 256 * 1024
+
+// awsMaxAttributes is the maximum number of attributes of an SQS or SNS message
+const awsMaxAttributes = 10
+
+// awsMessagingSink forwards the claimed messages to an SQS queue or an SNS
+// topic in batches, with the Kafka headers as message attributes. Messages
+// are sent once a batch is full, and at the latest by the commit barrier, so
+// the offsets are committed only once their messages were accepted.
+//
+// FIFO queues and topics get the key of the message as its group, ordering
+// the messages of a key, and its locator as deduplication id, so messages
+// sent again after a failed commit are dropped as duplicates.
+type awsMessagingSink struct {
+	// service is sqs or sns
+	service string
+	// endpoint receives the requests, the queue URL for SQS
+	endpoint string
+	topicARN string
+	fifo     bool
+	creds    awsCredentials
+	client   *http.Client
+
+	mu      sync.Mutex
+	entries []awsMessage
+}
+
+// awsMessage is a message of a batch
+type awsMessage struct {
+	body       string
+	attributes []awsAttribute
+	group      string
+	dedupID    string
+}
+
+// awsAttribute is a message attribute, binary unless it is valid UTF-8
+type awsAttribute struct {
+	name   string
+	value  []byte
+	binary bool
+}
+
+// awsBatchFailure is a message of a batch which was not accepted
+type awsBatchFailure struct {
+	ID          string `xml:"Id"`
+	Code        string `xml:"Code"`
+	Message     string `xml:"Message"`
+	SenderFault bool   `xml:"SenderFault"`
+}
+
+// awsBatchResponse holds the failures of a SendMessageBatch or PublishBatch request
+type awsBatchResponse struct {
+	SQSFailed []awsBatchFailure `xml:"SendMessageBatchResult>BatchResultErrorEntry"`
+	SNSFailed []awsBatchFailure `xml:"PublishBatchResult>Failed>member"`
+}
+
+// newSQSSink returns the sink for a queue URL such as
+// https://sqs.eu-west-1.amazonaws.com/123456789012/orders
+func newSQSSink(queueURL string) (*awsMessagingSink, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -sqs-queue-url %q", queueURL)
+	}
+	var region string
+	if parts := strings.Split(u.Hostname(), "."); len(parts) > 2 && strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		if region = parts[1]; parts[0] != "sqs" {
+			// the legacy <region>.queue.amazonaws.com endpoints
+			region = parts[0]
+		}
+	}
+	creds, err := envAWSCredentials(region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsMessagingSink{
+		service:  "sqs",
+		endpoint: queueURL,
+		fifo:     strings.HasSuffix(u.Path, ".fifo"),
+		creds:    creds,
+		client:   &http.Client{Timeout: awsTimeout},
+	}, nil
+}
+
+// newSNSSink returns the sink for a topic ARN such as
+// arn:aws:sns:eu-west-1:123456789012:orders, sent to the regional endpoint
+// of SNS unless another endpoint is given
+func newSNSSink(topicARN, endpoint string) (*awsMessagingSink, error) {
+	parts := strings.Split(topicARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" {
+		return nil, fmt.Errorf("invalid -sns-topic-arn %q, expected arn:aws:sns:<region>:<account>:<topic>", topicARN)
+	}
+	creds, err := envAWSCredentials(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == "" {
+		endpoint = "https://sns." + creds.region + ".amazonaws.com/"
+	}
+
+	return &awsMessagingSink{
+		service:  "sns",
+		endpoint: endpoint,
+		topicARN: topicARN,
+		fifo:     strings.HasSuffix(topicARN, ".fifo"),
+		creds:    creds,
+		client:   &http.Client{Timeout: awsTimeout},
+	}, nil
+}
+
+func (s *awsMessagingSink) name() string {
+	if s.service == "sns" {
+		return "sns sink " + s.topicARN
+	}
+	return "sqs sink " + s.endpoint
+}
+
+func (s *awsMessagingSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	m := awsMessage{body: string(value)}
+	if !utf8.Valid(value) {
+		m.body = base64.StdEncoding.EncodeToString(value)
+		m.attributes = append(m.attributes, awsAttribute{name: "content-transfer-encoding", value: []byte("base64")})
+	}
+	for _, h := range message.Headers {
+		if len(m.attributes) == awsMaxAttributes {
+			break
+		}
+		if name := awsAttributeName(string(h.Key)); name != "" {
+			m.attributes = append(m.attributes, awsAttribute{name: name, value: h.Value, binary: !utf8.Valid(h.Value)})
+		}
+	}
+	if s.fifo {
+		m.group = awsMessageID(message.Key)
+		if message.Key == nil {
+			m.group = fmt.Sprintf("%s-%d", message.Topic, message.Partition)
+		}
+		m.dedupID = awsMessageID([]byte(idempotencyKey(message)))
+	}
+	if size := m.size(); size > awsBatchBytes {
+		return fmt.Errorf("message at topic = %s, partition = %d, offset = %d exceeds the %d bytes %s allows with %d bytes", message.Topic, message.Partition, message.Offset, awsBatchBytes, strings.ToUpper(s.service), size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// send before buffering, so a write retried after a failure isn't buffered twice
+	if len(s.entries) >= awsBatchSize {
+		if err := s.send(); err != nil {
+			return err
+		}
+	}
+	s.entries = append(s.entries, m)
+	return nil
+}
+
+// size returns the size the message counts with towards the limit of a batch
+func (m awsMessage) size() int {
+	n := len(m.body)
+	for _, a := range m.attributes {
+		n += len(a.name) + len(a.value) + len("String")
+	}
+	return n
+}
+
+// awsAttributeName returns the header name as a valid attribute name, or ""
+// for headers which can't be attributes
+func awsAttributeName(header string) string {
+	name := strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, header), ".")
+	for strings.Contains(name, "..") {
+		name = strings.Replace(name, "..", ".", -1)
+	}
+	lower := strings.ToLower(name)
+	if name == "" || len(name) > 256 || strings.HasPrefix(lower, "aws.") || strings.HasPrefix(lower, "amazon.") {
+		return ""
+	}
+	return name
+}
+
+// awsMessageID returns the id as a group or deduplication id, which are
+// limited to 128 printable ASCII characters, hashed if it isn't one
+func awsMessageID(id []byte) string {
+	if len(id) > 0 && len(id) <= 128 {
+		printable := true
+		for _, c := range id {
+			if c < '!' || c > '~' {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return string(id)
+		}
+	}
+	return sha256Hex(id)
+}
+
+// flush sends the buffered messages, the barrier of a commit
+func (s *awsMessagingSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send()
+}
+
+// send sends the buffered messages in batches, the messages which weren't
+// accepted stay buffered for the next attempt
+func (s *awsMessagingSink) send() error {
+	var failed []awsMessage
+	var cause error
+	for len(s.entries) > 0 {
+		n, size := 0, 0
+		for n < len(s.entries) && n < awsBatchSize && size+s.entries[n].size() <= awsBatchBytes {
+			size += s.entries[n].size()
+			n++
+		}
+		rejected, err := s.sendBatch(s.entries[:n])
+		if err != nil {
+			s.entries = append(failed, s.entries...)
+			return err
+		}
+		for _, i := range rejected {
+			failed = append(failed, s.entries[i])
+		}
+		if len(rejected) > 0 {
+			cause = fmt.Errorf("%s rejected %d messages of a batch", strings.ToUpper(s.service), len(rejected))
+		}
+		s.entries = s.entries[n:]
+	}
+	s.entries = failed
+	return cause
+}
+
+// sendBatch sends a batch with the query API, returning the indices of the
+// messages which were not accepted
+func (s *awsMessagingSink) sendBatch(batch []awsMessage) ([]int, error) {
+	form := url.Values{}
+	entryPrefix, attributePrefix := "SendMessageBatchRequestEntry.%d.", "MessageAttribute.%d."
+	if s.service == "sns" {
+		form.Set("Action", "PublishBatch")
+		form.Set("Version", "2010-03-31")
+		form.Set("TopicArn", s.topicARN)
+		entryPrefix, attributePrefix = "PublishBatchRequestEntries.member.%d.", "MessageAttributes.entry.%d."
+	} else {
+		form.Set("Action", "SendMessageBatch")
+		form.Set("Version", "2012-11-05")
+	}
+	for i, m := range batch {
+		entry := fmt.Sprintf(entryPrefix, i+1)
+		form.Set(entry+"Id", strconv.Itoa(i))
+		if s.service == "sns" {
+			form.Set(entry+"Message", m.body)
+		} else {
+			form.Set(entry+"MessageBody", m.body)
+		}
+		if m.group != "" {
+			form.Set(entry+"MessageGroupId", m.group)
+			form.Set(entry+"MessageDeduplicationId", m.dedupID)
+		}
+		for j, a := range m.attributes {
+			attribute := entry + fmt.Sprintf(attributePrefix, j+1)
+			form.Set(attribute+"Name", a.name)
+			if a.binary {
+				form.Set(attribute+"Value.DataType", "Binary")
+				form.Set(attribute+"Value.BinaryValue", base64.StdEncoding.EncodeToString(a.value))
+			} else {
+				form.Set(attribute+"Value.DataType", "String")
+				form.Set(attribute+"Value.StringValue", string(a.value))
+			}
+		}
+	}
+
+	body := form.Encode()
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.creds.sign(req, s.service, sha256Hex([]byte(body)), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, awsError(resp)
+	}
+	var response awsBatchResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid %s response: %v", strings.ToUpper(s.service), err)
+	}
+
+	var rejected []int
+	for _, f := range append(response.SQSFailed, response.SNSFailed...) {
+		i, err := strconv.Atoi(f.ID)
+		if err != nil || i < 0 || i >= len(batch) {
+			continue
+		}
+		rejected = append(rejected, i)
+		log.Printf("Message rejected by %s: %s: %s", s.name(), f.Code, f.Message)
+	}
+	return rejected, nil
+}
+
+func (s *awsMessagingSink) close() error {
+	return s.flush(commitPoint{})
+}
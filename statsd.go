@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// statsdPacketSize keeps the UDP packets below the usual MTU
+const statsdPacketSize = 1400
+
+// statsdReporter flushes the Sarama metrics registry and the counters of
+// every running consumer to statsd as gauges, with dogstatsd tags
+type statsdReporter struct {
+	conn   net.Conn
+	prefix string
+	tags   []string
+	buf    bytes.Buffer
+}
+
+func newStatsdReporter(addr, prefix, tags string) (*statsdReporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &statsdReporter{conn: conn, prefix: prefix}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			r.tags = append(r.tags, tag)
+		}
+	}
+	return r, nil
+}
+
+// run flushes the metrics every interval, forever
+func (r *statsdReporter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		runningMu.RLock()
+		for _, consumer := range running {
+			r.report(consumer)
+		}
+		runningMu.RUnlock()
+		if *maxMemoryMB > 0 {
+			r.gauge("heap-bytes", float64(atomic.LoadUint64(&heapBytes)), r.tags)
+			r.gauge("memory-paused", float64(atomic.LoadInt32(&memoryPaused)), r.tags)
+			r.gauge("memory-pauses", float64(atomic.LoadInt64(&memoryPauses)), r.tags)
+		}
+		r.flush()
+	}
+}
+
+// report writes the metrics of the consumer
+func (r *statsdReporter) report(consumer *Consumer) {
+	status := consumer.status()
+	tags := append([]string{"consumer:" + status.Name, "group:" + status.Group}, r.tags...)
+
+	consumer.registry.Each(func(name string, metric interface{}) {
+		switch metric := metric.(type) {
+		case metrics.Counter:
+			r.gauge(name, float64(metric.Count()), tags)
+		case metrics.Gauge:
+			r.gauge(name, float64(metric.Value()), tags)
+		case metrics.GaugeFloat64:
+			r.gauge(name, metric.Value(), tags)
+		case metrics.Meter:
+			snapshot := metric.Snapshot()
+			r.gauge(name+".count", float64(snapshot.Count()), tags)
+			r.gauge(name+".rate1", snapshot.Rate1(), tags)
+		case metrics.Histogram:
+			snapshot := metric.Snapshot()
+			percentiles := snapshot.Percentiles([]float64{0.5, 0.99})
+			r.gauge(name+".count", float64(snapshot.Count()), tags)
+			r.gauge(name+".mean", snapshot.Mean(), tags)
+			r.gauge(name+".p50", percentiles[0], tags)
+			r.gauge(name+".p99", percentiles[1], tags)
+			r.gauge(name+".max", float64(snapshot.Max()), tags)
+		}
+	})
+
+	r.gauge("offset-gaps", float64(status.OffsetGaps), tags)
+	r.gauge("offset-duplicates", float64(status.OffsetDuplicates), tags)
+	r.gauge("commit-failures", float64(status.CommitFailures), tags)
+	r.gauge("transaction-markers", float64(status.TransactionMarkers), tags)
+	r.gauge("aborted-records", float64(status.AbortedRecords), tags)
+	if status.Breaker != "" {
+		open := 0.0
+		if status.Breaker != breakerClosed {
+			open = 1
+		}
+		r.gauge("breaker-open", open, tags)
+	}
+	if consumer.lagSLO != nil {
+		r.gauge("lag-slo-breached", float64(len(status.LagSLOBreached)), tags)
+	}
+	for _, partition := range status.Partitions {
+		partitionTags := append([]string{"topic:" + partition.Topic, "partition:" + strconv.Itoa(int(partition.Partition))}, tags...)
+		r.gauge("lag", float64(partition.Lag), partitionTags)
+	}
+}
+
+// gauge adds a gauge to the current packet, sending it first when full
+func (r *statsdReporter) gauge(name string, value float64, tags []string) {
+	line := r.prefix + statsdName(name) + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|g"
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	if r.buf.Len() > 0 && r.buf.Len()+len(line)+1 > statsdPacketSize {
+		r.flush()
+	}
+	if r.buf.Len() > 0 {
+		r.buf.WriteByte('\n')
+	}
+	r.buf.WriteString(line)
+}
+
+// flush sends the current packet, like the consumer logs it doesn't stop on errors
+func (r *statsdReporter) flush() {
+	if r.buf.Len() == 0 {
+		return
+	}
+	if _, err := r.conn.Write(r.buf.Bytes()); err != nil {
+		log.Printf("Unable to send metrics to statsd: %v", err)
+	}
+	r.buf.Reset()
+}
+
+// statsdName replaces the characters statsd doesn't allow in metric names
+func statsdName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
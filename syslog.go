@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// syslogTimeout bounds connecting to the syslog server and sending to it
+const syslogTimeout = 10 * time.Second
+
+// syslogBuffer is the number of bytes buffered for a stream before sending them
+const syslogBuffer = 64 * 1024
+
+// syslogEnterpriseID qualifies the names of the structured data elements, the
+// private enterprise number RFC 5424 reserves for examples
+const syslogEnterpriseID = "32473"
+
+// syslogFacilities are the facilities by name
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18,
+	"local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities are the severities by name, shared by the journald sink
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// syslogSink writes the claimed messages to a syslog server in the RFC 5424
+// format, with the message metadata and headers as structured data:
+//
+//	<134>1 2024-05-01T13:00:00.123Z host kafka-consumergroup 42 orders [kafka@32473 topic="orders" partition="0" offset="7" key="o1"] {"id":1}
+//
+// Messages are sent as datagrams over UDP, or with octet counting framing over
+// TCP and TLS. Streams are buffered, and sent at the latest by the commit
+// barrier; after a failure the buffer is sent again over a new connection.
+type syslogSink struct {
+	network  string
+	addr     string
+	useTLS   bool
+	priority int
+	hostname string
+	app      string
+	pid      string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	buf     []byte
+	pending bytes.Buffer
+}
+
+// newSyslogSink returns the sink for a udp://, tcp:// or tls:// address
+func newSyslogSink(addr, facility, severity, app string) (*syslogSink, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -syslog-addr %q, expected udp://, tcp:// or tls://host:port", addr)
+	}
+	f, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown -syslog-facility %q", facility)
+	}
+	sev, ok := syslogSeverities[severity]
+	if !ok {
+		return nil, fmt.Errorf("unknown -syslog-severity %q", severity)
+	}
+
+	s := &syslogSink{
+		network:  u.Scheme,
+		addr:     u.Host,
+		priority: f*8 + sev,
+		app:      syslogName(app, 48),
+		pid:      strconv.Itoa(os.Getpid()),
+	}
+	port := "514"
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		s.network, s.useTLS, port = "tcp", true, "6514"
+	default:
+		return nil, fmt.Errorf("invalid -syslog-addr %q, expected udp://, tcp:// or tls://host:port", addr)
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	host, _ := os.Hostname()
+	s.hostname = syslogName(host, 255)
+	return s, nil
+}
+
+func (s *syslogSink) name() string {
+	return "syslog sink " + s.addr
+}
+
+func (s *syslogSink) write(message *sarama.ConsumerMessage, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := s.format(s.buf[:0], message, value)
+	s.buf = buf
+
+	if s.network == "udp" {
+		if err := s.connect(); err != nil {
+			return err
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := s.conn.Write(buf); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+		return nil
+	}
+
+	// send before buffering, so a write retried after a failure isn't buffered twice
+	if s.pending.Len() >= syslogBuffer {
+		if err := s.send(); err != nil {
+			return err
+		}
+	}
+	s.pending.WriteString(strconv.Itoa(len(buf)))
+	s.pending.WriteByte(' ')
+	s.pending.Write(buf)
+	return nil
+}
+
+// format appends the message in the RFC 5424 format
+func (s *syslogSink) format(buf []byte, message *sarama.ConsumerMessage, value []byte) []byte {
+	buf = append(buf, '<')
+	buf = strconv.AppendInt(buf, int64(s.priority), 10)
+	buf = append(buf, ">1 "...)
+	if message.Timestamp.IsZero() {
+		buf = append(buf, '-')
+	} else {
+		buf = message.Timestamp.UTC().AppendFormat(buf, "2006-01-02T15:04:05.000000Z07:00")
+	}
+	buf = append(buf, ' ')
+	buf = append(buf, s.hostname...)
+	buf = append(buf, ' ')
+	buf = append(buf, s.app...)
+	buf = append(buf, ' ')
+	buf = append(buf, s.pid...)
+	buf = append(buf, ' ')
+	buf = append(buf, syslogName(message.Topic, 32)...)
+
+	buf = append(buf, " [kafka@"+syslogEnterpriseID+" topic=\""...)
+	buf = appendSyslogParam(buf, []byte(message.Topic))
+	buf = append(buf, "\" partition=\""...)
+	buf = strconv.AppendInt(buf, int64(message.Partition), 10)
+	buf = append(buf, "\" offset=\""...)
+	buf = strconv.AppendInt(buf, message.Offset, 10)
+	buf = append(buf, '"')
+	if message.Key != nil {
+		buf = append(buf, " key=\""...)
+		buf = appendSyslogParam(buf, message.Key)
+		buf = append(buf, '"')
+	}
+	buf = append(buf, ']')
+	if len(message.Headers) > 0 {
+		buf = append(buf, "[header@"+syslogEnterpriseID...)
+		for _, h := range message.Headers {
+			buf = append(buf, ' ')
+			buf = append(buf, syslogName(strings.NewReplacer("=", "_", "]", "_", "\"", "_").Replace(string(h.Key)), 32)...)
+			buf = append(buf, "=\""...)
+			buf = appendSyslogParam(buf, h.Value)
+			buf = append(buf, '"')
+		}
+		buf = append(buf, ']')
+	}
+
+	buf = append(buf, ' ')
+	return appendValue(buf, message, value)
+}
+
+// syslogName returns s as a header field or structured data name, printable
+// ASCII of at most max characters, or - when empty
+func syslogName(s string, max int) string {
+	name := strings.Map(func(r rune) rune {
+		if r < '!' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(name) > max {
+		name = name[:max]
+	}
+	if name == "" {
+		return "-"
+	}
+	return name
+}
+
+// appendSyslogParam appends a structured data parameter value, escaping the
+// characters RFC 5424 requires
+func appendSyslogParam(buf []byte, value []byte) []byte {
+	for _, c := range value {
+		if c == '"' || c == '\\' || c == ']' {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, c)
+	}
+	return buf
+}
+
+// flush sends the buffered messages, the barrier of a commit
+func (s *syslogSink) flush(point commitPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send()
+}
+
+// send sends the buffered messages of a stream. On failure the connection is
+// closed, and the messages are sent again by the next send.
+func (s *syslogSink) send() error {
+	if s.pending.Len() == 0 {
+		return nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := s.conn.Write(s.pending.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	s.pending.Reset()
+	return nil
+}
+
+// connect connects unless connected already
+func (s *syslogSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	var err error
+	if s.network == "udp" {
+		s.conn, err = net.DialTimeout("udp", s.addr, syslogTimeout)
+	} else {
+		s.conn, err = dialSink(s.addr, s.useTLS, syslogTimeout)
+	}
+	return err
+}
+
+func (s *syslogSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// delegationTokenFile is the -token-file, as written by the process issuing
+// the delegation tokens of this consumer
+type delegationTokenFile struct {
+	TokenID string `json:"token_id"`
+	HMAC    string `json:"hmac"`
+	// Expiry is the optional RFC3339 expiry time of the token
+	Expiry time.Time `json:"expiry"`
+}
+
+// delegationToken holds the current Kafka delegation token, authenticating
+// with SCRAM and the tokenauth extension instead of long-lived credentials.
+// The token is re-read from -token-file every -token-refresh, so every new
+// connection, and every reauthentication when the brokers limit the session
+// lifetime, uses the latest token.
+type delegationToken struct {
+	path string
+
+	mu    sync.RWMutex
+	token delegationTokenFile
+}
+
+// tokens is set with -token-id or -token-file
+var tokens *delegationToken
+
+// newDelegationToken returns the token given by the flags, or read from the file
+func newDelegationToken(id, hmac, path string) (*delegationToken, error) {
+	if path == "" {
+		if id == "" || hmac == "" {
+			return nil, errors.New("a delegation token requires -token-id and -token-hmac, or -token-file")
+		}
+		return &delegationToken{token: delegationTokenFile{TokenID: id, HMAC: hmac}}, nil
+	}
+
+	t := &delegationToken{path: path}
+	if _, err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload re-reads the token file and reports whether the token changed
+func (t *delegationToken) reload() (bool, error) {
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return false, err
+	}
+	var token delegationTokenFile
+	if err := json.Unmarshal(data, &token); err != nil {
+		return false, err
+	}
+	if token.TokenID == "" || token.HMAC == "" {
+		return false, errors.New("the token file requires a token_id and an hmac")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := token != t.token
+	t.token = token
+	return changed, nil
+}
+
+// credentials returns the token id and HMAC, the user name and password of the SCRAM exchange
+func (t *delegationToken) credentials() (string, string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.token.TokenID, t.token.HMAC
+}
+
+func (t *delegationToken) expiry() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.token.Expiry
+}
+
+// configure enables SCRAM authentication with the token in the Sarama config
+func (t *delegationToken) configure(config *sarama.Config) error {
+	mechanism := sarama.SASLMechanism(*tokenMechanism)
+	hash, err := scramHash(mechanism)
+	if err != nil {
+		return err
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = mechanism
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.Version = sarama.SASLHandshakeV1
+	// validated by Sarama, the SCRAM client takes the current token instead
+	config.Net.SASL.User, config.Net.SASL.Password = t.credentials()
+	config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+		return &scramClient{hash: hash, credentials: t.credentials, extensions: "tokenauth=true"}
+	}
+	return nil
+}
+
+// refresh re-reads the token file every -token-refresh, and more often as the
+// token approaches its expiry, warning when it expires without being renewed
+func (t *delegationToken) refresh() {
+	for {
+		delay := *tokenRefresh
+		if expiry := t.expiry(); !expiry.IsZero() {
+			if remaining := time.Until(expiry) / 2; remaining > time.Second && remaining < delay {
+				delay = remaining
+			}
+		}
+		time.Sleep(delay)
+
+		changed, err := t.reload()
+		if err != nil {
+			log.Printf("Unable to reload the delegation token from %s: %v", t.path, err)
+		} else if changed {
+			id, _ := t.credentials()
+			log.Printf("Delegation token reloaded: token id = %s, expiry = %v", id, t.expiry())
+		}
+
+		if expiry := t.expiry(); !expiry.IsZero() && time.Until(expiry) < *tokenRefresh {
+			log.Printf("Warning: the delegation token expires at %v and %s wasn't updated with a new one", expiry, t.path)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// bannerTopicConfigs are the topic configs logged at startup, those shaping
+// what the consumer gets to see
+var bannerTopicConfigs = []string{"cleanup.policy", "retention.ms", "retention.bytes", "max.message.bytes", "min.insync.replicas", "message.timestamp.type"}
+
+// logTopicConfigs logs the number of partitions, the replication factor and
+// the bannerTopicConfigs of every topic of the consumer, so operators see how
+// long messages are kept, whether the topics are compacted and how large
+// messages may be. Configs that can't be described, e.g. for lack of the
+// DescribeConfigs ACL, are left out.
+func (consumer *Consumer) logTopicConfigs() {
+	settings := consumer.settings()
+	configs, err := consumer.describeTopicConfigs(settings.topicNames)
+	if err != nil {
+		consumer.logger.Printf("Unable to describe the configs of %v: %v", settings.topicNames, err)
+	}
+
+	for _, topic := range settings.topicNames {
+		partitions, err := consumer.client.Partitions(topic)
+		if err != nil {
+			consumer.logger.Printf("Unable to look up the partitions of topic = %s: %v", topic, err)
+			continue
+		}
+		line := fmt.Sprintf("Topic %s: partitions = %d", topic, len(partitions))
+		if len(partitions) > 0 {
+			if replicas, err := consumer.client.Replicas(topic, partitions[0]); err == nil {
+				line += fmt.Sprintf(", replication factor = %d", len(replicas))
+			}
+		}
+		for _, name := range bannerTopicConfigs {
+			if value, ok := configs[topic][name]; ok {
+				line += ", " + name + " = " + describeTopicConfig(name, value)
+			}
+		}
+		consumer.logger.Print(line)
+	}
+}
+
+// describeTopicConfigs returns the bannerTopicConfigs of the topics by topic
+// and name
+func (consumer *Consumer) describeTopicConfigs(topics []string) (map[string]map[string]string, error) {
+	request := &sarama.DescribeConfigsRequest{}
+	for _, topic := range topics {
+		request.Resources = append(request.Resources, &sarama.ConfigResource{
+			Type:        sarama.TopicResource,
+			Name:        topic,
+			ConfigNames: bannerTopicConfigs,
+		})
+	}
+
+	broker, err := consumer.client.Controller()
+	if err != nil {
+		return nil, err
+	}
+	response, err := broker.DescribeConfigs(request)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]map[string]string)
+	var errs []string
+	for _, resource := range response.Resources {
+		if resource.ErrorCode != 0 {
+			errs = append(errs, fmt.Sprintf("topic %s: %v", resource.Name, sarama.KError(resource.ErrorCode)))
+			continue
+		}
+		configs[resource.Name] = make(map[string]string)
+		for _, entry := range resource.Configs {
+			configs[resource.Name][entry.Name] = entry.Value
+		}
+	}
+	if len(errs) > 0 {
+		return configs, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return configs, nil
+}
+
+// describeTopicConfig returns the value of the config with the durations and
+// sizes spelled out
+func describeTopicConfig(name, value string) string {
+	n, err := strconv.ParseInt(value, 10, 64)
+	switch {
+	case err != nil:
+		return value
+	case n < 0 && (name == "retention.ms" || name == "retention.bytes"):
+		return value + " (unlimited)"
+	case name == "retention.ms":
+		return fmt.Sprintf("%s (%v)", value, time.Duration(n)*time.Millisecond)
+	case name == "retention.bytes" || name == "max.message.bytes":
+		return fmt.Sprintf("%s (%.1f MiB)", value, float64(n)/(1<<20))
+	}
+	return value
+}
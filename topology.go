@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// topologyCheckInterval is the interval at which the cached cluster metadata
+// is checked for a moved coordinator or partition leader
+const topologyCheckInterval = 30 * time.Second
+
+// topologyLoop logs the group coordinator and the leaders of the claimed
+// partitions when the session starts, and again whenever one of them moves,
+// until the session ends
+func (consumer *Consumer) topologyLoop(session sarama.ConsumerGroupSession) {
+	var last map[string]string
+	ticker := time.NewTicker(topologyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		last = consumer.logTopology(session, last)
+
+		select {
+		case <-ticker.C:
+		case <-session.Context().Done():
+			return
+		}
+	}
+}
+
+// logTopology looks up the coordinator and the partition leaders in the client
+// metadata and logs those that differ from last, all of them when last is nil.
+// It returns the current topology, keyed by the coordinator or partition.
+func (consumer *Consumer) logTopology(session sarama.ConsumerGroupSession, last map[string]string) map[string]string {
+	current := make(map[string]string)
+	group := consumer.settings().Group
+
+	coordinator, err := consumer.client.Coordinator(group)
+	if err != nil {
+		consumer.logger.Printf("Unable to look up the coordinator of group %s: %v", group, err)
+	} else {
+		current["coordinator"] = describeBroker(coordinator)
+	}
+
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			key := fmt.Sprintf("%s/%d", topic, partition)
+			leader, err := consumer.client.Leader(topic, partition)
+			if err != nil {
+				consumer.logger.Printf("Unable to look up the leader of topic = %s, partition = %d: %v", topic, partition, err)
+				continue
+			}
+			current[key] = describeBroker(leader)
+		}
+	}
+
+	if broker, ok := current["coordinator"]; ok && broker != last["coordinator"] {
+		consumer.logger.Printf("Group coordinator of %s: %s", group, broker)
+	}
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			key := fmt.Sprintf("%s/%d", topic, partition)
+			if broker, ok := current[key]; ok && broker != last[key] {
+				consumer.logger.Printf("Leader of topic = %s, partition = %d: %s", topic, partition, broker)
+			}
+		}
+	}
+	return current
+}
+
+// describeBroker returns the id, address and rack of the broker
+func describeBroker(broker *sarama.Broker) string {
+	rack := broker.Rack()
+	if rack == "" {
+		rack = "unknown"
+	}
+	return fmt.Sprintf("broker id = %d, addr = %s, rack = %s", broker.ID(), broker.Addr(), rack)
+}
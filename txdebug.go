@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// gapFetchSize is the maximum size of the fetches classifying a gap
+const gapFetchSize = 1024 * 1024
+
+// gapStats classifies the offsets of a gap between two delivered messages
+type gapStats struct {
+	// markers are the commit and abort markers ending transactions
+	markers int64
+	// aborted are the records of aborted transactions
+	aborted int64
+	// other are records that should have been delivered
+	other int64
+	// missing are offsets without a record, removed by compaction or retention
+	missing int64
+}
+
+func (s gapStats) String() string {
+	return fmt.Sprintf("transaction markers = %d, aborted records = %d, other records = %d, missing offsets = %d", s.markers, s.aborted, s.other, s.missing)
+}
+
+// explainGap fetches the raw record batches at the offsets [from, to) of the
+// partition, which the consumer skips silently, and classifies them. The
+// fetch is read_committed, so the broker returns the aborted transactions.
+func explainGap(client sarama.Client, topic string, partition int32, from, to int64) (gapStats, error) {
+	stats := gapStats{}
+	broker, err := client.Leader(topic, partition)
+	if err != nil {
+		return stats, err
+	}
+
+	offset := from
+	for offset < to {
+		request := &sarama.FetchRequest{
+			Version:     4,
+			MaxWaitTime: 0,
+			MinBytes:    1,
+			MaxBytes:    gapFetchSize,
+			Isolation:   sarama.ReadCommitted,
+		}
+		request.AddBlock(topic, partition, offset, gapFetchSize, -1)
+
+		response, err := broker.Fetch(request)
+		if err != nil {
+			return stats, err
+		}
+		block := response.GetBlock(topic, partition)
+		if block == nil {
+			return stats, fmt.Errorf("no fetch response for topic = %s, partition = %d", topic, partition)
+		}
+		if block.Err != sarama.ErrNoError {
+			return stats, block.Err
+		}
+
+		// the first offset of every aborted transaction by producer
+		aborted := make(map[int64][]int64)
+		for _, txn := range block.AbortedTransactions {
+			aborted[txn.ProducerID] = append(aborted[txn.ProducerID], txn.FirstOffset)
+		}
+
+		next := offset
+		for _, records := range block.RecordsSet {
+			batch := records.RecordBatch
+			if batch == nil {
+				continue
+			}
+			for _, record := range batch.Records {
+				recordOffset := batch.FirstOffset + record.OffsetDelta
+				if recordOffset < offset || recordOffset >= to {
+					continue
+				}
+				switch {
+				case batch.Control:
+					stats.markers++
+				case batch.IsTransactional && abortedAt(aborted[batch.ProducerID], recordOffset):
+					stats.aborted++
+				default:
+					stats.other++
+				}
+			}
+			if end := batch.FirstOffset + int64(batch.LastOffsetDelta) + 1; end > next {
+				next = end
+			}
+		}
+
+		if next <= offset {
+			// nothing left before the high water mark
+			break
+		}
+		offset = next
+	}
+
+	stats.missing = to - from - stats.markers - stats.aborted - stats.other
+	return stats, nil
+}
+
+// abortedAt reports whether a transaction of the producer starting at one of
+// the given offsets was aborted at or before offset
+func abortedAt(firstOffsets []int64, offset int64) bool {
+	for _, first := range firstOffsets {
+		if first <= offset {
+			return true
+		}
+	}
+	return false
+}
+
+// explainedGap is a gap along with the classification of its offsets
+type explainedGap struct {
+	*offsetGap
+	stats gapStats
+}
+
+func (g *explainedGap) Error() string {
+	return fmt.Sprintf("%v: %v", g.offsetGap, g.stats)
+}
+
+// lost reports whether the gap skipped records that should have been delivered,
+// rather than offsets that compaction or retention removed
+func (g *explainedGap) lost() bool {
+	return g.stats.other > 0
+}
+
+// explainGap classifies the records skipped at the gap. It returns nil when the
+// gap is made of transaction markers and aborted records only, an explainedGap
+// otherwise, or the gap itself when it can't be classified.
+func (consumer *Consumer) explainGap(gap *offsetGap) error {
+	if consumer.client == nil {
+		// a mock consumer has no partition leader to fetch from
+		return gap
+	}
+	stats, err := explainGap(consumer.client, gap.topic, gap.partition, gap.expected, gap.offset)
+	if err != nil {
+		consumer.logger.Printf("Unable to fetch the records skipped at topic = %s, partition = %d: %v", gap.topic, gap.partition, err)
+		return gap
+	}
+
+	consumer.audit.explained(stats)
+	if stats.missing == 0 && stats.other == 0 {
+		consumer.logger.Printf("Skipped offsets %d to %d of topic = %s, partition = %d: %v", gap.expected, gap.offset-1, gap.topic, gap.partition, stats)
+		return nil
+	}
+	return &explainedGap{offsetGap: gap, stats: stats}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// untilBounds resolves the offset each partition is consumed up to, as given
+// by -until-offset and -until-timestamp. The offsets are resolved once per
+// partition for the lifetime of the consumer, so a bounded replay stops at the
+// same messages across rebalances. The partitions that reached their end are
+// recorded here as well rather than in the state of the session, so they stay
+// finished when they are claimed again after a rebalance.
+type untilBounds struct {
+	client sarama.Client
+
+	mu       sync.Mutex
+	ends     map[string]map[int32]int64
+	finished map[string]map[int32]bool
+}
+
+func newUntilBounds(client sarama.Client) *untilBounds {
+	if *untilOffset < 0 && untilTime.IsZero() {
+		return nil
+	}
+	return &untilBounds{client: client, ends: make(map[string]map[int32]int64), finished: make(map[string]map[int32]bool)}
+}
+
+// end returns the first offset of the partition that must not be consumed
+func (b *untilBounds) end(topic string, partition int32) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if end, ok := b.ends[topic][partition]; ok {
+		return end, nil
+	}
+
+	end := *untilOffset
+	if !untilTime.IsZero() {
+		offset, err := offsetAt(b.client, topic, partition, untilTime)
+		if err != nil {
+			return 0, err
+		}
+		if end < 0 || offset < end {
+			end = offset
+		}
+	}
+
+	if b.ends[topic] == nil {
+		b.ends[topic] = make(map[int32]int64)
+	}
+	b.ends[topic][partition] = end
+	return end, nil
+}
+
+// finish records the partition as finished and reports whether it already was
+func (b *untilBounds) finish(topic string, partition int32) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.finished[topic] == nil {
+		b.finished[topic] = make(map[int32]bool)
+	}
+	finished := b.finished[topic][partition]
+	b.finished[topic][partition] = true
+	return finished
+}
+
+// isFinished reports whether the partition reached its end, false for a nil
+// bounds
+func (b *untilBounds) isFinished(topic string, partition int32) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.finished[topic][partition]
+}
+
+// passedBound reports whether offset is at or past the end of the partition.
+// Once it is, the partition is paused and recorded as finished.
+func (consumer *Consumer) passedBound(topic string, partition int32, offset int64) (bool, error) {
+	if consumer.bounds == nil || offset < 0 {
+		return false, nil
+	}
+	end, err := consumer.bounds.end(topic, partition)
+	if err != nil || offset < end {
+		return false, err
+	}
+
+	consumer.group.Pause(map[string][]int32{topic: {partition}})
+	if !consumer.bounds.finish(topic, partition) {
+		consumer.logger.Printf("Reached the end of topic = %s, partition = %d at offset %d", topic, partition, end)
+	}
+
+	consumer.stateMu.Lock()
+	defer consumer.stateMu.Unlock()
+	for topic, partitions := range consumer.partitions {
+		for partition := range partitions {
+			if !consumer.bounds.isFinished(topic, partition) {
+				return true, nil
+			}
+		}
+	}
+	consumer.finishedOnce.Do(func() { close(consumer.finished) })
+	return true, nil
+}
+
+// waitFinished keeps the claim of a finished partition until the session
+// ends, discarding the messages fetched past its end. Returning from
+// ConsumeClaim would end the session of every claim, and the group would
+// rejoin only for the partition to finish again.
+func waitFinished(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) {
+	for {
+		select {
+		case _, ok := <-claim.Messages():
+			if !ok {
+				return
+			}
+		case <-session.Context().Done():
+			return
+		}
+	}
+}
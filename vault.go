@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// vaultTimeout bounds a request to Vault
+const vaultTimeout = 10 * time.Second
+
+// vaultCredentials are the SASL credentials and TLS material of a Vault secret
+type vaultCredentials struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key"`
+	CA          string `json:"ca"`
+	IssuingCA   string `json:"issuing_ca"`
+}
+
+// vaultSecret holds the credentials read from -vault-path. Dynamic secrets
+// are renewed before their lease expires, and read again once they can't be
+// renewed any more. Static secrets are read again every -vault-refresh. When
+// the credentials changed, all consumers reconnect with the new ones.
+type vaultSecret struct {
+	addr  string
+	token string
+	path  string
+
+	mu          sync.RWMutex
+	credentials vaultCredentials
+	leaseID     string
+	lease       time.Duration
+	renewable   bool
+}
+
+// vault is set with -vault-path
+var vault *vaultSecret
+
+// vaultResponse is the response of Vault to reading a secret or renewing its lease
+type vaultResponse struct {
+	LeaseID       string          `json:"lease_id"`
+	LeaseDuration int             `json:"lease_duration"`
+	Renewable     bool            `json:"renewable"`
+	Data          json.RawMessage `json:"data"`
+	Errors        []string        `json:"errors"`
+}
+
+func newVaultSecret(addr, token, path string) (*vaultSecret, error) {
+	if addr == "" || token == "" {
+		return nil, errors.New("-vault-path requires -vault-addr and -vault-token, or the VAULT_ADDR and VAULT_TOKEN environment variables")
+	}
+	v := &vaultSecret{addr: strings.TrimSuffix(addr, "/"), token: token, path: strings.Trim(path, "/")}
+	if _, err := v.read(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// request sends a request to the Vault API and decodes its response
+func (v *vaultSecret) request(method, path string, body interface{}) (*vaultResponse, error) {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	request, err := http.NewRequest(method, v.addr+"/v1/"+path, &payload)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", v.token)
+
+	client := http.Client{Timeout: vaultTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var decoded vaultResponse
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("vault %s %s: %s", method, path, response.Status)
+	}
+	if response.StatusCode >= 300 {
+		return nil, fmt.Errorf("vault %s %s: %s %s", method, path, response.Status, strings.Join(decoded.Errors, ", "))
+	}
+	return &decoded, nil
+}
+
+// read reads the secret and reports whether its credentials changed
+func (v *vaultSecret) read() (bool, error) {
+	response, err := v.request("GET", v.path, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// the secrets of the KV version 2 engine are nested in data.data
+	var nested struct {
+		Data     *vaultCredentials `json:"data"`
+		Metadata json.RawMessage   `json:"metadata"`
+	}
+	var credentials vaultCredentials
+	if err := json.Unmarshal(response.Data, &nested); err == nil && nested.Data != nil && nested.Metadata != nil {
+		credentials = *nested.Data
+	} else if err := json.Unmarshal(response.Data, &credentials); err != nil {
+		return false, fmt.Errorf("vault secret %s: %v", v.path, err)
+	}
+	if credentials.Username == "" && credentials.Certificate == "" {
+		return false, fmt.Errorf("vault secret %s holds neither a username nor a certificate", v.path)
+	}
+	if credentials.Certificate != "" && credentials.PrivateKey == "" {
+		return false, fmt.Errorf("vault secret %s holds a certificate without private_key", v.path)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	changed := credentials != v.credentials
+	v.credentials = credentials
+	v.leaseID, v.lease, v.renewable = response.LeaseID, time.Duration(response.LeaseDuration)*time.Second, response.Renewable
+	return changed, nil
+}
+
+// renew extends the lease of the secret. It returns false when the lease
+// can't be renewed, or not for as long as before as it reached its max TTL.
+func (v *vaultSecret) renew() (bool, error) {
+	v.mu.RLock()
+	leaseID, lease, renewable := v.leaseID, v.lease, v.renewable
+	v.mu.RUnlock()
+	if leaseID == "" || !renewable {
+		return false, nil
+	}
+
+	response, err := v.request("PUT", "sys/leases/renew", map[string]interface{}{
+		"lease_id":  leaseID,
+		"increment": int(lease / time.Second),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	renewed := time.Duration(response.LeaseDuration) * time.Second
+	v.renewable = response.Renewable
+	if renewed < lease {
+		return false, nil
+	}
+	v.lease = renewed
+	return true, nil
+}
+
+func (v *vaultSecret) current() vaultCredentials {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.credentials
+}
+
+// saslCredentials returns the user name and password for the SCRAM exchange
+func (v *vaultSecret) saslCredentials() (string, string) {
+	credentials := v.current()
+	return credentials.Username, credentials.Password
+}
+
+// configure applies the credentials of the secret to the Sarama config, in
+// place of the -certificate, -key and -ca files
+func (v *vaultSecret) configure(config *sarama.Config, verify bool) error {
+	credentials := v.current()
+
+	if credentials.Username != "" {
+		mechanism := sarama.SASLMechanism(*vaultSASLMechanism)
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = mechanism
+		config.Net.SASL.Handshake = true
+		config.Net.SASL.User, config.Net.SASL.Password = credentials.Username, credentials.Password
+		if mechanism != sarama.SASLTypePlaintext {
+			hash, err := scramHash(mechanism)
+			if err != nil {
+				return err
+			}
+			config.Net.SASL.Version = sarama.SASLHandshakeV1
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hash: hash, credentials: v.saslCredentials}
+			}
+		}
+	}
+
+	if credentials.Certificate != "" {
+		cert, err := tls.X509KeyPair([]byte(credentials.Certificate), []byte(credentials.PrivateKey))
+		if err != nil {
+			return fmt.Errorf("vault secret %s: %v", v.path, err)
+		}
+		tlsConfig := &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: verify,
+		}
+		if ca := credentials.CA + credentials.IssuingCA; ca != "" {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM([]byte(ca))
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	return nil
+}
+
+// rotate keeps the secret valid until the process exits. Leases are renewed
+// when two thirds of them passed, and the secret is read again once they can't
+// be renewed, or every -vault-refresh for secrets without a lease. Consumers
+// are restarted with the new credentials whenever they changed.
+func (v *vaultSecret) rotate() {
+	for {
+		v.mu.RLock()
+		delay := v.lease * 2 / 3
+		v.mu.RUnlock()
+		if delay <= 0 || delay > *vaultRefresh {
+			delay = *vaultRefresh
+		}
+		time.Sleep(delay)
+
+		renewed, err := v.renew()
+		if err != nil {
+			log.Printf("Unable to renew the lease of vault secret %s: %v", v.path, err)
+		}
+		if renewed {
+			continue
+		}
+
+		changed, err := v.read()
+		if err != nil {
+			log.Printf("Unable to read vault secret %s: %v", v.path, err)
+			continue
+		}
+		if changed {
+			log.Printf("Credentials of vault secret %s rotated, reconnecting", v.path)
+			restartConsumers()
+		}
+	}
+}
+
+// restartConsumers closes the running consumers and starts them again with
+// new connections, keeping their configuration. The consumers that fail to
+// start are retried with a backoff until they do, unless a reload started
+// them meanwhile.
+func restartConsumers() {
+	runningMu.Lock()
+	stopped := make(map[string]consumerConfig)
+	for name, consumer := range running {
+		consumer.Close()
+		delete(running, name)
+		stopped[name] = consumer.settings()
+	}
+	runningMu.Unlock()
+
+	backoff := time.Second
+	for {
+		runningMu.Lock()
+		for name, c := range stopped {
+			if _, ok := running[name]; ok {
+				delete(stopped, name)
+				continue
+			}
+			restarted, err := newConsumer(c)
+			if err != nil {
+				log.Printf("Unable to restart consumer %s, retrying in %v: %v", name, backoff, err)
+				continue
+			}
+			running[name] = restarted
+			go restarted.consume()
+			delete(stopped, name)
+		}
+		runningMu.Unlock()
+
+		if len(stopped) == 0 {
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// autoVersion as -version negotiates the Kafka version with the brokers
+const autoVersion = "auto"
+
+// fallbackVersion is used for brokers too old to answer ApiVersions requests
+var fallbackVersion = sarama.V0_10_0_0
+
+// Keys of the Kafka APIs the version is inferred from, or that are logged
+const (
+	apiFetch                = 1
+	apiListOffsets          = 2
+	apiMetadata             = 3
+	apiOffsetCommit         = 8
+	apiOffsetFetch          = 9
+	apiFindCoordinator      = 10
+	apiJoinGroup            = 11
+	apiHeartbeat            = 12
+	apiSyncGroup            = 14
+	apiApiVersions          = 18
+	apiDescribeClientQuotas = 48
+	apiDescribeCluster      = 60
+)
+
+// apiNames are the names of the APIs logged after the negotiation
+var apiNames = []struct {
+	key  int16
+	name string
+}{
+	{apiFetch, "Fetch"},
+	{apiListOffsets, "ListOffsets"},
+	{apiMetadata, "Metadata"},
+	{apiOffsetCommit, "OffsetCommit"},
+	{apiOffsetFetch, "OffsetFetch"},
+	{apiFindCoordinator, "FindCoordinator"},
+	{apiJoinGroup, "JoinGroup"},
+	{apiHeartbeat, "Heartbeat"},
+	{apiSyncGroup, "SyncGroup"},
+	{apiApiVersions, "ApiVersions"},
+}
+
+// versionMarkers infer the Kafka version from the API versions of a broker,
+// newest first: a broker supporting at least the given version of the API
+// implements the requests of the Kafka version. Brokers implementing the
+// protocol without being Kafka, such as Redpanda, are mapped the same way.
+var versionMarkers = []struct {
+	version sarama.KafkaVersion
+	key     int16
+	min     int16
+}{
+	{sarama.V3_1_0_0, apiFetch, 13},
+	{sarama.V2_8_0_0, apiDescribeCluster, 0},
+	{sarama.V2_7_0_0, apiFetch, 12},
+	{sarama.V2_6_0_0, apiDescribeClientQuotas, 0},
+	{sarama.V2_4_0_0, apiApiVersions, 3},
+	{sarama.V2_3_0_0, apiFetch, 11},
+	{sarama.V2_1_0_0, apiFetch, 10},
+	{sarama.V2_0_0_0, apiFetch, 8},
+	{sarama.V1_1_0_0, apiFetch, 7},
+	{sarama.V1_0_0_0, apiFetch, 6},
+	{sarama.V0_11_0_0, apiFetch, 5},
+	{sarama.V0_10_1_0, apiFetch, 3},
+}
+
+var (
+	negotiatedMu sync.Mutex
+	// negotiated caches the version per broker list, so reconnecting
+	// consumers don't negotiate again
+	negotiated = make(map[string]sarama.KafkaVersion)
+)
+
+// negotiateVersion asks the first reachable broker for the versions of the
+// APIs it supports and returns the newest Kafka version they cover, capped at
+// the newest version Sarama knows. Brokers that don't answer ApiVersions
+// requests, older than 0.10, get fallbackVersion.
+func negotiateVersion(addrs []string, config *sarama.Config) (sarama.KafkaVersion, error) {
+	key := strings.Join(addrs, ",")
+	negotiatedMu.Lock()
+	defer negotiatedMu.Unlock()
+	if version, ok := negotiated[key]; ok {
+		return version, nil
+	}
+
+	// probe with the oldest version that authenticates like the real client
+	probe := *config
+	probe.Version = sarama.V1_0_0_0
+	if !config.Net.SASL.Enable {
+		probe.Version = sarama.V0_10_0_0
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		broker := sarama.NewBroker(addr)
+		if err := broker.Open(&probe); err != nil {
+			lastErr = err
+			continue
+		}
+		response, err := broker.ApiVersions(&sarama.ApiVersionsRequest{})
+		broker.Close()
+		if err != nil {
+			if err == sarama.ErrUnsupportedVersion || err == sarama.ErrInvalidRequest {
+				log.Printf("Broker %s doesn't support ApiVersions requests, falling back to Kafka version %s", addr, fallbackVersion)
+				negotiated[key] = fallbackVersion
+				return fallbackVersion, nil
+			}
+			lastErr = err
+			continue
+		}
+		if kerr := sarama.KError(response.ErrorCode); kerr != sarama.ErrNoError {
+			lastErr = kerr
+			continue
+		}
+
+		version := inferVersion(response.ApiKeys)
+		log.Printf("Negotiated Kafka version %s with broker %s: %s", version, addr, describeAPIs(response.ApiKeys))
+		negotiated[key] = version
+		return version, nil
+	}
+	return fallbackVersion, fmt.Errorf("unable to negotiate the Kafka version, set -version explicitly: %v", lastErr)
+}
+
+// inferVersion returns the newest Kafka version whose APIs the broker supports
+func inferVersion(apis []sarama.ApiVersionsResponseKey) sarama.KafkaVersion {
+	max := make(map[int16]int16)
+	for _, api := range apis {
+		max[api.ApiKey] = api.MaxVersion
+	}
+
+	version := sarama.V0_10_0_0
+	for _, marker := range versionMarkers {
+		if supported, ok := max[marker.key]; ok && supported >= marker.min {
+			version = marker.version
+			break
+		}
+	}
+	if sarama.MaxVersion.IsAtLeast(version) {
+		return version
+	}
+	return sarama.MaxVersion
+}
+
+// describeAPIs lists the version ranges of the APIs used by the consumer
+func describeAPIs(apis []sarama.ApiVersionsResponseKey) string {
+	var parts []string
+	for _, known := range apiNames {
+		for _, api := range apis {
+			if api.ApiKey == known.key {
+				parts = append(parts, fmt.Sprintf("%s v%d-v%d", known.name, api.MinVersion, api.MaxVersion))
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
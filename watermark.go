@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// watermarkTracker tracks the event-time watermark of every topic, the
+// smallest of the newest timestamps delivered by its claimed partitions: no
+// message older than it is expected anymore, unless delivered late. A topic
+// has no watermark until each of its claimed partitions delivered a message,
+// and a partition without new messages holds back the watermark of its topic.
+// A nil tracker tracks nothing.
+type watermarkTracker struct {
+	registry metrics.Registry
+	lateness time.Duration
+
+	mu sync.Mutex
+	// newest is the newest timestamp delivered by every claimed partition,
+	// zero before its first message
+	newest map[string]map[int32]time.Time
+}
+
+// newWatermarkTracker returns the tracker of -watermarks, reporting to the
+// registry, or nil when disabled
+func newWatermarkTracker(enabled bool, lateness time.Duration, registry metrics.Registry) *watermarkTracker {
+	if !enabled {
+		return nil
+	}
+	return &watermarkTracker{registry: registry, lateness: lateness, newest: make(map[string]map[int32]time.Time)}
+}
+
+// assign tracks the claimed partitions, keeping the newest timestamps of
+// those claimed before and forgetting the others, so they don't hold back the
+// watermarks of their topics
+func (w *watermarkTracker) assign(claims map[string][]int32) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	newest := make(map[string]map[int32]time.Time)
+	for topic, partitions := range claims {
+		newest[topic] = make(map[int32]time.Time)
+		for _, partition := range partitions {
+			newest[topic][partition] = w.newest[topic][partition]
+		}
+		w.register(topic)
+	}
+	w.newest = newest
+}
+
+// register registers the watermark-delay-ms gauge of the topic, the time
+// since its watermark
+func (w *watermarkTracker) register(topic string) {
+	w.registry.GetOrRegister("watermark-delay-ms-for-topic-"+topic, metrics.NewFunctionalGauge(func() int64 {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		watermark := w.watermark(topic)
+		if watermark.IsZero() {
+			return 0
+		}
+		return int64(time.Since(watermark) / time.Millisecond)
+	}))
+}
+
+// observe advances the watermark of the topic of the message, counting the
+// message in the late-messages metrics when its timestamp is older than the
+// watermark by more than -allowed-lateness. It reports whether it was late.
+func (w *watermarkTracker) observe(message *sarama.ConsumerMessage) bool {
+	if w == nil || message.Timestamp.IsZero() {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	partitions := w.newest[message.Topic]
+	if partitions == nil {
+		partitions = make(map[int32]time.Time)
+		w.newest[message.Topic] = partitions
+		w.register(message.Topic)
+	}
+
+	late := false
+	if watermark := w.watermark(message.Topic); !watermark.IsZero() && message.Timestamp.Before(watermark.Add(-w.lateness)) {
+		late = true
+		metrics.GetOrRegisterCounter("late-messages", w.registry).Inc(1)
+		metrics.GetOrRegisterCounter("late-messages-for-topic-"+message.Topic, w.registry).Inc(1)
+	}
+	if message.Timestamp.After(partitions[message.Partition]) {
+		partitions[message.Partition] = message.Timestamp
+	}
+	if watermark := w.watermark(message.Topic); !watermark.IsZero() {
+		metrics.GetOrRegisterGauge("watermark-for-topic-"+message.Topic, w.registry).Update(watermark.UnixNano() / int64(time.Millisecond))
+	}
+	return late
+}
+
+// watermark returns the watermark of the topic, zero before each of its
+// partitions delivered a message. It must be called with the lock held.
+func (w *watermarkTracker) watermark(topic string) time.Time {
+	var watermark time.Time
+	for _, newest := range w.newest[topic] {
+		if newest.IsZero() {
+			return time.Time{}
+		}
+		if watermark.IsZero() || newest.Before(watermark) {
+			watermark = newest
+		}
+	}
+	return watermark
+}
+
+// watermarks returns the watermarks of the topics
+func (w *watermarkTracker) watermarks() map[string]time.Time {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watermarks := make(map[string]time.Time)
+	for topic := range w.newest {
+		if watermark := w.watermark(topic); !watermark.IsZero() {
+			watermarks[topic] = watermark
+		}
+	}
+	return watermarks
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// weightedStrategyName is the protocol name of the weighted strategy in the group
+const weightedStrategyName = "weighted"
+
+// partitionWeights is the parsed -partition-weights flag
+type partitionWeights struct {
+	// explicit weights by topic/partition, or by topic for all its partitions
+	explicit map[string]int64
+	// lag weighs the other partitions by their lag when planning
+	lag bool
+}
+
+// parsePartitionWeights parses a comma separated list of topic=weight and
+// topic/partition=weight pairs, and lag to learn the weight of the partitions
+// without a pair from their lag
+func parsePartitionWeights(spec string) (*partitionWeights, error) {
+	weights := &partitionWeights{explicit: make(map[string]int64)}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		if pair == "lag" {
+			weights.lag = true
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid partition weight %q, expected topic=weight, topic/partition=weight or lag", pair)
+		}
+		weight, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight of %s, expected a positive number", kv[0])
+		}
+		weights.explicit[kv[0]] = weight
+	}
+	return weights, nil
+}
+
+// weight returns the explicit weight of the partition, 0 when it has none
+func (w *partitionWeights) weight(topic string, partition int32) int64 {
+	if weight, ok := w.explicit[topic+"/"+strconv.Itoa(int(partition))]; ok {
+		return weight
+	}
+	return w.explicit[topic]
+}
+
+// weightedStrategy is a sarama.BalanceStrategy distributing the partitions by
+// their -partition-weights, so heavy partitions don't pile up on one member as
+// with the range assignment. The heaviest partitions are assigned first, each
+// to the subscribed member with the lowest total weight so far.
+type weightedStrategy struct {
+	weights *partitionWeights
+	// consumer looks up the lags of the partitions with -partition-weights lag,
+	// set once the consumer is created
+	consumer *Consumer
+}
+
+func newWeightedStrategy(weights *partitionWeights) *weightedStrategy {
+	return &weightedStrategy{weights: weights}
+}
+
+func (s *weightedStrategy) Name() string {
+	return weightedStrategyName
+}
+
+// weighedPartition is a partition to assign with its weight
+type weighedPartition struct {
+	topic     string
+	partition int32
+	weight    int64
+}
+
+func (s *weightedStrategy) Plan(members map[string]sarama.ConsumerGroupMemberMetadata, topics map[string][]int32) (sarama.BalanceStrategyPlan, error) {
+	subscribers := make(map[string][]string)
+	for memberID, meta := range members {
+		for _, topic := range meta.Topics {
+			subscribers[topic] = append(subscribers[topic], memberID)
+		}
+	}
+
+	var lags map[string]map[int32]int64
+	if s.weights.lag && s.consumer != nil {
+		var err error
+		if lags, err = s.consumer.partitionLags(topics); err != nil {
+			log.Printf("Unable to learn the partition weights from their lag, weighing them equally: %v", err)
+		}
+	}
+
+	var partitions []weighedPartition
+	for topic, ids := range topics {
+		sort.Strings(subscribers[topic])
+		for _, partition := range ids {
+			weight := s.weights.weight(topic, partition)
+			if weight == 0 {
+				// partitions without lag still count, so they are spread evenly
+				weight = 1 + lags[topic][partition]
+			}
+			partitions = append(partitions, weighedPartition{topic: topic, partition: partition, weight: weight})
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		a, b := partitions[i], partitions[j]
+		if a.weight != b.weight {
+			return a.weight > b.weight
+		}
+		if a.topic != b.topic {
+			return a.topic < b.topic
+		}
+		return a.partition < b.partition
+	})
+
+	plan := make(sarama.BalanceStrategyPlan, len(members))
+	load := make(map[string]int64, len(members))
+	assigned := make(map[string]int, len(members))
+	for _, p := range partitions {
+		best := ""
+		for _, member := range subscribers[p.topic] {
+			if best == "" || load[member] < load[best] || load[member] == load[best] && assigned[member] < assigned[best] {
+				best = member
+			}
+		}
+		if best == "" {
+			continue
+		}
+		plan.Add(best, p.topic, p.partition)
+		load[best] += p.weight
+		assigned[best]++
+	}
+
+	memberIDs := make([]string, 0, len(members))
+	for memberID := range members {
+		memberIDs = append(memberIDs, memberID)
+	}
+	sort.Strings(memberIDs)
+	for _, memberID := range memberIDs {
+		log.Printf("Planned weighted assignment: member id = %s, partitions = %d, weight = %d", memberID, assigned[memberID], load[memberID])
+	}
+	return plan, nil
+}
+
+func (s *weightedStrategy) AssignmentData(memberID string, topics map[string][]int32, generationID int32) ([]byte, error) {
+	return nil, nil
+}
+
+// partitionLags returns the number of messages between the committed offset of
+// the group and the newest offset of the partitions, 0 for partitions without
+// a committed offset
+func (consumer *Consumer) partitionLags(topics map[string][]int32) (map[string]map[int32]int64, error) {
+	committed, err := consumer.committedOffsets(topics)
+	if err != nil {
+		return nil, err
+	}
+
+	lags := make(map[string]map[int32]int64)
+	for topic, partitions := range committed {
+		lags[topic] = make(map[int32]int64)
+		for partition, offset := range partitions {
+			if offset < 0 {
+				continue
+			}
+			newest, err := consumer.client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, err
+			}
+			if newest > offset {
+				lags[topic][partition] = newest - offset
+			}
+		}
+	}
+	return lags, nil
+}